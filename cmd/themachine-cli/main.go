@@ -9,19 +9,21 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/alpdeniz/themachine/internal/db"
 	"github.com/alpdeniz/themachine/internal/keystore"
 	"github.com/alpdeniz/themachine/internal/network"
 	"github.com/alpdeniz/themachine/internal/transaction"
 )
 
-func parseArguments() (actionType int, objectType int, command string, message string) {
+func parseArguments() (actionType int, objectType int, command string, message string, mongoURI string) {
 	flag.StringVar(&command, "c", "GetHead", "Command to execute") // GetHead, Broadcast,
 	flag.IntVar(&actionType, "a", 0, "Transaction type to broadcast")
 	flag.IntVar(&objectType, "o", 0, "Transaction type to broadcast")
 	flag.StringVar(&message, "f", "Hi", "Transaction message to broadcast")
+	flag.StringVar(&mongoURI, "m", db.DefaultMongoURI, "MongoDB URI to store data in")
 	flag.Parse()
 
-	return actionType, objectType, command, message
+	return actionType, objectType, command, message, mongoURI
 }
 
 var testOrg = transaction.Organization{
@@ -35,14 +37,21 @@ var testOrg = transaction.Organization{
 
 func main() {
 
+	actionTypeInt, objectTypeInt, command, message, mongoURI := parseArguments()
+
+	store, err := db.NewMongoStore(mongoURI)
+	if err != nil {
+		fmt.Println("Could not connect to db ", err)
+		return
+	}
+	db.Use(store)
+
 	keystore.Open()
 	conn, err := network.ConnectToNode("127.0.0.1")
 	if err != nil {
 		fmt.Println("Could not connect to node ", err)
 	}
 
-	actionTypeInt, objectTypeInt, command, message := parseArguments()
-
 	switch command {
 	case "GetHead":
 		conn.GetHead()
@@ -65,6 +74,8 @@ func main() {
 			fmt.Printf("Cannot build transaction %s\n", err)
 			return
 		}
+		// sign as its creator
+		tx.Sign(*keystore.GetKeyPairByName("Node"))
 
 		fmt.Println("Tx contents: ", string(tx.ToBytes()))
 		fmt.Println("Tx hash: ", hex.EncodeToString(tx.Hash))
@@ -74,9 +85,10 @@ func main() {
 	}
 
 	// Handle ctrl+c signal as shutdown
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-c
 	network.StopNetwork()
+	db.Close()
 	os.Exit(1)
 }
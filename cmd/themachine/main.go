@@ -5,14 +5,39 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
+	"github.com/alpdeniz/themachine/internal/block"
+	"github.com/alpdeniz/themachine/internal/compute"
+	"github.com/alpdeniz/themachine/internal/db"
 	"github.com/alpdeniz/themachine/internal/keystore"
 	"github.com/alpdeniz/themachine/internal/network"
+	"github.com/alpdeniz/themachine/internal/transaction"
 	"github.com/alpdeniz/themachine/internal/webserver"
 	"github.com/urfave/cli"
 )
 
+// storage flags, shared by the node and the commands working on its data
+var storeFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "mongouri",
+		Usage: "Store data in MongoDB at `URI`",
+		Value: db.DefaultMongoURI,
+	},
+	cli.StringFlag{
+		Name:  "datadir",
+		Usage: "Store data in an embedded database under `DIR` instead of MongoDB",
+	},
+	cli.BoolFlag{
+		Name:  "memory",
+		Usage: "Keep all data in memory, nothing is persisted (ephemeral node)",
+	},
+}
+
+// commits verified transactions as blocks once the node is started
+var builder *block.Builder
+
 // entry
 func main() {
 
@@ -35,14 +60,51 @@ func main() {
 			Usage: "Serve node on PORT`",
 			Value: 8443,
 		},
+		cli.StringFlag{
+			Name:  "webtoken",
+			Usage: "Require `TOKEN` to create and sign transactions on the web, generated if not given",
+		},
+		cli.IntFlag{
+			Name:  "jobworkers",
+			Usage: "Run at most `N` compute jobs at once",
+			Value: compute.DefaultQueueConfig.Workers,
+		},
+		cli.IntFlag{
+			Name:  "jobqueue",
+			Usage: "Keep at most `N` compute jobs waiting",
+			Value: compute.DefaultQueueConfig.Size,
+		},
+		cli.DurationFlag{
+			Name:  "jobtimeout",
+			Usage: "Cancel compute jobs not finished within `DURATION` of their submission",
+			Value: compute.DefaultQueueConfig.Timeout,
+		},
+		cli.IntFlag{
+			Name:  "sandboxid",
+			Usage: fmt.Sprintf("Run code as host uids and gids from `ID` to ID+%d, which nothing else may use", compute.SandboxIDs.Count-1),
+			Value: compute.SandboxIDs.First,
+		},
+	}
+	app.Flags = append(app.Flags, storeFlags...)
+	app.Commands = []cli.Command{
+		{
+			Name:   "verify-chain",
+			Usage:  "Recheck every hash, signature and link of the stored chain from genesis to head",
+			Flags:  storeFlags,
+			Action: verifyChain,
+		},
 	}
 
 	// Handle ctrl+c signal as shutdown
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		<-c
 		network.StopNetwork()
+		if builder != nil {
+			builder.Stop()
+		}
+		db.Close()
 		os.Exit(1)
 	}()
 
@@ -55,23 +117,96 @@ func main() {
 }
 
 // start the app:
+// - open storage
 // - open keystore
+// - start the block builder
+// - start compute jobs
 // - start networking
 // - start web server
 func start(c *cli.Context) error {
 
+	// select storage backend
+	err := openStore(c)
+	if err != nil {
+		return err
+	}
+
 	// load keystore
 	ok := keystore.Open()
 	if !ok {
 		return nil
 	}
 
+	// batch verified transactions into blocks sealed by the node key
+	builder, err = block.NewBuilder(keystore.GetKeyPairByName("Node"))
+	if err != nil {
+		return err
+	}
+	builder.Start()
+
+	// run compute jobs of peers and web users in the background
+	jobs := compute.DefaultQueueConfig
+	jobs.Workers = c.Int("jobworkers")
+	jobs.Size = c.Int("jobqueue")
+	jobs.Timeout = c.Duration("jobtimeout")
+	compute.SandboxIDs.First = c.Int("sandboxid")
+	network.StartJobs(jobs)
+
 	// start node socket server
-	network.StartNetwork(c.Int("nodeport"))
+	err = network.StartNetwork(c.Int("nodeport"))
+	if err != nil {
+		return err
+	}
 
 	// start the web server
 	port := c.Int("webport")
+	webserver.Token = c.String("webtoken")
 	webserver.Start(port)
 
 	return nil
 }
+
+// verifyChain walks the stored chain and reports the first inconsistency, exits with 1 if any
+func verifyChain(c *cli.Context) error {
+	err := openStore(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	count, err := transaction.VerifyChain()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Verified %d transactions, then: %s", count, err), 1)
+	}
+	fmt.Println("Verified", count, "transactions, the chain is consistent")
+	return nil
+}
+
+// openStore selects the in-memory store, the embedded store if a data directory is given or mongo
+func openStore(c *cli.Context) error {
+	if c.Bool("memory") {
+		db.Use(db.NewMemoryStore())
+		return nil
+	}
+
+	datadir := c.String("datadir")
+	if datadir == "" {
+		store, err := db.NewMongoStore(c.String("mongouri"))
+		if err != nil {
+			return err
+		}
+		db.Use(store)
+		return nil
+	}
+
+	err := os.MkdirAll(datadir, 0700)
+	if err != nil {
+		return err
+	}
+	store, err := db.NewBoltStore(filepath.Join(datadir, "themachine.db"))
+	if err != nil {
+		return err
+	}
+	db.Use(store)
+	return nil
+}
@@ -6,9 +6,9 @@ require (
 	github.com/btcsuite/btcutil v1.0.2
 	github.com/ethereum/go-ethereum v1.9.25
 	github.com/go-chi/chi v1.5.1
-	github.com/gobuffalo/packr/v2 v2.2.0
 	github.com/urfave/cli v1.22.5
 	github.com/wemeetagain/go-hdwallet v0.1.0
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.4.4
 	golang.org/x/crypto v0.0.0-20201216223049-8b5274cf687f
 )
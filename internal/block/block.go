@@ -0,0 +1,238 @@
+package block
+
+// Blocks of transactions
+// Verified transactions are not appended to the chain one by one, the Builder collects them
+// and commits them together: the head of the chain is looked up once and the whole batch is
+// saved at once. The header of a block commits to
+// - its transactions by their Merkle root, see MerkleRoot
+// - the previous block by its hash
+// and is signed by the node that built it, the sealer.
+// Blocks are a record of this node, peers still exchange chain entries (see transaction.Entry)
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+const HeaderSize = 113
+
+var ErrInvalidBlock = errors.New("Invalid block")
+
+type Header struct {
+	Height     uint64
+	PrevHash   []byte // hash of the previous block, empty for the first one
+	Timestamp  time.Time
+	MerkleRoot []byte
+	Sealer     []byte // public key of the node that built the block
+}
+
+type Block struct {
+	Header
+	Hash         []byte
+	Signature    []byte // of the hash by the sealer
+	Transactions []*transaction.Transaction
+}
+
+// Export header as bytes
+// Layout (little endian): height (8) + previous block hash (32, zeros for the first one)
+// + timestamp in milliseconds (8) + merkle root (32) + sealer public key (33)
+func (h *Header) ToBytes() []byte {
+	headerBytes := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint64(headerBytes[0:8], h.Height)
+	copy(headerBytes[8:40], h.PrevHash)
+	binary.LittleEndian.PutUint64(headerBytes[40:48], uint64(h.Timestamp.UnixNano()/1e6))
+	copy(headerBytes[48:80], h.MerkleRoot)
+	copy(headerBytes[80:113], h.Sealer)
+	return headerBytes
+}
+
+// Parse header bytes, see ToBytes
+func ParseHeader(headerBytes []byte) (*Header, error) {
+	if len(headerBytes) != HeaderSize {
+		return nil, fmt.Errorf("%w: header is %d bytes", ErrInvalidBlock, len(headerBytes))
+	}
+	h := Header{
+		Height:     binary.LittleEndian.Uint64(headerBytes[0:8]),
+		Timestamp:  time.Unix(0, int64(binary.LittleEndian.Uint64(headerBytes[40:48]))*1e6),
+		MerkleRoot: append([]byte{}, headerBytes[48:80]...),
+		Sealer:     append([]byte{}, headerBytes[80:113]...),
+	}
+	if prev := headerBytes[8:40]; !bytes.Equal(prev, make([]byte, 32)) {
+		h.PrevHash = append([]byte{}, prev...)
+	}
+	return &h, nil
+}
+
+func (h *Header) CalculateHash() []byte {
+	return crypto.DHash(h.ToBytes())
+}
+
+// New builds and signs the block of given transactions following the last block
+func New(transactions []*transaction.Transaction, sealer keystore.KeyPair) (*Block, error) {
+	var hashes [][]byte
+	for _, v := range transactions {
+		hashes = append(hashes, v.Hash)
+	}
+	last := db.GetLastBlock()
+
+	b := Block{
+		Header: Header{
+			Height:     last.Height + 1,
+			PrevHash:   last.Hash,
+			Timestamp:  time.Now(),
+			MerkleRoot: MerkleRoot(hashes),
+			Sealer:     sealer.PublicKey,
+		},
+		Transactions: transactions,
+	}
+	b.Hash = b.CalculateHash()
+	sig, err := crypto.Sign(b.Hash, sealer.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	b.Signature = sig
+	return &b, nil
+}
+
+// Verify checks the block hash, the seal and that the transactions are the ones committed to
+func (b *Block) Verify() error {
+	if len(b.Transactions) == 0 {
+		return fmt.Errorf("%w: no transactions", ErrInvalidBlock)
+	}
+	var hashes [][]byte
+	seen := make(map[string]bool)
+	for _, v := range b.Transactions {
+		// repeating the last ones keeps the merkle root, see nextLevel
+		if seen[string(v.Hash)] {
+			return fmt.Errorf("%w: transaction %x is repeated", ErrInvalidBlock, v.Hash)
+		}
+		seen[string(v.Hash)] = true
+		hashes = append(hashes, v.Hash)
+	}
+	if !bytes.Equal(MerkleRoot(hashes), b.MerkleRoot) {
+		return fmt.Errorf("%w: merkle root does not match the transactions", ErrInvalidBlock)
+	}
+	if !bytes.Equal(b.CalculateHash(), b.Hash) {
+		return fmt.Errorf("%w: hash does not match the header", ErrInvalidBlock)
+	}
+	if !crypto.Verify(b.Signature, b.Hash, b.Sealer) {
+		return fmt.Errorf("%w: seal signature is invalid", ErrInvalidBlock)
+	}
+	return nil
+}
+
+// Commit appends the transactions to the chain as a new block sealed by given key
+// Transactions already in the chain or no longer valid are left out, returns nil if none is left
+func Commit(transactions []*transaction.Transaction, sealer keystore.KeyPair) (*Block, error) {
+	var b *Block
+	err := transaction.WithChain(func() error {
+		var fresh []*transaction.Transaction
+		var items []db.MainDBItem
+		seen := make(map[string]bool)
+		head := db.GetLastTransaction().Index
+		for _, v := range transactions {
+			if seen[string(v.Hash)] || len(db.Get(v.Hash).Hash) != 0 {
+				continue
+			}
+			seen[string(v.Hash)] = true
+
+			// the chain may have changed since it was queued, e.g. by a seal of the same height,
+			// it is checked again as following the ones before it in the block
+			if ok, err := v.ValidateIn(db.Staged(head+1, items)); !ok || err != nil {
+				fmt.Println("Leaving out invalid transaction", hex.EncodeToString(v.Hash), err)
+				continue
+			}
+			item := v.ToDBItem()
+			item.Index = head + uint64(len(items)) + 1
+			fresh = append(fresh, v)
+			items = append(items, item)
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+
+		var err error
+		b, err = New(fresh, sealer)
+		if err != nil {
+			return err
+		}
+		stored := db.InsertBlock(b.dbItem(), items)
+		for i, v := range fresh {
+			v.Index = stored.First + uint64(i)
+		}
+		return nil
+	})
+	if err != nil || b == nil {
+		return nil, err
+	}
+	fmt.Println("Committed block", b.Height, "of", len(b.Transactions), "transactions")
+	return b, nil
+}
+
+func (b *Block) dbItem() db.BlockDBItem {
+	return db.BlockDBItem{
+		Height:     b.Height,
+		Hash:       b.Hash,
+		PrevHash:   b.PrevHash,
+		Timestamp:  b.Timestamp,
+		MerkleRoot: b.MerkleRoot,
+		Sealer:     b.Sealer,
+		Signature:  b.Signature,
+	}
+}
+
+// fromDBItem builds the block along with its transactions, nil if there is no such block
+func fromDBItem(item db.BlockDBItem) *Block {
+	if len(item.Hash) == 0 {
+		return nil
+	}
+	b := Block{
+		Header: Header{
+			Height:     item.Height,
+			PrevHash:   item.PrevHash,
+			Timestamp:  item.Timestamp,
+			MerkleRoot: item.MerkleRoot,
+			Sealer:     item.Sealer,
+		},
+		Hash:      item.Hash,
+		Signature: item.Signature,
+	}
+	for i := item.First; i <= item.Last && i != 0; i++ {
+		tx := transaction.RetrieveByIndex(i)
+		if tx == nil {
+			fmt.Println("Missing transaction", i, "of block", item.Height)
+			return nil
+		}
+		b.Transactions = append(b.Transactions, tx)
+	}
+	return &b
+}
+
+// Get the block by its hash
+func Retrieve(hash []byte) *Block {
+	return fromDBItem(db.GetBlock(hash))
+}
+
+// Get the block at given height
+func RetrieveByHeight(height uint64) *Block {
+	return fromDBItem(db.GetBlockByHeight(height))
+}
+
+// Get the last block, nil if there is none
+func Last() *Block {
+	return fromDBItem(db.GetLastBlock())
+}
+
+// Height is the height of the last block, 0 if there is none
+func Height() uint64 {
+	return db.GetLastBlock().Height
+}
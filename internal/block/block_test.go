@@ -0,0 +1,189 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+func TestMain(m *testing.M) {
+	db.Use(db.NewMemoryStore())
+	os.Exit(m.Run())
+}
+
+func newTestKeyPair(t *testing.T) keystore.KeyPair {
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	return keystore.KeyPair{
+		Name:           "Node",
+		DerivationPath: "0",
+		PublicKey:      master.Pub().Key,
+		PrivateKey:     master.Key,
+	}
+}
+
+// saves the genesis of given organization, returns signed file transactions of it, not saved
+func newTestTransactions(t *testing.T, keypair keystore.KeyPair, name string, n int) []*transaction.Transaction {
+	foundation, _ := json.Marshal(transaction.Organization{Name: name})
+	genesis, err := transaction.Build(transaction.Genesis, "json", nil, foundation, nil)
+	if err != nil {
+		t.Fatal("Cannot build genesis transaction", err)
+	}
+	genesis.Sign(keypair)
+	genesis.Save()
+
+	var transactions []*transaction.Transaction
+	for i := 0; i < n; i++ {
+		file, err := transaction.Build(transaction.File, "txt", genesis.Hash, []byte{byte(i)}, nil)
+		if err != nil {
+			t.Fatal("Cannot build file transaction", err)
+		}
+		file.Sign(keypair)
+		transactions = append(transactions, file)
+	}
+	return transactions
+}
+
+func TestCommit(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+
+	sealer := newTestKeyPair(t)
+	transactions := newTestTransactions(t, sealer, "Block Org", 5)
+
+	// duplicates are committed once
+	batch := []*transaction.Transaction{transactions[0], transactions[1], transactions[2], transactions[0]}
+	first, err := Commit(batch, sealer)
+	if err != nil || first == nil || first.Height != 1 || len(first.Transactions) != 3 {
+		t.Fatal("Cannot commit block", first, err)
+	}
+	second, err := Commit(transactions[2:], sealer)
+	if err != nil || second == nil || len(second.Transactions) != 2 {
+		t.Fatal("Cannot commit block", second, err)
+	}
+	if !bytes.Equal(second.PrevHash, first.Hash) || Height() != 2 {
+		t.Error("Blocks are not linked", Height())
+	}
+	if none, err := Commit(transactions[:1], sealer); none != nil || err != nil {
+		t.Error("Nothing new should be committed", none, err)
+	}
+
+	// transactions are appended to the chain in block order
+	if transaction.Height() != 6 || transactions[4].Index != 6 {
+		t.Error("Transactions of the blocks are not in the chain", transaction.Height(), transactions[4].Index)
+	}
+	if count, err := transaction.VerifyChain(); count != 6 || err != nil {
+		t.Error("Chain of blocks does not verify", count, err)
+	}
+
+	stored := RetrieveByHeight(1)
+	if stored == nil || !bytes.Equal(stored.Hash, first.Hash) || len(stored.Transactions) != 3 {
+		t.Fatal("Cannot retrieve block by height")
+	}
+	if err := stored.Verify(); err != nil {
+		t.Error("Stored block should verify", err)
+	}
+	if b := Retrieve(second.Hash); b == nil || b.Height != 2 {
+		t.Error("Cannot retrieve block by hash")
+	}
+	if b := Last(); b == nil || !bytes.Equal(b.Hash, second.Hash) {
+		t.Error("Last block is not the second one")
+	}
+
+	// tampering is detected
+	tampered := *stored
+	tampered.Transactions = stored.Transactions[1:]
+	if err := tampered.Verify(); !errors.Is(err, ErrInvalidBlock) {
+		t.Error("Block with missing transactions should be invalid", err)
+	}
+	tampered = *stored
+	tampered.Transactions = append(append([]*transaction.Transaction{}, stored.Transactions...), stored.Transactions[2])
+	if err := tampered.Verify(); !errors.Is(err, ErrInvalidBlock) {
+		t.Error("Block repeating its odd last transaction has the same root but should be invalid", err)
+	}
+	tampered = *stored
+	tampered.Height = 5
+	if err := tampered.Verify(); !errors.Is(err, ErrInvalidBlock) {
+		t.Error("Block with changed header should be invalid", err)
+	}
+	tampered = *stored
+	tampered.Sealer = newTestKeyPair(t).PublicKey
+	tampered.Hash = tampered.CalculateHash()
+	if err := tampered.Verify(); !errors.Is(err, ErrInvalidBlock) {
+		t.Error("Block sealed by someone else should be invalid", err)
+	}
+
+	// blocks leave with their transactions
+	db.RemoveFrom(5)
+	if Height() != 1 || Retrieve(second.Hash) != nil {
+		t.Error("Block of removed transactions should be gone", Height())
+	}
+}
+
+func TestCommitInvalid(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+	defer func(verifier func(tx *transaction.Transaction, chain db.View) error) {
+		transaction.SealVerifier = verifier
+	}(transaction.SealVerifier)
+	// one seal per height, the first data byte
+	transaction.SealVerifier = func(tx *transaction.Transaction, chain db.View) error {
+		for _, v := range chain.GetByObjectType(byte(transaction.Seal)) {
+			if v.Data[0] == tx.Data[0] {
+				return errors.New("Height is sealed")
+			}
+		}
+		return nil
+	}
+
+	sealer := newTestKeyPair(t)
+	foundation, _ := json.Marshal(transaction.Organization{Name: "Sealed Org", Validators: 1})
+	genesis, err := transaction.Build(transaction.Genesis, "json", nil, foundation, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis.Sign(sealer)
+	genesis.Save()
+	seal := func(height byte, data string) *transaction.Transaction {
+		tx, err := transaction.Build(transaction.Seal, "batch", genesis.Hash, []byte{height, data[0]}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Sign(sealer)
+		if ok, err := tx.Validate(); !ok || err != nil {
+			t.Fatal("Seal should be valid while queued", err)
+		}
+		return tx
+	}
+
+	// both valid while queued, only the first one is committed
+	first, second, third := seal(1, "a"), seal(1, "b"), seal(1, "c")
+	b, err := Commit([]*transaction.Transaction{first, second}, sealer)
+	if err != nil || b == nil || len(b.Transactions) != 1 || !bytes.Equal(b.Transactions[0].Hash, first.Hash) {
+		t.Fatal("Only the first seal of a height should be committed", b, err)
+	}
+	if b, err := Commit([]*transaction.Transaction{third}, sealer); b != nil || err != nil {
+		t.Error("Seal of a sealed height should not be committed", b, err)
+	}
+
+	// tampered after it was queued
+	next := seal(2, "a")
+	next.Data[1] = 'z'
+	if b, err := Commit([]*transaction.Transaction{next}, sealer); b != nil || err != nil {
+		t.Error("Invalid transaction should not be committed", b, err)
+	}
+	if height := transaction.Height(); height != 2 {
+		t.Error("Only the genesis and the first seal should be in the chain", height)
+	}
+}
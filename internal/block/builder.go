@@ -0,0 +1,125 @@
+package block
+
+// Block builder
+// Once started, verified transactions are queued here instead of being saved one by one
+// (see transaction.Committer). The queue is committed as a block every BlockInterval or as
+// soon as it holds MaxBlockSize transactions
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+const (
+	MaxBlockSize  = 500
+	BlockInterval = time.Second
+)
+
+var ErrNoSealer = errors.New("No key to seal blocks")
+
+type Builder struct {
+	mu       sync.Mutex
+	sealer   keystore.KeyPair
+	queue    []*transaction.Transaction
+	queued   map[string]bool // queued or being committed
+	stop     chan struct{}
+	previous func(tx *transaction.Transaction)
+}
+
+// NewBuilder returns a builder sealing blocks with given key
+func NewBuilder(sealer *keystore.KeyPair) (*Builder, error) {
+	if sealer == nil || len(sealer.PrivateKey) == 0 {
+		return nil, ErrNoSealer
+	}
+	return &Builder{
+		sealer: *sealer,
+		queued: make(map[string]bool),
+	}, nil
+}
+
+// Add queues a verified transaction, the block is committed right away once full
+func (b *Builder) Add(tx *transaction.Transaction) {
+	b.mu.Lock()
+	if b.queued[string(tx.Hash)] {
+		b.mu.Unlock()
+		return
+	}
+	b.queued[string(tx.Hash)] = true
+	b.queue = append(b.queue, tx)
+	full := len(b.queue) >= MaxBlockSize
+	b.mu.Unlock()
+
+	if full {
+		if _, err := b.Flush(); err != nil {
+			fmt.Println("Cannot commit block", err)
+		}
+	}
+}
+
+// Len returns the number of queued transactions
+func (b *Builder) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue)
+}
+
+// Flush commits the queued transactions as a block, returns nil if there were none
+func (b *Builder) Flush() (*Block, error) {
+	b.mu.Lock()
+	batch := b.queue
+	b.queue = nil
+	b.mu.Unlock()
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	block, err := Commit(batch, b.sealer)
+
+	b.mu.Lock()
+	for _, v := range batch {
+		delete(b.queued, string(v.Hash))
+	}
+	b.mu.Unlock()
+	return block, err
+}
+
+// Start takes over committing verified transactions, see transaction.Committer
+func (b *Builder) Start() {
+	b.stop = make(chan struct{})
+	b.previous = transaction.Committer
+	transaction.Committer = b.Add
+	go b.loop(b.stop)
+}
+
+// Stop gives committing back and commits what is queued
+func (b *Builder) Stop() {
+	if b.stop == nil {
+		return
+	}
+	transaction.Committer = b.previous
+	close(b.stop)
+	b.stop = nil
+	if _, err := b.Flush(); err != nil {
+		fmt.Println("Cannot commit block", err)
+	}
+}
+
+func (b *Builder) loop(stop chan struct{}) {
+	ticker := time.NewTicker(BlockInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := b.Flush(); err != nil {
+				fmt.Println("Cannot commit block", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package block
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+func TestBuilder(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+
+	if _, err := NewBuilder(nil); !errors.Is(err, ErrNoSealer) {
+		t.Error("Builder without a key should be refused", err)
+	}
+	sealer := newTestKeyPair(t)
+	builder, err := NewBuilder(&sealer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions := newTestTransactions(t, sealer, "Builder Org", 3)
+
+	builder.Start()
+	for _, v := range append(transactions, transactions[0]) {
+		if _, err := transaction.ProcessTransaction(v); err != nil {
+			t.Fatal("Cannot process transaction", err)
+		}
+	}
+	// verified transactions wait for the block
+	if builder.Len() != 3 || transaction.Height() != 1 {
+		t.Fatal("Transactions should be queued", builder.Len(), transaction.Height())
+	}
+
+	b, err := builder.Flush()
+	if err != nil || b == nil || len(b.Transactions) != 3 || transaction.Height() != 4 {
+		t.Fatal("Queued transactions should be committed as a block", err, transaction.Height())
+	}
+	if b, err = builder.Flush(); b != nil || err != nil {
+		t.Error("Empty queue should commit nothing", b, err)
+	}
+
+	// once stopped transactions are saved one by one again
+	builder.Stop()
+	more := newTestTransactions(t, sealer, "Other Org", 1)
+	if _, err := transaction.ProcessTransaction(more[0]); err != nil {
+		t.Fatal("Cannot process transaction", err)
+	}
+	if transaction.Height() != 6 || Height() != 1 {
+		t.Error("Transaction should be saved without a block", transaction.Height(), Height())
+	}
+}
@@ -0,0 +1,69 @@
+package block
+
+// Merkle tree of transaction hashes
+// Leaves are the transaction hashes in block order, each parent is the double hash of its
+// two children. A level of odd length pairs its last node with itself, so hashes ending with a
+// repeated pair have the same root as without it: blocks never hold a transaction twice, see Block.Verify
+// The branch of a leaf is the sibling at every level from the leaf up, enough to recompute
+// the root, see Proof
+
+import (
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+// MerkleRoot returns the root of the tree over given hashes, nil if there are none
+func MerkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		return nil
+	}
+	level := hashes
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+// MerkleBranch returns the siblings of the hash at given position from the leaf up
+func MerkleBranch(hashes [][]byte, position int) [][]byte {
+	if position < 0 || position >= len(hashes) {
+		return nil
+	}
+	var branch [][]byte
+	level := hashes
+	for len(level) > 1 {
+		sibling := position ^ 1
+		if sibling >= len(level) {
+			sibling = position
+		}
+		branch = append(branch, level[sibling])
+		level = nextLevel(level)
+		position /= 2
+	}
+	return branch
+}
+
+// RootFromBranch recomputes the root from a leaf, its position and its branch
+func RootFromBranch(leaf []byte, position uint32, branch [][]byte) []byte {
+	node := leaf
+	for _, sibling := range branch {
+		if position%2 == 0 {
+			node = crypto.DHash(append(append([]byte{}, node...), sibling...))
+		} else {
+			node = crypto.DHash(append(append([]byte{}, sibling...), node...))
+		}
+		position /= 2
+	}
+	return node
+}
+
+func nextLevel(level [][]byte) [][]byte {
+	var next [][]byte
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, crypto.DHash(append(append([]byte{}, level[i]...), right...)))
+	}
+	return next
+}
@@ -0,0 +1,54 @@
+package block
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	a, b, c := crypto.DHash([]byte("a")), crypto.DHash([]byte("b")), crypto.DHash([]byte("c"))
+	pair := func(left, right []byte) []byte {
+		return crypto.DHash(append(append([]byte{}, left...), right...))
+	}
+
+	if MerkleRoot(nil) != nil {
+		t.Error("Root of nothing should be nil")
+	}
+	if !bytes.Equal(MerkleRoot([][]byte{a}), a) {
+		t.Error("Root of a single hash should be the hash itself")
+	}
+	if !bytes.Equal(MerkleRoot([][]byte{a, b}), pair(a, b)) {
+		t.Error("Wrong root of two hashes")
+	}
+	// the last node of an odd level is paired with itself
+	if !bytes.Equal(MerkleRoot([][]byte{a, b, c}), pair(pair(a, b), pair(c, c))) {
+		t.Error("Wrong root of three hashes")
+	}
+	if bytes.Equal(MerkleRoot([][]byte{a, b, c}), MerkleRoot([][]byte{b, a, c})) {
+		t.Error("Root should depend on the order")
+	}
+}
+
+func TestMerkleBranch(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var hashes [][]byte
+		for i := 0; i < n; i++ {
+			hashes = append(hashes, crypto.DHash([]byte{byte(i)}))
+		}
+		root := MerkleRoot(hashes)
+		for i := range hashes {
+			branch := MerkleBranch(hashes, i)
+			if !bytes.Equal(RootFromBranch(hashes[i], uint32(i), branch), root) {
+				t.Error("Branch does not lead to the root", n, i)
+			}
+			if i^1 < n && bytes.Equal(RootFromBranch(hashes[i], uint32(i)^1, branch), root) {
+				t.Error("Branch should not prove another position", n, i)
+			}
+		}
+	}
+	if MerkleBranch([][]byte{crypto.DHash([]byte("a"))}, 1) != nil {
+		t.Error("Branch of a missing position should be nil")
+	}
+}
@@ -0,0 +1,253 @@
+package block
+
+// Merkle inclusion proofs
+// A proof shows that a transaction is committed in a block without the rest of the block:
+// the header of the block with its seal, the position of the transaction in the block and
+// its Merkle branch. It is verified offline against an Anchor: the sealer keys or the block
+// hashes the verifier already trusts, a proof sealed by anyone else proves nothing.
+// Only blocks built by a node have proofs there, entries it synced from peers are not in its
+// blocks: their proofs are to be asked from the nodes which committed them.
+// In JSON (see /proof/{txid} of the web server) bytes are hex and the timestamp
+// is in milliseconds, as hashed:
+// {"Transaction": "..", "Position": 2, "Branch": [".."], "Block": "..", "Height": 1, "PrevHash": "..",
+//  "Timestamp": 1600000000000, "MerkleRoot": "..", "Sealer": "..", "Signature": ".."}
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+const MaxBranchLength = 32
+
+var (
+	ErrInvalidProof   = errors.New("Invalid proof")
+	ErrUntrustedProof = errors.New("Proof is not anchored to a trusted block")
+	ErrNotInBlock     = errors.New("Transaction is not committed in a block")
+)
+
+// Anchor tells whether the block of a proof is trusted, see TrustSealers, TrustBlocks and TrustChain
+type Anchor func(p *Proof) bool
+
+type Proof struct {
+	Header
+	Signature   []byte   // of the block hash by the sealer
+	Transaction []byte   // hash of the proven transaction
+	Position    uint32   // of the transaction in the block
+	Branch      [][]byte // see MerkleBranch
+}
+
+// NewProof builds the inclusion proof of the transaction with given hash
+// Transactions synced from peers or saved on their own are not in a block of this node, there is no proof of them
+func NewProof(txid []byte) (*Proof, error) {
+	item := db.Get(txid)
+	if item.Index == 0 {
+		return nil, fmt.Errorf("%w: %x is not in the chain", ErrNotInBlock, txid)
+	}
+	stored := db.GetBlockContaining(item.Index)
+	if len(stored.Hash) == 0 {
+		return nil, fmt.Errorf("%w: %x is in the chain at %d but not in a block of this node", ErrNotInBlock, txid, item.Index)
+	}
+
+	var hashes [][]byte
+	for i := stored.First; i <= stored.Last; i++ {
+		hashes = append(hashes, db.GetByIndex(i).Hash)
+	}
+	position := int(item.Index - stored.First)
+
+	return &Proof{
+		Header: Header{
+			Height:     stored.Height,
+			PrevHash:   stored.PrevHash,
+			Timestamp:  stored.Timestamp,
+			MerkleRoot: stored.MerkleRoot,
+			Sealer:     stored.Sealer,
+		},
+		Signature:   stored.Signature,
+		Transaction: item.Hash,
+		Position:    uint32(position),
+		Branch:      MerkleBranch(hashes, position),
+	}, nil
+}
+
+// BlockHash returns the hash of the block the transaction is proven to be in
+func (p *Proof) BlockHash() []byte {
+	return p.CalculateHash()
+}
+
+// Verify checks that the branch leads to the merkle root of the header, that the header
+// is sealed by its sealer and that the anchor trusts the block
+func (p *Proof) Verify(anchor Anchor) error {
+	if len(p.Branch) > MaxBranchLength || uint64(p.Position)>>uint(len(p.Branch)) != 0 {
+		return fmt.Errorf("%w: position %d with a branch of %d", ErrInvalidProof, p.Position, len(p.Branch))
+	}
+	if !bytes.Equal(RootFromBranch(p.Transaction, p.Position, p.Branch), p.MerkleRoot) {
+		return fmt.Errorf("%w: branch does not lead to the merkle root", ErrInvalidProof)
+	}
+	if !crypto.Verify(p.Signature, p.BlockHash(), p.Sealer) {
+		return fmt.Errorf("%w: block seal is invalid", ErrInvalidProof)
+	}
+	if anchor == nil || !anchor(p) {
+		return fmt.Errorf("%w: block %x sealed by %x", ErrUntrustedProof, p.BlockHash(), p.Sealer)
+	}
+	return nil
+}
+
+// TrustSealers trusts the blocks sealed by given public keys
+func TrustSealers(keys ...[]byte) Anchor {
+	return func(p *Proof) bool {
+		for _, v := range keys {
+			if bytes.Equal(v, p.Sealer) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TrustBlocks trusts the blocks of given hashes
+func TrustBlocks(hashes ...[]byte) Anchor {
+	return func(p *Proof) bool {
+		hash := p.BlockHash()
+		for _, v := range hashes {
+			if bytes.Equal(v, hash) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TrustChain trusts the blocks of the local chain
+func TrustChain(p *Proof) bool {
+	return len(db.GetBlock(p.BlockHash()).Hash) != 0
+}
+
+// Export proof as bytes
+// Layout (little endian): header (see Header.ToBytes) + signature length (1) + signature
+// + transaction hash (32) + position (4) + branch length (1) + siblings (32 each)
+func (p *Proof) ToBytes() []byte {
+	proofBytes := p.Header.ToBytes()
+	proofBytes = append(proofBytes, byte(len(p.Signature)))
+	proofBytes = append(proofBytes, p.Signature...)
+	proofBytes = append(proofBytes, p.Transaction...)
+	position := make([]byte, 4)
+	binary.LittleEndian.PutUint32(position, p.Position)
+	proofBytes = append(proofBytes, position...)
+	proofBytes = append(proofBytes, byte(len(p.Branch)))
+	for _, v := range p.Branch {
+		proofBytes = append(proofBytes, v...)
+	}
+	return proofBytes
+}
+
+// Parse proof bytes, see ToBytes
+func ParseProof(proofBytes []byte) (*Proof, error) {
+	malformed := fmt.Errorf("%w: malformed proof of %d bytes", ErrInvalidProof, len(proofBytes))
+	if len(proofBytes) < HeaderSize+1 {
+		return nil, malformed
+	}
+	header, err := ParseHeader(proofBytes[:HeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	rest := proofBytes[HeaderSize:]
+	sigLength := int(rest[0])
+	if len(rest) < 1+sigLength+37 {
+		return nil, malformed
+	}
+	p := Proof{
+		Header:      *header,
+		Signature:   append([]byte{}, rest[1:1+sigLength]...),
+		Transaction: append([]byte{}, rest[1+sigLength:33+sigLength]...),
+		Position:    binary.LittleEndian.Uint32(rest[33+sigLength : 37+sigLength]),
+	}
+	rest = rest[37+sigLength:]
+	count := int(rest[0])
+	if count > MaxBranchLength || len(rest) != 1+32*count {
+		return nil, malformed
+	}
+	for i := 0; i < count; i++ {
+		p.Branch = append(p.Branch, append([]byte{}, rest[1+32*i:33+32*i]...))
+	}
+	return &p, nil
+}
+
+type proofJSON struct {
+	Transaction string
+	Position    uint32
+	Branch      []string
+	Block       string
+	Height      uint64
+	PrevHash    string
+	Timestamp   int64
+	MerkleRoot  string
+	Sealer      string
+	Signature   string
+}
+
+func (p *Proof) MarshalJSON() ([]byte, error) {
+	branch := []string{}
+	for _, v := range p.Branch {
+		branch = append(branch, hex.EncodeToString(v))
+	}
+	return json.Marshal(proofJSON{
+		Transaction: hex.EncodeToString(p.Transaction),
+		Position:    p.Position,
+		Branch:      branch,
+		Block:       hex.EncodeToString(p.BlockHash()),
+		Height:      p.Height,
+		PrevHash:    hex.EncodeToString(p.PrevHash),
+		Timestamp:   p.Timestamp.UnixNano() / 1e6,
+		MerkleRoot:  hex.EncodeToString(p.MerkleRoot),
+		Sealer:      hex.EncodeToString(p.Sealer),
+		Signature:   hex.EncodeToString(p.Signature),
+	})
+}
+
+// UnmarshalJSON reads a proof as served, the block hash is recomputed rather than read
+func (p *Proof) UnmarshalJSON(data []byte) error {
+	var v proofJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var err error
+	decode := func(s string) []byte {
+		b, e := hex.DecodeString(s)
+		if e != nil && err == nil {
+			err = fmt.Errorf("%w: %s", ErrInvalidProof, e)
+		}
+		return b
+	}
+
+	proof := Proof{
+		Header: Header{
+			Height:     v.Height,
+			PrevHash:   decode(v.PrevHash),
+			Timestamp:  time.Unix(0, v.Timestamp*1e6),
+			MerkleRoot: decode(v.MerkleRoot),
+			Sealer:     decode(v.Sealer),
+		},
+		Signature:   decode(v.Signature),
+		Transaction: decode(v.Transaction),
+		Position:    v.Position,
+	}
+	if len(proof.PrevHash) == 0 {
+		proof.PrevHash = nil
+	}
+	for _, s := range v.Branch {
+		proof.Branch = append(proof.Branch, decode(s))
+	}
+	if err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
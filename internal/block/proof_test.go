@@ -0,0 +1,104 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+func TestProof(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+
+	sealer := newTestKeyPair(t)
+	transactions := newTestTransactions(t, sealer, "Proof Org", 5)
+	b, err := Commit(transactions, sealer)
+	if err != nil || b == nil {
+		t.Fatal("Cannot commit block", err)
+	}
+
+	trusted := TrustSealers(sealer.PublicKey)
+	for i, tx := range transactions {
+		p, err := NewProof(tx.Hash)
+		if err != nil {
+			t.Fatal("Cannot build proof", i, err)
+		}
+		if err := p.Verify(trusted); err != nil || p.Position != uint32(i) || !bytes.Equal(p.BlockHash(), b.Hash) {
+			t.Error("Proof should verify", i, err)
+		}
+
+		// as served to light clients
+		encoded, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromJSON Proof
+		if err := json.Unmarshal(encoded, &fromJSON); err != nil || fromJSON.Verify(trusted) != nil || !bytes.Equal(fromJSON.BlockHash(), b.Hash) {
+			t.Error("Proof does not verify from JSON", i, err)
+		}
+		fromBytes, err := ParseProof(p.ToBytes())
+		if err != nil || fromBytes.Verify(trusted) != nil || !bytes.Equal(fromBytes.Transaction, tx.Hash) {
+			t.Error("Proof does not verify from bytes", i, err)
+		}
+	}
+
+	p, _ := NewProof(transactions[2].Hash)
+	cases := []struct {
+		name   string
+		change func(p *Proof)
+	}{
+		{"transaction", func(p *Proof) { p.Transaction = transactions[3].Hash }},
+		{"position", func(p *Proof) { p.Position = 3 }},
+		{"position beyond the tree", func(p *Proof) { p.Position += 8 }},
+		{"branch", func(p *Proof) { p.Branch = p.Branch[1:] }},
+		{"sibling", func(p *Proof) { p.Branch = [][]byte{crypto.DHash([]byte("x")), p.Branch[1], p.Branch[2]} }},
+		{"header", func(p *Proof) { p.Height = 2 }},
+		{"sealer", func(p *Proof) { p.Sealer = newTestKeyPair(t).PublicKey }},
+	}
+	for _, c := range cases {
+		tampered := *p
+		c.change(&tampered)
+		if err := tampered.Verify(trusted); !errors.Is(err, ErrInvalidProof) {
+			t.Error("Proof with changed", c.name, "should be invalid", err)
+		}
+	}
+
+	// a proof holds for the blocks the verifier trusts only
+	if err := p.Verify(TrustBlocks(b.Hash)); err != nil {
+		t.Error("Proof of a trusted block should verify", err)
+	}
+	if err := p.Verify(TrustChain); err != nil {
+		t.Error("Proof of a block in the chain should verify", err)
+	}
+	if err := p.Verify(nil); !errors.Is(err, ErrUntrustedProof) {
+		t.Error("Proof without an anchor should be refused", err)
+	}
+	minted := *p
+	outsider := newTestKeyPair(t)
+	minted.Sealer = outsider.PublicKey
+	minted.Signature, err = crypto.Sign(minted.BlockHash(), outsider.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, anchor := range []Anchor{trusted, TrustBlocks(b.Hash), TrustChain} {
+		if err := minted.Verify(anchor); !errors.Is(err, ErrUntrustedProof) {
+			t.Error("Proof sealed by anyone else should be refused", err)
+		}
+	}
+
+	// the genesis is saved on its own
+	if _, err := NewProof(db.GetByIndex(1).Hash); !errors.Is(err, ErrNotInBlock) {
+		t.Error("Transaction out of blocks has no proof", err)
+	}
+	if _, err := NewProof(crypto.DHash([]byte("unknown"))); !errors.Is(err, ErrNotInBlock) {
+		t.Error("Unknown transaction has no proof", err)
+	}
+	if _, err := ParseProof(p.ToBytes()[:200]); !errors.Is(err, ErrInvalidProof) {
+		t.Error("Truncated proof should be refused", err)
+	}
+}
@@ -4,38 +4,231 @@ package compute
 // It works in a tree structure where any script can execute a remote call inside
 // This module is just a dummy as there is much research and work to do
 // Some TODOs:
-// - Study efficient sandboxed environments for untrusted code execution. Docker, codejail ...
 // - Study distributed computation, including related academic papers and Ethereum's EVM
 // - Use existing connections from inside execution environment for remote calls
+//
+// Code of executable transactions is untrusted, it only runs in a sandbox (see sandbox_linux.go):
+// - own user, mount, pid, network, ipc and uts namespaces, thus no network
+// - read-only root with a small writable /tmp
+// - seccomp filter against syscalls that could leave the sandbox
+// - rlimits on cpu time, memory, processes and files; wall time and output size are watched
+// Where no sandbox can be set up (e.g. other than linux) code is not run at all
+// WebAssembly code does not need the sandbox, it runs in the node, see wasm.go
+// The runtime of an executable is chosen by its sub type, see runtime.go
+// Runs are tracked as jobs in a queue with a limited number of workers, see queue.go
 
 // Should require payment for computation
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
-	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
 )
 
 type ComputeChannel []byte
 
-var cmds = make(map[int]exec.Cmd)
-var stdins = make(map[int]io.WriteCloser)
+var (
+	ErrSandboxUnavailable = errors.New("Sandbox is not available")
+	ErrInvalidResult      = errors.New("Invalid compute result")
+)
+
+type Limits struct {
+	CPUTime   time.Duration // of all processes of the run, rounded up to seconds
+	Memory    uint64        // address space of each process in bytes
+	WallTime  time.Duration
+	Output    int    // bytes of stdout and stderr together
+	Processes uint64 // maximum number of processes
+	FileSize  uint64 // bytes of a file written into /tmp
+	Gas       uint64 // of a WebAssembly run
+}
+
+var DefaultLimits = Limits{
+	CPUTime:   5 * time.Second,
+	Memory:    256 << 20,
+	WallTime:  10 * time.Second,
+	Output:    1 << 20,
+	Processes: 16,
+	FileSize:  16 << 20,
+	Gas:       50000000,
+}
+
+// IDRange is a range of host uids and gids
+type IDRange struct {
+	First int
+	Count int
+}
+
+// SandboxIDs are the host uids and gids sandboxes run as, one for each run at a time. Nothing
+// else may use them: the process limit of a run counts the processes of its uid. Mapping them
+// into the sandbox needs a node with CAP_SETUID and CAP_SETGID, e.g. running as root
+var SandboxIDs = IDRange{First: 1000000000, Count: 64}
+
+type Result struct {
+	Stdout    []byte // stdout and stderr together keep up to Limits.Output bytes
+	Stderr    []byte
+	ExitCode  int    // -1 if killed by a signal or trapped
+	Signal    string // name of the signal that ended the run, if any
+	Trap      string // reason a WebAssembly run stopped, if any
+	TimedOut  bool   // killed after Limits.WallTime
+	Truncated bool   // killed after Limits.Output
+	CPUTime   time.Duration
+	MaxMemory uint64 // peak resident memory in bytes
+	WallTime  time.Duration
+	GasUsed   uint64 // of a WebAssembly run
+}
+
+// Succeeded tells if the code exited with status 0 within its limits
+func (r *Result) Succeeded() bool {
+	return r.ExitCode == 0 && !r.TimedOut && !r.Truncated && r.Trap == ""
+}
+
+// Digest identifies what a run produced: exit code, trap, gas used, truncation and output
+// Every node running the same WebAssembly transaction with the same input gets the same digest
+func (r *Result) Digest() []byte {
+	b := make([]byte, 13, 18+len(r.Trap)+len(r.Stdout)+len(r.Stderr))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(int32(r.ExitCode)))
+	binary.LittleEndian.PutUint64(b[4:12], r.GasUsed)
+	if r.Truncated {
+		b[12] = 1
+	}
+	b = append(append(b, byte(len(r.Trap))), r.Trap...)
+	return crypto.Hash(append(appendOutput(b, r.Stdout), r.Stderr...))
+}
+
+// appendOutput appends the length (4) and the bytes of stdout, stderr follows it
+func appendOutput(b []byte, stdout []byte) []byte {
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(stdout)))
+	return append(append(b, length...), stdout...)
+}
+
+func (r *Result) String() string {
+	status := fmt.Sprintf("exit status %d", r.ExitCode)
+	switch {
+	case r.TimedOut:
+		status = "timed out"
+	case r.Truncated:
+		status = "output limit exceeded"
+	case r.Signal != "":
+		status = "killed by " + r.Signal
+	case r.Trap != "":
+		status = "trapped: " + r.Trap
+	}
+	usage := fmt.Sprintf("%s, cpu %s, memory %d KB, wall %s", status, r.CPUTime, r.MaxMemory>>10, r.WallTime)
+	if r.GasUsed != 0 {
+		usage += fmt.Sprintf(", gas %d", r.GasUsed)
+	}
+	return usage
+}
 
-func Execute(code string) []byte {
+// Export result as bytes, to answer compute requests
+// Layout (little endian): exit code (4) + flags (1: timed out, 2: truncated) + signal length (1)
+// + signal + trap length (1) + trap + cpu time in microseconds (8) + max memory (8)
+// + wall time in microseconds (8) + gas used (8) + stdout length (4) + stdout + stderr
+func (r *Result) ToBytes() []byte {
+	resultBytes := make([]byte, 4, 43+len(r.Signal)+len(r.Trap)+len(r.Stdout)+len(r.Stderr))
+	binary.LittleEndian.PutUint32(resultBytes, uint32(int32(r.ExitCode)))
+	var flags byte
+	if r.TimedOut {
+		flags |= 1
+	}
+	if r.Truncated {
+		flags |= 2
+	}
+	resultBytes = append(resultBytes, flags, byte(len(r.Signal)))
+	resultBytes = append(resultBytes, r.Signal...)
+	resultBytes = append(append(resultBytes, byte(len(r.Trap))), r.Trap...)
+	usage := make([]byte, 32)
+	binary.LittleEndian.PutUint64(usage[0:8], uint64(r.CPUTime/time.Microsecond))
+	binary.LittleEndian.PutUint64(usage[8:16], r.MaxMemory)
+	binary.LittleEndian.PutUint64(usage[16:24], uint64(r.WallTime/time.Microsecond))
+	binary.LittleEndian.PutUint64(usage[24:32], r.GasUsed)
+	resultBytes = append(resultBytes, usage...)
+	return append(appendOutput(resultBytes, r.Stdout), r.Stderr...)
+}
 
-	// import the machine computation module to include remote calls
-	// cmd := exec.Command("/usr/bin/python3", "-m", "themachine", "-c", code)
-	cmd := exec.Command("/usr/bin/python3", "-c", code)
-	result, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Println("Error while computing", err)
+// Parse result bytes, see ToBytes
+func ParseResult(resultBytes []byte) (*Result, error) {
+	short := fmt.Errorf("%w: %d bytes", ErrInvalidResult, len(resultBytes))
+	if len(resultBytes) < 7 || len(resultBytes) < 7+int(resultBytes[5]) {
+		return nil, short
+	}
+	signalEnd := 6 + int(resultBytes[5])
+	trapEnd := signalEnd + 1 + int(resultBytes[signalEnd])
+	if len(resultBytes) < trapEnd+36 {
+		return nil, short
+	}
+	usage := resultBytes[trapEnd : trapEnd+32]
+	stdoutEnd := uint64(trapEnd+36) + uint64(binary.LittleEndian.Uint32(resultBytes[trapEnd+32:]))
+	if uint64(len(resultBytes)) < stdoutEnd {
+		return nil, short
 	}
+	return &Result{
+		ExitCode:  int(int32(binary.LittleEndian.Uint32(resultBytes[0:4]))),
+		TimedOut:  resultBytes[4]&1 != 0,
+		Truncated: resultBytes[4]&2 != 0,
+		Signal:    string(resultBytes[6:signalEnd]),
+		Trap:      string(resultBytes[signalEnd+1 : trapEnd]),
+		CPUTime:   time.Duration(binary.LittleEndian.Uint64(usage[0:8])) * time.Microsecond,
+		MaxMemory: binary.LittleEndian.Uint64(usage[8:16]),
+		WallTime:  time.Duration(binary.LittleEndian.Uint64(usage[16:24])) * time.Microsecond,
+		GasUsed:   binary.LittleEndian.Uint64(usage[24:32]),
+		Stdout:    append([]byte{}, resultBytes[trapEnd+36:stdoutEnd]...),
+		Stderr:    append([]byte{}, resultBytes[stdoutEnd:]...),
+	}, nil
+}
 
-	return result
+// limitedBuffer keeps up to limit bytes and reports once more is written
+// Buffers of the same run share the limit, see stream
+type limitedBuffer struct {
+	buf bytes.Buffer
+	*outputLimit
 }
 
-// Placeholder method for code validation
-// To be used when validating an executable transaction
-func ValidateCode(code string) (bool, error) {
-	return true, nil
+type outputLimit struct {
+	sync.Mutex
+	room     int
+	exceeded chan struct{}
+}
+
+func newLimitedBuffer(limit int) *limitedBuffer {
+	return &limitedBuffer{outputLimit: &outputLimit{room: limit, exceeded: make(chan struct{})}}
+}
+
+// stream returns another buffer sharing the limit, e.g. stderr of stdout
+func (b *limitedBuffer) stream() *limitedBuffer {
+	return &limitedBuffer{outputLimit: b.outputLimit}
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if len(p) > b.room {
+		if b.room > 0 {
+			b.buf.Write(p[:b.room])
+			b.room = 0
+		}
+		select {
+		case <-b.exceeded:
+		default:
+			close(b.exceeded)
+		}
+		return len(p), nil
+	}
+	b.room -= len(p)
+	return b.buf.Write(p)
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
 }
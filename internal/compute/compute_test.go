@@ -1,7 +1,14 @@
 package compute
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestExecute(t *testing.T) {
@@ -11,9 +18,97 @@ func TestExecute(t *testing.T) {
 import sys, os
 print("python output")`
 
-	result := Execute(code)
-	if string(result[:len(result)-1]) != "python output" {
-		t.Error("Error with compute result")
+	result, err := Execute(code)
+	if err != nil {
+		t.Fatal("Cannot execute", err)
 	}
+	if string(result.Stdout) != "python output\n" || !result.Succeeded() {
+		t.Error("Error with compute result", result, string(result.Stdout))
+	}
+
+}
+
+func TestSandbox(t *testing.T) {
+	if _, err := Execute("pass"); err != nil {
+		t.Skip("No sandbox in this environment:", err)
+	}
+	limits := DefaultLimits
+	limits.WallTime = 2 * time.Second
+	limits.Output = 1000
+	// a directory of the node, e.g. the datadir with its keystore
+	datadir, err := ioutil.TempDir(".", "datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+	datadir, _ = filepath.Abs(datadir)
+
+	cases := []struct {
+		name  string
+		code  string
+		check func(*Result) bool
+	}{
+		{"exit code", "import sys; sys.exit(3)", func(r *Result) bool { return r.ExitCode == 3 }},
+		{"wall time", "while True: pass", func(r *Result) bool { return r.TimedOut && !r.Succeeded() }},
+		{"output size", "print('x' * 5000)", func(r *Result) bool { return r.Truncated && len(r.Stdout) == 1000 }},
+		{"no network", `
+import socket
+try:
+    socket.create_connection(("1.1.1.1", 53), timeout=1)
+except OSError:
+    print("refused")`, func(r *Result) bool { return strings.TrimSpace(string(r.Stdout)) == "refused" }},
+		{"read-only root", `
+open("/tmp/scratch", "w").write("ok")
+try:
+    open("/usr/sandbox-escape", "w")
+except OSError:
+    print("read-only")`, func(r *Result) bool { return strings.TrimSpace(string(r.Stdout)) == "read-only" }},
+		{"no mounts", `
+import ctypes
+libc = ctypes.CDLL(None, use_errno=True)
+print(libc.mount(b"tmpfs", b"/usr", b"tmpfs", 0, None), ctypes.get_errno())`, func(r *Result) bool { return strings.TrimSpace(string(r.Stdout)) == "-1 1" }},
+		{"hidden host", fmt.Sprintf(`
+import os
+print(os.path.exists(%q), os.path.exists("/etc/passwd"), "root" in os.listdir("/"))`, datadir), func(r *Result) bool {
+			return strings.TrimSpace(string(r.Stdout)) == "False False False"
+		}},
+		{"own uid", `print(open("/proc/self/uid_map").read())`, func(r *Result) bool {
+			var inside, host, size int
+			fmt.Sscan(string(r.Stdout), &inside, &host, &size)
+			return inside == 0 && host >= SandboxIDs.First && host < SandboxIDs.First+SandboxIDs.Count && size == 1
+		}},
+	}
+	for _, c := range cases {
+		result, err := Run(c.code, limits)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if !c.check(result) {
+			t.Error("Sandbox does not enforce", c.name, result, string(result.Stdout))
+		}
+	}
+}
 
+func TestResultBytes(t *testing.T) {
+	result := Result{
+		Stdout:    []byte("output"),
+		Stderr:    []byte("error"),
+		ExitCode:  -1,
+		Signal:    "killed",
+		TimedOut:  true,
+		CPUTime:   1500 * time.Millisecond,
+		MaxMemory: 1 << 20,
+		WallTime:  2 * time.Second,
+	}
+	parsed, err := ParseResult(result.ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Stdout, result.Stdout) || !bytes.Equal(parsed.Stderr, result.Stderr) || parsed.ExitCode != -1 || parsed.Signal != result.Signal ||
+		!parsed.TimedOut || parsed.Truncated || parsed.CPUTime != result.CPUTime || parsed.MaxMemory != result.MaxMemory || parsed.WallTime != result.WallTime {
+		t.Error("Result does not survive a round trip", parsed)
+	}
+	if _, err := ParseResult(result.ToBytes()[:20]); err == nil {
+		t.Error("Short result should be refused")
+	}
 }
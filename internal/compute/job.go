@@ -0,0 +1,130 @@
+package compute
+
+// Jobs run an executable transaction with input parameters
+// - the input is a JSON value, given to interpreters in the INPUT environment variable
+//   and to WebAssembly code by its input host functions
+// - the executing node signs the result together with the executable and the hash of the input,
+//   so whoever gets it can tell which node computed what
+// A failed run is still a result, its exit code, signal or trap tell why, see Result.Succeeded
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+// MaxInput is the size limit of job input in bytes
+const MaxInput = 64 * 1024
+
+var (
+	ErrInvalidInput        = errors.New("Invalid job input")
+	ErrInvalidJobResult    = errors.New("Invalid job result")
+	ErrInvalidJobSignature = errors.New("Invalid job result signature")
+)
+
+type Job struct {
+	Executable []byte          // hash of the executable transaction
+	Input      json.RawMessage // parameters of the run, empty if none
+}
+
+type JobResult struct {
+	Executable []byte // hash of the executable transaction
+	InputHash  []byte // hash of the job input
+	*Result
+	Node      []byte // public key of the executing node
+	Signature []byte // of SignedHash by the node
+}
+
+// NewJob checks the input, which has to be JSON, and copies it
+func NewJob(executable []byte, input []byte) (*Job, error) {
+	if len(executable) != 32 {
+		return nil, fmt.Errorf("%w: executable hash of %d bytes", ErrInvalidInput, len(executable))
+	}
+	if len(input) > MaxInput {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidInput, len(input))
+	}
+	if len(input) != 0 && !json.Valid(input) {
+		return nil, fmt.Errorf("%w: not JSON", ErrInvalidInput)
+	}
+	return &Job{Executable: append([]byte{}, executable...), Input: append(json.RawMessage{}, input...)}, nil
+}
+
+// Run executes the code of the executable by the runtime of its sub type
+// The result is not signed yet, see JobResult.Sign
+func (j *Job) Run(codeType string, code []byte) (*JobResult, error) {
+	return j.RunContext(context.Background(), codeType, code)
+}
+
+// RunContext stops the run once the context is done
+func (j *Job) RunContext(ctx context.Context, codeType string, code []byte) (*JobResult, error) {
+	result, err := ExecuteCodeContext(ctx, codeType, code, j.Input)
+	if err != nil {
+		return nil, err
+	}
+	return &JobResult{
+		Executable: j.Executable,
+		InputHash:  crypto.Hash(j.Input),
+		Result:     result,
+	}, nil
+}
+
+// Gets the hash the node signs: executable + input hash + result bytes
+func (r *JobResult) SignedHash() []byte {
+	b := append(append([]byte{}, r.Executable...), r.InputHash...)
+	return crypto.Hash(append(b, r.Result.ToBytes()...))
+}
+
+// Sign the result with the key of the executing node
+func (r *JobResult) Sign(publicKey []byte, privateKey []byte) error {
+	signature, err := crypto.Sign(r.SignedHash(), privateKey)
+	if err != nil {
+		return err
+	}
+	r.Node = publicKey
+	r.Signature = signature
+	return nil
+}
+
+// Verify the signature of the executing node
+func (r *JobResult) Verify() error {
+	if len(r.Node) == 0 || len(r.Signature) == 0 || !crypto.Verify(r.Signature, r.SignedHash(), r.Node) {
+		return ErrInvalidJobSignature
+	}
+	return nil
+}
+
+// Export job result as bytes, to answer compute requests
+// Layout: executable hash (32) + input hash (32) + node key length (1) + node key
+// + signature length (1) + signature + result, see Result.ToBytes
+func (r *JobResult) ToBytes() []byte {
+	b := append(append([]byte{}, r.Executable...), r.InputHash...)
+	b = append(append(b, byte(len(r.Node))), r.Node...)
+	b = append(append(b, byte(len(r.Signature))), r.Signature...)
+	return append(b, r.Result.ToBytes()...)
+}
+
+// Parse job result bytes, see ToBytes
+func ParseJobResult(b []byte) (*JobResult, error) {
+	if len(b) < 65 || len(b) < 66+int(b[64]) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidJobResult, len(b))
+	}
+	nodeEnd := 65 + int(b[64])
+	signatureEnd := nodeEnd + 1 + int(b[nodeEnd])
+	if len(b) < signatureEnd {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidJobResult, len(b))
+	}
+	result, err := ParseResult(b[signatureEnd:])
+	if err != nil {
+		return nil, err
+	}
+	return &JobResult{
+		Executable: append([]byte{}, b[0:32]...),
+		InputHash:  append([]byte{}, b[32:64]...),
+		Node:       append([]byte{}, b[65:nodeEnd]...),
+		Signature:  append([]byte{}, b[nodeEnd+1:signatureEnd]...),
+		Result:     result,
+	}, nil
+}
@@ -0,0 +1,74 @@
+package compute
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+func TestNewJob(t *testing.T) {
+	executable := bytes.Repeat([]byte{1}, 32)
+	for _, v := range []string{"{", "not json", string(bytes.Repeat([]byte("1"), MaxInput+1))} {
+		if _, err := NewJob(executable, []byte(v)); !errors.Is(err, ErrInvalidInput) {
+			t.Error("Input should be refused", len(v), err)
+		}
+	}
+	if _, err := NewJob(executable[:4], nil); !errors.Is(err, ErrInvalidInput) {
+		t.Error("Short executable hash should be refused", err)
+	}
+	for _, v := range []string{"", `{"n": 3}`, "[1, 2]", "null"} {
+		if _, err := NewJob(executable, []byte(v)); err != nil {
+			t.Error("Input should be accepted", v, err)
+		}
+	}
+}
+
+func TestJob(t *testing.T) {
+	if _, err := Execute("pass"); err != nil {
+		t.Skip("No sandbox in this environment:", err)
+	}
+	job, _ := NewJob(bytes.Repeat([]byte{1}, 32), []byte(`{"n": 6}`))
+	code := `
+import json, os, sys
+n = json.loads(os.environ["INPUT"])["n"]
+print(n * 7)
+print("done", file=sys.stderr)
+sys.exit(2)`
+	result, err := job.Run(CodeTypePython, []byte(code))
+	if err != nil {
+		t.Fatal("Cannot run job", err)
+	}
+	if string(result.Stdout) != "42\n" || string(result.Stderr) != "done\n" || result.ExitCode != 2 || result.Succeeded() {
+		t.Error("Unexpected job result", result, string(result.Stdout), string(result.Stderr))
+	}
+	if !bytes.Equal(result.InputHash, crypto.Hash(job.Input)) {
+		t.Error("Result should refer to the input")
+	}
+	if err := result.Verify(); err == nil {
+		t.Error("Unsigned result should not verify")
+	}
+
+	key, publicKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Sign(publicKey, key); err != nil {
+		t.Fatal("Cannot sign job result", err)
+	}
+	parsed, err := ParseJobResult(result.ToBytes())
+	if err != nil {
+		t.Fatal("Cannot parse job result", err)
+	}
+	if err := parsed.Verify(); err != nil || !bytes.Equal(parsed.Node, publicKey) || string(parsed.Stderr) != "done\n" {
+		t.Error("Job result does not survive a round trip", parsed, err)
+	}
+	parsed.Stdout = []byte("43\n")
+	if err := parsed.Verify(); !errors.Is(err, ErrInvalidJobSignature) {
+		t.Error("Changed result should not verify", err)
+	}
+	if _, err := ParseJobResult(result.ToBytes()[:70]); err == nil {
+		t.Error("Short job result should be refused")
+	}
+}
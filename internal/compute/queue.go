@@ -0,0 +1,276 @@
+package compute
+
+// Queue runs jobs in the background by a fixed number of workers
+// Submitting returns a job id at once, the job is then polled by it or cancelled:
+// queued -> running -> done, or failed if it could not run, did not succeed, timed out or was cancelled
+// Finished jobs are kept for QueueConfig.Keep, then forgotten
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+var (
+	ErrQueueFull    = errors.New("Job queue is full")
+	ErrQueueClosed  = errors.New("Job queue is closed")
+	ErrUnknownJob   = errors.New("Unknown job")
+	ErrJobCancelled = errors.New("Job cancelled")
+	ErrJobTimeout   = errors.New("Job timed out")
+)
+
+type QueueConfig struct {
+	Workers int           // jobs running at once
+	Size    int           // jobs waiting at most
+	Timeout time.Duration // of a job from its submission, besides the limits of its run
+	Keep    time.Duration // finished jobs are kept for polling
+}
+
+var DefaultQueueConfig = QueueConfig{
+	Workers: 4,
+	Size:    64,
+	Timeout: time.Minute,
+	Keep:    10 * time.Minute,
+}
+
+// RunFunc runs a job, stopping once the context is done
+type RunFunc func(ctx context.Context, job *Job) (*JobResult, error)
+
+// JobState is a snapshot of a job in the queue
+type JobState struct {
+	ID        string // 16 random bytes as hex
+	Job       *Job
+	Status    JobStatus
+	Error     string     // why the job failed, if it did
+	Result    *JobResult // once the code has run, also of failed jobs
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+}
+
+type Queue struct {
+	config  QueueConfig
+	run     RunFunc
+	pending chan *queuedJob
+	mu      sync.Mutex
+	jobs    map[string]*queuedJob
+	closed  bool
+}
+
+type queuedJob struct {
+	state  JobState
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewQueue starts the workers of a queue
+func NewQueue(config QueueConfig, run RunFunc) *Queue {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	q := &Queue{
+		config:  config,
+		run:     run,
+		pending: make(chan *queuedJob, config.Size),
+		jobs:    make(map[string]*queuedJob),
+	}
+	for i := 0; i < config.Workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Submit queues a job, refused if the queue is full
+func (q *Queue) Submit(job *Job) (JobState, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return JobState{}, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return JobState{}, ErrQueueClosed
+	}
+	q.forget(time.Now().Add(-q.config.Keep))
+
+	qj := &queuedJob{
+		state: JobState{ID: hex.EncodeToString(id), Job: job, Status: JobQueued, Submitted: time.Now()},
+		done:  make(chan struct{}),
+	}
+	qj.ctx, qj.cancel = context.WithTimeout(context.Background(), q.config.Timeout)
+	select {
+	case q.pending <- qj:
+	default:
+		qj.cancel()
+		return JobState{}, ErrQueueFull
+	}
+	q.jobs[qj.state.ID] = qj
+	return qj.state, nil
+}
+
+// Status of a job by its id
+func (q *Queue) Status(id string) (JobState, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qj, ok := q.jobs[id]
+	if !ok {
+		return JobState{}, fmt.Errorf("%w: %s", ErrUnknownJob, id)
+	}
+	return qj.state, nil
+}
+
+// Done is closed once the job is finished
+func (q *Queue) Done(id string) (<-chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qj, ok := q.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJob, id)
+	}
+	return qj.done, nil
+}
+
+// Cancel stops a running job or drops a queued one, finished jobs stay as they are
+func (q *Queue) Cancel(id string) (JobState, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qj, ok := q.jobs[id]
+	if !ok {
+		return JobState{}, fmt.Errorf("%w: %s", ErrUnknownJob, id)
+	}
+	qj.cancel()
+	if qj.state.Status == JobQueued {
+		q.finish(qj, nil, ErrJobCancelled)
+	}
+	return qj.state, nil
+}
+
+// Close cancels all jobs and stops the workers
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, v := range q.jobs {
+		v.cancel()
+	}
+	close(q.pending)
+}
+
+func (q *Queue) work() {
+	for qj := range q.pending {
+		q.mu.Lock()
+		if qj.state.Status != JobQueued {
+			// cancelled while waiting
+			q.mu.Unlock()
+			continue
+		}
+		if err := qj.ctx.Err(); err != nil {
+			q.finish(qj, nil, contextError(err))
+			q.mu.Unlock()
+			continue
+		}
+		qj.state.Status = JobRunning
+		qj.state.Started = time.Now()
+		q.mu.Unlock()
+
+		result, err := q.run(qj.ctx, qj.state.Job)
+		if ctxErr := qj.ctx.Err(); ctxErr != nil {
+			err = contextError(ctxErr)
+		}
+
+		q.mu.Lock()
+		q.finish(qj, result, err)
+		q.mu.Unlock()
+		qj.cancel()
+	}
+}
+
+// finish sets the final state of a job, q.mu is held
+func (q *Queue) finish(qj *queuedJob, result *JobResult, err error) {
+	qj.state.Result = result
+	qj.state.Finished = time.Now()
+	switch {
+	case err != nil:
+		qj.state.Status = JobFailed
+		qj.state.Error = err.Error()
+	case !result.Succeeded():
+		qj.state.Status = JobFailed
+		qj.state.Error = result.String()
+	default:
+		qj.state.Status = JobDone
+	}
+	close(qj.done)
+}
+
+// forget finished jobs before given time, q.mu is held
+func (q *Queue) forget(before time.Time) {
+	for id, v := range q.jobs {
+		if (v.state.Status == JobDone || v.state.Status == JobFailed) && v.state.Finished.Before(before) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrJobTimeout
+	}
+	return ErrJobCancelled
+}
+
+// Export job state as bytes, to answer job requests
+// Layout: id (16) + status length (1) + status + error length (2) + error + job result, if any
+func (s *JobState) ToBytes() []byte {
+	id, _ := hex.DecodeString(s.ID)
+	b := append(append(id, byte(len(s.Status))), s.Status...)
+	length := make([]byte, 2)
+	binary.LittleEndian.PutUint16(length, uint16(len(s.Error)))
+	b = append(append(b, length...), s.Error...)
+	if s.Result != nil {
+		b = append(b, s.Result.ToBytes()...)
+	}
+	return b
+}
+
+// Parse job state bytes, see ToBytes
+func ParseJobState(b []byte) (*JobState, error) {
+	if len(b) < 17 || len(b) < 19+int(b[16]) {
+		return nil, fmt.Errorf("%w: job state of %d bytes", ErrInvalidJobResult, len(b))
+	}
+	statusEnd := 17 + int(b[16])
+	errorEnd := statusEnd + 2 + int(binary.LittleEndian.Uint16(b[statusEnd:]))
+	if len(b) < errorEnd {
+		return nil, fmt.Errorf("%w: job state of %d bytes", ErrInvalidJobResult, len(b))
+	}
+	s := &JobState{
+		ID:     hex.EncodeToString(b[0:16]),
+		Status: JobStatus(b[17:statusEnd]),
+		Error:  string(b[statusEnd+2 : errorEnd]),
+	}
+	if len(b) > errorEnd {
+		result, err := ParseJobResult(b[errorEnd:])
+		if err != nil {
+			return nil, err
+		}
+		s.Result = result
+	}
+	return s, nil
+}
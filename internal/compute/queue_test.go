@@ -0,0 +1,128 @@
+package compute
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitJob(t *testing.T, q *Queue, id string) JobState {
+	done, err := q.Done(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job is not finished", id)
+	}
+	state, _ := q.Status(id)
+	return state
+}
+
+func TestQueue(t *testing.T) {
+	started := make(chan struct{}, 10)
+	q := NewQueue(QueueConfig{Workers: 1, Size: 1, Timeout: time.Minute, Keep: time.Minute},
+		func(ctx context.Context, job *Job) (*JobResult, error) {
+			started <- struct{}{}
+			if string(job.Input) == "wait" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &JobResult{Result: &Result{ExitCode: len(job.Input)}}, nil
+		})
+	defer q.Close()
+	executable := bytes.Repeat([]byte{1}, 32)
+
+	ok, _ := q.Submit(&Job{Executable: executable})
+	if state := waitJob(t, q, ok.ID); state.Status != JobDone || state.Result == nil || state.Started.IsZero() {
+		t.Error("Job should be done", state)
+	}
+	<-started
+	failing, _ := q.Submit(&Job{Executable: executable, Input: []byte("1")})
+	if state := waitJob(t, q, failing.ID); state.Status != JobFailed || state.Result.ExitCode != 1 || state.Error == "" {
+		t.Error("Job exiting with 1 should fail", state)
+	}
+	<-started
+
+	// one running, one waiting, no room for another
+	running, _ := q.Submit(&Job{Executable: executable, Input: []byte("wait")})
+	<-started
+	queued, err := q.Submit(&Job{Executable: executable})
+	if err != nil || queued.Status != JobQueued {
+		t.Fatal("Job should be queued", queued, err)
+	}
+	if _, err := q.Submit(&Job{Executable: executable}); !errors.Is(err, ErrQueueFull) {
+		t.Error("Queue should be full", err)
+	}
+	if state, _ := q.Status(running.ID); state.Status != JobRunning {
+		t.Error("Job should be running", state)
+	}
+
+	if state, err := q.Cancel(queued.ID); err != nil || state.Status != JobFailed || state.Error != ErrJobCancelled.Error() {
+		t.Error("Queued job should be cancelled", state, err)
+	}
+	q.Cancel(running.ID)
+	if state := waitJob(t, q, running.ID); state.Status != JobFailed || state.Error != ErrJobCancelled.Error() {
+		t.Error("Running job should be cancelled", state)
+	}
+	if _, err := q.Status("unknown"); !errors.Is(err, ErrUnknownJob) {
+		t.Error("Unknown job should not have a state", err)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	// a loop long enough to run out of time, but not of gas
+	loop := mainModule(noLocals, []byte{0x03, 0x40, 0x0c, 0, 0x0b}, i32Const(0), []byte{0x0b})
+	q := NewQueue(QueueConfig{Workers: 2, Size: 4, Timeout: 50 * time.Millisecond, Keep: time.Minute},
+		func(ctx context.Context, job *Job) (*JobResult, error) {
+			return job.RunContext(ctx, CodeTypeWASM, loop)
+		})
+	defer q.Close()
+
+	limits := DefaultLimits
+	DefaultLimits.Gas = 1 << 40
+	defer func() { DefaultLimits = limits }()
+
+	start := time.Now()
+	job, _ := q.Submit(&Job{Executable: bytes.Repeat([]byte{1}, 32)})
+	state := waitJob(t, q, job.ID)
+	if state.Status != JobFailed || state.Error != ErrJobTimeout.Error() || state.Result.Trap != "cancelled" {
+		t.Error("Job should time out", state)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Job should stop once timed out", time.Since(start))
+	}
+
+	q.Close()
+	if _, err := q.Submit(job.Job); !errors.Is(err, ErrQueueClosed) {
+		t.Error("Closed queue should refuse jobs", err)
+	}
+}
+
+func TestJobStateBytes(t *testing.T) {
+	state := JobState{
+		ID:     "00112233445566778899aabbccddeeff",
+		Status: JobFailed,
+		Error:  "exit status 1",
+		Result: &JobResult{
+			Executable: bytes.Repeat([]byte{1}, 32),
+			InputHash:  bytes.Repeat([]byte{2}, 32),
+			Result:     &Result{ExitCode: 1, Stdout: []byte("out")},
+		},
+	}
+	for _, v := range []JobState{state, {ID: state.ID, Status: JobQueued}} {
+		parsed, err := ParseJobState(v.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.ID != v.ID || parsed.Status != v.Status || parsed.Error != v.Error || (parsed.Result == nil) != (v.Result == nil) {
+			t.Error("Job state does not survive a round trip", parsed)
+		}
+	}
+	if _, err := ParseJobState(state.ToBytes()[:20]); err == nil {
+		t.Error("Short job state should be refused")
+	}
+}
@@ -0,0 +1,156 @@
+package compute
+
+// Runtimes run the code of executable transactions, keyed by their sub type
+// - python  python3 in the sandbox
+// - nodejs  node in the sandbox
+// - wasm    the WebAssembly interpreter in the node, see wasm.go
+// Interpreters read the code from stdin. Only environment variables named in Env
+// are passed from the node into the sandbox, besides PATH, HOME, LANG and INPUT
+// The sandbox sees no files of the host but the interpreter and the paths in Mounts
+// A node may configure a runtime (e.g. another binary) by registering it again
+// The sub types of the protocol are valid on every node, whichever runtimes it has
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Sub types of executable transactions
+const (
+	CodeTypePython = "python"
+	CodeTypeNodeJS = "nodejs"
+	CodeTypeWASM   = "wasm"
+)
+
+var ErrUnsupportedRuntime = errors.New("Unsupported runtime")
+
+type Runtime struct {
+	Name   string   // sub type of executable transactions it runs
+	Path   string   // interpreter binary, looked up in PATH if not absolute
+	Args   []string // given to the interpreter to read the code from stdin
+	Env    []string // names of environment variables passed into the sandbox
+	Limits *Limits  // DefaultLimits if nil
+	Mounts []string // host paths the interpreter needs, bound read-only into the sandbox, DefaultMounts if nil
+
+	// runtimes in the node do not use the sandbox
+	run func(ctx context.Context, code []byte, input []byte, limits Limits) (*Result, error)
+}
+
+// DefaultMounts hold the interpreters of the system and their libraries
+var DefaultMounts = []string{"/usr", "/lib", "/lib64", "/etc/ld.so.cache"}
+
+var (
+	runtimes     = make(map[string]Runtime)
+	runtimesLock sync.RWMutex
+)
+
+func init() {
+	RegisterRuntime(Runtime{Name: CodeTypePython, Path: "/usr/bin/python3", Args: []string{"-I", "-"}})
+	// V8 reserves about 1 GB of address space up front, its heap is limited by the flag instead
+	node := DefaultLimits
+	node.Memory = 2 << 30
+	RegisterRuntime(Runtime{
+		Name:   CodeTypeNodeJS,
+		Path:   "/usr/bin/node",
+		Args:   []string{"--max-old-space-size=256", "-"},
+		Limits: &node,
+	})
+	RegisterRuntime(Runtime{Name: CodeTypeWASM, run: runWASM})
+}
+
+// RegisterRuntime adds or replaces the runtime of its sub type
+func RegisterRuntime(rt Runtime) {
+	runtimesLock.Lock()
+	defer runtimesLock.Unlock()
+	runtimes[rt.Name] = rt
+}
+
+// GetRuntime returns the runtime of a sub type
+func GetRuntime(codeType string) (Runtime, error) {
+	runtimesLock.RLock()
+	defer runtimesLock.RUnlock()
+	rt, ok := runtimes[codeType]
+	if !ok {
+		return rt, fmt.Errorf("%w: %q", ErrUnsupportedRuntime, codeType)
+	}
+	return rt, nil
+}
+
+// Gets the limits of a run
+func (rt Runtime) limits() Limits {
+	if rt.Limits != nil {
+		return *rt.Limits
+	}
+	return DefaultLimits
+}
+
+// Gets the host paths bound into the sandbox
+func (rt Runtime) mounts() []string {
+	if rt.Mounts != nil {
+		return rt.Mounts
+	}
+	return DefaultMounts
+}
+
+// Gets the environment of the sandbox: the fixed variables and allowed ones of the node
+func (rt Runtime) environment() []string {
+	env := []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=/tmp",
+		"LANG=C.UTF-8",
+	}
+	for _, v := range rt.Env {
+		if value, ok := os.LookupEnv(v); ok {
+			env = append(env, v+"="+value)
+		}
+	}
+	return env
+}
+
+// Execute runs python code in the sandbox with the default limits
+func Execute(code string) (*Result, error) {
+	return Run(code, DefaultLimits)
+}
+
+// Run executes python code in the sandbox, within given limits
+func Run(code string, limits Limits) (*Result, error) {
+	rt, err := GetRuntime(CodeTypePython)
+	if err != nil {
+		return nil, err
+	}
+	return runSandboxed(context.Background(), rt, code, nil, limits)
+}
+
+// ExecuteCode runs the code of an executable transaction by the runtime of its sub type
+// Interpreters get the input in the INPUT environment variable, WebAssembly by its host functions
+func ExecuteCode(codeType string, code []byte, input []byte) (*Result, error) {
+	return ExecuteCodeContext(context.Background(), codeType, code, input)
+}
+
+// ExecuteCodeContext stops the run once the context is done, e.g. a cancelled job
+func ExecuteCodeContext(ctx context.Context, codeType string, code []byte, input []byte) (*Result, error) {
+	rt, err := GetRuntime(codeType)
+	if err != nil {
+		return nil, err
+	}
+	if rt.run != nil {
+		return rt.run(ctx, code, input, rt.limits())
+	}
+	return runSandboxed(ctx, rt, string(code), input, rt.limits())
+}
+
+// ValidateCode tells if the code of an executable transaction is of a sub type of the protocol
+// WebAssembly modules are also decoded. Validity does not depend on the runtimes of a node, code
+// of a sub type it has no runtime for fails when run, see ExecuteCode
+func ValidateCode(codeType string, code []byte) error {
+	switch codeType {
+	case CodeTypeWASM:
+		return ValidateWASM(code)
+	case CodeTypePython, CodeTypeNodeJS:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnsupportedRuntime, codeType)
+}
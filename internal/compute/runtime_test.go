@@ -0,0 +1,96 @@
+package compute
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExecuteCode(t *testing.T) {
+	if _, err := Execute("pass"); err != nil {
+		t.Skip("No sandbox in this environment:", err)
+	}
+	if _, err := GetRuntime(CodeTypeNodeJS); err != nil {
+		t.Fatal("Node.js should have a runtime", err)
+	}
+
+	python, _ := GetRuntime(CodeTypePython)
+	defer RegisterRuntime(python)
+	node, _ := GetRuntime(CodeTypeNodeJS)
+	defer RegisterRuntime(node)
+
+	os.Setenv("THEMACHINE_TEST_ALLOWED", "allowed")
+	os.Setenv("THEMACHINE_TEST_HIDDEN", "hidden")
+	defer os.Unsetenv("THEMACHINE_TEST_ALLOWED")
+	defer os.Unsetenv("THEMACHINE_TEST_HIDDEN")
+	python.Env = []string{"THEMACHINE_TEST_ALLOWED"}
+	RegisterRuntime(python)
+
+	code := `import os; print(os.environ.get("THEMACHINE_TEST_ALLOWED"), os.environ.get("THEMACHINE_TEST_HIDDEN"))`
+	result, err := ExecuteCode(CodeTypePython, []byte(code), nil)
+	if err != nil {
+		t.Fatal("Cannot execute", err)
+	}
+	if string(result.Stdout) != "allowed None\n" {
+		t.Error("Only allowed environment should pass", string(result.Stdout))
+	}
+
+	if _, err := os.Stat(node.Path); err != nil {
+		t.Skip("Node.js is not installed:", err)
+	}
+	result, err = ExecuteCode(CodeTypeNodeJS, []byte("console.log(process.release.name, 6 * 7)"), nil)
+	if err != nil {
+		t.Fatal("Cannot execute", err)
+	}
+	if string(result.Stdout) != "node 42\n" || !result.Succeeded() {
+		t.Error("Code should run under node", result, string(result.Stdout))
+	}
+
+	// runtimes are configurable, e.g. a missing binary
+	node.Path = "/nonexistent/node"
+	RegisterRuntime(node)
+	if _, err := ExecuteCode(CodeTypeNodeJS, []byte("console.log(1)"), nil); !errors.Is(err, ErrSandboxUnavailable) {
+		t.Error("Missing interpreter should not run", err)
+	}
+}
+
+func TestValidateCode(t *testing.T) {
+	for _, v := range []string{"", "json", "ruby", "Python"} {
+		if err := ValidateCode(v, []byte("code")); !errors.Is(err, ErrUnsupportedRuntime) {
+			t.Error("Sub type out of the protocol should be invalid", v, err)
+		}
+		if _, err := ExecuteCode(v, []byte("code"), nil); !errors.Is(err, ErrUnsupportedRuntime) {
+			t.Error("Sub type should not run", v, err)
+		}
+	}
+	for _, v := range []string{CodeTypePython, CodeTypeNodeJS} {
+		if err := ValidateCode(v, []byte("print(1)")); err != nil {
+			t.Error("Code should be valid", v, err)
+		}
+	}
+	if err := ValidateCode(CodeTypeWASM, []byte("print(1)")); !errors.Is(err, ErrInvalidModule) || strings.Contains(err.Error(), "runtime") {
+		t.Error("WebAssembly code should be decoded", err)
+	}
+
+	// a node without the runtime of a sub type of the protocol still accepts its code
+	node, _ := GetRuntime(CodeTypeNodeJS)
+	defer RegisterRuntime(node)
+	runtimesLock.Lock()
+	delete(runtimes, CodeTypeNodeJS)
+	runtimesLock.Unlock()
+	if err := ValidateCode(CodeTypeNodeJS, []byte("console.log(1)")); err != nil {
+		t.Error("Validity should not depend on the runtimes of the node", err)
+	}
+	if _, err := ExecuteCode(CodeTypeNodeJS, []byte("console.log(1)"), nil); !errors.Is(err, ErrUnsupportedRuntime) {
+		t.Error("Code without a runtime should not run", err)
+	}
+
+	// the module is decoded even by a node running WebAssembly otherwise
+	wasm, _ := GetRuntime(CodeTypeWASM)
+	defer RegisterRuntime(wasm)
+	RegisterRuntime(Runtime{Name: CodeTypeWASM, Path: "/usr/bin/wasmtime"})
+	if err := ValidateCode(CodeTypeWASM, []byte("print(1)")); !errors.Is(err, ErrInvalidModule) {
+		t.Error("WebAssembly code should be decoded by every node", err)
+	}
+}
@@ -0,0 +1,365 @@
+package compute
+
+// Sandbox on linux
+// The node binary starts itself again (/proc/self/exe) in new namespaces with sandboxEnv set,
+// as root of its user namespace mapped to a host uid of SandboxIDs no other run uses.
+// Before anything else runs, init notices it is the sandbox and sets it up: a new root holding
+// only the interpreter and its libraries, rlimits and the seccomp filter. Then it becomes the
+// interpreter by exec.
+// Setup errors are written to a pipe (fd 3) closed on exec, so an empty pipe means the code runs.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	sandboxEnv       = "THEMACHINE_SANDBOX"
+	sandboxMountsEnv = "THEMACHINE_SANDBOX_MOUNTS"
+)
+
+// sandboxRoot is where the new root is built, on a tmpfs hiding the directory of the host
+const sandboxRoot = "/tmp"
+
+// devices bound into the sandbox
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// ids of SandboxIDs not used by a run
+var sandboxIDs struct {
+	sync.Mutex
+	IDRange
+	free chan int
+}
+
+func init() {
+	if os.Getenv(sandboxEnv) != "" {
+		sandboxMain()
+	}
+}
+
+// runSandboxed executes the code by the interpreter of the runtime in the sandbox, within given limits
+// The input is given in the INPUT environment variable
+// The code failing, being killed or exceeding a limit is reported in the result, not as an error
+func runSandboxed(ctx context.Context, rt Runtime, code string, input []byte, limits Limits) (*Result, error) {
+	if len(input) > MaxInput || bytes.IndexByte(input, 0) >= 0 {
+		return nil, ErrInvalidInput
+	}
+	interpreter, err := exec.LookPath(rt.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSandboxUnavailable, err)
+	}
+	id, free, err := acquireSandboxID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { free <- id }()
+	setupErrors, setupWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer setupErrors.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, limits.WallTime)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", append([]string{interpreter}, rt.Args...)...)
+	cmd.Env = append([]string{
+		sandboxEnv + "=" + encodeLimits(limits),
+		sandboxMountsEnv + "=" + strings.Join(rt.mounts(), ":"),
+	}, rt.environment()...)
+	if len(input) != 0 {
+		cmd.Env = append(cmd.Env, "INPUT="+string(input))
+	}
+	cmd.Dir = "/"
+	cmd.Stdin = strings.NewReader(code)
+	output := newLimitedBuffer(limits.Output)
+	stderr := output.stream()
+	cmd.Stdout = output
+	cmd.Stderr = stderr
+	cmd.ExtraFiles = []*os.File{setupWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: id, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: id, Size: 1}},
+		// the node switches to the mapped ids, leaving its own groups behind
+		Credential:                 &syscall.Credential{Uid: 0, Gid: 0, Groups: []uint32{}},
+		GidMappingsEnableSetgroups: true,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+
+	start := time.Now()
+	err = cmd.Start()
+	setupWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSandboxUnavailable, err)
+	}
+	// killing the first process of the pid namespace ends all of its processes
+	go func() {
+		select {
+		case <-output.exceeded:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	setupError, _ := ioutil.ReadAll(setupErrors)
+	waitErr := cmd.Wait()
+	wall := time.Since(start)
+
+	if len(setupError) != 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSandboxUnavailable, setupError)
+	}
+	if cmd.ProcessState == nil {
+		return nil, waitErr
+	}
+
+	result := Result{
+		Stdout:    output.buf.Bytes(),
+		Stderr:    stderr.buf.Bytes(),
+		ExitCode:  cmd.ProcessState.ExitCode(),
+		WallTime:  wall,
+		TimedOut:  ctx.Err() == context.DeadlineExceeded,
+		Truncated: isClosed(output.exceeded),
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = status.Signal().String()
+	}
+	if usage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		result.CPUTime = time.Duration(syscall.TimevalToNsec(usage.Utime) + syscall.TimevalToNsec(usage.Stime))
+		result.MaxMemory = uint64(usage.Maxrss) << 10
+	}
+	return &result, nil
+}
+
+// acquireSandboxID waits for an id of SandboxIDs no other run uses, it goes back to free after the run
+func acquireSandboxID(ctx context.Context) (int, chan int, error) {
+	sandboxIDs.Lock()
+	if sandboxIDs.free == nil || sandboxIDs.IDRange != SandboxIDs {
+		sandboxIDs.IDRange = SandboxIDs
+		sandboxIDs.free = make(chan int, SandboxIDs.Count)
+		for i := 0; i < SandboxIDs.Count; i++ {
+			sandboxIDs.free <- SandboxIDs.First + i
+		}
+	}
+	free := sandboxIDs.free
+	sandboxIDs.Unlock()
+
+	if cap(free) == 0 || SandboxIDs.First <= 0 {
+		return 0, nil, fmt.Errorf("%w: no sandbox ids", ErrSandboxUnavailable)
+	}
+	select {
+	case id := <-free:
+		return id, free, nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func encodeLimits(l Limits) string {
+	cpu := uint64((l.CPUTime + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%d,%d,%d,%d", cpu, l.Memory, l.Processes, l.FileSize)
+}
+
+func decodeLimits(s string) ([4]uint64, error) {
+	var values [4]uint64
+	fields := strings.Split(s, ",")
+	if len(fields) != len(values) {
+		return values, fmt.Errorf("malformed limits %q", s)
+	}
+	for i, v := range fields {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return values, fmt.Errorf("malformed limits %q", s)
+		}
+		values[i] = n
+	}
+	return values, nil
+}
+
+// sandboxMain runs in the sandbox process and never returns
+func sandboxMain() {
+	// the seccomp filter applies to this thread, which becomes the interpreter
+	runtime.LockOSThread()
+	setupErrors := os.NewFile(3, "setup errors")
+	fail := func(step string, err error) {
+		fmt.Fprintf(setupErrors, "%s: %s", step, err)
+		os.Exit(1)
+	}
+	limits, err := decodeLimits(os.Getenv(sandboxEnv))
+	if err != nil {
+		fail("limits", err)
+	}
+	if len(os.Args) < 2 {
+		fail("interpreter", fmt.Errorf("missing"))
+	}
+	mounts := append(strings.Split(os.Getenv(sandboxMountsEnv), ":"), os.Args[1])
+	if err := setupMounts(mounts); err != nil {
+		fail("mounts", err)
+	}
+	if err := setupLimits(limits); err != nil {
+		fail("rlimits", err)
+	}
+	if err := syscall.Chdir("/tmp"); err != nil {
+		fail("chdir", err)
+	}
+	if err := installSeccomp(); err != nil {
+		fail("seccomp", err)
+	}
+	syscall.CloseOnExec(3)
+
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, sandboxEnv+"=") && !strings.HasPrefix(v, sandboxMountsEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	err = syscall.Exec(os.Args[1], os.Args[1:], env)
+	fail("exec", err)
+}
+
+// setupMounts moves into a new root holding only the given host paths bound read-only, a few
+// devices, a fresh /proc of the pid namespace and a small writable /tmp. The root of the host is
+// unmounted, then the new one is made read-only. Host paths under sandboxRoot cannot be bound
+func setupMounts(paths []string) error {
+	// nothing done here propagates back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if err := syscall.Mount("tmpfs", sandboxRoot, "tmpfs", flags, "size=1m,mode=755"); err != nil {
+		return fmt.Errorf("root: %s", err)
+	}
+	for _, v := range append(paths, sandboxDevices...) {
+		if v == "" {
+			continue
+		}
+		if err := bindReadOnly(v); err != nil {
+			return fmt.Errorf("%s: %s", v, err)
+		}
+	}
+
+	flags |= syscall.MS_NOEXEC
+	for _, v := range []string{"/proc", "/tmp", "/old"} {
+		if err := os.MkdirAll(sandboxRoot+v, 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("proc", sandboxRoot+"/proc", "proc", flags, ""); err != nil {
+		return fmt.Errorf("proc: %s", err)
+	}
+	if err := syscall.Mount("tmpfs", sandboxRoot+"/tmp", "tmpfs", flags, "size=16m,mode=1777"); err != nil {
+		return fmt.Errorf("tmp: %s", err)
+	}
+
+	if err := syscall.PivotRoot(sandboxRoot, sandboxRoot+"/old"); err != nil {
+		return fmt.Errorf("pivot root: %s", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("host root: %s", err)
+	}
+	if err := os.Remove("/old"); err != nil {
+		return err
+	}
+	if err := remountReadOnly("/"); err != nil {
+		return fmt.Errorf("read-only root: %s", err)
+	}
+	return nil
+}
+
+// bindReadOnly shows the host path at the same place of the new root, missing ones are skipped
+// A symbolic link is copied, a linked interpreter is bound along with its target
+func bindReadOnly(path string) error {
+	target := sandboxRoot + path
+	if _, err := os.Lstat(target); err == nil {
+		// within a path bound already
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil
+		}
+		return bindReadOnly(resolved)
+	case info.IsDir():
+		err = os.Mkdir(target, 0755)
+	default:
+		err = ioutil.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(path, target, "", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	return remountReadOnly(target)
+}
+
+// remountReadOnly keeps the flags of the mount, which cannot be cleared in a user namespace
+func remountReadOnly(mountPoint string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return err
+	}
+	kept := uintptr(stat.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	return syscall.Mount("", mountPoint, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|kept, "")
+}
+
+func setupLimits(limits [4]uint64) error {
+	cpu, memory, processes, fileSize := limits[0], limits[1], limits[2], limits[3]
+	rlimits := []struct {
+		resource int
+		soft     uint64
+		hard     uint64
+	}{
+		// SIGXCPU at the soft limit, SIGKILL at the hard one
+		{syscall.RLIMIT_CPU, cpu, cpu + 1},
+		{syscall.RLIMIT_AS, memory, memory},
+		// counts the processes of the sandbox uid, which no other run uses
+		{rlimitNproc, processes, processes},
+		{syscall.RLIMIT_FSIZE, fileSize, fileSize},
+		{syscall.RLIMIT_NOFILE, 64, 64},
+		{syscall.RLIMIT_CORE, 0, 0},
+	}
+	for _, v := range rlimits {
+		if err := syscall.Setrlimit(v.resource, &syscall.Rlimit{Cur: v.soft, Max: v.hard}); err != nil {
+			return fmt.Errorf("resource %d: %s", v.resource, err)
+		}
+	}
+	return nil
+}
+
+// not defined by package syscall
+const rlimitNproc = 6
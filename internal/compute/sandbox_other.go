@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package compute
+
+import "context"
+
+// runSandboxed refuses to execute code, there is no sandbox but on linux
+func runSandboxed(ctx context.Context, rt Runtime, code string, input []byte, limits Limits) (*Result, error) {
+	return nil, ErrSandboxUnavailable
+}
@@ -0,0 +1,138 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+package compute
+
+// Seccomp filter of the sandbox
+// A deny list: syscalls that change mounts, namespaces, the kernel or other processes fail
+// with EPERM, sockets other than unix ones too. Other architectures and the x32 ABI are killed
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKill  = 0x80000000 // whole process
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	auditArchX86_64 = 0xc000003e
+	x32SyscallBit   = 0x40000000
+
+	// offsets in struct seccomp_data
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArg0 = 16
+
+	bpfLoad = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeq  = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJge  = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfJset = 0x45 // BPF_JMP | BPF_JSET | BPF_K
+	bpfRet  = 0x06 // BPF_RET | BPF_K
+
+	// flags of clone creating namespaces
+	cloneNamespaces = 0x7e020000
+
+	// not defined by package syscall
+	sysProcessVMReadv  = 310
+	sysProcessVMWritev = 311
+	sysKcmp            = 312
+	sysFinitModule     = 313
+	sysClockAdjtime    = 305
+	sysSetns           = 308
+	sysOpenByHandleAt  = 304
+	sysNameToHandleAt  = 303
+	sysBPF             = 321
+	sysUserfaultfd     = 323
+	sysKexecFileLoad   = 320
+	sysOpenTree        = 428
+	sysMoveMount       = 429
+	sysFsopen          = 430
+	sysFsconfig        = 431
+	sysFsmount         = 432
+	sysFspick          = 433
+	sysClone3          = 435
+	sysMountSetattr    = 442
+)
+
+var deniedSyscalls = []uint32{
+	syscall.SYS_PTRACE, sysProcessVMReadv, sysProcessVMWritev, sysKcmp,
+	syscall.SYS_MOUNT, syscall.SYS_UMOUNT2, syscall.SYS_PIVOT_ROOT, syscall.SYS_CHROOT,
+	sysOpenTree, sysMoveMount, sysFsopen, sysFsconfig, sysFsmount, sysFspick, sysMountSetattr,
+	syscall.SYS_UNSHARE, sysSetns,
+	syscall.SYS_KEXEC_LOAD, sysKexecFileLoad, syscall.SYS_REBOOT,
+	syscall.SYS_INIT_MODULE, sysFinitModule, syscall.SYS_DELETE_MODULE,
+	syscall.SYS_SWAPON, syscall.SYS_SWAPOFF, syscall.SYS_ACCT, syscall.SYS_QUOTACTL,
+	syscall.SYS_SETTIMEOFDAY, syscall.SYS_CLOCK_SETTIME, sysClockAdjtime, syscall.SYS_ADJTIMEX,
+	syscall.SYS_SETHOSTNAME, syscall.SYS_SETDOMAINNAME, syscall.SYS_IOPL, syscall.SYS_IOPERM,
+	syscall.SYS_KEYCTL, syscall.SYS_ADD_KEY, syscall.SYS_REQUEST_KEY,
+	sysBPF, syscall.SYS_PERF_EVENT_OPEN, sysUserfaultfd, syscall.SYS_FANOTIFY_INIT,
+	sysOpenByHandleAt, sysNameToHandleAt, syscall.SYS_LOOKUP_DCOOKIE,
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+func seccompFilter() []sockFilter {
+	errno := func(e syscall.Errno) sockFilter {
+		return sockFilter{code: bpfRet, k: seccompRetErrno | uint32(e)}
+	}
+	allow := sockFilter{code: bpfRet, k: seccompRetAllow}
+
+	filter := []sockFilter{
+		{code: bpfLoad, k: offsetArch},
+		{code: bpfJeq, jt: 1, k: auditArchX86_64},
+		{code: bpfRet, k: seccompRetKill},
+		{code: bpfLoad, k: offsetNr},
+		{code: bpfJge, jf: 1, k: x32SyscallBit},
+		{code: bpfRet, k: seccompRetKill},
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, sockFilter{code: bpfJeq, jf: 1, k: nr}, errno(syscall.EPERM))
+	}
+	// clone3 hides its flags in memory, the C library falls back to clone
+	filter = append(filter, sockFilter{code: bpfJeq, jf: 1, k: sysClone3}, errno(syscall.ENOSYS))
+	filter = append(filter,
+		// clone without new namespaces
+		sockFilter{code: bpfJeq, jf: 4, k: syscall.SYS_CLONE},
+		sockFilter{code: bpfLoad, k: offsetArg0},
+		sockFilter{code: bpfJset, jf: 1, k: cloneNamespaces},
+		errno(syscall.EPERM),
+		allow,
+		// unix sockets only
+		sockFilter{code: bpfJeq, jf: 4, k: syscall.SYS_SOCKET},
+		sockFilter{code: bpfLoad, k: offsetArg0},
+		sockFilter{code: bpfJeq, jt: 1, k: syscall.AF_UNIX},
+		errno(syscall.EPERM),
+		allow,
+		allow,
+	)
+	return filter
+}
+
+// installSeccomp applies the filter to the calling thread, no privileges can be gained after
+func installSeccomp() error {
+	filter := seccompFilter()
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); e != 0 {
+		return e
+	}
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build linux && !amd64
+// +build linux,!amd64
+
+package compute
+
+import "errors"
+
+// installSeccomp only knows the syscall numbers of amd64, code does not run elsewhere
+func installSeccomp() error {
+	return errors.New("Seccomp filter is only available on amd64")
+}
@@ -0,0 +1,546 @@
+package compute
+
+// WebAssembly backend
+// Executable transactions of sub type "wasm" hold a WebAssembly module run by the interpreter
+// embedded in the node. Unlike python, a run only depends on the module, its input and the
+// committed transactions it reads, so nodes executing the same transaction compare results
+// (see Result.Digest):
+// - MVP integer instructions, sign extension, memory.copy and memory.fill
+// - no floating point, NaN bits are not the same on every host
+// - every instruction costs one gas, growing memory and host calls cost more; a run traps
+//   once Limits.Gas is used up, whatever the speed of the node
+// - memory is limited by Limits.Memory, the call stack by maxCallDepth
+// - the module calls the node through functions imported from "env", see wasm_host.go
+// - exported "main" is the entry point, it takes nothing and may return an i32 exit code
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidModule = errors.New("Invalid WebAssembly module")
+
+type valType byte
+
+const (
+	i32 valType = 0x7f
+	i64 valType = 0x7e
+)
+
+type funcType struct {
+	params  []valType
+	results []valType
+}
+
+func (t funcType) equals(other funcType) bool {
+	return bytes.Equal(valTypeBytes(t.params), valTypeBytes(other.params)) &&
+		bytes.Equal(valTypeBytes(t.results), valTypeBytes(other.results))
+}
+
+func valTypeBytes(types []valType) []byte {
+	b := make([]byte, len(types))
+	for i, v := range types {
+		b[i] = byte(v)
+	}
+	return b
+}
+
+type wasmImport struct {
+	module, name string
+	typ          funcType
+}
+
+// wasmBlock is a block, loop or if instruction of a function body, by its position
+type wasmBlock struct {
+	params, results int
+	start           int // first instruction inside
+	elsePos, endPos int // elsePos is 0 without else
+}
+
+type wasmFunction struct {
+	typ    funcType
+	locals int // besides parameters
+	body   []byte
+	blocks map[int]wasmBlock
+}
+
+type wasmGlobal struct {
+	mutable bool
+	init    uint64
+}
+
+type wasmSegment struct {
+	offset uint32
+	data   []byte   // data segments
+	funcs  []uint32 // element segments
+}
+
+type wasmModule struct {
+	types     []funcType
+	imports   []wasmImport // functions only
+	funcs     []wasmFunction
+	hasTable  bool
+	tableMin  uint32
+	hasMemory bool
+	memoryMin uint32
+	memoryMax uint32 // pages, 0 without maximum
+	globals   []wasmGlobal
+	exports   map[string]uint32 // functions by name
+	start     int64             // -1 without start function
+	elements  []wasmSegment
+	data      []wasmSegment
+}
+
+func (m *wasmModule) funcType(index uint32) funcType {
+	if int(index) < len(m.imports) {
+		return m.imports[index].typ
+	}
+	return m.funcs[int(index)-len(m.imports)].typ
+}
+
+// decodeError stops decoding, it is turned into ErrInvalidModule
+type decodeError string
+
+type wasmReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *wasmReader) fail(format string, args ...interface{}) {
+	panic(decodeError(fmt.Sprintf(format, args...)))
+}
+
+func (r *wasmReader) byte() byte {
+	if r.pos >= len(r.b) {
+		r.fail("unexpected end")
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if uint64(n) > uint64(len(r.b)-r.pos) {
+		r.fail("unexpected end")
+	}
+	b := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// uleb reads an unsigned LEB128 integer of given bits
+func (r *wasmReader) uleb(bits uint) uint64 {
+	var result uint64
+	for i := uint(0); i < (bits+6)/7; i++ {
+		b := r.byte()
+		result |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			if bits < 64 && result>>bits != 0 || bits == 64 && i == 9 && b > 1 {
+				r.fail("integer too large")
+			}
+			return result
+		}
+	}
+	r.fail("integer too long")
+	return 0
+}
+
+// sleb reads a signed LEB128 integer of given bits
+func (r *wasmReader) sleb(bits uint) int64 {
+	var result int64
+	var shift uint
+	for i := uint(0); i < (bits+6)/7; i++ {
+		b := r.byte()
+		result |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+			if bits < 64 && (result < -(1<<(bits-1)) || result >= 1<<(bits-1)) {
+				r.fail("integer too large")
+			}
+			return result
+		}
+	}
+	r.fail("integer too long")
+	return 0
+}
+
+func (r *wasmReader) u32() uint32 {
+	return uint32(r.uleb(32))
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+func (r *wasmReader) valType() valType {
+	switch t := valType(r.byte()); t {
+	case i32, i64:
+		return t
+	case 0x7d, 0x7c:
+		r.fail("floating point is not deterministic")
+	default:
+		r.fail("unsupported value type 0x%x", byte(t))
+	}
+	return 0
+}
+
+func (r *wasmReader) valTypes() []valType {
+	n := r.u32()
+	if int(n) > len(r.b)-r.pos {
+		r.fail("unexpected end")
+	}
+	types := make([]valType, n)
+	for i := range types {
+		types[i] = r.valType()
+	}
+	return types
+}
+
+// limits reads minimum and maximum, 0 without maximum
+func (r *wasmReader) limits() (uint32, uint32) {
+	switch r.byte() {
+	case 0:
+		return r.u32(), 0
+	case 1:
+		min, max := r.u32(), r.u32()
+		if max < min {
+			r.fail("maximum below minimum")
+		}
+		return min, max
+	}
+	r.fail("invalid limits")
+	return 0, 0
+}
+
+// constExpr reads an initializer: a constant or a preceding global, then end
+func (r *wasmReader) constExpr(m *wasmModule) uint64 {
+	var v uint64
+	switch op := r.byte(); op {
+	case 0x41:
+		v = uint64(uint32(r.sleb(32)))
+	case 0x42:
+		v = uint64(r.sleb(64))
+	case 0x23:
+		index := r.u32()
+		if int(index) >= len(m.globals) {
+			r.fail("unknown global %d", index)
+		}
+		v = m.globals[index].init
+	default:
+		r.fail("unsupported constant expression 0x%x", op)
+	}
+	if r.byte() != 0x0b {
+		r.fail("constant expression is not ended")
+	}
+	return v
+}
+
+// blockType reads the type of a block as numbers of parameters and results
+func (r *wasmReader) blockType(m *wasmModule) (int, int) {
+	if r.pos >= len(r.b) {
+		r.fail("unexpected end")
+	}
+	switch b := r.b[r.pos]; {
+	case b == 0x40:
+		r.pos++
+		return 0, 0
+	case b == byte(i32) || b == byte(i64) || b == 0x7d || b == 0x7c:
+		r.valType()
+		return 0, 1
+	}
+	index := r.sleb(33)
+	if index < 0 || index >= int64(len(m.types)) {
+		r.fail("unknown block type %d", index)
+	}
+	return len(m.types[index].params), len(m.types[index].results)
+}
+
+// section ids in their required order, custom sections (0) may be anywhere
+var sectionOrder = map[byte]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 12: 10, 10: 11, 11: 12}
+
+// parseModule decodes a binary module and checks what the interpreter relies on
+func parseModule(code []byte) (m *wasmModule, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			d, ok := e.(decodeError)
+			if !ok {
+				panic(e)
+			}
+			m, err = nil, fmt.Errorf("%w: %s", ErrInvalidModule, string(d))
+		}
+	}()
+
+	r := &wasmReader{b: code}
+	if !bytes.Equal(r.bytes(8), []byte{0, 'a', 's', 'm', 1, 0, 0, 0}) {
+		r.fail("not a WebAssembly module")
+	}
+	m = &wasmModule{exports: map[string]uint32{}, start: -1}
+	var funcTypes []uint32
+	var bodies [][]byte
+	last := 0
+	for r.pos < len(r.b) {
+		id := r.byte()
+		s := &wasmReader{b: r.bytes(r.u32())}
+		if id == 0 {
+			s.name()
+			continue
+		}
+		order, ok := sectionOrder[id]
+		if !ok || order <= last {
+			r.fail("unexpected section %d", id)
+		}
+		last = order
+
+		switch id {
+		case 1:
+			for n := s.u32(); n > 0; n-- {
+				if s.byte() != 0x60 {
+					s.fail("invalid function type")
+				}
+				m.types = append(m.types, funcType{params: s.valTypes(), results: s.valTypes()})
+			}
+		case 2:
+			for n := s.u32(); n > 0; n-- {
+				module, name := s.name(), s.name()
+				if s.byte() != 0 {
+					s.fail("only functions can be imported, not %s.%s", module, name)
+				}
+				index := s.u32()
+				if int(index) >= len(m.types) {
+					s.fail("unknown type %d", index)
+				}
+				m.imports = append(m.imports, wasmImport{module, name, m.types[index]})
+			}
+		case 3:
+			for n := s.u32(); n > 0; n-- {
+				index := s.u32()
+				if int(index) >= len(m.types) {
+					s.fail("unknown type %d", index)
+				}
+				funcTypes = append(funcTypes, index)
+			}
+		case 4:
+			if s.u32() != 1 || s.byte() != 0x70 {
+				s.fail("one table of functions is supported")
+			}
+			m.hasTable = true
+			m.tableMin, _ = s.limits()
+		case 5:
+			if s.u32() != 1 {
+				s.fail("one memory is supported")
+			}
+			m.hasMemory = true
+			m.memoryMin, m.memoryMax = s.limits()
+		case 6:
+			for n := s.u32(); n > 0; n-- {
+				s.valType()
+				mutable := s.byte()
+				if mutable > 1 {
+					s.fail("invalid global mutability")
+				}
+				m.globals = append(m.globals, wasmGlobal{mutable: mutable == 1, init: s.constExpr(m)})
+			}
+		case 7:
+			for n := s.u32(); n > 0; n-- {
+				name, kind, index := s.name(), s.byte(), s.u32()
+				if kind != 0 {
+					continue
+				}
+				if _, ok := m.exports[name]; ok {
+					s.fail("duplicate export %s", name)
+				}
+				if int(index) >= len(m.imports)+len(funcTypes) {
+					s.fail("unknown function %d", index)
+				}
+				m.exports[name] = index
+			}
+		case 8:
+			index := s.u32()
+			if int(index) >= len(m.imports)+len(funcTypes) {
+				s.fail("unknown function %d", index)
+			}
+			m.start = int64(index)
+		case 9:
+			for n := s.u32(); n > 0; n-- {
+				if s.u32() != 0 || !m.hasTable {
+					s.fail("only active elements of the table are supported")
+				}
+				segment := wasmSegment{offset: uint32(s.constExpr(m))}
+				for k := s.u32(); k > 0; k-- {
+					index := s.u32()
+					if int(index) >= len(m.imports)+len(funcTypes) {
+						s.fail("unknown function %d", index)
+					}
+					segment.funcs = append(segment.funcs, index)
+				}
+				m.elements = append(m.elements, segment)
+			}
+		case 12:
+			s.u32()
+		case 10:
+			n := s.u32()
+			if int(n) != len(funcTypes) {
+				s.fail("%d function bodies for %d functions", n, len(funcTypes))
+			}
+			for ; n > 0; n-- {
+				bodies = append(bodies, s.bytes(s.u32()))
+			}
+		case 11:
+			for n := s.u32(); n > 0; n-- {
+				if s.u32() != 0 || !m.hasMemory {
+					s.fail("only active data of the memory is supported")
+				}
+				offset := uint32(s.constExpr(m))
+				m.data = append(m.data, wasmSegment{offset: offset, data: s.bytes(s.u32())})
+			}
+		}
+		if s.pos != len(s.b) {
+			s.fail("section %d is longer than its contents", id)
+		}
+	}
+	if len(bodies) != len(funcTypes) {
+		r.fail("%d function bodies for %d functions", len(bodies), len(funcTypes))
+	}
+	m.funcs = make([]wasmFunction, len(bodies))
+	for i, body := range bodies {
+		m.funcs[i].typ = m.types[funcTypes[i]]
+		m.parseBody(&m.funcs[i], body)
+	}
+	if m.start >= 0 {
+		if t := m.funcType(uint32(m.start)); len(t.params) != 0 || len(t.results) != 0 {
+			r.fail("start function takes or returns values")
+		}
+	}
+	return m, nil
+}
+
+// maxLocals of a function, parameters included
+const maxLocals = 50000
+
+// parseBody reads the locals of a function and finds the blocks of its instructions
+func (m *wasmModule) parseBody(f *wasmFunction, body []byte) {
+	r := &wasmReader{b: body}
+	locals := uint64(len(f.typ.params))
+	for n := r.u32(); n > 0; n-- {
+		locals += uint64(r.u32())
+		r.valType()
+		if locals > maxLocals {
+			r.fail("too many locals")
+		}
+	}
+	f.locals = int(locals) - len(f.typ.params)
+	f.body = body[r.pos:]
+	f.blocks = map[int]wasmBlock{}
+	r = &wasmReader{b: f.body}
+
+	// positions of the open blocks, the function itself is the outermost
+	var open []int
+	isIf := map[int]bool{}
+	for r.pos < len(r.b) {
+		pos := r.pos
+		switch op := r.byte(); {
+		case op == 0x02 || op == 0x03 || op == 0x04:
+			params, results := r.blockType(m)
+			f.blocks[pos] = wasmBlock{params: params, results: results, start: r.pos}
+			open = append(open, pos)
+			isIf[pos] = op == 0x04
+		case op == 0x05:
+			if len(open) == 0 || !isIf[open[len(open)-1]] || f.blocks[open[len(open)-1]].elsePos != 0 {
+				r.fail("else without if")
+			}
+			b := f.blocks[open[len(open)-1]]
+			b.elsePos = pos
+			f.blocks[open[len(open)-1]] = b
+		case op == 0x0b:
+			if len(open) == 0 {
+				if r.pos != len(r.b) {
+					r.fail("instructions after the end of the function")
+				}
+				return
+			}
+			b := f.blocks[open[len(open)-1]]
+			b.endPos = pos
+			f.blocks[open[len(open)-1]] = b
+			open = open[:len(open)-1]
+		case op == 0x0c || op == 0x0d:
+			if int(r.u32()) > len(open) {
+				r.fail("unknown label")
+			}
+		case op == 0x0e:
+			for n := uint64(r.u32()) + 1; n > 0; n-- {
+				if int(r.u32()) > len(open) {
+					r.fail("unknown label")
+				}
+			}
+		case op == 0x10:
+			if int(r.u32()) >= len(m.imports)+len(m.funcs) {
+				r.fail("unknown function")
+			}
+		case op == 0x11:
+			if int(r.u32()) >= len(m.types) || r.byte() != 0 || !m.hasTable {
+				r.fail("invalid indirect call")
+			}
+		case op == 0x1c:
+			if len(r.valTypes()) != 1 {
+				r.fail("invalid select")
+			}
+		case op >= 0x20 && op <= 0x22:
+			if uint64(r.u32()) >= locals {
+				r.fail("unknown local")
+			}
+		case op == 0x23 || op == 0x24:
+			index := r.u32()
+			if int(index) >= len(m.globals) || op == 0x24 && !m.globals[index].mutable {
+				r.fail("unknown or immutable global")
+			}
+		case op >= 0x28 && op <= 0x3e:
+			if op >= 0x2a && op <= 0x2b || op >= 0x38 && op <= 0x39 {
+				r.fail("floating point is not deterministic")
+			}
+			r.u32()
+			r.u32()
+			m.needsMemory(r)
+		case op == 0x3f || op == 0x40:
+			if r.byte() != 0 {
+				r.fail("unknown memory")
+			}
+			m.needsMemory(r)
+		case op == 0x41:
+			r.sleb(32)
+		case op == 0x42:
+			r.sleb(64)
+		case op == 0xfc:
+			switch r.u32() {
+			case 10:
+				if r.byte() != 0 || r.byte() != 0 {
+					r.fail("unknown memory")
+				}
+			case 11:
+				if r.byte() != 0 {
+					r.fail("unknown memory")
+				}
+			default:
+				r.fail("unsupported instruction")
+			}
+			m.needsMemory(r)
+		case op == 0x43 || op == 0x44 || op >= 0x5b && op <= 0x66 || op >= 0x8b && op <= 0xa6 ||
+			op >= 0xa8 && op <= 0xab || op >= 0xae && op <= 0xbf:
+			r.fail("floating point is not deterministic")
+		case op <= 0x01 || op == 0x0f || op == 0x1a || op == 0x1b || op >= 0x45 && op <= 0x5a ||
+			op >= 0x67 && op <= 0x8a || op == 0xa7 || op == 0xac || op == 0xad || op >= 0xc0 && op <= 0xc4:
+		default:
+			r.fail("unsupported instruction 0x%x", op)
+		}
+	}
+	r.fail("function is not ended")
+}
+
+func (m *wasmModule) needsMemory(r *wasmReader) {
+	if !m.hasMemory {
+		r.fail("no memory")
+	}
+}
@@ -0,0 +1,561 @@
+package compute
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"runtime"
+)
+
+const (
+	pageSize     = 65536
+	maxPages     = 65536
+	maxCallDepth = 1024
+	maxStack     = 1 << 20 // values
+	pageGas      = 1000    // per page of memory, initial or grown
+	copyGas      = 64      // copied or filled bytes per gas
+)
+
+// wasmTrap stops a run, the reason is part of its result
+type wasmTrap string
+
+func trap(reason string) {
+	panic(wasmTrap(reason))
+}
+
+type wasmInstance struct {
+	module   *wasmModule
+	host     []hostFunction // imported functions
+	memory   []byte
+	maxPages uint32
+	globals  []uint64
+	table    []int64 // function indexes, -1 for none
+	stack    []uint64
+	depth    int
+	gas      uint64
+
+	input        []byte
+	output       *limitedBuffer
+	transactions func(hash []byte) []byte
+	cancelled    <-chan struct{} // looked at every cancelCheck instructions
+}
+
+const cancelCheck = 1 << 16
+
+// protect runs f, returning the reason of a trap if any
+func (in *wasmInstance) protect(f func()) (reason string) {
+	defer func() {
+		switch e := recover().(type) {
+		case nil:
+		case wasmTrap:
+			reason = string(e)
+		case runtime.Error:
+			// stack underflows and the like of code the decoder let through
+			reason = "invalid code"
+		default:
+			panic(e)
+		}
+	}()
+	f()
+	return ""
+}
+
+func (in *wasmInstance) charge(gas uint64) {
+	if in.gas < gas {
+		in.gas = 0
+		trap("out of gas")
+	}
+	in.gas -= gas
+}
+
+// instantiate sets up memory, globals and the table of the module
+func (in *wasmInstance) instantiate(memoryLimit uint64) {
+	m := in.module
+	in.maxPages = maxPages
+	if limit := memoryLimit / pageSize; limit < uint64(in.maxPages) {
+		in.maxPages = uint32(limit)
+	}
+	if m.memoryMax != 0 && m.memoryMax < in.maxPages {
+		in.maxPages = m.memoryMax
+	}
+	if m.memoryMin > in.maxPages {
+		trap("memory limit exceeded")
+	}
+	in.charge(uint64(m.memoryMin) * pageGas)
+	in.memory = make([]byte, int(m.memoryMin)*pageSize)
+	for _, v := range m.globals {
+		in.globals = append(in.globals, v.init)
+	}
+	in.table = make([]int64, m.tableMin)
+	for i := range in.table {
+		in.table[i] = -1
+	}
+	for _, v := range m.elements {
+		if uint64(v.offset)+uint64(len(v.funcs)) > uint64(len(in.table)) {
+			trap("out of bounds table access")
+		}
+		for i, f := range v.funcs {
+			in.table[int(v.offset)+i] = int64(f)
+		}
+	}
+	for _, v := range m.data {
+		copy(in.memorySlice(uint64(v.offset), uint64(len(v.data))), v.data)
+	}
+}
+
+func (in *wasmInstance) memorySlice(address, length uint64) []byte {
+	if address+length > uint64(len(in.memory)) {
+		trap("out of bounds memory access")
+	}
+	return in.memory[address : address+length]
+}
+
+func (in *wasmInstance) push(v uint64) {
+	in.stack = append(in.stack, v)
+}
+
+func (in *wasmInstance) pop() uint64 {
+	v := in.stack[len(in.stack)-1]
+	in.stack = in.stack[:len(in.stack)-1]
+	return v
+}
+
+// call runs a function with its arguments on the stack, leaving its results there
+func (in *wasmInstance) call(index uint32) {
+	if int(index) < len(in.host) {
+		h := in.host[index]
+		n := len(h.typ.params)
+		args := append([]uint64{}, in.stack[len(in.stack)-n:]...)
+		in.stack = in.stack[:len(in.stack)-n]
+		in.charge(hostGas)
+		in.stack = append(in.stack, h.call(in, args)...)
+		return
+	}
+	f := &in.module.funcs[int(index)-len(in.host)]
+	if in.depth++; in.depth > maxCallDepth || len(in.stack) > maxStack {
+		trap("call stack exhausted")
+	}
+	n := len(f.typ.params)
+	locals := make([]uint64, n+f.locals)
+	copy(locals, in.stack[len(in.stack)-n:])
+	in.stack = in.stack[:len(in.stack)-n]
+	in.execute(f, locals)
+	in.depth--
+}
+
+// label is where a branch goes
+type label struct {
+	arity  int // values a branch carries
+	height int // of the stack at the start of the block
+	target int // loops start over by entering again
+}
+
+func (in *wasmInstance) execute(f *wasmFunction, locals []uint64) {
+	body := f.body
+	pc := 0
+	labels := []label{{arity: len(f.typ.results), height: len(in.stack), target: len(body)}}
+
+	branch := func(depth uint32) {
+		l := labels[len(labels)-1-int(depth)]
+		in.stack = append(in.stack[:l.height], in.stack[len(in.stack)-l.arity:]...)
+		labels = labels[:len(labels)-1-int(depth)]
+		pc = l.target
+	}
+	enter := func(pos int, loop bool) {
+		b := f.blocks[pos]
+		l := label{arity: b.results, height: len(in.stack) - b.params, target: b.endPos + 1}
+		if loop {
+			l = label{arity: b.params, height: l.height, target: pos}
+		}
+		labels = append(labels, l)
+		pc = b.start
+	}
+	// immediates were checked by the decoder
+	u32 := func() uint32 {
+		var v uint32
+		for shift := uint(0); ; shift += 7 {
+			b := body[pc]
+			pc++
+			v |= uint32(b&0x7f) << shift
+			if b&0x80 == 0 {
+				return v
+			}
+		}
+	}
+	s64 := func() int64 {
+		var v int64
+		for shift := uint(0); ; {
+			b := body[pc]
+			pc++
+			v |= int64(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				if shift < 64 && b&0x40 != 0 {
+					v |= -1 << shift
+				}
+				return v
+			}
+		}
+	}
+	address := func(size uint64) uint64 {
+		u32()
+		offset := uint64(u32())
+		a := uint64(uint32(in.pop())) + offset
+		in.memorySlice(a, size)
+		return a
+	}
+	le := binary.LittleEndian
+
+	for len(labels) > 0 {
+		if in.gas == 0 {
+			trap("out of gas")
+		}
+		if in.gas%cancelCheck == 0 && isClosed(in.cancelled) {
+			trap("cancelled")
+		}
+		in.gas--
+		pos := pc
+		op := body[pc]
+		pc++
+
+		switch op {
+		case 0x00:
+			trap("unreachable")
+		case 0x01:
+		case 0x02:
+			enter(pos, false)
+		case 0x03:
+			enter(pos, true)
+		case 0x04:
+			b := f.blocks[pos]
+			c := in.pop()
+			enter(pos, false)
+			if uint32(c) == 0 {
+				if b.elsePos != 0 {
+					pc = b.elsePos + 1
+				} else {
+					pc = b.endPos
+				}
+			}
+		case 0x05:
+			// end of the then branch
+			branch(0)
+		case 0x0b:
+			labels = labels[:len(labels)-1]
+		case 0x0c:
+			branch(u32())
+		case 0x0d:
+			depth := u32()
+			if uint32(in.pop()) != 0 {
+				branch(depth)
+			}
+		case 0x0e:
+			n := u32()
+			i := uint32(in.pop())
+			var depth uint32
+			for k := uint32(0); k <= n; k++ {
+				d := u32()
+				if k == i || k == n && i >= n {
+					depth = d
+				}
+			}
+			branch(depth)
+		case 0x0f:
+			branch(uint32(len(labels) - 1))
+		case 0x10:
+			in.call(u32())
+		case 0x11:
+			t := in.module.types[u32()]
+			pc++
+			i := uint32(in.pop())
+			if int64(i) >= int64(len(in.table)) || in.table[i] < 0 {
+				trap("undefined element")
+			}
+			if !in.module.funcType(uint32(in.table[i])).equals(t) {
+				trap("indirect call type mismatch")
+			}
+			in.call(uint32(in.table[i]))
+		case 0x1a:
+			in.pop()
+		case 0x1b, 0x1c:
+			if op == 0x1c {
+				u32()
+				pc++
+			}
+			c, b, a := in.pop(), in.pop(), in.pop()
+			if uint32(c) != 0 {
+				in.push(a)
+			} else {
+				in.push(b)
+			}
+		case 0x20:
+			in.push(locals[u32()])
+		case 0x21:
+			locals[u32()] = in.pop()
+		case 0x22:
+			locals[u32()] = in.stack[len(in.stack)-1]
+		case 0x23:
+			in.push(in.globals[u32()])
+		case 0x24:
+			in.globals[u32()] = in.pop()
+
+		case 0x28:
+			in.push(uint64(le.Uint32(in.memory[address(4):])))
+		case 0x29:
+			in.push(le.Uint64(in.memory[address(8):]))
+		case 0x2c:
+			in.push(uint64(uint32(int32(int8(in.memory[address(1)])))))
+		case 0x2d:
+			in.push(uint64(in.memory[address(1)]))
+		case 0x2e:
+			in.push(uint64(uint32(int32(int16(le.Uint16(in.memory[address(2):]))))))
+		case 0x2f:
+			in.push(uint64(le.Uint16(in.memory[address(2):])))
+		case 0x30:
+			in.push(uint64(int64(int8(in.memory[address(1)]))))
+		case 0x31:
+			in.push(uint64(in.memory[address(1)]))
+		case 0x32:
+			in.push(uint64(int64(int16(le.Uint16(in.memory[address(2):])))))
+		case 0x33:
+			in.push(uint64(le.Uint16(in.memory[address(2):])))
+		case 0x34:
+			in.push(uint64(int64(int32(le.Uint32(in.memory[address(4):])))))
+		case 0x35:
+			in.push(uint64(le.Uint32(in.memory[address(4):])))
+		case 0x36, 0x3e:
+			v := in.pop()
+			le.PutUint32(in.memory[address(4):], uint32(v))
+		case 0x37:
+			v := in.pop()
+			le.PutUint64(in.memory[address(8):], v)
+		case 0x3a, 0x3c:
+			v := in.pop()
+			in.memory[address(1)] = byte(v)
+		case 0x3b, 0x3d:
+			v := in.pop()
+			le.PutUint16(in.memory[address(2):], uint16(v))
+		case 0x3f:
+			pc++
+			in.push(uint64(len(in.memory) / pageSize))
+		case 0x40:
+			pc++
+			n := uint64(uint32(in.pop()))
+			old := uint64(len(in.memory) / pageSize)
+			if old+n > uint64(in.maxPages) {
+				in.push(uint64(math.MaxUint32))
+				break
+			}
+			in.charge(n * pageGas)
+			in.memory = append(in.memory, make([]byte, n*pageSize)...)
+			in.push(old)
+
+		case 0x41:
+			in.push(uint64(uint32(s64())))
+		case 0x42:
+			in.push(uint64(s64()))
+
+		case 0x45:
+			in.push(boolValue(uint32(in.pop()) == 0))
+		case 0x50:
+			in.push(boolValue(in.pop() == 0))
+		case 0x46, 0x47, 0x48, 0x49, 0x4a, 0x4b, 0x4c, 0x4d, 0x4e, 0x4f:
+			b, a := uint32(in.pop()), uint32(in.pop())
+			in.push(boolValue(compare(op-0x46, int64(int32(a)), int64(int32(b)), uint64(a), uint64(b))))
+		case 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a:
+			b, a := in.pop(), in.pop()
+			in.push(boolValue(compare(op-0x51, int64(a), int64(b), a, b)))
+
+		case 0x67:
+			in.push(uint64(bits.LeadingZeros32(uint32(in.pop()))))
+		case 0x68:
+			in.push(uint64(bits.TrailingZeros32(uint32(in.pop()))))
+		case 0x69:
+			in.push(uint64(bits.OnesCount32(uint32(in.pop()))))
+		case 0x79:
+			in.push(uint64(bits.LeadingZeros64(in.pop())))
+		case 0x7a:
+			in.push(uint64(bits.TrailingZeros64(in.pop())))
+		case 0x7b:
+			in.push(uint64(bits.OnesCount64(in.pop())))
+		case 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78:
+			b, a := uint32(in.pop()), uint32(in.pop())
+			in.push(uint64(binary32(op, a, b)))
+		case 0x7c, 0x7d, 0x7e, 0x7f, 0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89, 0x8a:
+			b, a := in.pop(), in.pop()
+			in.push(binary64(op, a, b))
+
+		case 0xa7:
+			in.push(uint64(uint32(in.pop())))
+		case 0xac:
+			in.push(uint64(int64(int32(uint32(in.pop())))))
+		case 0xad:
+			in.push(uint64(uint32(in.pop())))
+		case 0xc0:
+			in.push(uint64(uint32(int32(int8(in.pop())))))
+		case 0xc1:
+			in.push(uint64(uint32(int32(int16(in.pop())))))
+		case 0xc2:
+			in.push(uint64(int64(int8(in.pop()))))
+		case 0xc3:
+			in.push(uint64(int64(int16(in.pop()))))
+		case 0xc4:
+			in.push(uint64(int64(int32(in.pop()))))
+
+		case 0xfc:
+			switch u32() {
+			case 10:
+				pc += 2
+				n, src, dst := uint64(uint32(in.pop())), uint64(uint32(in.pop())), uint64(uint32(in.pop()))
+				in.charge(n / copyGas)
+				copy(in.memorySlice(dst, n), in.memorySlice(src, n))
+			case 11:
+				pc++
+				n, v, dst := uint64(uint32(in.pop())), byte(in.pop()), uint64(uint32(in.pop()))
+				in.charge(n / copyGas)
+				s := in.memorySlice(dst, n)
+				for i := range s {
+					s[i] = v
+				}
+			}
+		default:
+			trap("invalid code")
+		}
+	}
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// compare does eq, ne, lt_s, lt_u, gt_s, gt_u, le_s, le_u, ge_s and ge_u in that order
+func compare(i byte, sa, sb int64, ua, ub uint64) bool {
+	switch i {
+	case 0:
+		return ua == ub
+	case 1:
+		return ua != ub
+	case 2:
+		return sa < sb
+	case 3:
+		return ua < ub
+	case 4:
+		return sa > sb
+	case 5:
+		return ua > ub
+	case 6:
+		return sa <= sb
+	case 7:
+		return ua <= ub
+	case 8:
+		return sa >= sb
+	}
+	return ua >= ub
+}
+
+func binary32(op byte, a, b uint32) uint32 {
+	switch op {
+	case 0x6a:
+		return a + b
+	case 0x6b:
+		return a - b
+	case 0x6c:
+		return a * b
+	case 0x6d:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		if int32(a) == math.MinInt32 && int32(b) == -1 {
+			trap("integer overflow")
+		}
+		return uint32(int32(a) / int32(b))
+	case 0x6e:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		return a / b
+	case 0x6f:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		if int32(b) == -1 {
+			return 0
+		}
+		return uint32(int32(a) % int32(b))
+	case 0x70:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		return a % b
+	case 0x71:
+		return a & b
+	case 0x72:
+		return a | b
+	case 0x73:
+		return a ^ b
+	case 0x74:
+		return a << (b & 31)
+	case 0x75:
+		return uint32(int32(a) >> (b & 31))
+	case 0x76:
+		return a >> (b & 31)
+	case 0x77:
+		return bits.RotateLeft32(a, int(b&31))
+	}
+	return bits.RotateLeft32(a, -int(b&31))
+}
+
+func binary64(op byte, a, b uint64) uint64 {
+	switch op {
+	case 0x7c:
+		return a + b
+	case 0x7d:
+		return a - b
+	case 0x7e:
+		return a * b
+	case 0x7f:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			trap("integer overflow")
+		}
+		return uint64(int64(a) / int64(b))
+	case 0x80:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		return a / b
+	case 0x81:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		if int64(b) == -1 {
+			return 0
+		}
+		return uint64(int64(a) % int64(b))
+	case 0x82:
+		if b == 0 {
+			trap("integer divide by zero")
+		}
+		return a % b
+	case 0x83:
+		return a & b
+	case 0x84:
+		return a | b
+	case 0x85:
+		return a ^ b
+	case 0x86:
+		return a << (b & 63)
+	case 0x87:
+		return uint64(int64(a) >> (b & 63))
+	case 0x88:
+		return a >> (b & 63)
+	case 0x89:
+		return bits.RotateLeft64(a, int(b&63))
+	}
+	return bits.RotateLeft64(a, -int(b&63))
+}
@@ -0,0 +1,153 @@
+package compute
+
+// Host functions a WebAssembly module may import from "env"
+// - input_size() i32                             bytes of the input of the run
+// - input_read(ptr, offset, len i32) i32          copies input from offset to ptr, returns bytes copied
+// - transaction_read(hash, ptr, len i32) i32      copies the committed transaction with the 32 byte
+//                                                 hash at hash to ptr, returns its full size or -1
+//                                                 if the node does not have it
+// - output(ptr, len i32)                          appends to the output (stdout) of the run
+// Besides hostGas per call, copied bytes cost gas like memory.copy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const hostGas = 100
+
+// TransactionReader returns a committed transaction as bytes, nil if there is none
+// Set by the node, see network
+var TransactionReader = func(hash []byte) []byte { return nil }
+
+type hostFunction struct {
+	typ  funcType
+	call func(in *wasmInstance, args []uint64) []uint64
+}
+
+var hostFunctions = map[string]hostFunction{
+	"input_size": {
+		funcType{nil, []valType{i32}},
+		func(in *wasmInstance, args []uint64) []uint64 {
+			return []uint64{uint64(len(in.input))}
+		},
+	},
+	"input_read": {
+		funcType{[]valType{i32, i32, i32}, []valType{i32}},
+		func(in *wasmInstance, args []uint64) []uint64 {
+			ptr, offset, length := uint64(uint32(args[0])), uint64(uint32(args[1])), uint64(uint32(args[2]))
+			if offset > uint64(len(in.input)) {
+				offset = uint64(len(in.input))
+			}
+			dst := in.memorySlice(ptr, length)
+			in.charge(length / copyGas)
+			n := copy(dst, in.input[offset:])
+			return []uint64{uint64(n)}
+		},
+	},
+	"transaction_read": {
+		funcType{[]valType{i32, i32, i32}, []valType{i32}},
+		func(in *wasmInstance, args []uint64) []uint64 {
+			hash := in.memorySlice(uint64(uint32(args[0])), 32)
+			dst := in.memorySlice(uint64(uint32(args[1])), uint64(uint32(args[2])))
+			in.charge(uint64(len(dst)) / copyGas)
+			tx := in.transactions(hash)
+			if tx == nil {
+				return []uint64{uint64(uint32(0xffffffff))}
+			}
+			copy(dst, tx)
+			return []uint64{uint64(uint32(len(tx)))}
+		},
+	},
+	"output": {
+		funcType{[]valType{i32, i32}, nil},
+		func(in *wasmInstance, args []uint64) []uint64 {
+			data := in.memorySlice(uint64(uint32(args[0])), uint64(uint32(args[1])))
+			in.charge(uint64(len(data)) / copyGas)
+			in.output.Write(data)
+			if isClosed(in.output.exceeded) {
+				trap("output limit exceeded")
+			}
+			return nil
+		},
+	},
+}
+
+// compileWASM decodes a module and resolves its imports and entry point
+func compileWASM(code []byte) (*wasmModule, []hostFunction, uint32, error) {
+	m, err := parseModule(code)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var host []hostFunction
+	for _, v := range m.imports {
+		h, ok := hostFunctions[v.name]
+		if v.module != "env" || !ok {
+			return nil, nil, 0, fmt.Errorf("%w: unknown import %s.%s", ErrInvalidModule, v.module, v.name)
+		}
+		if !h.typ.equals(v.typ) {
+			return nil, nil, 0, fmt.Errorf("%w: wrong type of import %s.%s", ErrInvalidModule, v.module, v.name)
+		}
+		host = append(host, h)
+	}
+	main, ok := m.exports["main"]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("%w: no main function", ErrInvalidModule)
+	}
+	if t := m.funcType(main); len(t.params) != 0 || len(t.results) > 1 || len(t.results) == 1 && t.results[0] != i32 {
+		return nil, nil, 0, fmt.Errorf("%w: main should take nothing and return nothing or an i32", ErrInvalidModule)
+	}
+	return m, host, main, nil
+}
+
+// ValidateWASM tells if the code is a module the node can run
+func ValidateWASM(code []byte) error {
+	_, _, _, err := compileWASM(code)
+	return err
+}
+
+// RunWASM runs the main function of a WebAssembly module with given input
+// Traps, including running out of gas, are reported in the result, not as an error
+func RunWASM(code []byte, input []byte, limits Limits) (*Result, error) {
+	return runWASM(context.Background(), code, input, limits)
+}
+
+// runWASM traps once the context is done
+func runWASM(ctx context.Context, code []byte, input []byte, limits Limits) (*Result, error) {
+	m, host, main, err := compileWASM(code)
+	if err != nil {
+		return nil, err
+	}
+	in := &wasmInstance{
+		module:       m,
+		host:         host,
+		gas:          limits.Gas,
+		input:        input,
+		output:       newLimitedBuffer(limits.Output),
+		transactions: TransactionReader,
+		cancelled:    ctx.Done(),
+	}
+	start := time.Now()
+	result := Result{}
+	result.Trap = in.protect(func() {
+		in.instantiate(limits.Memory)
+		if m.start >= 0 {
+			in.call(uint32(m.start))
+		}
+		in.call(main)
+		if len(m.funcType(main).results) == 1 {
+			result.ExitCode = int(int32(in.pop()))
+		}
+	})
+	result.WallTime = time.Since(start)
+	result.CPUTime = result.WallTime
+	result.Stdout = in.output.buf.Bytes()
+	result.Truncated = isClosed(in.output.exceeded)
+	result.MaxMemory = uint64(len(in.memory))
+	result.GasUsed = limits.Gas - in.gas
+	if result.Trap != "" {
+		result.ExitCode = -1
+	}
+	return &result, nil
+}
@@ -0,0 +1,249 @@
+package compute
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// helpers to assemble modules by hand
+
+func uleb(v uint64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func i32Const(v int32) []byte {
+	b := []byte{0x41}
+	x := int64(v)
+	for {
+		c := byte(x & 0x7f)
+		x >>= 7
+		if x == 0 && c&0x40 == 0 || x == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, v := range parts {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func vec(items ...[]byte) []byte {
+	return append(uleb(uint64(len(items))), concat(items...)...)
+}
+
+func name(s string) []byte {
+	return append(uleb(uint64(len(s))), s...)
+}
+
+func section(id byte, items ...[]byte) []byte {
+	content := vec(items...)
+	return concat([]byte{id}, uleb(uint64(len(content))), content)
+}
+
+func body(locals []byte, code ...[]byte) []byte {
+	b := append(locals, concat(code...)...)
+	return append(uleb(uint64(len(b))), b...)
+}
+
+func module(sections ...[]byte) []byte {
+	return concat(append([][]byte{{0, 'a', 's', 'm', 1, 0, 0, 0}}, sections...)...)
+}
+
+var (
+	typeOutput = []byte{0x60, 2, 0x7f, 0x7f, 0}             // (i32, i32)
+	typeMain   = []byte{0x60, 0, 1, 0x7f}                   // () i32
+	typeRead   = []byte{0x60, 3, 0x7f, 0x7f, 0x7f, 1, 0x7f} // (i32, i32, i32) i32
+	typeFac    = []byte{0x60, 1, 0x7e, 1, 0x7e}             // (i64) i64
+	noLocals   = []byte{0}
+	oneMemory  = section(5, []byte{0, 1})
+)
+
+// mainModule has one page of memory and main as its only function
+func mainModule(locals []byte, code ...[]byte) []byte {
+	return module(
+		section(1, typeMain),
+		section(3, []byte{0}),
+		oneMemory,
+		section(7, concat(name("main"), []byte{0, 0})),
+		section(10, body(locals, code...)),
+	)
+}
+
+func TestRunWASM(t *testing.T) {
+	hello := module(
+		section(1, typeOutput, typeMain),
+		section(2, concat(name("env"), name("output"), []byte{0, 0})),
+		section(3, []byte{1}),
+		oneMemory,
+		section(7, concat(name("main"), []byte{0, 1})),
+		section(10, body(noLocals, i32Const(0), i32Const(5), []byte{0x10, 0}, i32Const(7), []byte{0x0b})),
+		section(11, concat([]byte{0}, i32Const(0), []byte{0x0b}, name("hello"))),
+	)
+	result, err := RunWASM(hello, nil, DefaultLimits)
+	if err != nil {
+		t.Fatal("Cannot run module", err)
+	}
+	if string(result.Stdout) != "hello" || result.ExitCode != 7 || result.Trap != "" || result.GasUsed == 0 {
+		t.Error("Unexpected result", result, string(result.Stdout))
+	}
+
+	// fib(20) in a loop, fac(10) by recursion
+	fib := mainModule([]byte{1, 3, 0x7f},
+		i32Const(1), []byte{0x21, 1},
+		i32Const(20), []byte{0x21, 2},
+		[]byte{0x02, 0x40, 0x03, 0x40},
+		[]byte{0x20, 2, 0x45, 0x0d, 1},
+		[]byte{0x20, 0, 0x20, 1, 0x6a, 0x20, 1, 0x21, 0, 0x21, 1},
+		[]byte{0x20, 2}, i32Const(1), []byte{0x6b, 0x21, 2},
+		[]byte{0x0c, 0, 0x0b, 0x0b, 0x20, 0, 0x0b},
+	)
+	fac := module(
+		section(1, typeMain, typeFac),
+		section(3, []byte{0}, []byte{1}),
+		section(7, concat(name("main"), []byte{0, 0})),
+		section(10,
+			body(noLocals, []byte{0x42, 10, 0x10, 1, 0xa7, 0x0b}),
+			body(noLocals, []byte{0x20, 0, 0x50, 0x04, 0x7e, 0x42, 1, 0x05, 0x20, 0, 0x20, 0, 0x42, 1, 0x7d, 0x10, 1, 0x7e, 0x0b, 0x0b}),
+		),
+	)
+	for _, v := range []struct {
+		code []byte
+		want int
+	}{{fib, 6765}, {fac, 3628800}} {
+		result, err := RunWASM(v.code, nil, DefaultLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ExitCode != v.want || result.Trap != "" {
+			t.Error("Wrong result", result, "expected exit code", v.want)
+		}
+		again, _ := RunWASM(v.code, nil, DefaultLimits)
+		if !bytes.Equal(result.Digest(), again.Digest()) || result.GasUsed != again.GasUsed {
+			t.Error("Same code should give the same result")
+		}
+	}
+
+	traps := map[string][]byte{
+		"integer divide by zero":      mainModule(noLocals, i32Const(1), i32Const(0), []byte{0x6d, 0x0b}),
+		"out of bounds memory access": mainModule(noLocals, i32Const(65536), []byte{0x28, 2, 0, 0x0b}),
+		"unreachable":                 mainModule(noLocals, []byte{0x00, 0x0b}),
+		"out of gas":                  mainModule(noLocals, []byte{0x03, 0x40, 0x0c, 0, 0x0b}, i32Const(0), []byte{0x0b}),
+	}
+	for reason, code := range traps {
+		result, err := RunWASM(code, nil, DefaultLimits)
+		if err != nil {
+			t.Fatal(reason, err)
+		}
+		if result.Trap != reason || result.ExitCode != -1 || result.Succeeded() {
+			t.Error("Expected trap", reason, "got", result)
+		}
+	}
+	limits := DefaultLimits
+	limits.Gas = 1000
+	result, _ = RunWASM(traps["out of gas"], nil, limits)
+	if result.GasUsed != limits.Gas {
+		t.Error("Run should use all of its gas", result.GasUsed)
+	}
+
+	// memory does not grow beyond the limit
+	limits.Memory = 2 * pageSize
+	limits.Gas = DefaultLimits.Gas
+	grow := mainModule(noLocals, i32Const(5), []byte{0x40, 0, 0x0b})
+	if result, _ := RunWASM(grow, nil, limits); result.ExitCode != -1 || result.Trap != "" {
+		t.Error("Memory should not grow beyond the limit", result)
+	}
+	grow = mainModule(noLocals, i32Const(1), []byte{0x40, 0, 0x0b})
+	if result, _ := RunWASM(grow, nil, limits); result.ExitCode != 1 || result.MaxMemory != 2*pageSize {
+		t.Error("Memory should grow within the limit", result)
+	}
+
+	limits.Output = 3
+	if result, _ := RunWASM(hello, nil, limits); !result.Truncated || string(result.Stdout) != "hel" {
+		t.Error("Output should be limited", result)
+	}
+}
+
+func TestWASMHost(t *testing.T) {
+	hash := bytes.Repeat([]byte{'h'}, 32)
+	defer func(reader func([]byte) []byte) { TransactionReader = reader }(TransactionReader)
+	TransactionReader = func(h []byte) []byte {
+		if bytes.Equal(h, hash) {
+			return []byte("transaction")
+		}
+		return nil
+	}
+
+	// outputs its input, then the transaction with the hash at 200
+	echo := module(
+		section(1, typeOutput, typeMain, typeRead),
+		section(2,
+			concat(name("env"), name("input_read"), []byte{0, 2}),
+			concat(name("env"), name("output"), []byte{0, 0}),
+			concat(name("env"), name("transaction_read"), []byte{0, 2}),
+		),
+		section(3, []byte{1}),
+		oneMemory,
+		section(7, concat(name("main"), []byte{0, 3})),
+		section(10, body([]byte{1, 1, 0x7f},
+			i32Const(0), i32Const(0), i32Const(64), []byte{0x10, 0, 0x21, 0},
+			i32Const(0), []byte{0x20, 0, 0x10, 1},
+			i32Const(200), i32Const(300), i32Const(100), []byte{0x10, 2, 0x21, 0},
+			i32Const(300), []byte{0x20, 0, 0x10, 1},
+			i32Const(0), []byte{0x0b},
+		)),
+		section(11, concat([]byte{0}, i32Const(200), []byte{0x0b}, uleb(32), hash)),
+	)
+	result, err := RunWASM(echo, []byte("input "), DefaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "input transaction" || !result.Succeeded() {
+		t.Error("Unexpected output", result, string(result.Stdout))
+	}
+	// a missing transaction is -1, here an invalid output length
+	hash = nil
+	if result, _ := RunWASM(echo, []byte("input "), DefaultLimits); result.Trap != "out of bounds memory access" {
+		t.Error("Missing transaction should not be read", result)
+	}
+	if result, _ := ExecuteCode(CodeTypeWASM, echo, []byte("ok")); string(result.Stdout) != "ok" {
+		t.Error("Executable should run by its code type", result)
+	}
+}
+
+func TestValidateWASM(t *testing.T) {
+	invalid := map[string][]byte{
+		"garbage":        []byte("print('python')"),
+		"floating point": mainModule(noLocals, []byte{0x43, 0, 0, 0, 0, 0x1a}, i32Const(0), []byte{0x0b}),
+		"unknown import": module(
+			section(1, typeMain),
+			section(2, concat(name("env"), name("exec"), []byte{0, 0})),
+			section(3, []byte{0}),
+			section(7, concat(name("main"), []byte{0, 1})),
+			section(10, body(noLocals, i32Const(0), []byte{0x0b})),
+		),
+		"no main": bytes.Replace(mainModule(noLocals, i32Const(0), []byte{0x0b}), name("main"), name("mein"), 1),
+		"unended": mainModule(noLocals, i32Const(0)),
+	}
+	for reason, code := range invalid {
+		if err := ValidateWASM(code); !errors.Is(err, ErrInvalidModule) {
+			t.Error("Module should be invalid:", reason, err)
+		}
+	}
+	if err := ValidateWASM(mainModule(noLocals, i32Const(0), []byte{0x0b})); err != nil {
+		t.Error("Module should be valid", err)
+	}
+}
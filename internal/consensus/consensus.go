@@ -0,0 +1,351 @@
+package consensus
+
+// Proof of authority
+// An organization designates validators in its genesis: the keys at ValidatorPath/0 .. /Validators-1
+// derived from its master public key. Validators take turns, round robin by batch height, sealing
+// batches of verified transactions of the organization into Seal transactions:
+// - a batch lists the transactions not sealed yet, in chain order
+// - a batch links to the previous seal of the organization by its hash
+// - a seal is signed by the validator whose turn it is, see Leader, or by one of the next ones
+//   once the leader is late, see Leaders
+// Seals of the wrong validator, of unknown, unsealable or already sealed transactions are invalid.
+// The entries of an organization up to its last seal are final, see transaction.Finalized
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+const (
+	MaxBatchSize  = 1000
+	BatchInterval = 10 * time.Second
+)
+
+// LeaderTimeout is how long a round waits for its leader before the next validator may seal it too
+var LeaderTimeout = 3 * BatchInterval
+
+var (
+	ErrNoValidators  = errors.New("Organization has no validators")
+	ErrNotLeader     = errors.New("Seal is not signed by the leader")
+	ErrInvalidBatch  = errors.New("Invalid batch")
+	ErrEmptyBatch    = errors.New("Nothing to seal")
+	ErrUnsealable    = errors.New("Transaction cannot be sealed")
+	ErrAlreadySealed = errors.New("Transaction is already sealed")
+)
+
+func init() {
+	transaction.SealVerifier = VerifySeal
+}
+
+// Batch is the data of a Seal transaction
+type Batch struct {
+	Height       uint64   // number of seals of the organization including this one
+	PrevSeal     []byte   // hash of the previous seal, empty for the first one
+	Transactions [][]byte // hashes of the sealed transactions
+}
+
+// Export batch as bytes
+// Layout (little endian): height (8) + previous seal hash (32, zeros for the first one)
+// + count (2) + transaction hashes (32 each)
+func (b *Batch) ToBytes() []byte {
+	batchBytes := make([]byte, 42, 42+32*len(b.Transactions))
+	binary.LittleEndian.PutUint64(batchBytes[0:8], b.Height)
+	copy(batchBytes[8:40], b.PrevSeal)
+	binary.LittleEndian.PutUint16(batchBytes[40:42], uint16(len(b.Transactions)))
+	for _, v := range b.Transactions {
+		batchBytes = append(batchBytes, v...)
+	}
+	return batchBytes
+}
+
+// Parse batch bytes, see ToBytes
+func ParseBatch(batchBytes []byte) (*Batch, error) {
+	if len(batchBytes) < 42 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidBatch, len(batchBytes))
+	}
+	count := int(binary.LittleEndian.Uint16(batchBytes[40:42]))
+	if count > MaxBatchSize || len(batchBytes) != 42+32*count {
+		return nil, fmt.Errorf("%w: %d bytes for %d transactions", ErrInvalidBatch, len(batchBytes), count)
+	}
+
+	b := Batch{Height: binary.LittleEndian.Uint64(batchBytes[0:8])}
+	if prev := batchBytes[8:40]; !bytes.Equal(prev, make([]byte, 32)) {
+		b.PrevSeal = append([]byte{}, prev...)
+	}
+	for i := 0; i < count; i++ {
+		b.Transactions = append(b.Transactions, append([]byte{}, batchBytes[42+32*i:74+32*i]...))
+	}
+	return &b, nil
+}
+
+// Leader returns the validator index sealing the batch of given height
+func Leader(organization *transaction.Organization, height uint64) uint32 {
+	return uint32((height - 1) % uint64(organization.Validators))
+}
+
+// Leaders returns the validator indices which may seal the batch of given height, waited long after
+// the previous seal: the leader, then one more of the next validators every LeaderTimeout
+func Leaders(organization *transaction.Organization, height uint64, waited time.Duration) []uint32 {
+	count := uint64(1)
+	if waited > 0 {
+		count += uint64(waited / LeaderTimeout)
+	}
+	if count > uint64(organization.Validators) {
+		count = uint64(organization.Validators)
+	}
+	var result []uint32
+	for i := uint64(0); i < count; i++ {
+		result = append(result, uint32((height-1+i)%uint64(organization.Validators)))
+	}
+	return result
+}
+
+// roundStart returns when the round after given seals started: the date of the last one, that of
+// the genesis of the organization before the first seal
+func roundStart(chain db.View, organizationTx []byte, previous []db.MainDBItem) time.Time {
+	if len(previous) > 0 {
+		return previous[len(previous)-1].Date
+	}
+	return chain.Get(organizationTx).Date
+}
+
+// ValidatorKey derives the public key of a validator from the master public key of the organization
+func ValidatorKey(organization *transaction.Organization, index uint32) ([]byte, error) {
+	steps, err := organization.ValidatorSteps(index)
+	if err != nil {
+		return nil, err
+	}
+	w, err := crypto.DeriveFromMPK(steps, organization.MasterPublicKeyString())
+	if err != nil {
+		return nil, err
+	}
+	return w.Pub().Key, nil
+}
+
+// seals returns the seals of the organization before given index of the chain, in chain order
+func seals(chain db.View, organizationTx []byte, before uint64) []db.MainDBItem {
+	var result []db.MainDBItem
+	for _, v := range chain.GetByObjectType(byte(transaction.Seal)) {
+		if v.Index < before && bytes.Equal(v.OrganizationTransaction, organizationTx) {
+			result = append(result, v)
+		}
+	}
+	sortByIndex(result)
+	return result
+}
+
+// sealed returns the hashes of the transactions sealed by given seals
+func sealed(items []db.MainDBItem) map[string]bool {
+	result := make(map[string]bool)
+	for _, v := range items {
+		b, err := ParseBatch(v.Data)
+		if err != nil {
+			continue
+		}
+		for _, h := range b.Transactions {
+			result[string(h)] = true
+		}
+	}
+	return result
+}
+
+// Next returns the batch of the transactions of the organization waiting for a seal
+func Next(organizationTx []byte) *Batch {
+	previous := seals(db.CurrentView(), organizationTx, transaction.Height()+1)
+	done := sealed(previous)
+
+	b := Batch{Height: uint64(len(previous)) + 1}
+	if len(previous) > 0 {
+		b.PrevSeal = previous[len(previous)-1].Hash
+	}
+	items := db.GetByOrganization(organizationTx)
+	sortByIndex(items)
+	for _, v := range items {
+		if len(b.Transactions) == MaxBatchSize {
+			break
+		}
+		if v.Index == 0 || v.ObjectType == byte(transaction.Seal) || done[string(v.Hash)] {
+			continue
+		}
+		b.Transactions = append(b.Transactions, v.Hash)
+	}
+	return &b
+}
+
+// VerifySeal checks a Seal transaction against the given chain before it, see transaction.SealVerifier
+func VerifySeal(tx *transaction.Transaction, chain db.View) error {
+	organization := &tx.Organization
+	if organization.Validators == 0 {
+		return ErrNoValidators
+	}
+	b, err := ParseBatch(tx.Data)
+	if err != nil {
+		return err
+	}
+	if len(b.Transactions) == 0 {
+		return ErrEmptyBatch
+	}
+
+	// a new seal follows the head, now
+	index, date := tx.Index, tx.Date
+	if index == 0 {
+		item := chain.Get(tx.Hash)
+		index, date = item.Index, item.Date
+	}
+	if index == 0 {
+		index = chain.GetLastTransaction().Index + 1
+	}
+	if now := time.Now(); date.IsZero() || date.After(now) {
+		date = now
+	}
+
+	// link to the previous seal
+	previous := seals(chain, tx.OrganizationTx, index)
+	if b.Height != uint64(len(previous))+1 {
+		return fmt.Errorf("%w: height %d after %d seals", ErrInvalidBatch, b.Height, len(previous))
+	}
+	var prevSeal []byte
+	if len(previous) > 0 {
+		prevSeal = previous[len(previous)-1].Hash
+	}
+	if !bytes.Equal(b.PrevSeal, prevSeal) {
+		return fmt.Errorf("%w: previous seal is %x instead of %x", ErrInvalidBatch, b.PrevSeal, prevSeal)
+	}
+
+	// signed by the leader of the round, or a next validator once it is late
+	leaders := Leaders(organization, b.Height, date.Sub(roundStart(chain, tx.OrganizationTx, previous)))
+	signed := false
+	for _, v := range leaders {
+		leader, err := organization.ValidatorSteps(v)
+		if err != nil {
+			return err
+		}
+		if len(tx.Signatures) == 1 && equalSteps(tx.DerivationSteps[0], leader) &&
+			crypto.CheckPublicKeyPath(leader, tx.PublicKeys[0], organization.MasterPublicKeyString()) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%w: validators %v of height %d", ErrNotLeader, leaders, b.Height)
+	}
+
+	// sealed transactions are verified ones of the organization
+	done := sealed(previous)
+	for _, h := range b.Transactions {
+		item := chain.Get(h)
+		if item.Index == 0 || item.Index >= index || !bytes.Equal(item.OrganizationTransaction, tx.OrganizationTx) ||
+			item.ObjectType == byte(transaction.Seal) {
+			return fmt.Errorf("%w: %x", ErrUnsealable, h)
+		}
+		if done[string(h)] {
+			return fmt.Errorf("%w: %x", ErrAlreadySealed, h)
+		}
+		done[string(h)] = true
+	}
+	return nil
+}
+
+func sortByIndex(items []db.MainDBItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].Index < items[j].Index })
+}
+
+func equalSteps(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// leaderKey returns the key of this node sealing the batch, if it is one of given leaders
+func leaderKey(organization *transaction.Organization, leaders []uint32) (keystore.KeyPair, bool) {
+	for _, v := range leaders {
+		leader, err := organization.ValidatorSteps(v)
+		if err != nil {
+			return keystore.KeyPair{}, false
+		}
+		for _, keypair := range keystore.CurrentKeyMap {
+			steps, err := crypto.ParseDerivationPathString(keypair.DerivationPath)
+			if err != nil || !equalSteps(steps, leader) {
+				continue
+			}
+			if crypto.CheckPublicKeyPath(leader, keypair.PublicKey, organization.MasterPublicKeyString()) {
+				return keypair, true
+			}
+		}
+	}
+	return keystore.KeyPair{}, false
+}
+
+// Propose seals the transactions of the organization waiting for a seal if it is the turn of this node
+// Returns nil if there is nothing to seal or other validators are the leaders
+func Propose(organizationTx []byte) (*transaction.Transaction, error) {
+	genesis := transaction.Retrieve(organizationTx)
+	if genesis == nil || genesis.ObjectType != transaction.Genesis {
+		return nil, errors.New("Cannot find organization transaction")
+	}
+	organization, err := transaction.ParseOrganizationData(genesis.Data)
+	if err != nil {
+		return nil, err
+	}
+	if organization.Validators == 0 {
+		return nil, ErrNoValidators
+	}
+
+	b := Next(organizationTx)
+	if len(b.Transactions) == 0 {
+		return nil, nil
+	}
+	chain := db.CurrentView()
+	previous := seals(chain, organizationTx, chain.GetLastTransaction().Index+1)
+	waited := time.Since(roundStart(chain, organizationTx, previous))
+	keypair, ok := leaderKey(organization, Leaders(organization, b.Height, waited))
+	if !ok {
+		return nil, nil
+	}
+
+	seal, err := transaction.Build(transaction.Seal, "batch", organizationTx, b.ToBytes(), nil)
+	if err != nil {
+		return nil, err
+	}
+	seal.Sign(keypair)
+	if _, err := transaction.ProcessTransaction(seal); err != nil {
+		return nil, err
+	}
+	fmt.Println("Sealed", len(b.Transactions), "transactions of", organization.Name, "at height", b.Height)
+	return seal, nil
+}
+
+// ProposeAll seals the waiting transactions of every organization this node is the leader of
+func ProposeAll() []*transaction.Transaction {
+	var result []*transaction.Transaction
+	for _, v := range db.GetByObjectType(byte(transaction.Genesis)) {
+		organization, err := transaction.ParseOrganizationData(v.Data)
+		if err != nil || organization.Validators == 0 {
+			continue
+		}
+		seal, err := Propose(v.Hash)
+		if err != nil {
+			fmt.Println("Cannot seal transactions of", organization.Name, err)
+			continue
+		}
+		if seal != nil {
+			result = append(result, seal)
+		}
+	}
+	return result
+}
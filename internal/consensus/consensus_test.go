@@ -0,0 +1,250 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+	"github.com/wemeetagain/go-hdwallet"
+)
+
+// key of given validator of an organization created by master
+func newTestValidator(t *testing.T, master *hdwallet.HDWallet, organization *transaction.Organization, index uint32) keystore.KeyPair {
+	steps, err := organization.ValidatorSteps(index)
+	if err != nil {
+		t.Fatal("Invalid validator path", err)
+	}
+	w := master
+	for _, v := range steps {
+		if w, err = w.Child(v); err != nil {
+			t.Fatal("Cannot derive child", err)
+		}
+	}
+	path := crypto.PathFromSteps(steps).String()
+	return keystore.KeyPair{
+		Name:           path,
+		DerivationPath: path,
+		PublicKey:      w.Pub().Key,
+		PrivateKey:     w.Key,
+	}
+}
+
+// builds and signs a transaction of given object type
+func newTestTransaction(t *testing.T, objectType transaction.ObjectType, organizationTx []byte, data []byte, keypair keystore.KeyPair) *transaction.Transaction {
+	tx, err := transaction.Build(objectType, "txt", organizationTx, data, nil)
+	if err != nil {
+		t.Fatal("Cannot build transaction", err)
+	}
+	tx.Sign(keypair)
+	return tx
+}
+
+func useKeys(keypairs ...keystore.KeyPair) {
+	keystore.CurrentKeyMap = keystore.KeyMap{}
+	for _, v := range keypairs {
+		keystore.CurrentKeyMap[v.Name] = v
+	}
+}
+
+func TestMain(m *testing.M) {
+	db.Use(db.NewMemoryStore())
+	os.Exit(m.Run())
+}
+
+func TestParseBatch(t *testing.T) {
+	b := Batch{Height: 3, PrevSeal: crypto.DHash([]byte("seal")), Transactions: [][]byte{crypto.DHash([]byte("tx"))}}
+	parsed, err := ParseBatch(b.ToBytes())
+	if err != nil || parsed.Height != 3 || !bytes.Equal(parsed.PrevSeal, b.PrevSeal) || !bytes.Equal(parsed.Transactions[0], b.Transactions[0]) {
+		t.Error("Batch does not parse back", parsed, err)
+	}
+	if first, err := ParseBatch((&Batch{Height: 1}).ToBytes()); err != nil || first.PrevSeal != nil {
+		t.Error("First batch should have no previous seal", err)
+	}
+	if _, err := ParseBatch(b.ToBytes()[:50]); !errors.Is(err, ErrInvalidBatch) {
+		t.Error("Truncated batch should be refused", err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	keys := keystore.CurrentKeyMap
+	defer func() { keystore.CurrentKeyMap = keys }()
+	transaction.Forks = transaction.NewForkPool()
+
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	organization := transaction.Organization{
+		Name:            "Validated Org",
+		MasterPublicKey: master.Pub().Serialize(),
+		ValidatorPath:   "m/7",
+		Validators:      2,
+	}
+	first := newTestValidator(t, master, &organization, 0)
+	second := newTestValidator(t, master, &organization, 1)
+
+	foundation, _ := json.Marshal(organization)
+	genesis := newTestTransaction(t, transaction.Genesis, nil, foundation, first)
+	genesis.Save()
+	file := newTestTransaction(t, transaction.File, genesis.Hash, []byte("first"), first)
+	file.Save()
+
+	// the first batch is sealed by the first validator
+	useKeys(second)
+	if seal, err := Propose(genesis.Hash); seal != nil || err != nil {
+		t.Fatal("Only the leader should seal", seal, err)
+	}
+	useKeys(first, second)
+	seal, err := Propose(genesis.Hash)
+	if seal == nil || err != nil {
+		t.Fatal("Leader should seal the batch", err)
+	}
+	if transaction.Height() != 3 || transaction.Finalized(genesis.Hash) != 3 {
+		t.Error("Seal is not saved", transaction.Height(), transaction.Finalized(genesis.Hash))
+	}
+	if again, err := Propose(genesis.Hash); again != nil || err != nil {
+		t.Error("Nothing should be left to seal", again, err)
+	}
+
+	// invalid seals of the second batch
+	other := newTestTransaction(t, transaction.File, genesis.Hash, []byte("second"), first)
+	other.Save()
+	cases := []struct {
+		name    string
+		batch   Batch
+		keypair keystore.KeyPair
+	}{
+		{"wrong leader", Batch{2, seal.Hash, [][]byte{other.Hash}}, first},
+		{"outsider", Batch{2, seal.Hash, [][]byte{other.Hash}}, newTestValidator(t, master, &organization, 2)},
+		{"unsaved transaction", Batch{2, seal.Hash, [][]byte{crypto.DHash([]byte("unknown"))}}, second},
+		{"sealed transaction", Batch{2, seal.Hash, [][]byte{file.Hash, other.Hash}}, second},
+		{"seal", Batch{2, seal.Hash, [][]byte{seal.Hash}}, second},
+		{"empty", Batch{2, seal.Hash, nil}, second},
+		{"height", Batch{3, seal.Hash, [][]byte{other.Hash}}, second},
+		{"previous seal", Batch{2, nil, [][]byte{other.Hash}}, second},
+	}
+	for _, c := range cases {
+		forged := newTestTransaction(t, transaction.Seal, genesis.Hash, c.batch.ToBytes(), c.keypair)
+		if _, err := transaction.ProcessTransaction(forged); !errors.Is(err, transaction.ErrInvalidSeal) {
+			t.Error("Seal of", c.name, "should be refused", err)
+		}
+	}
+
+	// the second batch is sealed by the second validator
+	useKeys(second)
+	if seal, err = Propose(genesis.Hash); seal == nil || err != nil {
+		t.Fatal("Second validator should seal the second batch", err)
+	}
+	if transaction.Finalized(genesis.Hash) != 5 {
+		t.Error("Organization should be final up to the second seal", transaction.Finalized(genesis.Hash))
+	}
+	if count, err := transaction.VerifyChain(); count != 5 || err != nil {
+		t.Error("Sealed chain does not verify", count, err)
+	}
+
+	// sealed entries are never replaced
+	tx := newTestTransaction(t, transaction.File, genesis.Hash, []byte("fork"), first)
+	entry := &transaction.Entry{Index: 2, PrevHash: transaction.EntryHash(1), Date: time.Now().Add(-time.Hour), Tx: tx}
+	if _, err := transaction.AddEntry(entry); !errors.Is(err, transaction.ErrFinalized) {
+		t.Error("Fork below the last seal should be refused", err)
+	}
+
+	// seals of an organization leave the entries of others as they are
+	other = newTestTransaction(t, transaction.Genesis, nil, []byte(`{"Name": "Unsealed Org"}`), first)
+	entry = &transaction.Entry{Index: 2, PrevHash: transaction.EntryHash(1), Date: time.Now().Add(-time.Hour), Tx: other}
+	if _, err := transaction.AddEntry(entry); err != nil {
+		t.Error("Fork of another organization should not be final", err)
+	}
+	if transaction.Finalized(other.Hash) != 0 {
+		t.Error("Organization without seals should not be final")
+	}
+}
+
+func TestLeaders(t *testing.T) {
+	organization := &transaction.Organization{Validators: 3}
+	cases := []struct {
+		height  uint64
+		waited  time.Duration
+		leaders []uint32
+	}{
+		{1, 0, []uint32{0}},
+		{2, LeaderTimeout - time.Second, []uint32{1}},
+		{3, LeaderTimeout, []uint32{2, 0}},
+		{1, 2 * LeaderTimeout, []uint32{0, 1, 2}},
+		{2, 10 * LeaderTimeout, []uint32{1, 2, 0}},
+		{1, -time.Hour, []uint32{0}},
+	}
+	for _, c := range cases {
+		if leaders := Leaders(organization, c.height, c.waited); fmt.Sprint(leaders) != fmt.Sprint(c.leaders) {
+			t.Error("Wrong leaders of height", c.height, "after", c.waited, leaders)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+	keys := keystore.CurrentKeyMap
+	defer func() { keystore.CurrentKeyMap = keys }()
+	defer func(timeout time.Duration) { LeaderTimeout = timeout }(LeaderTimeout)
+	transaction.Forks = transaction.NewForkPool()
+
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	organization := transaction.Organization{
+		Name:            "Fallback Org",
+		MasterPublicKey: master.Pub().Serialize(),
+		ValidatorPath:   "m/7",
+		Validators:      3,
+	}
+	first := newTestValidator(t, master, &organization, 0)
+	second := newTestValidator(t, master, &organization, 1)
+	third := newTestValidator(t, master, &organization, 2)
+
+	foundation, _ := json.Marshal(organization)
+	genesis := newTestTransaction(t, transaction.Genesis, nil, foundation, first)
+	genesis.Save()
+	file := newTestTransaction(t, transaction.File, genesis.Hash, []byte("waiting"), first)
+	file.Save()
+	batch := (&Batch{Height: 1, Transactions: [][]byte{file.Hash}}).ToBytes()
+
+	// the next validator waits for the leader
+	LeaderTimeout = time.Hour
+	useKeys(second)
+	if seal, err := Propose(genesis.Hash); seal != nil || err != nil {
+		t.Fatal("Next validator should wait for the leader", seal, err)
+	}
+	early := newTestTransaction(t, transaction.Seal, genesis.Hash, batch, second)
+	if _, err := transaction.ProcessTransaction(early); !errors.Is(err, transaction.ErrInvalidSeal) {
+		t.Error("Seal of the next validator should be refused before the timeout", err)
+	}
+
+	// then seals in its place, the one after it still waits
+	time.Sleep(100 * time.Millisecond)
+	LeaderTimeout = time.Since(db.Get(genesis.Hash).Date)
+	late := newTestTransaction(t, transaction.Seal, genesis.Hash, batch, third)
+	if _, err := transaction.ProcessTransaction(late); !errors.Is(err, transaction.ErrInvalidSeal) {
+		t.Error("Seal of the validator after the next one should be refused", err)
+	}
+	seal, err := Propose(genesis.Hash)
+	if seal == nil || err != nil {
+		t.Fatal("Next validator should seal once the leader is late", err)
+	}
+	if transaction.Finalized(genesis.Hash) != 3 {
+		t.Error("Fallback seal should be final", transaction.Finalized(genesis.Hash))
+	}
+	if count, err := transaction.VerifyChain(); count != 3 || err != nil {
+		t.Error("Chain with a fallback seal does not verify", count, err)
+	}
+}
@@ -0,0 +1,276 @@
+package crypto
+
+// BLS signatures over BLS12-381
+// Public keys are in G1 (96 bytes), signatures in G2 (192 bytes), both uncompressed.
+// Signatures of the same message add up to a single signature, checked against the sum of
+// the public keys with one pairing. Summing keys is only safe if nobody can choose their key
+// as a function of the others' (rogue key attack): keys are derived from the organization
+// BLS master public key at their path, see BLSDerivePublicKey, so they are not chosen.
+//
+// Derivation follows the unhardened scheme of BIP32:
+// - unhardened child: sk + H(pk || index), public key pk + H(pk || index)·G1
+// - hardened child:   H(sk || index), private keys only
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto/bls12381"
+)
+
+const (
+	BLSPublicKeySize  = 96
+	BLSSignatureSize  = 192
+	BLSPrivateKeySize = 32
+)
+
+var (
+	ErrInvalidBLSKey       = errors.New("Invalid BLS key")
+	ErrInvalidBLSSignature = errors.New("Invalid BLS signature")
+)
+
+var (
+	blsDomain     = []byte("THEMACHINE-BLS-SIG-BLS12381G2")
+	blsKeyDomain  = []byte("THEMACHINE-BLS-KEYGEN")
+	blsFieldOrder = bigFromHex("1a0111ea397fe69a4b1ba7b6434bacd764774b84f38512bf6730d2a0f6b0f6241eabfffeb153ffffb9feffffffffaaab")
+)
+
+func bigFromHex(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 16)
+	return n
+}
+
+// BLSKeyFromSeed derives a BLS private key and its public key from a secret seed
+func BLSKeyFromSeed(seed []byte) ([]byte, []byte, error) {
+	if len(seed) < 32 {
+		return nil, nil, errors.New("BLS seed should be at least 32 bytes")
+	}
+	sk := blsScalar(seed, nil)
+	return blsScalarBytes(sk), blsPublicKey(sk), nil
+}
+
+// BLSPublicKey returns the public key of a BLS private key
+func BLSPublicKey(privateKey []byte) ([]byte, error) {
+	sk, err := parseBLSPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return blsPublicKey(sk), nil
+}
+
+// BLSSign signs the message with a BLS private key
+func BLSSign(message []byte, privateKey []byte) ([]byte, error) {
+	sk, err := parseBLSPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	h, err := blsHashToG2(message)
+	if err != nil {
+		return nil, err
+	}
+	g2 := bls12381.NewG2()
+	return g2.ToBytes(g2.MulScalar(g2.New(), h, sk)), nil
+}
+
+// BLSVerify checks a BLS signature, or an aggregate one of the same message against the
+// aggregate public key, see BLSAggregatePublicKeys
+func BLSVerify(signature []byte, message []byte, publicKey []byte) bool {
+	pk, err := parseBLSPublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	sig, err := parseBLSSignature(signature)
+	if err != nil {
+		return false
+	}
+	h, err := blsHashToG2(message)
+	if err != nil {
+		return false
+	}
+	// e(pk, H(m)) == e(G1, sig)
+	e := bls12381.NewPairingEngine()
+	e.AddPair(pk, h)
+	e.AddPairInv(e.G1.One(), sig)
+	return e.Check()
+}
+
+// BLSAggregateSignatures adds up signatures into one
+func BLSAggregateSignatures(signatures [][]byte) ([]byte, error) {
+	if len(signatures) == 0 {
+		return nil, ErrInvalidBLSSignature
+	}
+	g2 := bls12381.NewG2()
+	sum := g2.Zero()
+	for _, v := range signatures {
+		sig, err := parseBLSSignature(v)
+		if err != nil {
+			return nil, err
+		}
+		g2.Add(sum, sum, sig)
+	}
+	return g2.ToBytes(sum), nil
+}
+
+// BLSAggregatePublicKeys adds up public keys into the key of their aggregate signature
+func BLSAggregatePublicKeys(publicKeys [][]byte) ([]byte, error) {
+	if len(publicKeys) == 0 {
+		return nil, ErrInvalidBLSKey
+	}
+	g1 := bls12381.NewG1()
+	sum := g1.Zero()
+	for _, v := range publicKeys {
+		pk, err := parseBLSPublicKey(v)
+		if err != nil {
+			return nil, err
+		}
+		g1.Add(sum, sum, pk)
+	}
+	if g1.IsZero(sum) {
+		return nil, ErrInvalidBLSKey
+	}
+	return g1.ToBytes(sum), nil
+}
+
+// BLSVerifyAggregate checks the aggregate signature of the same message by all given keys
+func BLSVerifyAggregate(signature []byte, message []byte, publicKeys [][]byte) bool {
+	pk, err := BLSAggregatePublicKeys(publicKeys)
+	if err != nil {
+		return false
+	}
+	return BLSVerify(signature, message, pk)
+}
+
+// BLSDeriveKey derives the private key at given path from a BLS master private key
+func BLSDeriveKey(path []uint32, masterPrivateKey []byte) ([]byte, error) {
+	sk, err := parseBLSPrivateKey(masterPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	q := bls12381.NewG1().Q()
+	for _, index := range path {
+		if index >= HardenedOffset {
+			sk = blsScalar(blsScalarBytes(sk), blsIndex(index))
+			continue
+		}
+		tweak := blsScalar(blsPublicKey(sk), blsIndex(index))
+		sk = new(big.Int).Mod(new(big.Int).Add(sk, tweak), q)
+	}
+	if sk.Sign() == 0 {
+		return nil, ErrInvalidBLSKey
+	}
+	return blsScalarBytes(sk), nil
+}
+
+// BLSDerivePublicKey derives the public key at given unhardened path from a BLS master public key
+func BLSDerivePublicKey(path []uint32, masterPublicKey []byte) ([]byte, error) {
+	pk, err := parseBLSPublicKey(masterPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	g1 := bls12381.NewG1()
+	for _, index := range path {
+		if index >= HardenedOffset {
+			return nil, errors.New("Cannot derive hardened child from a public key")
+		}
+		tweak := blsScalar(g1.ToBytes(pk), blsIndex(index))
+		g1.Add(pk, pk, g1.MulScalar(g1.New(), g1.One(), tweak))
+	}
+	if g1.IsZero(pk) {
+		return nil, ErrInvalidBLSKey
+	}
+	return g1.ToBytes(pk), nil
+}
+
+// CheckBLSPublicKeyPath checks if given path is a correct derivation path for a BLS master public key
+func CheckBLSPublicKeyPath(path []uint32, publicKey []byte, masterPublicKey []byte) bool {
+	derived, err := BLSDerivePublicKey(path, masterPublicKey)
+	if err != nil {
+		return false
+	}
+	return string(derived) == string(publicKey)
+}
+
+func blsIndex(index uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, index)
+	return b
+}
+
+// blsScalar maps input to a non zero scalar
+func blsScalar(secret []byte, info []byte) *big.Int {
+	q := bls12381.NewG1().Q()
+	for i := byte(0); ; i++ {
+		keys, _ := HKDF(secret, append(append(append([]byte{}, blsKeyDomain...), info...), i), 1, 48)
+		sk := new(big.Int).Mod(new(big.Int).SetBytes(keys[0]), q)
+		if sk.Sign() != 0 {
+			return sk
+		}
+	}
+}
+
+func blsScalarBytes(sk *big.Int) []byte {
+	return sk.FillBytes(make([]byte, BLSPrivateKeySize))
+}
+
+func blsPublicKey(sk *big.Int) []byte {
+	g1 := bls12381.NewG1()
+	return g1.ToBytes(g1.MulScalar(g1.New(), g1.One(), sk))
+}
+
+func parseBLSPrivateKey(privateKey []byte) (*big.Int, error) {
+	sk := new(big.Int).SetBytes(privateKey)
+	if len(privateKey) != BLSPrivateKeySize || sk.Sign() == 0 || sk.Cmp(bls12381.NewG1().Q()) >= 0 {
+		return nil, ErrInvalidBLSKey
+	}
+	return sk, nil
+}
+
+func parseBLSPublicKey(publicKey []byte) (*bls12381.PointG1, error) {
+	if len(publicKey) != BLSPublicKeySize {
+		return nil, ErrInvalidBLSKey
+	}
+	g1 := bls12381.NewG1()
+	pk, err := g1.FromBytes(publicKey)
+	if err != nil || g1.IsZero(pk) || !g1.InCorrectSubgroup(pk) {
+		return nil, ErrInvalidBLSKey
+	}
+	return pk, nil
+}
+
+func parseBLSSignature(signature []byte) (*bls12381.PointG2, error) {
+	if len(signature) != BLSSignatureSize {
+		return nil, ErrInvalidBLSSignature
+	}
+	g2 := bls12381.NewG2()
+	sig, err := g2.FromBytes(signature)
+	if err != nil || !g2.InCorrectSubgroup(sig) {
+		return nil, ErrInvalidBLSSignature
+	}
+	return sig, nil
+}
+
+// blsHashToG2 hashes the message to a point of G2: two field elements are mapped to the
+// curve and added up, see MapToCurve
+func blsHashToG2(message []byte) (*bls12381.PointG2, error) {
+	g2 := bls12381.NewG2()
+	elements, err := HKDF(message, blsDomain, 4, 64)
+	if err != nil {
+		return nil, err
+	}
+	sum := g2.Zero()
+	for i := 0; i < 2; i++ {
+		// a field element of Fp2 is c1 || c0, 48 bytes each
+		fe := make([]byte, 96)
+		for j := 0; j < 2; j++ {
+			c := new(big.Int).Mod(new(big.Int).SetBytes(elements[2*i+j]), blsFieldOrder)
+			c.FillBytes(fe[48*j : 48*(j+1)])
+		}
+		p, err := g2.MapToCurve(fe)
+		if err != nil {
+			return nil, err
+		}
+		g2.Add(sum, sum, p)
+	}
+	return sum, nil
+}
@@ -0,0 +1,106 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBLSSignAndVerify(t *testing.T) {
+	sk, pk, err := BLSKeyFromSeed(Hash([]byte("seed")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromPrivate, _ := BLSPublicKey(sk); !bytes.Equal(fromPrivate, pk) || len(pk) != BLSPublicKeySize {
+		t.Fatal("Public key does not match private key")
+	}
+	message := DHash([]byte("message"))
+	sig, err := BLSSign(message, sk)
+	if err != nil || len(sig) != BLSSignatureSize {
+		t.Fatal("Cannot sign", err)
+	}
+	if !BLSVerify(sig, message, pk) {
+		t.Error("Signature should verify")
+	}
+	if BLSVerify(sig, DHash([]byte("other")), pk) {
+		t.Error("Signature of another message should not verify")
+	}
+	_, other, _ := BLSKeyFromSeed(Hash([]byte("other seed")))
+	if BLSVerify(sig, message, other) {
+		t.Error("Signature should not verify with another key")
+	}
+	if BLSVerify(sig[:100], message, pk) || BLSVerify(sig, message, pk[:50]) {
+		t.Error("Truncated input should not verify")
+	}
+}
+
+func TestBLSAggregate(t *testing.T) {
+	master, masterPublic, _ := BLSKeyFromSeed(Hash([]byte("organization")))
+	message := DHash([]byte("transaction"))
+
+	var signatures, publicKeys [][]byte
+	for i := uint32(0); i < 3; i++ {
+		path := []uint32{1, i}
+		sk, err := BLSDeriveKey(path, master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk, _ := BLSPublicKey(sk)
+		if !CheckBLSPublicKeyPath(path, pk, masterPublic) {
+			t.Error("Public derivation does not match private derivation", path)
+		}
+		sig, _ := BLSSign(message, sk)
+		signatures = append(signatures, sig)
+		publicKeys = append(publicKeys, pk)
+	}
+	if CheckBLSPublicKeyPath([]uint32{1, 5}, publicKeys[0], masterPublic) {
+		t.Error("Key should not match another path")
+	}
+	if _, err := BLSDerivePublicKey([]uint32{HardenedOffset}, masterPublic); err == nil {
+		t.Error("Hardened child should not be derived from a public key")
+	}
+
+	aggregate, err := BLSAggregateSignatures(signatures)
+	if err != nil || len(aggregate) != BLSSignatureSize {
+		t.Fatal("Cannot aggregate", err)
+	}
+	if !BLSVerifyAggregate(aggregate, message, publicKeys) {
+		t.Error("Aggregate signature should verify")
+	}
+	if BLSVerifyAggregate(aggregate, message, publicKeys[:2]) {
+		t.Error("Aggregate signature should not verify without a signer")
+	}
+	partial, _ := BLSAggregateSignatures(signatures[:2])
+	if BLSVerifyAggregate(partial, message, publicKeys) {
+		t.Error("Partial aggregate should not verify for all signers")
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	message := DHash([]byte("message"))
+	blsKey, blsPublic, _ := BLSKeyFromSeed(Hash([]byte("seed")))
+	ecKey, ecPublic, _ := GenerateKey()
+	keys := map[SchemeID][2][]byte{Secp256k1: {ecKey, ecPublic}, BLS: {blsKey, blsPublic}, Schnorr: {ecKey, ecPublic}}
+
+	for id, key := range keys {
+		s, err := GetScheme(id)
+		if err != nil || s.ID() != id {
+			t.Fatal("Missing scheme", id, err)
+		}
+		if !s.IsPublicKey(key[1]) {
+			t.Error("Public key is not recognized by", id)
+		}
+		sig, err := s.Sign(message, key[0])
+		if err != nil || !s.Verify(sig, message, key[1]) {
+			t.Error("Signature should verify with", id, err)
+		}
+	}
+	if s, _ := GetScheme(BLS); s.IsPublicKey(ecPublic) {
+		t.Error("secp256k1 key should not be a BLS key")
+	}
+	if _, ok := interface{}(blsScheme{}).(Aggregator); !ok {
+		t.Error("BLS should aggregate")
+	}
+	if _, err := GetScheme(SchemeID(9)); err == nil {
+		t.Error("Unknown scheme should be refused")
+	}
+}
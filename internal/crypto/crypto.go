@@ -9,23 +9,30 @@ package crypto
 // - Decrypt AES-GCM
 // - Sign    ECC - secp256k1
 // - Verify  ECC - secp256k1
+// - BLS     BLS12-381 signatures that aggregate, see bls.go and scheme.go
+// - Schnorr BIP340 on secp256k1 and MuSig2 multi-signatures, see schnorr.go and musig.go
+// - ECDH    ECC - secp256k1 shared secret
+// - HKDF    HMAC-SHA256 key derivation
 
 // For encrypt/decrypt: AES-GCM or AES-CBC or ...?
 // For sign/verify: ECC or PBC (Pairing Based Cryptography e.g. BLS)
 // - ECC requires n signatures for n signees
 // - BLS requires 1 signature for n signees
-// - Study & Discuss Schnorr
-// Note: Signature method affects HD key functions (BLS does not allow child derivation from master public key. Needs fact check)
+// - Schnorr (BIP340) requires 1 signature for n signees signing together (MuSig2)
+// Note: Signature method affects HD key functions, BLS keys have their own derivation (see bls.go)
 
 import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 
 	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/ripemd160"
 )
@@ -84,6 +91,11 @@ func Decrypt(data []byte, encryptionKey []byte) ([]byte, error) {
 	return aesGCM.Open(nil, nonce, ciphertext, nil)
 }
 
+// NewGCM returns the AES-GCM cipher of Encrypt/Decrypt for callers managing their own nonces
+func NewGCM(key []byte) (cipher.AEAD, error) {
+	return setupGCM(key)
+}
+
 func setupGCM(key []byte) (cipher.AEAD, error) {
 	// get block size
 	block, err := aes.NewCipher(key)
@@ -122,3 +134,54 @@ func Sign(message []byte, key []byte) ([]byte, error) {
 func Verify(signature []byte, message []byte, publicKey []byte) bool {
 	return secp256k1.VerifySignature(publicKey, message, signature)
 }
+
+// Generates a random secp256k1 private key and its compressed public key
+func GenerateKey() ([]byte, []byte, error) {
+	curve := secp256k1.S256()
+	key := make([]byte, 32)
+	for {
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, nil, err
+		}
+		k := new(big.Int).SetBytes(key)
+		if k.Sign() > 0 && k.Cmp(curve.N) < 0 {
+			break
+		}
+	}
+	x, y := curve.ScalarBaseMult(key)
+	return key, secp256k1.CompressPubkey(x, y), nil
+}
+
+// ECDH returns the hash of the shared point of a private key and the compressed public key of the other party
+func ECDH(privateKey []byte, publicKey []byte) ([]byte, error) {
+	// in case it has a leading zero byte
+	if len(privateKey) == 33 {
+		privateKey = privateKey[1:]
+	}
+	if len(privateKey) != 32 {
+		return nil, errors.New("Invalid private key")
+	}
+
+	x, y := secp256k1.DecompressPubkey(publicKey)
+	if x == nil {
+		return nil, errors.New("Invalid public key")
+	}
+	sx, _ := secp256k1.S256().ScalarMult(x, y, privateKey)
+	if sx == nil {
+		return nil, errors.New("Invalid shared point")
+	}
+	return Hash(sx.FillBytes(make([]byte, 32))), nil
+}
+
+// HKDF derives n keys of given length from a secret
+func HKDF(secret []byte, info []byte, n int, keyLength int) ([][]byte, error) {
+	r := hkdf.New(sha256.New, secret, nil, info)
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, keyLength)
+		if _, err := io.ReadFull(r, keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
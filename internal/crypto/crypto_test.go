@@ -38,3 +38,36 @@ func TestEncryption(t *testing.T) {
 		t.Error("Resulting bytes after decryption does not match")
 	}
 }
+
+func TestECDH(t *testing.T) {
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal("Error generating key", err)
+	}
+	// against a wallet key
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatal("Error generating wallet", err)
+	}
+
+	secret, err := ECDH(private, wallet.Pub().Key)
+	if err != nil {
+		t.Fatal("Error calculating shared secret", err)
+	}
+	other, err := ECDH(wallet.Key, public)
+	if err != nil {
+		t.Fatal("Error calculating shared secret", err)
+	}
+	if len(secret) != 32 || !bytes.Equal(secret, other) {
+		t.Error("Shared secrets do not match")
+	}
+
+	if _, err := ECDH(private, []byte("not a key")); err == nil {
+		t.Error("Invalid public key should fail")
+	}
+
+	keys, err := HKDF(secret, []byte("test"), 2, 32)
+	if err != nil || len(keys) != 2 || bytes.Equal(keys[0], keys[1]) {
+		t.Error("Error deriving keys", err)
+	}
+}
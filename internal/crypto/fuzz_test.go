@@ -0,0 +1,35 @@
+//go:build go1.18
+// +build go1.18
+
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func FuzzParseDerivationPathString(f *testing.F) {
+	for _, v := range []string{"m/1'/5", "0/4/*", "1/", "", "/", "m", "1/*:2", "4294967295"} {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		p, err := ParsePath(path)
+		if err != nil {
+			return
+		}
+		// the canonical form parses to the same path
+		formatted, err := ParsePath(p.String())
+		if err != nil || !reflect.DeepEqual(formatted, p) {
+			t.Error("Formatted path does not parse back", path, p.String(), err)
+		}
+
+		steps, err := ParseDerivationPathString(path)
+		if err != nil {
+			return
+		}
+		if decoded := ParseDerivationPathBytes(DerivationPathToBytes(steps)); !reflect.DeepEqual(decoded, steps) {
+			t.Error("Encoded path does not decode back", path, steps, decoded)
+		}
+	})
+}
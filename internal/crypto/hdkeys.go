@@ -6,9 +6,8 @@ package crypto
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/wemeetagain/go-hdwallet"
 	// "go.dedis.ch/kyber/v3/pairing"
@@ -26,6 +25,15 @@ func NewWallet() (*hdwallet.HDWallet, error) {
 	return hdwallet.MasterKey(randomSeed), nil
 }
 
+// BLS master key pair of a wallet, its public key is published by the organization
+// so that BLS keys of members can be recognized, see BLSDerivePublicKey
+func BLSMasterKey(w *hdwallet.HDWallet) ([]byte, []byte, error) {
+	if len(w.Key) != 33 || w.Key[0] != 0 {
+		return nil, nil, errors.New("BLS master key needs an extended private key")
+	}
+	return BLSKeyFromSeed(append(append([]byte{}, w.Key...), w.Chaincode...))
+}
+
 // Build wallet from extended key
 func WalletFromExtendedKey(extendedKey string) (*hdwallet.HDWallet, error) {
 	return hdwallet.StringWallet(extendedKey)
@@ -36,99 +44,65 @@ func PublicKeyToAddress(key []byte) []byte {
 	return Hash160(key)
 }
 
-// Parses derivation paths of form "i/j/k/l"
-func ParseDerivationPathString(path string) []uint32 {
-	var result []uint32
-	var childIndex uint32
-	elems := strings.Split(path, "/")
-	for _, v := range elems {
-		if len(v) == 0 {
-			// decide what to do with "" or "0/1/" (ending with "/")
-			continue
-		}
-		if v != "*" {
-			childIndex = uint32(v[0])
-			if len(v) == 2 {
-				// hardened key
-				childIndex += 0x80000000
-			}
-			result = append(result, childIndex)
-		} else {
-			result = append(result, 0)
-		}
-	}
+// IsValidDerivationPath tells if the path is well formed, see ParsePath
+func IsValidDerivationPath(path string) bool {
+	_, err := ParsePath(path)
+	return err == nil
+}
 
-	return result
+// Parses derivation paths of form "m/i/j'/k" into child indices
+func ParseDerivationPathString(path string) ([]uint32, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.Steps()
 }
 
+// Parses the byte encoding of derivation paths, nil if malformed
 func ParseDerivationPathBytes(path []byte) []uint32 {
-	if len(path) != 16 {
+	p, err := ParsePathBytes(path)
+	if err != nil {
 		return nil
 	}
-
-	var result []uint32
-	var childIndex uint32
-	for i := 0; i < 4; i++ {
-		childIndex = binary.BigEndian.Uint32(path[i*4 : (i+1)*4])
-		result = append(result, childIndex)
-	}
-	return result
+	steps, _ := p.Steps()
+	return steps
 }
 
 func DerivationPathToBytes(path []uint32) []byte {
-	var result []byte
-	var tmp = make([]byte, 4)
-	for _, v := range path {
-		binary.BigEndian.PutUint32(tmp, v)
-		result = append(result, tmp...)
-	}
+	result, _ := PathFromSteps(path).Bytes()
 	return result
 }
 
 // Determine if exact path is within a target path (see transaction.Transaction.Targets)
-func IsPathUnderPath(exactPathSteps []uint32, targetPath []uint32) bool {
-	// exactPathSteps := ParseDerivationPath(exactPath)
-	for i, v := range targetPath {
-		// it is a higer path
-		if len(exactPathSteps) == i {
-			return false
-		}
-		if v != 0 {
-			if exactPathSteps[i] != v {
-				return false
-			}
-		} else {
-			return true
-		}
-	}
-	return false
+func IsPathUnderPath(exactPathSteps []uint32, targetPath DerivationPath) bool {
+	return PathFromSteps(exactPathSteps).IsUnder(targetPath)
 }
 
 // Checks if given path is a correct derivation path for a master public key (of an organization)
 func CheckPublicKeyPath(path []uint32, publicKey []byte, masterPublicKey string) bool {
 	// extract derivation path from extended public key
-	derivedKey := DeriveFromMPK(path, masterPublicKey)
+	derivedKey, err := DeriveFromMPK(path, masterPublicKey)
+	if err != nil {
+		return false
+	}
 	// return true if correct
 	return bytes.Equal(derivedKey.Pub().Key, publicKey)
 }
 
 // Given path derive a child
-func DeriveFromMPK(derivationSteps []uint32, masterPublicKey string) hdwallet.HDWallet {
+func DeriveFromMPK(derivationSteps []uint32, masterPublicKey string) (*hdwallet.HDWallet, error) {
 	w, err := hdwallet.StringWallet(masterPublicKey)
 	if err != nil {
-		fmt.Println("Error reading master public key")
+		return nil, errors.New("Error reading master public key")
 	}
 
 	for i, v := range derivationSteps {
-		// Stop if child index is 0
-		if v == 0 {
-			return *w
-		}
 		// Derive child
-		w, err = w.Child(uint32(v))
+		w, err = w.Child(v)
 		if err != nil {
-			fmt.Printf("Error deriving child key %d at depth %d from master public key\n", v, i)
+			return nil, fmt.Errorf("Error deriving child key %d at depth %d from master public key: %s", v, i, err)
 		}
 	}
-	return *w
+	return w, nil
 }
@@ -61,20 +61,32 @@ func TestChildSignatures(t *testing.T) {
 
 func TestPaths(t *testing.T) {
 
-	keyPath := ParseDerivationPathString("1/5")
-	targetPath := ParseDerivationPathString("1/*")
+	keyPath, err := ParseDerivationPathString("1/5")
+	if err != nil {
+		t.Fatal("Cannot parse key path", err)
+	}
+	targetPath, err := ParsePath("1/*")
+	if err != nil {
+		t.Fatal("Cannot parse target path", err)
+	}
 	ok := IsPathUnderPath(keyPath, targetPath)
 	if !ok {
 		t.Error("Given path should be covered by target path")
 	}
 
+	// deeper than 4 levels and wider than 9 children per level
+	keyPath, _ = ParseDerivationPathString("1/12/300/7/0/25")
+
 	master, err := NewWallet()
 	if err != nil {
 		t.Error("Could not generate master key", err)
 	}
 
 	publicMaster := master.Pub()
-	childPublicMaster := DeriveFromMPK(keyPath, publicMaster.String())
+	childPublicMaster, err := DeriveFromMPK(keyPath, publicMaster.String())
+	if err != nil {
+		t.Fatal("Could not derive from master public key", err)
+	}
 
 	ok = CheckPublicKeyPath(keyPath, childPublicMaster.Key, publicMaster.String())
 	if !ok {
@@ -0,0 +1,275 @@
+package crypto
+
+// MuSig2 multi-signatures (BIP327, without tweaks)
+// Co-signers of the same message sign together into one BIP340 signature, valid under their
+// aggregate key, see MuSigKeyAgg. The aggregate key weighs every key by a coefficient hashed
+// from all of them, so no key can be chosen to cancel the others.
+// Two rounds:
+// 1. every signer draws a nonce (MuSigNonceGen) and shares its public part
+// 2. public nonces are added up (MuSigNonceAgg), every signer makes a partial signature in a
+//    session over the aggregate nonce (MuSigSession.Sign) and shares it
+// The partial signatures add up to the signature (MuSigSession.Aggregate).
+// A secret nonce must never sign twice, MuSigSession.Sign clears it.
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+)
+
+const MuSigPublicNonceSize = 66
+
+var ErrInvalidMuSig = errors.New("Invalid MuSig2 input")
+
+// Secret nonce of a signer, used once
+type MuSigNonce struct {
+	k1, k2    *big.Int
+	PublicKey []byte // of the signer
+}
+
+// MuSigKeyAgg returns the aggregate public key (compressed) of given keys, in given order
+func MuSigKeyAgg(publicKeys [][]byte) ([]byte, error) {
+	Q, _, err := keyAgg(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return Q.bytes(), nil
+}
+
+// keyAgg returns the aggregate key and the coefficient of each key
+func keyAgg(publicKeys [][]byte) (point, []*big.Int, error) {
+	if len(publicKeys) == 0 {
+		return point{}, nil, ErrInvalidMuSig
+	}
+	var all []byte
+	for _, v := range publicKeys {
+		all = append(all, v...)
+	}
+	list := TaggedHash("KeyAgg list", all)
+	// the second distinct key gets coefficient 1
+	var second []byte
+	for _, v := range publicKeys[1:] {
+		if string(v) != string(publicKeys[0]) {
+			second = v
+			break
+		}
+	}
+
+	var Q point
+	coefficients := make([]*big.Int, len(publicKeys))
+	for i, v := range publicKeys {
+		P, err := parsePoint(v)
+		if err != nil {
+			return point{}, nil, err
+		}
+		if second != nil && string(v) == string(second) {
+			coefficients[i] = big.NewInt(1)
+		} else {
+			coefficients[i] = hashToScalar("KeyAgg coefficient", list, v)
+		}
+		Q = Q.add(P.mul(coefficients[i]))
+	}
+	if Q.isInfinity() {
+		return point{}, nil, ErrInvalidMuSig
+	}
+	return Q, coefficients, nil
+}
+
+// MuSigVerify checks a MuSig2 signature of the message by all given keys
+func MuSigVerify(signature []byte, message []byte, publicKeys [][]byte) bool {
+	Q, err := MuSigKeyAgg(publicKeys)
+	if err != nil {
+		return false
+	}
+	return SchnorrVerify(signature, message, Q)
+}
+
+// MuSigNonceGen draws the nonce of a signer for the message, the public nonce (66 bytes) is shared
+func MuSigNonceGen(privateKey []byte, message []byte) (*MuSigNonce, []byte, error) {
+	d, err := parseScalar(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	random := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return nil, nil, err
+	}
+	nonce := MuSigNonce{PublicKey: baseMul(d).bytes()}
+	for i, k := range []**big.Int{&nonce.k1, &nonce.k2} {
+		*k = hashToScalar("MuSig/nonce", random, scalarBytes(d), nonce.PublicKey, message, []byte{byte(i)})
+		if (*k).Sign() == 0 {
+			return nil, nil, errors.New("Invalid MuSig2 nonce")
+		}
+	}
+	public := append(baseMul(nonce.k1).bytes(), baseMul(nonce.k2).bytes()...)
+	return &nonce, public, nil
+}
+
+// MuSigNonceAgg adds up the public nonces of all signers
+func MuSigNonceAgg(publicNonces [][]byte) ([]byte, error) {
+	var R1, R2 point
+	for _, v := range publicNonces {
+		if len(v) != MuSigPublicNonceSize {
+			return nil, ErrInvalidMuSig
+		}
+		P1, err := parsePoint(v[:33])
+		if err != nil {
+			return nil, err
+		}
+		P2, err := parsePoint(v[33:])
+		if err != nil {
+			return nil, err
+		}
+		R1, R2 = R1.add(P1), R2.add(P2)
+	}
+	return append(R1.bytes(), R2.bytes()...), nil
+}
+
+// parseAggregateNonce reads an aggregate nonce, its points may be infinity
+func parseAggregateNonce(aggregateNonce []byte) (point, point, error) {
+	if len(aggregateNonce) != MuSigPublicNonceSize {
+		return point{}, point{}, ErrInvalidMuSig
+	}
+	var R [2]point
+	for i := range R {
+		encoded := aggregateNonce[33*i : 33*(i+1)]
+		if string(encoded) == string(make([]byte, 33)) {
+			continue
+		}
+		var err error
+		if R[i], err = parsePoint(encoded); err != nil {
+			return point{}, point{}, err
+		}
+	}
+	return R[0], R[1], nil
+}
+
+// MuSigSession is the signing of a message by given keys with an aggregate nonce
+type MuSigSession struct {
+	PublicKeys     [][]byte
+	Message        []byte
+	AggregateNonce []byte
+
+	q            point
+	coefficients []*big.Int
+	r            point
+	b, e         *big.Int
+}
+
+func NewMuSigSession(publicKeys [][]byte, aggregateNonce []byte, message []byte) (*MuSigSession, error) {
+	Q, coefficients, err := keyAgg(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	R1, R2, err := parseAggregateNonce(aggregateNonce)
+	if err != nil {
+		return nil, err
+	}
+	b := hashToScalar("MuSig/noncecoef", aggregateNonce, Q.xBytes(), message)
+	R := R1.add(R2.mul(b))
+	if R.isInfinity() {
+		R = baseMul(big.NewInt(1))
+	}
+	return &MuSigSession{
+		PublicKeys:     publicKeys,
+		Message:        message,
+		AggregateNonce: aggregateNonce,
+		q:              Q,
+		coefficients:   coefficients,
+		r:              R,
+		b:              b,
+		e:              hashToScalar("BIP0340/challenge", R.xBytes(), Q.xBytes(), message),
+	}, nil
+}
+
+// coefficient of the key in the session, nil if it is not a signer
+func (s *MuSigSession) coefficient(publicKey []byte) *big.Int {
+	for i, v := range s.PublicKeys {
+		if string(v) == string(publicKey) {
+			return s.coefficients[i]
+		}
+	}
+	return nil
+}
+
+// g negates the keys if the aggregate key has an odd y
+func (s *MuSigSession) g() *big.Int {
+	if s.q.hasEvenY() {
+		return big.NewInt(1)
+	}
+	return new(big.Int).Sub(s256.N, big.NewInt(1))
+}
+
+// Sign makes the partial signature (32 bytes) of the signer, the nonce cannot be used again
+func (s *MuSigSession) Sign(nonce *MuSigNonce, privateKey []byte) ([]byte, error) {
+	if nonce == nil || nonce.k1 == nil {
+		return nil, errors.New("MuSig2 nonce is already used")
+	}
+	k1, k2 := nonce.k1, nonce.k2
+	nonce.k1, nonce.k2 = nil, nil
+
+	d, err := parseScalar(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := baseMul(d).bytes()
+	a := s.coefficient(publicKey)
+	if a == nil || string(publicKey) != string(nonce.PublicKey) {
+		return nil, errors.New("Signer is not part of the MuSig2 session")
+	}
+	if !s.r.hasEvenY() {
+		k1 = new(big.Int).Sub(s256.N, k1)
+		k2 = new(big.Int).Sub(s256.N, k2)
+	}
+	d.Mul(d, s.g())
+
+	// s = k1 + b·k2 + e·a·d
+	partial := new(big.Int).Mul(s.e, a)
+	partial.Mul(partial, d)
+	partial.Add(partial, new(big.Int).Mul(s.b, k2))
+	partial.Add(partial, k1).Mod(partial, s256.N)
+	return scalarBytes(partial), nil
+}
+
+// VerifyPartial checks the partial signature of a signer against its public nonce
+func (s *MuSigSession) VerifyPartial(partial []byte, publicNonce []byte, publicKey []byte) bool {
+	a := s.coefficient(publicKey)
+	P, err := parsePoint(publicKey)
+	if a == nil || err != nil || len(partial) != 32 || len(publicNonce) != MuSigPublicNonceSize {
+		return false
+	}
+	sp := new(big.Int).SetBytes(partial)
+	R1, err1 := parsePoint(publicNonce[:33])
+	R2, err2 := parsePoint(publicNonce[33:])
+	if err1 != nil || err2 != nil || sp.Cmp(s256.N) >= 0 {
+		return false
+	}
+	R := R1.add(R2.mul(s.b))
+	if !s.r.hasEvenY() {
+		R = R.negate()
+	}
+	// s·G == R + e·a·g·P
+	eag := new(big.Int).Mul(s.e, a)
+	eag.Mul(eag, s.g())
+	expected := R.add(P.mul(eag))
+	actual := baseMul(sp)
+	return !actual.isInfinity() && !expected.isInfinity() && actual.x.Cmp(expected.x) == 0 && actual.y.Cmp(expected.y) == 0
+}
+
+// Aggregate adds up the partial signatures of all signers into the signature (64 bytes)
+func (s *MuSigSession) Aggregate(partials [][]byte) ([]byte, error) {
+	if len(partials) != len(s.PublicKeys) {
+		return nil, ErrInvalidMuSig
+	}
+	sum := new(big.Int)
+	for _, v := range partials {
+		sp := new(big.Int).SetBytes(v)
+		if len(v) != 32 || sp.Cmp(s256.N) >= 0 {
+			return nil, ErrInvalidMuSig
+		}
+		sum.Add(sum, sp)
+	}
+	sum.Mod(sum, s256.N)
+	return append(s.r.xBytes(), scalarBytes(sum)...), nil
+}
@@ -0,0 +1,163 @@
+package crypto
+
+// BIP32 derivation paths
+// e.g. "m/1'/5", "0/4/*", "m/44h/0h/10/*"
+// - "m" is the master key itself, the "m/" prefix is optional
+// - "'" or "h" marks a hardened index
+// - "*" matches any index at its level; a path covers its whole subtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	HardenedOffset = 0x80000000
+	// paths are encoded in at most 255 bytes
+	MaxPathDepth = 63
+)
+
+var ErrInvalidPath = errors.New("Invalid derivation path")
+
+type PathElement struct {
+	Index    uint32 // without the hardened offset
+	Hardened bool
+	Wildcard bool
+}
+
+type DerivationPath []PathElement
+
+// ParsePath parses a derivation path string
+func ParsePath(path string) (DerivationPath, error) {
+	if path == "m" {
+		return DerivationPath{}, nil
+	}
+	path = strings.TrimPrefix(path, "m/")
+	if path == "" {
+		return nil, fmt.Errorf("%w: empty path", ErrInvalidPath)
+	}
+
+	elems := strings.Split(path, "/")
+	if len(elems) > MaxPathDepth {
+		return nil, fmt.Errorf("%w: depth %d, maximum is %d", ErrInvalidPath, len(elems), MaxPathDepth)
+	}
+
+	result := make(DerivationPath, 0, len(elems))
+	for i, v := range elems {
+		e, err := parsePathElement(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q at depth %d", err, v, i)
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+func parsePathElement(v string) (PathElement, error) {
+	if v == "*" {
+		return PathElement{Wildcard: true}, nil
+	}
+
+	var e PathElement
+	if strings.HasSuffix(v, "'") || strings.HasSuffix(v, "h") {
+		e.Hardened = true
+		v = v[:len(v)-1]
+	}
+	// digits only, no signs or spaces
+	if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+		return e, ErrInvalidPath
+	}
+	index, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || index >= HardenedOffset {
+		return e, ErrInvalidPath
+	}
+	e.Index = uint32(index)
+	return e, nil
+}
+
+// PathFromSteps builds a path from child indices, hardened ones include the offset
+func PathFromSteps(steps []uint32) DerivationPath {
+	result := make(DerivationPath, len(steps))
+	for i, v := range steps {
+		result[i] = PathElement{Index: v &^ HardenedOffset, Hardened: v >= HardenedOffset}
+	}
+	return result
+}
+
+// ParsePathBytes parses the encoding of Bytes, 4 bytes per level
+func ParsePathBytes(path []byte) (DerivationPath, error) {
+	if len(path)%4 != 0 || len(path)/4 > MaxPathDepth {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidPath, len(path))
+	}
+	steps := make([]uint32, len(path)/4)
+	for i := range steps {
+		steps[i] = binary.BigEndian.Uint32(path[i*4 : (i+1)*4])
+	}
+	return PathFromSteps(steps), nil
+}
+
+// Steps returns child indices ready for derivation, fails for wildcard paths
+func (p DerivationPath) Steps() ([]uint32, error) {
+	result := make([]uint32, len(p))
+	for i, e := range p {
+		if e.Wildcard {
+			return nil, fmt.Errorf("%w: wildcard at depth %d", ErrInvalidPath, i)
+		}
+		result[i] = e.Index
+		if e.Hardened {
+			result[i] += HardenedOffset
+		}
+	}
+	return result, nil
+}
+
+// Bytes encodes a path without wildcards as big endian uint32 per level
+func (p DerivationPath) Bytes() ([]byte, error) {
+	steps, err := p.Steps()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 4*len(steps))
+	for i, v := range steps {
+		binary.BigEndian.PutUint32(result[i*4:], v)
+	}
+	return result, nil
+}
+
+// IsUnder tells if the path is the target itself or in its subtree
+// A wildcard in the target matches any single element, thus "1/*" covers "1/5" and "1/5/2" but not "1"
+func (p DerivationPath) IsUnder(target DerivationPath) bool {
+	if len(p) < len(target) {
+		return false
+	}
+	for i, e := range target {
+		if e.Wildcard {
+			continue
+		}
+		if p[i].Wildcard || p[i].Index != e.Index || p[i].Hardened != e.Hardened {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the path in its canonical form, e.g. "m/1'/5/*"
+func (p DerivationPath) String() string {
+	var b strings.Builder
+	b.WriteString("m")
+	for _, e := range p {
+		b.WriteString("/")
+		if e.Wildcard {
+			b.WriteString("*")
+			continue
+		}
+		b.WriteString(strconv.FormatUint(uint64(e.Index), 10))
+		if e.Hardened {
+			b.WriteString("'")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+
+	valid := map[string]string{
+		"m":                "m",
+		"10":               "m/10",
+		"m/1'/5":           "m/1'/5",
+		"m/44h/0h/10/*":    "m/44'/0'/10/*",
+		"0/4/*":            "m/0/4/*",
+		"2147483647'/123":  "m/2147483647'/123",
+		"1/2/3/4/5/6/7/99": "m/1/2/3/4/5/6/7/99",
+	}
+	for path, expected := range valid {
+		p, err := ParsePath(path)
+		if err != nil {
+			t.Error("Cannot parse path", path, err)
+			continue
+		}
+		if p.String() != expected {
+			t.Error("Unexpected format", path, p.String())
+		}
+	}
+
+	for _, path := range []string{"", "m/", "/1", "1/", "1//2", "a", "1''", "-1", "+1", "1 ", "1/*:2", "2147483648", "4294967296", "*'"} {
+		if _, err := ParsePath(path); !errors.Is(err, ErrInvalidPath) {
+			t.Error("Path should be invalid", path, err)
+		}
+	}
+
+	steps, err := ParseDerivationPathString("m/10/1'")
+	if err != nil || len(steps) != 2 || steps[0] != 10 || steps[1] != 1+HardenedOffset {
+		t.Error("Unexpected steps", steps, err)
+	}
+	if _, err := ParseDerivationPathString("1/*"); err == nil {
+		t.Error("Wildcard path should not have steps")
+	}
+
+	encoded := DerivationPathToBytes(steps)
+	if len(encoded) != 8 {
+		t.Error("Unexpected encoding length", len(encoded))
+	}
+	if decoded := ParseDerivationPathBytes(encoded); len(decoded) != 2 || decoded[1] != steps[1] {
+		t.Error("Encoded path does not decode back", decoded)
+	}
+	if ParseDerivationPathBytes(encoded[:5]) != nil {
+		t.Error("Malformed encoding should not parse")
+	}
+}
+
+func TestIsUnder(t *testing.T) {
+
+	cases := []struct {
+		path, target string
+		under        bool
+	}{
+		{"1/5", "1/*", true},
+		{"1/5/2", "1/*", true},
+		{"1", "1/*", false},
+		{"1/5", "1", true},
+		{"1/5", "1/5", true},
+		{"1/50", "1/5", false},
+		{"10/5", "1/*", false},
+		{"1'/5", "1/*", false},
+		{"1'/5", "1'/*", true},
+		{"3/7/2", "*/7", true},
+		{"3/8/2", "*/7", false},
+		{"0", "m", true},
+	}
+	for _, c := range cases {
+		p, _ := ParsePath(c.path)
+		target, _ := ParsePath(c.target)
+		if p.IsUnder(target) != c.under {
+			t.Error("Unexpected result", c.path, c.target, !c.under)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package crypto
+
+// Signature schemes
+// A transaction names the scheme its signatures are made with, see transaction.Transaction.Scheme
+// - Secp256k1: ECDSA, keys are derived from the organization extended master public key
+// - BLS:       BLS12-381, keys are derived from the organization BLS master public key and
+//              signatures of the same message aggregate into one, see bls.go
+// - Schnorr:   BIP340 with the secp256k1 keys of the organization, co-signers may sign
+//              together into one signature with MuSig2, see schnorr.go and musig.go
+
+import "fmt"
+
+type SchemeID byte
+
+const (
+	Secp256k1 SchemeID = iota
+	BLS
+	Schnorr
+)
+
+type Scheme interface {
+	ID() SchemeID
+	Sign(message []byte, privateKey []byte) ([]byte, error)
+	Verify(signature []byte, message []byte, publicKey []byte) bool
+	// IsPublicKey tells if the key has the form of a public key of the scheme
+	IsPublicKey(publicKey []byte) bool
+}
+
+// AggregateVerifier is a scheme where several keys can make one signature of the same message
+type AggregateVerifier interface {
+	Scheme
+	VerifyAggregate(signature []byte, message []byte, publicKeys [][]byte) bool
+}
+
+// Aggregator is a scheme whose signatures, made independently, compress to one
+// Schnorr signers have to sign together instead, see MuSigSession
+type Aggregator interface {
+	AggregateVerifier
+	Aggregate(signatures [][]byte) ([]byte, error)
+}
+
+type secp256k1Scheme struct{}
+
+func (secp256k1Scheme) ID() SchemeID { return Secp256k1 }
+
+func (secp256k1Scheme) Sign(message []byte, privateKey []byte) ([]byte, error) {
+	return Sign(message, privateKey)
+}
+
+func (secp256k1Scheme) Verify(signature []byte, message []byte, publicKey []byte) bool {
+	return Verify(signature, message, publicKey)
+}
+
+func (secp256k1Scheme) IsPublicKey(publicKey []byte) bool {
+	return len(publicKey) == 33
+}
+
+type blsScheme struct{}
+
+func (blsScheme) ID() SchemeID { return BLS }
+
+func (blsScheme) Sign(message []byte, privateKey []byte) ([]byte, error) {
+	return BLSSign(message, privateKey)
+}
+
+func (blsScheme) Verify(signature []byte, message []byte, publicKey []byte) bool {
+	return BLSVerify(signature, message, publicKey)
+}
+
+func (blsScheme) IsPublicKey(publicKey []byte) bool {
+	return len(publicKey) == BLSPublicKeySize
+}
+
+func (blsScheme) Aggregate(signatures [][]byte) ([]byte, error) {
+	return BLSAggregateSignatures(signatures)
+}
+
+func (blsScheme) VerifyAggregate(signature []byte, message []byte, publicKeys [][]byte) bool {
+	return BLSVerifyAggregate(signature, message, publicKeys)
+}
+
+type schnorrScheme struct{}
+
+func (schnorrScheme) ID() SchemeID { return Schnorr }
+
+func (schnorrScheme) Sign(message []byte, privateKey []byte) ([]byte, error) {
+	return SchnorrSign(message, privateKey)
+}
+
+func (schnorrScheme) Verify(signature []byte, message []byte, publicKey []byte) bool {
+	return SchnorrVerify(signature, message, publicKey)
+}
+
+func (schnorrScheme) IsPublicKey(publicKey []byte) bool {
+	return len(publicKey) == 33
+}
+
+func (schnorrScheme) VerifyAggregate(signature []byte, message []byte, publicKeys [][]byte) bool {
+	return MuSigVerify(signature, message, publicKeys)
+}
+
+var schemes = map[SchemeID]Scheme{
+	Secp256k1: secp256k1Scheme{},
+	BLS:       blsScheme{},
+	Schnorr:   schnorrScheme{},
+}
+
+// GetScheme returns the signature scheme with given identifier
+func GetScheme(id SchemeID) (Scheme, error) {
+	s, ok := schemes[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signature scheme %d", id)
+	}
+	return s, nil
+}
+
+func (id SchemeID) String() string {
+	switch id {
+	case Secp256k1:
+		return "secp256k1"
+	case BLS:
+		return "bls"
+	case Schnorr:
+		return "schnorr"
+	}
+	return fmt.Sprintf("scheme(%d)", byte(id))
+}
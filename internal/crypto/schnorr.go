@@ -0,0 +1,212 @@
+package crypto
+
+// Schnorr signatures on secp256k1 (BIP340)
+// Keys are the usual secp256k1 keys, so that signers keep their HD derived key pairs.
+// Public keys stay in their compressed form (33 bytes) here, BIP340 itself only uses the
+// x coordinate. Signatures are 64 bytes: x(R) + s.
+// Co-signers can sign together into one signature under their aggregate key, see musig.go
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+)
+
+const SchnorrSignatureSize = 64
+
+var ErrInvalidSchnorrKey = errors.New("Invalid Schnorr key")
+
+// point of secp256k1, infinity has nil coordinates
+type point struct {
+	x, y *big.Int
+}
+
+var s256 = secp256k1.S256()
+
+func (p point) isInfinity() bool {
+	return p.x == nil
+}
+
+func (p point) hasEvenY() bool {
+	return p.y.Bit(0) == 0
+}
+
+func (p point) negate() point {
+	if p.isInfinity() {
+		return p
+	}
+	return point{p.x, new(big.Int).Sub(s256.P, p.y)}
+}
+
+// add handles infinity and doubling, which the curve addition does not
+func (p point) add(q point) point {
+	switch {
+	case p.isInfinity():
+		return q
+	case q.isInfinity():
+		return p
+	case p.x.Cmp(q.x) == 0 && p.y.Cmp(q.y) == 0:
+		x, y := s256.Double(p.x, p.y)
+		return point{x, y}
+	case p.x.Cmp(q.x) == 0:
+		return point{}
+	}
+	x, y := s256.Add(p.x, p.y, q.x, q.y)
+	return point{x, y}
+}
+
+func (p point) mul(k *big.Int) point {
+	k = new(big.Int).Mod(k, s256.N)
+	if p.isInfinity() || k.Sign() == 0 {
+		return point{}
+	}
+	x, y := s256.ScalarMult(p.x, p.y, scalarBytes(k))
+	return point{x, y}
+}
+
+func baseMul(k *big.Int) point {
+	return point{s256.Gx, s256.Gy}.mul(k)
+}
+
+// compressed form, 33 zero bytes for infinity
+func (p point) bytes() []byte {
+	if p.isInfinity() {
+		return make([]byte, 33)
+	}
+	return secp256k1.CompressPubkey(p.x, p.y)
+}
+
+func (p point) xBytes() []byte {
+	return scalarBytes(p.x)
+}
+
+func parsePoint(compressed []byte) (point, error) {
+	if len(compressed) != 33 {
+		return point{}, ErrInvalidSchnorrKey
+	}
+	x, y := secp256k1.DecompressPubkey(compressed)
+	if x == nil {
+		return point{}, ErrInvalidSchnorrKey
+	}
+	return point{x, y}, nil
+}
+
+// liftX returns the point with given x coordinate and an even y
+func liftX(x *big.Int) (point, error) {
+	if x.Cmp(s256.P) >= 0 {
+		return point{}, ErrInvalidSchnorrKey
+	}
+	// y² = x³ + 7, p = 3 mod 4 so y = c^((p+1)/4)
+	c := new(big.Int).Exp(x, big.NewInt(3), s256.P)
+	c.Add(c, big.NewInt(7)).Mod(c, s256.P)
+	y := new(big.Int).Exp(c, new(big.Int).Rsh(new(big.Int).Add(s256.P, big.NewInt(1)), 2), s256.P)
+	if new(big.Int).Exp(y, big.NewInt(2), s256.P).Cmp(c) != 0 {
+		return point{}, ErrInvalidSchnorrKey
+	}
+	if y.Bit(0) != 0 {
+		y.Sub(s256.P, y)
+	}
+	return point{x, y}, nil
+}
+
+func scalarBytes(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, 32))
+}
+
+// parseScalar reads a private key, with or without its leading zero byte
+func parseScalar(key []byte) (*big.Int, error) {
+	if len(key) == 33 && key[0] == 0 {
+		key = key[1:]
+	}
+	d := new(big.Int).SetBytes(key)
+	if len(key) != 32 || d.Sign() == 0 || d.Cmp(s256.N) >= 0 {
+		return nil, ErrInvalidSchnorrKey
+	}
+	return d, nil
+}
+
+// TaggedHash is sha256(sha256(tag) + sha256(tag) + data), see BIP340
+func TaggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, v := range data {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+func hashToScalar(tag string, data ...[]byte) *big.Int {
+	return new(big.Int).Mod(new(big.Int).SetBytes(TaggedHash(tag, data...)), s256.N)
+}
+
+// SchnorrSign signs the message with a secp256k1 private key
+func SchnorrSign(message []byte, privateKey []byte) ([]byte, error) {
+	aux := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, aux); err != nil {
+		return nil, err
+	}
+	return schnorrSign(message, privateKey, aux)
+}
+
+func schnorrSign(message []byte, privateKey []byte, aux []byte) ([]byte, error) {
+	d, err := parseScalar(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	P := baseMul(d)
+	if !P.hasEvenY() {
+		d.Sub(s256.N, d)
+	}
+
+	t := TaggedHash("BIP0340/aux", aux)
+	for i, v := range scalarBytes(d) {
+		t[i] ^= v
+	}
+	k := hashToScalar("BIP0340/nonce", t, P.xBytes(), message)
+	if k.Sign() == 0 {
+		return nil, errors.New("Invalid Schnorr nonce")
+	}
+	R := baseMul(k)
+	if !R.hasEvenY() {
+		k.Sub(s256.N, k)
+	}
+	e := hashToScalar("BIP0340/challenge", R.xBytes(), P.xBytes(), message)
+
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k).Mod(s, s256.N)
+	return append(R.xBytes(), scalarBytes(s)...), nil
+}
+
+// SchnorrVerify checks a BIP340 signature, the public key is either compressed (33 bytes)
+// or its x coordinate (32 bytes)
+func SchnorrVerify(signature []byte, message []byte, publicKey []byte) bool {
+	if len(publicKey) == 33 {
+		if publicKey[0] != 2 && publicKey[0] != 3 {
+			return false
+		}
+		publicKey = publicKey[1:]
+	}
+	if len(signature) != SchnorrSignatureSize || len(publicKey) != 32 {
+		return false
+	}
+	P, err := liftX(new(big.Int).SetBytes(publicKey))
+	if err != nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if r.Cmp(s256.P) >= 0 || s.Cmp(s256.N) >= 0 {
+		return false
+	}
+	e := hashToScalar("BIP0340/challenge", signature[:32], publicKey, message)
+
+	// R = s·G - e·P
+	R := baseMul(s).add(P.mul(e).negate())
+	return !R.isInfinity() && R.hasEvenY() && R.x.Cmp(r) == 0
+}
@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// test vectors of BIP340
+func TestSchnorrVectors(t *testing.T) {
+	vectors := []struct {
+		key, publicKey, aux, message, signature string
+	}{
+		{
+			"0000000000000000000000000000000000000000000000000000000000000003",
+			"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+		},
+		{
+			"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF",
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+		},
+	}
+	for i, v := range vectors {
+		message := fromHex(t, v.message)
+		signature, err := schnorrSign(message, fromHex(t, v.key), fromHex(t, v.aux))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(signature, fromHex(t, v.signature)) {
+			t.Errorf("Vector %d signature is %X", i, signature)
+		}
+		if !SchnorrVerify(signature, message, fromHex(t, v.publicKey)) {
+			t.Error("Vector", i, "should verify")
+		}
+	}
+}
+
+func TestSchnorrSignAndVerify(t *testing.T) {
+	key, publicKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := DHash([]byte("message"))
+	signature, err := SchnorrSign(message, append([]byte{0}, key...))
+	if err != nil || len(signature) != SchnorrSignatureSize {
+		t.Fatal("Cannot sign", err)
+	}
+	if !SchnorrVerify(signature, message, publicKey) || !SchnorrVerify(signature, message, publicKey[1:]) {
+		t.Error("Signature should verify with compressed and x only key")
+	}
+	if SchnorrVerify(signature, DHash([]byte("other")), publicKey) {
+		t.Error("Signature of another message should not verify")
+	}
+	signature[63] ^= 1
+	if SchnorrVerify(signature, message, publicKey) {
+		t.Error("Changed signature should not verify")
+	}
+}
+
+func TestMuSig(t *testing.T) {
+	message := DHash([]byte("transaction"))
+	var keys, publicKeys [][]byte
+	for i := 0; i < 3; i++ {
+		key, publicKey, _ := GenerateKey()
+		keys = append(keys, key)
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	// first round
+	nonces := make([]*MuSigNonce, len(keys))
+	publicNonces := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		if nonces[i], publicNonces[i], err = MuSigNonceGen(key, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aggregateNonce, err := MuSigNonceAgg(publicNonces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// second round
+	session, err := NewMuSigSession(publicKeys, aggregateNonce, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partials [][]byte
+	for i, key := range keys {
+		partial, err := session.Sign(nonces[i], key)
+		if err != nil {
+			t.Fatal("Cannot sign partially", err)
+		}
+		if !session.VerifyPartial(partial, publicNonces[i], publicKeys[i]) {
+			t.Error("Partial signature should verify", i)
+		}
+		if session.VerifyPartial(partial, publicNonces[(i+1)%3], publicKeys[i]) {
+			t.Error("Partial signature should not verify with another nonce", i)
+		}
+		partials = append(partials, partial)
+	}
+	if _, err := session.Sign(nonces[0], keys[0]); err == nil {
+		t.Error("Nonce should not sign twice")
+	}
+
+	signature, err := session.Aggregate(partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !MuSigVerify(signature, message, publicKeys) {
+		t.Error("MuSig2 signature should verify")
+	}
+	aggregateKey, _ := MuSigKeyAgg(publicKeys)
+	if !SchnorrVerify(signature, message, aggregateKey) {
+		t.Error("MuSig2 signature should be a BIP340 signature of the aggregate key")
+	}
+	if MuSigVerify(signature, message, publicKeys[:2]) {
+		t.Error("MuSig2 signature should not verify without a signer")
+	}
+	if MuSigVerify(signature, message, [][]byte{publicKeys[1], publicKeys[0], publicKeys[2]}) {
+		t.Error("Aggregate key depends on the order of the keys")
+	}
+	outsider, _, _ := GenerateKey()
+	if _, err := session.Sign(&MuSigNonce{k1: nonces[1].k1}, outsider); err == nil {
+		t.Error("Key out of the session should not sign")
+	}
+}
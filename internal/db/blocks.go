@@ -0,0 +1,66 @@
+package db
+
+// DB methods related to blocks
+
+import (
+	"fmt"
+	"log"
+)
+
+// Saves a block and appends its transactions to the chain in one go
+// The head is looked up once for all of them, returns the block with its index range set
+func InsertBlock(block BlockDBItem, items []MainDBItem) BlockDBItem {
+	last := GetLastTransaction()
+	for i := range items {
+		items[i].Index = last.Index + 1
+		items[i].PrevHash = last.EntryHash
+		items[i].EntryHash = items[i].CalculateEntryHash()
+		last = items[i]
+	}
+	if len(items) > 0 {
+		block.First = items[0].Index
+		block.Last = last.Index
+	}
+
+	err := Current().InsertBlock(block, items)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return block
+}
+
+// Gets the block by its hash
+func GetBlock(hash []byte) BlockDBItem {
+	block, err := Current().GetBlock(hash)
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting block", err)
+	}
+	return block
+}
+
+// Gets the block at given height
+func GetBlockByHeight(height uint64) BlockDBItem {
+	block, err := Current().GetBlockByHeight(height)
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting block by height", err)
+	}
+	return block
+}
+
+// Gets the block holding the transaction at given index of the chain
+func GetBlockContaining(index uint64) BlockDBItem {
+	block, err := Current().GetBlockContaining(index)
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting block of transaction", err)
+	}
+	return block
+}
+
+// Gets the block with the highest height
+func GetLastBlock() BlockDBItem {
+	block, err := Current().GetLastBlock()
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting last block", err)
+	}
+	return block
+}
@@ -0,0 +1,428 @@
+package db
+
+// Embedded single file storage backend (bbolt)
+// Items are bson encoded like the mongo documents. Buckets:
+// - transactions              hash -> item
+// - transactions_index        index -> hash
+// - transactions_objecttype   object type + index -> hash
+// - transactions_organization organization tx + index -> hash
+// - blocks                    height -> block
+// - blocks_hash               hash -> height
+// - related_transactions      hash -> item
+// - keys                      address -> key
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	transactionsBucket       = []byte("transactions")
+	indexBucket              = []byte("transactions_index")
+	objectTypeBucket         = []byte("transactions_objecttype")
+	organizationBucket       = []byte("transactions_organization")
+	blocksBucket             = []byte("blocks")
+	blockHashBucket          = []byte("blocks_hash")
+	relatedTransactionBucket = []byte("related_transactions")
+	keysBucket               = []byte("keys")
+)
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the database file at given path
+func NewBoltStore(path string) (*BoltStore, error) {
+	boltDB, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure all buckets exist
+	err = boltDB.Update(func(btx *bolt.Tx) error {
+		for _, name := range [][]byte{transactionsBucket, indexBucket, objectTypeBucket, organizationBucket, blocksBucket, blockHashBucket, relatedTransactionBucket, keysBucket} {
+			if _, err := btx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltDB.Close()
+		return nil, err
+	}
+
+	return &BoltStore{boltDB}, nil
+}
+
+// Gets the transaction by its hash
+func (s *BoltStore) Get(txhash []byte) (MainDBItem, error) {
+	var dbItem MainDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return getItem(btx.Bucket(transactionsBucket), txhash, &dbItem)
+	})
+	return dbItem, err
+}
+
+// Gets the transaction at given index of the chain
+func (s *BoltStore) GetByIndex(index uint64) (MainDBItem, error) {
+	var dbItem MainDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		hash := btx.Bucket(indexBucket).Get(uint64Key(index))
+		if hash == nil {
+			return ErrNotFound
+		}
+		return getItem(btx.Bucket(transactionsBucket), hash, &dbItem)
+	})
+	return dbItem, err
+}
+
+// Gets the transaction with the highest index
+func (s *BoltStore) GetLastTransaction() (MainDBItem, error) {
+	var lastDbItem MainDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		_, hash := btx.Bucket(indexBucket).Cursor().Last()
+		if hash == nil {
+			return ErrNotFound
+		}
+		return getItem(btx.Bucket(transactionsBucket), hash, &lastDbItem)
+	})
+	return lastDbItem, err
+}
+
+// Get transactions of an object type in chain order
+func (s *BoltStore) GetByObjectType(objectType byte) ([]MainDBItem, error) {
+	return s.scanIndex(objectTypeBucket, []byte{objectType})
+}
+
+// Get transactions referring to an organization in chain order
+func (s *BoltStore) GetByOrganization(organizationTx []byte) ([]MainDBItem, error) {
+	return s.scanIndex(organizationBucket, organizationTx)
+}
+
+// Saves a transaction as is and updates indexes
+func (s *BoltStore) Insert(dbItem MainDBItem) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return putItem(btx, dbItem)
+	})
+}
+
+// Removes the transactions from given index to the head along with their indexes
+func (s *BoltStore) RemoveFrom(index uint64) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return removeFrom(btx, index)
+	})
+}
+
+// Replaces the transactions from given index to the head in a single database transaction
+func (s *BoltStore) ReplaceFrom(index uint64, items []MainDBItem) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		if err := removeFrom(btx, index); err != nil {
+			return err
+		}
+		for _, v := range items {
+			if err := putItem(btx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Saves a block along with its transactions in a single database transaction
+func (s *BoltStore) InsertBlock(block BlockDBItem, items []MainDBItem) error {
+	encoded, err := bson.Marshal(block)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(btx *bolt.Tx) error {
+		for _, v := range items {
+			if err := putItem(btx, v); err != nil {
+				return err
+			}
+		}
+		height := uint64Key(block.Height)
+		if err := btx.Bucket(blocksBucket).Put(height, encoded); err != nil {
+			return err
+		}
+		return btx.Bucket(blockHashBucket).Put(block.Hash, height)
+	})
+}
+
+// Gets the block by its hash
+func (s *BoltStore) GetBlock(hash []byte) (BlockDBItem, error) {
+	var block BlockDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		height := btx.Bucket(blockHashBucket).Get(hash)
+		if height == nil {
+			return ErrNotFound
+		}
+		return getItem(btx.Bucket(blocksBucket), height, &block)
+	})
+	return block, err
+}
+
+// Gets the block at given height
+func (s *BoltStore) GetBlockByHeight(height uint64) (BlockDBItem, error) {
+	var block BlockDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return getItem(btx.Bucket(blocksBucket), uint64Key(height), &block)
+	})
+	return block, err
+}
+
+// Gets the block holding the transaction at given index of the chain
+// Blocks hold increasing index ranges, the first one ending at or after the index is the candidate
+func (s *BoltStore) GetBlockContaining(index uint64) (BlockDBItem, error) {
+	var block BlockDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		c := btx.Bucket(blocksBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := bson.Unmarshal(copyBytes(v), &block); err != nil {
+				return err
+			}
+			if block.Last >= index {
+				if block.First <= index {
+					return nil
+				}
+				break
+			}
+		}
+		block = BlockDBItem{}
+		return ErrNotFound
+	})
+	return block, err
+}
+
+// Gets the block with the highest height
+func (s *BoltStore) GetLastBlock() (BlockDBItem, error) {
+	var block BlockDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		height, _ := btx.Bucket(blocksBucket).Cursor().Last()
+		if height == nil {
+			return ErrNotFound
+		}
+		return getItem(btx.Bucket(blocksBucket), height, &block)
+	})
+	return block, err
+}
+
+// Saves a transaction related to this account
+func (s *BoltStore) InsertRelated(dbItem MainDBItem) error {
+	encoded, err := bson.Marshal(dbItem)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(relatedTransactionBucket).Put(dbItem.Hash, encoded)
+	})
+}
+
+func (s *BoltStore) CountNumberOfTransactions() (int64, error) {
+	return s.count(transactionsBucket)
+}
+
+// Gets a single keypair by its given name
+func (s *BoltStore) GetKeyByName(name string) (KeyDBItem, error) {
+	keys, err := s.filterKeys(func(key KeyDBItem) bool { return key.Name == name })
+	if err != nil {
+		return KeyDBItem{}, err
+	}
+	if len(keys) == 0 {
+		return KeyDBItem{}, ErrNotFound
+	}
+	return keys[0], nil
+}
+
+// GetsKeyByDerivationPath fetches a list of keys with given a derivation path
+func (s *BoltStore) GetsKeyByDerivationPath(derivationPath string) ([]KeyDBItem, error) {
+	return s.filterKeys(func(key KeyDBItem) bool { return key.DerivationPath == derivationPath })
+}
+
+// Get all keypairs in this account as a list
+func (s *BoltStore) GetKeyPairs() ([]KeyDBItem, error) {
+	return s.filterKeys(func(key KeyDBItem) bool { return true })
+}
+
+// Add new key to the account
+func (s *BoltStore) AddKey(keyDBItem KeyDBItem) error {
+	encoded, err := bson.Marshal(keyDBItem)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(keysBucket).Put([]byte(keyDBItem.Address), encoded)
+	})
+}
+
+func (s *BoltStore) CountNumberOfKeys() (int64, error) {
+	return s.count(keysBucket)
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// putItem saves a transaction as is and updates indexes
+func putItem(btx *bolt.Tx, dbItem MainDBItem) error {
+	encoded, err := bson.Marshal(dbItem)
+	if err != nil {
+		return err
+	}
+	if err := btx.Bucket(transactionsBucket).Put(dbItem.Hash, encoded); err != nil {
+		return err
+	}
+	index := uint64Key(dbItem.Index)
+	if err := btx.Bucket(indexBucket).Put(index, dbItem.Hash); err != nil {
+		return err
+	}
+	if err := btx.Bucket(objectTypeBucket).Put(concat([]byte{dbItem.ObjectType}, index), dbItem.Hash); err != nil {
+		return err
+	}
+	if len(dbItem.OrganizationTransaction) > 0 {
+		return btx.Bucket(organizationBucket).Put(concat(dbItem.OrganizationTransaction, index), dbItem.Hash)
+	}
+	return nil
+}
+
+// removeFrom removes the transactions from given index on, their indexes and blocks
+func removeFrom(btx *bolt.Tx, index uint64) error {
+	items := btx.Bucket(transactionsBucket)
+	indexes := btx.Bucket(indexBucket)
+	var keys, hashes [][]byte
+	c := indexes.Cursor()
+	for k, hash := c.Seek(uint64Key(index)); k != nil; k, hash = c.Next() {
+		keys = append(keys, copyBytes(k))
+		hashes = append(hashes, copyBytes(hash))
+	}
+
+	// cursors do not survive deletes, remove after the scan
+	if err := removeBlocks(btx, index); err != nil {
+		return err
+	}
+	for i, hash := range hashes {
+		var dbItem MainDBItem
+		if err := getItem(items, hash, &dbItem); err != nil {
+			return err
+		}
+		if err := btx.Bucket(objectTypeBucket).Delete(concat([]byte{dbItem.ObjectType}, keys[i])); err != nil {
+			return err
+		}
+		if len(dbItem.OrganizationTransaction) > 0 {
+			if err := btx.Bucket(organizationBucket).Delete(concat(dbItem.OrganizationTransaction, keys[i])); err != nil {
+				return err
+			}
+		}
+		if err := indexes.Delete(keys[i]); err != nil {
+			return err
+		}
+		if err := items.Delete(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBlocks removes the blocks holding transactions from given index on
+func removeBlocks(btx *bolt.Tx, index uint64) error {
+	blocks := btx.Bucket(blocksBucket)
+	var heights, hashes [][]byte
+	err := blocks.ForEach(func(k, v []byte) error {
+		var block BlockDBItem
+		if err := bson.Unmarshal(copyBytes(v), &block); err != nil {
+			return err
+		}
+		if block.Last >= index {
+			heights = append(heights, copyBytes(k))
+			hashes = append(hashes, block.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range heights {
+		if err := blocks.Delete(heights[i]); err != nil {
+			return err
+		}
+		if err := btx.Bucket(blockHashBucket).Delete(hashes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanIndex returns the transactions pointed by index entries starting with prefix
+func (s *BoltStore) scanIndex(bucket []byte, prefix []byte) ([]MainDBItem, error) {
+	var transactions []MainDBItem
+	err := s.db.View(func(btx *bolt.Tx) error {
+		items := btx.Bucket(transactionsBucket)
+		c := btx.Bucket(bucket).Cursor()
+		for k, hash := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, hash = c.Next() {
+			var dbItem MainDBItem
+			if err := getItem(items, hash, &dbItem); err != nil {
+				return err
+			}
+			transactions = append(transactions, dbItem)
+		}
+		return nil
+	})
+	return transactions, err
+}
+
+// filterKeys returns the keys matching given function
+func (s *BoltStore) filterKeys(match func(KeyDBItem) bool) ([]KeyDBItem, error) {
+	var keys = []KeyDBItem{}
+	err := s.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(keysBucket).ForEach(func(_, v []byte) error {
+			var key KeyDBItem
+			if err := bson.Unmarshal(copyBytes(v), &key); err != nil {
+				return err
+			}
+			if match(key) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (s *BoltStore) count(bucket []byte) (int64, error) {
+	var count int64
+	err := s.db.View(func(btx *bolt.Tx) error {
+		count = int64(btx.Bucket(bucket).Stats().KeyN)
+		return nil
+	})
+	return count, err
+}
+
+func getItem(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	encoded := bucket.Get(key)
+	if encoded == nil {
+		return ErrNotFound
+	}
+	// bolt owned memory is only valid during the transaction
+	return bson.Unmarshal(copyBytes(encoded), v)
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+func uint64Key(i uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, i)
+	return key
+}
+
+func concat(a []byte, b []byte) []byte {
+	return append(copyBytes(a), b...)
+}
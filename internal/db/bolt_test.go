@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "themachine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltStore(filepath.Join(dir, "themachine.db"))
+	if err != nil {
+		t.Fatal("Cannot open bolt store", err)
+	}
+	defer s.Close()
+
+	organizationTx := bytes.Repeat([]byte{1}, 32)
+	items := []MainDBItem{
+		{Index: 1, Hash: organizationTx, ObjectType: 0x00, Date: time.Now()},
+		{Index: 2, Hash: bytes.Repeat([]byte{2}, 32), ObjectType: 0x01, OrganizationTransaction: organizationTx, Date: time.Now()},
+		{Index: 3, Hash: bytes.Repeat([]byte{3}, 32), ObjectType: 0x01, OrganizationTransaction: organizationTx, Date: time.Now()},
+	}
+	for _, v := range items {
+		if err := s.Insert(v); err != nil {
+			t.Fatal("Cannot insert transaction", err)
+		}
+	}
+
+	tx, err := s.Get(items[1].Hash)
+	if err != nil || !bytes.Equal(tx.Hash, items[1].Hash) {
+		t.Error("Cannot get transaction by hash", err)
+	}
+
+	last, err := s.GetLastTransaction()
+	if err != nil || last.Index != 3 {
+		t.Error("Last transaction is not the one with highest index", last.Index, err)
+	}
+
+	byIndex, err := s.GetByIndex(2)
+	if err != nil || !bytes.Equal(byIndex.Hash, items[1].Hash) {
+		t.Error("Cannot get transaction by index", err)
+	}
+
+	files, err := s.GetByObjectType(0x01)
+	if err != nil || len(files) != 2 || files[0].Index != 2 {
+		t.Error("Wrong transactions by object type", len(files), err)
+	}
+
+	related, err := s.GetByOrganization(organizationTx)
+	if err != nil || len(related) != 2 {
+		t.Error("Wrong transactions by organization", len(related), err)
+	}
+
+	_, err = s.Get([]byte("missing"))
+	if err != ErrNotFound {
+		t.Error("Missing transaction should not be found", err)
+	}
+
+	// reorganization drops the head along with its indexes
+	if err = s.RemoveFrom(3); err != nil {
+		t.Fatal("Cannot remove transactions", err)
+	}
+	last, err = s.GetLastTransaction()
+	if err != nil || last.Index != 2 {
+		t.Error("Removed transaction is still the last one", last.Index, err)
+	}
+	if _, err = s.Get(items[2].Hash); err != ErrNotFound {
+		t.Error("Removed transaction should not be found", err)
+	}
+	if related, _ = s.GetByOrganization(organizationTx); len(related) != 1 {
+		t.Error("Removed transaction is still indexed by organization", len(related))
+	}
+	if count, _ := s.CountNumberOfTransactions(); count != 2 {
+		t.Error("Wrong number of transactions after removal", count)
+	}
+
+	// blocks are saved with their transactions and dropped with them
+	block := BlockDBItem{Height: 1, Hash: bytes.Repeat([]byte{9}, 32), First: 3, Last: 3, Timestamp: time.Now()}
+	if err = s.InsertBlock(block, items[2:]); err != nil {
+		t.Fatal("Cannot insert block", err)
+	}
+	if last, _ = s.GetLastTransaction(); last.Index != 3 {
+		t.Error("Transactions of the block are not saved", last.Index)
+	}
+	if b, err := s.GetBlock(block.Hash); err != nil || b.Height != 1 || b.Last != 3 {
+		t.Error("Cannot get block by hash", err)
+	}
+	if b, err := s.GetBlockByHeight(1); err != nil || !bytes.Equal(b.Hash, block.Hash) {
+		t.Error("Cannot get block by height", err)
+	}
+	if b, err := s.GetLastBlock(); err != nil || b.Height != 1 {
+		t.Error("Cannot get last block", err)
+	}
+	if b, err := s.GetBlockContaining(3); err != nil || b.Height != 1 {
+		t.Error("Cannot get block of transaction", err)
+	}
+	if _, err := s.GetBlockContaining(2); err != ErrNotFound {
+		t.Error("Transaction out of blocks should have no block", err)
+	}
+	if err = s.RemoveFrom(3); err != nil {
+		t.Fatal("Cannot remove transactions", err)
+	}
+	if _, err = s.GetBlock(block.Hash); err != ErrNotFound {
+		t.Error("Block of removed transactions should not be found", err)
+	}
+	if _, err = s.GetLastBlock(); err != ErrNotFound {
+		t.Error("No block should be left", err)
+	}
+
+	// a branch replaces the head at once
+	replacement := MainDBItem{Index: 2, Hash: bytes.Repeat([]byte{4}, 32), ObjectType: 0x02, Date: time.Now()}
+	if err = s.ReplaceFrom(2, []MainDBItem{replacement}); err != nil {
+		t.Fatal("Cannot replace transactions", err)
+	}
+	if byIndex, _ = s.GetByIndex(2); !bytes.Equal(byIndex.Hash, replacement.Hash) {
+		t.Error("Transaction is not replaced", byIndex.Index)
+	}
+	if _, err = s.Get(items[1].Hash); err != ErrNotFound {
+		t.Error("Replaced transaction should not be found", err)
+	}
+	if files, _ = s.GetByObjectType(0x01); len(files) != 0 {
+		t.Error("Replaced transaction is still indexed by object type", len(files))
+	}
+
+	// keys
+	err = s.AddKey(KeyDBItem{Name: "Node", DerivationPath: "0", Address: "address", PublicKey: []byte{2}})
+	if err != nil {
+		t.Fatal("Cannot add key", err)
+	}
+	key, err := s.GetKeyByName("Node")
+	if err != nil || key.Address != "address" {
+		t.Error("Cannot get key by name", err)
+	}
+	count, err := s.CountNumberOfKeys()
+	if err != nil || count != 1 {
+		t.Error("Wrong number of keys", count, err)
+	}
+}
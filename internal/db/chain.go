@@ -0,0 +1,53 @@
+package db
+
+// Hash linked chain
+// Every saved transaction is an entry of the chain. The entry hash covers the index, the hash
+// of the previous entry, the transaction hash (thus its body), the signatures and the date it was saved.
+// Changing or removing any entry breaks the links of all the following ones, see transaction.VerifyChain
+
+import (
+	"encoding/binary"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+// CalculateEntryHash returns the hash of the entry
+// index (8) + date in milliseconds (8) + previous entry hash + transaction hash + signatures
+// + aggregate signature if any
+// Milliseconds since every backend keeps the date at least to the millisecond
+func (item MainDBItem) CalculateEntryHash() []byte {
+	buf := make([]byte, 16, 256)
+	binary.BigEndian.PutUint64(buf[0:8], item.Index)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(item.Date.UnixNano()/1e6))
+	buf = appendBytes(buf, item.PrevHash)
+	buf = appendBytes(buf, item.Hash)
+
+	buf = appendCount(buf, len(item.Signatures))
+	for i := range item.Signatures {
+		buf = appendBytes(buf, item.Signatures[i])
+		buf = appendBytes(buf, at(item.PublicKeys, i))
+		buf = appendBytes(buf, at(item.DerivationPaths, i))
+	}
+	if len(item.AggregateSignature) != 0 {
+		buf = appendBytes(buf, item.AggregateSignature)
+	}
+	return crypto.DHash(buf)
+}
+
+// length prefixed so that no two entries encode the same
+func appendBytes(buf []byte, b []byte) []byte {
+	return append(appendCount(buf, len(b)), b...)
+}
+
+func appendCount(buf []byte, n int) []byte {
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(n))
+	return append(buf, count[:]...)
+}
+
+func at(list [][]byte, i int) []byte {
+	if i < len(list) {
+		return list[i]
+	}
+	return nil
+}
@@ -1,35 +1,50 @@
 package db
 
+// Storage layer of the node
+// All persistence goes through the Store interface so that the backend
+// (MongoDB or the embedded bolt file) is chosen at startup instead of being wired in on import.
+// Package level functions in transactions.go and keys.go operate on the
+// store selected via Use.
+
 import (
-	"context"
-	"fmt"
+	"errors"
 	"log"
+	"sync"
 	"time"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var MainDBClient mongo.Collection
-var RelDBClient mongo.Collection
-var KeyDBClient mongo.Collection
-
 // Transaction structure
 type MainDBItem struct {
 	Index                   uint64
 	Hash                    []byte
-	PrevHash                []byte
+	PrevHash                []byte // entry hash of the previous transaction
+	EntryHash               []byte // links the transaction to the chain, see CalculateEntryHash
 	Date                    time.Time
 	ObjectType              byte
-	SubType                 byte
+	SubType                 string
 	Data                    []byte
 	Targets                 []string
 	Signatures              [][]byte
 	PublicKeys              [][]byte
 	DerivationPaths         [][]byte
+	AggregateSignature      []byte // of the signers with an empty signature, see transaction.Aggregate
+	Scheme                  byte   // signature scheme, see crypto.SchemeID
 	OrganizationTransaction []byte // Genesis transaction of the organization referred by this transaction
 }
 
+// Block structure, its transactions are the ones at First .. Last of the chain
+type BlockDBItem struct {
+	Height     uint64
+	Hash       []byte
+	PrevHash   []byte // hash of the previous block
+	Timestamp  time.Time
+	MerkleRoot []byte
+	Sealer     []byte // public key of the node that built the block
+	Signature  []byte
+	First      uint64
+	Last       uint64
+}
+
 // Key structure
 type KeyDBItem struct {
 	Name           string
@@ -39,25 +54,72 @@ type KeyDBItem struct {
 	EncPrivateKey  []byte
 }
 
-// Connect to db on init
-func init() {
-	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		log.Fatal(err)
-	}
+// Store is implemented by every storage backend
+type Store interface {
+	// main chain of all verified transactions
+	Get(txhash []byte) (MainDBItem, error)
+	GetByIndex(index uint64) (MainDBItem, error)
+	GetLastTransaction() (MainDBItem, error)
+	GetByObjectType(objectType byte) ([]MainDBItem, error)
+	GetByOrganization(organizationTx []byte) ([]MainDBItem, error)
+	Insert(dbItem MainDBItem) error
+	RemoveFrom(index uint64) error                      // removes the transactions from index to the head and their blocks, see transaction.Reorganize
+	ReplaceFrom(index uint64, items []MainDBItem) error // RemoveFrom and Insert of the items at once, nothing changes on error
+	CountNumberOfTransactions() (int64, error)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	// blocks of transactions, see internal/block
+	InsertBlock(block BlockDBItem, items []MainDBItem) error // saves the block along with its transactions at once
+	GetBlock(hash []byte) (BlockDBItem, error)
+	GetBlockByHeight(height uint64) (BlockDBItem, error)
+	GetLastBlock() (BlockDBItem, error)
+	GetBlockContaining(index uint64) (BlockDBItem, error) // block of the transaction at given index
 
-	err = client.Connect(ctx)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// transactions related to our keys, verified or not
+	InsertRelated(dbItem MainDBItem) error
+
+	// the keys consisting the account of this node
+	GetKeyByName(name string) (KeyDBItem, error)
+	GetsKeyByDerivationPath(derivationPath string) ([]KeyDBItem, error)
+	GetKeyPairs() ([]KeyDBItem, error)
+	AddKey(keyDBItem KeyDBItem) error
+	CountNumberOfKeys() (int64, error)
+
+	Close() error
+}
+
+// ErrNotFound is returned by stores when a lookup has no result
+var ErrNotFound = errors.New("Not found")
 
-	// store db access
-	MainDBClient = *client.Database("themachine").Collection("transactions")        // main chain of all verified transactions
-	RelDBClient = *client.Database("themachine").Collection("related_transactions") // transactions related to our keys, verified or not
-	KeyDBClient = *client.Database("themachine").Collection("keys")                 // the keys consisting the account of this node
+var (
+	storeMu sync.RWMutex
+	store   Store
+)
+
+// Use selects the storage backend. To be called once at startup
+func Use(s Store) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
+}
 
-	fmt.Println("Connected to The Machine db ")
+// Current returns the selected storage backend
+func Current() Store {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if store == nil {
+		log.Fatal("No storage backend selected")
+	}
+	return store
+}
+
+// Close closes the selected storage backend, if any
+func Close() error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store == nil {
+		return nil
+	}
+	err := store.Close()
+	store = nil
+	return err
 }
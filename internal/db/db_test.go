@@ -2,12 +2,31 @@ package db
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"os"
 	"testing"
-
-	"github.com/gobuffalo/packr/v2/file/resolver/encoding/hex"
+	"time"
 )
 
+var genesisHash, _ = hex.DecodeString("2b3fb3187a38410fa07b7d564d8e8dabc0d0494d748d4b38a94e82ebfe83d923")
+
+func TestMain(m *testing.M) {
+	Use(NewMemoryStore())
+	seed()
+	os.Exit(m.Run())
+}
+
+// seed fills the selected store with fixtures
+func seed() {
+	AddKey("Node", "0", "node address", []byte{2}, []byte{})
+	AddKey("Organization", "1/5", "organization address", []byte{3}, []byte{})
+
+	now := time.Now()
+	Insert(MainDBItem{Hash: genesisHash, Date: now, ObjectType: 0x00, Data: []byte("{}")})
+	Insert(MainDBItem{Hash: bytes.Repeat([]byte{1}, 32), Date: now.Add(time.Second), ObjectType: 0x01, Data: []byte("file"), OrganizationTransaction: genesisHash})
+}
+
 func TestKeys(t *testing.T) {
 
 	count := CountNumberOfKeys()
@@ -40,9 +59,8 @@ func TestTransactions(t *testing.T) {
 	}
 	fmt.Println("Number of transactions: ", count)
 
-	txHashBytes, _ := hex.DecodeString("2b3fb3187a38410fa07b7d564d8e8dabc0d0494d748d4b38a94e82ebfe83d923")
-	tx := Get(txHashBytes)
-	if !bytes.Equal(tx.Hash, txHashBytes) {
+	tx := Get(genesisHash)
+	if !bytes.Equal(tx.Hash, genesisHash) {
 		t.Error("Tx hash does not match")
 	}
 
@@ -50,4 +68,57 @@ func TestTransactions(t *testing.T) {
 	if len(txs) == 0 {
 		t.Error("Could not find any genesis transactions")
 	}
+
+	txs = GetByOrganization(genesisHash)
+	if len(txs) != 1 {
+		t.Error("Could not find the organization's transaction")
+	}
+}
+
+func TestInsertLinksTransactions(t *testing.T) {
+
+	genesis := GetByIndex(1)
+	if !bytes.Equal(genesis.Hash, genesisHash) {
+		t.Error("Genesis is not the first transaction")
+	}
+	if len(genesis.PrevHash) != 0 || !bytes.Equal(genesis.EntryHash, genesis.CalculateEntryHash()) {
+		t.Error("Genesis entry hash is wrong", genesis.PrevHash, genesis.EntryHash)
+	}
+
+	last := GetLastTransaction()
+	if last.Index != 2 || !bytes.Equal(last.PrevHash, genesis.EntryHash) {
+		t.Error("Last transaction is not linked to the previous one", last.Index, last.PrevHash)
+	}
+	if !bytes.Equal(last.EntryHash, last.CalculateEntryHash()) {
+		t.Error("Entry hash is wrong", last.EntryHash)
+	}
+}
+
+func TestInsertBlock(t *testing.T) {
+	previous := Current()
+	Use(NewMemoryStore())
+	defer Use(previous)
+
+	now := time.Now()
+	Insert(MainDBItem{Hash: genesisHash, Date: now, ObjectType: 0x00, Data: []byte("{}")})
+	items := []MainDBItem{
+		{Hash: bytes.Repeat([]byte{1}, 32), Date: now, ObjectType: 0x01, OrganizationTransaction: genesisHash},
+		{Hash: bytes.Repeat([]byte{2}, 32), Date: now, ObjectType: 0x01, OrganizationTransaction: genesisHash},
+	}
+	block := InsertBlock(BlockDBItem{Height: 1, Hash: bytes.Repeat([]byte{9}, 32), Timestamp: now}, items)
+	if block.First != 2 || block.Last != 3 {
+		t.Error("Wrong index range of the block", block.First, block.Last)
+	}
+
+	prev := GetByIndex(1)
+	for i := uint64(2); i <= 3; i++ {
+		item := GetByIndex(i)
+		if !bytes.Equal(item.PrevHash, prev.EntryHash) || !bytes.Equal(item.EntryHash, item.CalculateEntryHash()) {
+			t.Error("Transaction of the block is not linked", i)
+		}
+		prev = item
+	}
+	if last := GetLastBlock(); last.Height != 1 || !bytes.Equal(GetBlockByHeight(1).Hash, block.Hash) {
+		t.Error("Block is not saved", last.Height)
+	}
 }
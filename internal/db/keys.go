@@ -8,64 +8,36 @@ package db
 // - CountNumberOfKeys        Dummy
 
 import (
-	"context"
 	"fmt"
 	"log"
-
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Gets a single keypair by its given name
 func GetKeyByName(name string) KeyDBItem {
-	var key KeyDBItem
-	filter := bson.M{"name": name}
-	KeyDBClient.FindOne(context.TODO(), filter).Decode(&key)
+	key, err := Current().GetKeyByName(name)
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting key", err)
+	}
 	return key
 }
 
 // GetsKeyByDerivationPath fetches a list of keys with given a derivation path
 func GetsKeyByDerivationPath(derivationPath string) []KeyDBItem {
-	var keys = []KeyDBItem{}
-
-	filter := bson.M{"derivationpath": derivationPath}
-	cur, err := KeyDBClient.Find(context.TODO(), filter)
+	keys, err := Current().GetsKeyByDerivationPath(derivationPath)
 	if err != nil {
 		fmt.Println("ERROR")
 		log.Fatal(err)
 	}
-
-	for i := 0; cur.Next(context.TODO()); {
-		keys = append(keys, KeyDBItem{})
-		err := cur.Decode(&keys[i])
-		if err != nil {
-			log.Fatal(err)
-		}
-		i++
-	}
-
 	return keys
 }
 
 // Get all keypairs in this account as a list
 func GetKeyPairs() []KeyDBItem {
-	var accountKeys = []KeyDBItem{}
-
-	filter := bson.D{}
-	cur, err := KeyDBClient.Find(context.TODO(), filter)
+	accountKeys, err := Current().GetKeyPairs()
 	if err != nil {
 		fmt.Println("ERROR")
 		log.Fatal(err)
 	}
-
-	for i := 0; cur.Next(context.TODO()); {
-		accountKeys = append(accountKeys, KeyDBItem{})
-		err := cur.Decode(&accountKeys[i])
-		if err != nil {
-			log.Fatal(err)
-		}
-		i++
-	}
-
 	return accountKeys
 }
 
@@ -79,15 +51,14 @@ func AddKey(name string, derivationPath string, address string, publicKey []byte
 		encPrivateKey,
 	}
 
-	_, err := KeyDBClient.InsertOne(context.TODO(), keyDBItem)
+	err := Current().AddKey(keyDBItem)
 	if err != nil {
 		log.Fatal(err)
 	}
-
 }
 
 func CountNumberOfKeys() int64 {
-	count, err := KeyDBClient.CountDocuments(context.TODO(), bson.M{})
+	count, err := Current().CountNumberOfKeys()
 	if err != nil {
 		fmt.Println("Cannot count keys")
 	}
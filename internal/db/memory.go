@@ -0,0 +1,243 @@
+package db
+
+// In-memory storage backend for tests and ephemeral nodes
+// Nothing is persisted, query semantics follow the mongo backend
+
+import (
+	"bytes"
+	"sync"
+)
+
+type MemoryStore struct {
+	mu           sync.RWMutex
+	transactions []MainDBItem // main chain of all verified transactions
+	blocks       []BlockDBItem
+	related      []MainDBItem // transactions related to our keys, verified or not
+	keys         []KeyDBItem  // the keys consisting the account of this node
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Gets the transaction by its hash
+func (s *MemoryStore) Get(txhash []byte) (MainDBItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.transactions {
+		if bytes.Equal(v.Hash, txhash) {
+			return v, nil
+		}
+	}
+	return MainDBItem{}, ErrNotFound
+}
+
+// Gets the transaction at given index of the chain
+func (s *MemoryStore) GetByIndex(index uint64) (MainDBItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.transactions {
+		if v.Index == index {
+			return v, nil
+		}
+	}
+	return MainDBItem{}, ErrNotFound
+}
+
+// Gets the last transaction, the one with the highest index
+func (s *MemoryStore) GetLastTransaction() (MainDBItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.transactions) == 0 {
+		return MainDBItem{}, ErrNotFound
+	}
+	last := s.transactions[0]
+	for _, v := range s.transactions[1:] {
+		if v.Index > last.Index {
+			last = v
+		}
+	}
+	return last, nil
+}
+
+// Get transactions of an object type
+func (s *MemoryStore) GetByObjectType(objectType byte) ([]MainDBItem, error) {
+	return s.filterTransactions(func(item MainDBItem) bool { return item.ObjectType == objectType }), nil
+}
+
+// Get transactions referring to an organization
+func (s *MemoryStore) GetByOrganization(organizationTx []byte) ([]MainDBItem, error) {
+	return s.filterTransactions(func(item MainDBItem) bool {
+		return bytes.Equal(item.OrganizationTransaction, organizationTx)
+	}), nil
+}
+
+// Saves a transaction as is
+func (s *MemoryStore) Insert(dbItem MainDBItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transactions = append(s.transactions, dbItem)
+	return nil
+}
+
+// Removes the transactions from given index to the head
+func (s *MemoryStore) RemoveFrom(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeFrom(index)
+	return nil
+}
+
+// Replaces the transactions from given index to the head
+func (s *MemoryStore) ReplaceFrom(index uint64, items []MainDBItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeFrom(index)
+	s.transactions = append(s.transactions, items...)
+	return nil
+}
+
+// removeFrom drops the transactions from index on and their blocks, s.mu is held
+func (s *MemoryStore) removeFrom(index uint64) {
+	var kept []MainDBItem
+	for _, v := range s.transactions {
+		if v.Index < index {
+			kept = append(kept, v)
+		}
+	}
+	s.transactions = kept
+
+	var blocks []BlockDBItem
+	for _, v := range s.blocks {
+		if v.Last < index {
+			blocks = append(blocks, v)
+		}
+	}
+	s.blocks = blocks
+}
+
+// Saves a block along with its transactions
+func (s *MemoryStore) InsertBlock(block BlockDBItem, items []MainDBItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transactions = append(s.transactions, items...)
+	s.blocks = append(s.blocks, block)
+	return nil
+}
+
+// Gets the block by its hash
+func (s *MemoryStore) GetBlock(hash []byte) (BlockDBItem, error) {
+	return s.findBlock(func(block BlockDBItem) bool { return bytes.Equal(block.Hash, hash) })
+}
+
+// Gets the block at given height
+func (s *MemoryStore) GetBlockByHeight(height uint64) (BlockDBItem, error) {
+	return s.findBlock(func(block BlockDBItem) bool { return block.Height == height })
+}
+
+// Gets the block holding the transaction at given index of the chain
+func (s *MemoryStore) GetBlockContaining(index uint64) (BlockDBItem, error) {
+	return s.findBlock(func(block BlockDBItem) bool { return block.First <= index && index <= block.Last })
+}
+
+// Gets the block with the highest height
+func (s *MemoryStore) GetLastBlock() (BlockDBItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blocks) == 0 {
+		return BlockDBItem{}, ErrNotFound
+	}
+	last := s.blocks[0]
+	for _, v := range s.blocks[1:] {
+		if v.Height > last.Height {
+			last = v
+		}
+	}
+	return last, nil
+}
+
+// Saves a transaction related to this account
+func (s *MemoryStore) InsertRelated(dbItem MainDBItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.related = append(s.related, dbItem)
+	return nil
+}
+
+func (s *MemoryStore) CountNumberOfTransactions() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.transactions)), nil
+}
+
+// Gets a single keypair by its given name
+func (s *MemoryStore) GetKeyByName(name string) (KeyDBItem, error) {
+	keys := s.filterKeys(func(key KeyDBItem) bool { return key.Name == name })
+	if len(keys) == 0 {
+		return KeyDBItem{}, ErrNotFound
+	}
+	return keys[0], nil
+}
+
+// GetsKeyByDerivationPath fetches a list of keys with given a derivation path
+func (s *MemoryStore) GetsKeyByDerivationPath(derivationPath string) ([]KeyDBItem, error) {
+	return s.filterKeys(func(key KeyDBItem) bool { return key.DerivationPath == derivationPath }), nil
+}
+
+// Get all keypairs in this account as a list
+func (s *MemoryStore) GetKeyPairs() ([]KeyDBItem, error) {
+	return s.filterKeys(func(key KeyDBItem) bool { return true }), nil
+}
+
+// Add new key to the account
+func (s *MemoryStore) AddKey(keyDBItem KeyDBItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, keyDBItem)
+	return nil
+}
+
+func (s *MemoryStore) CountNumberOfKeys() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.keys)), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) filterTransactions(match func(MainDBItem) bool) []MainDBItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var transactions []MainDBItem
+	for _, v := range s.transactions {
+		if match(v) {
+			transactions = append(transactions, v)
+		}
+	}
+	return transactions
+}
+
+func (s *MemoryStore) findBlock(match func(BlockDBItem) bool) (BlockDBItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.blocks {
+		if match(v) {
+			return v, nil
+		}
+	}
+	return BlockDBItem{}, ErrNotFound
+}
+
+func (s *MemoryStore) filterKeys(match func(KeyDBItem) bool) []KeyDBItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys = []KeyDBItem{}
+	for _, v := range s.keys {
+		if match(v) {
+			keys = append(keys, v)
+		}
+	}
+	return keys
+}
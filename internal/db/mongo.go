@@ -0,0 +1,257 @@
+package db
+
+// MongoDB storage backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const DefaultMongoURI = "mongodb://localhost:27017"
+
+type MongoStore struct {
+	client       *mongo.Client
+	mainDBClient *mongo.Collection
+	relDBClient  *mongo.Collection
+	blockClient  *mongo.Collection
+	keyDBClient  *mongo.Collection
+}
+
+// NewMongoStore connects to the mongo server at given uri
+func NewMongoStore(uri string) (*MongoStore, error) {
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Connected to The Machine db ")
+
+	database := client.Database("themachine")
+	return &MongoStore{
+		client:       client,
+		mainDBClient: database.Collection("transactions"),         // main chain of all verified transactions
+		relDBClient:  database.Collection("related_transactions"), // transactions related to our keys, verified or not
+		blockClient:  database.Collection("blocks"),               // blocks of the main chain transactions
+		keyDBClient:  database.Collection("keys"),                 // the keys consisting the account of this node
+	}, nil
+}
+
+// Gets the transaction by its hash
+func (s *MongoStore) Get(txhash []byte) (MainDBItem, error) {
+	var dbItem MainDBItem
+	filter := bson.M{"hash": txhash}
+	err := s.mainDBClient.FindOne(context.TODO(), filter).Decode(&dbItem)
+	return dbItem, mongoError(err)
+}
+
+// Gets the transaction at given index of the chain
+func (s *MongoStore) GetByIndex(index uint64) (MainDBItem, error) {
+	var dbItem MainDBItem
+	filter := bson.M{"index": index}
+	err := s.mainDBClient.FindOne(context.TODO(), filter).Decode(&dbItem)
+	return dbItem, mongoError(err)
+}
+
+// Gets the last transaction
+func (s *MongoStore) GetLastTransaction() (MainDBItem, error) {
+	var lastDbItem MainDBItem
+	filter := bson.D{}
+	findOneOptions := options.FindOne()
+	findOneOptions.SetSort(bson.D{primitive.E{Key: "index", Value: -1}})
+	err := s.mainDBClient.FindOne(context.TODO(), filter, findOneOptions).Decode(&lastDbItem)
+	return lastDbItem, mongoError(err)
+}
+
+// Get transactions of an object type
+func (s *MongoStore) GetByObjectType(objectType byte) ([]MainDBItem, error) {
+	var transactions []MainDBItem
+	filter := bson.M{"objecttype": objectType}
+	cur, err := s.mainDBClient.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(context.TODO(), &transactions)
+	return transactions, err
+}
+
+// Get transactions referring to an organization
+func (s *MongoStore) GetByOrganization(organizationTx []byte) ([]MainDBItem, error) {
+	var transactions []MainDBItem
+	filter := bson.M{"organizationtransaction": organizationTx}
+	cur, err := s.mainDBClient.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(context.TODO(), &transactions)
+	return transactions, err
+}
+
+// Saves a transaction as is
+func (s *MongoStore) Insert(dbItem MainDBItem) error {
+	_, err := s.mainDBClient.InsertOne(context.TODO(), dbItem)
+	return err
+}
+
+// Removes the transactions from given index to the head
+func (s *MongoStore) RemoveFrom(index uint64) error {
+	return s.removeFrom(context.TODO(), index)
+}
+
+// Replaces the transactions from given index to the head in a multi-document transaction,
+// which needs the server to be a replica set member
+func (s *MongoStore) ReplaceFrom(index uint64, items []MainDBItem) error {
+	return s.client.UseSession(context.TODO(), func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			if err := s.removeFrom(sc, index); err != nil {
+				return nil, err
+			}
+			if len(items) == 0 {
+				return nil, nil
+			}
+			documents := make([]interface{}, len(items))
+			for i, v := range items {
+				documents[i] = v
+			}
+			_, err := s.mainDBClient.InsertMany(sc, documents)
+			return nil, err
+		})
+		return err
+	})
+}
+
+func (s *MongoStore) removeFrom(ctx context.Context, index uint64) error {
+	filter := bson.M{"index": bson.M{"$gte": index}}
+	_, err := s.mainDBClient.DeleteMany(ctx, filter)
+	if err != nil {
+		return err
+	}
+	_, err = s.blockClient.DeleteMany(ctx, bson.M{"last": bson.M{"$gte": index}})
+	return err
+}
+
+// Saves a block along with its transactions
+func (s *MongoStore) InsertBlock(block BlockDBItem, items []MainDBItem) error {
+	if len(items) > 0 {
+		documents := make([]interface{}, len(items))
+		for i, v := range items {
+			documents[i] = v
+		}
+		if _, err := s.mainDBClient.InsertMany(context.TODO(), documents); err != nil {
+			return err
+		}
+	}
+	_, err := s.blockClient.InsertOne(context.TODO(), block)
+	return err
+}
+
+// Gets the block by its hash
+func (s *MongoStore) GetBlock(hash []byte) (BlockDBItem, error) {
+	var block BlockDBItem
+	err := s.blockClient.FindOne(context.TODO(), bson.M{"hash": hash}).Decode(&block)
+	return block, mongoError(err)
+}
+
+// Gets the block at given height
+func (s *MongoStore) GetBlockByHeight(height uint64) (BlockDBItem, error) {
+	var block BlockDBItem
+	err := s.blockClient.FindOne(context.TODO(), bson.M{"height": height}).Decode(&block)
+	return block, mongoError(err)
+}
+
+// Gets the block holding the transaction at given index of the chain
+func (s *MongoStore) GetBlockContaining(index uint64) (BlockDBItem, error) {
+	var block BlockDBItem
+	filter := bson.M{"first": bson.M{"$lte": index}, "last": bson.M{"$gte": index}}
+	err := s.blockClient.FindOne(context.TODO(), filter).Decode(&block)
+	return block, mongoError(err)
+}
+
+// Gets the block with the highest height
+func (s *MongoStore) GetLastBlock() (BlockDBItem, error) {
+	var block BlockDBItem
+	findOneOptions := options.FindOne()
+	findOneOptions.SetSort(bson.D{primitive.E{Key: "height", Value: -1}})
+	err := s.blockClient.FindOne(context.TODO(), bson.D{}, findOneOptions).Decode(&block)
+	return block, mongoError(err)
+}
+
+// Saves a transaction related to this account
+func (s *MongoStore) InsertRelated(dbItem MainDBItem) error {
+	_, err := s.relDBClient.InsertOne(context.TODO(), dbItem)
+	return err
+}
+
+func (s *MongoStore) CountNumberOfTransactions() (int64, error) {
+	return s.mainDBClient.CountDocuments(context.TODO(), bson.M{})
+}
+
+// Gets a single keypair by its given name
+func (s *MongoStore) GetKeyByName(name string) (KeyDBItem, error) {
+	var key KeyDBItem
+	filter := bson.M{"name": name}
+	err := s.keyDBClient.FindOne(context.TODO(), filter).Decode(&key)
+	return key, mongoError(err)
+}
+
+// GetsKeyByDerivationPath fetches a list of keys with given a derivation path
+func (s *MongoStore) GetsKeyByDerivationPath(derivationPath string) ([]KeyDBItem, error) {
+	var keys = []KeyDBItem{}
+	filter := bson.M{"derivationpath": derivationPath}
+	cur, err := s.keyDBClient.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(context.TODO(), &keys)
+	return keys, err
+}
+
+// Get all keypairs in this account as a list
+func (s *MongoStore) GetKeyPairs() ([]KeyDBItem, error) {
+	var accountKeys = []KeyDBItem{}
+	cur, err := s.keyDBClient.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(context.TODO(), &accountKeys)
+	return accountKeys, err
+}
+
+// Add new key to the account
+func (s *MongoStore) AddKey(keyDBItem KeyDBItem) error {
+	_, err := s.keyDBClient.InsertOne(context.TODO(), keyDBItem)
+	return err
+}
+
+func (s *MongoStore) CountNumberOfKeys() (int64, error) {
+	return s.keyDBClient.CountDocuments(context.TODO(), bson.M{})
+}
+
+func (s *MongoStore) Close() error {
+	return s.client.Disconnect(context.TODO())
+}
+
+// translate driver errors into store errors
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package db
+
+// Staged view of the chain
+// Shows the chain as it would be with its transactions from an index on replaced, without
+// writing anything. A branch is validated against it before the chain is replaced, see
+// transaction.Reorganize. The chain cannot be changed through it, everything else goes
+// to the store underneath. Readers of the selected store keep seeing the chain as it is.
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrStaged is returned for changes of the chain while it is staged
+var ErrStaged = errors.New("Chain is staged")
+
+type stagedStore struct {
+	Store
+	from  uint64
+	items []MainDBItem // entries from index from on
+}
+
+// Staged gets a view of the selected store with the transactions from index on replaced by items
+// Only the view shows them, the caller must keep writers of the chain out while using it
+func Staged(from uint64, items []MainDBItem) View {
+	return View{&stagedStore{Current(), from, items}}
+}
+
+func (s *stagedStore) Get(txhash []byte) (MainDBItem, error) {
+	for _, v := range s.items {
+		if bytes.Equal(v.Hash, txhash) {
+			return v, nil
+		}
+	}
+	dbItem, err := s.Store.Get(txhash)
+	if err == nil && dbItem.Index >= s.from {
+		return MainDBItem{}, ErrNotFound
+	}
+	return dbItem, err
+}
+
+func (s *stagedStore) GetByIndex(index uint64) (MainDBItem, error) {
+	if index < s.from {
+		return s.Store.GetByIndex(index)
+	}
+	if index-s.from < uint64(len(s.items)) {
+		return s.items[index-s.from], nil
+	}
+	return MainDBItem{}, ErrNotFound
+}
+
+func (s *stagedStore) GetLastTransaction() (MainDBItem, error) {
+	if len(s.items) > 0 {
+		return s.items[len(s.items)-1], nil
+	}
+	if s.from <= 1 {
+		return MainDBItem{}, ErrNotFound
+	}
+	last, err := s.Store.GetLastTransaction()
+	if err == nil && last.Index >= s.from {
+		return s.Store.GetByIndex(s.from - 1)
+	}
+	return last, err
+}
+
+func (s *stagedStore) GetByObjectType(objectType byte) ([]MainDBItem, error) {
+	transactions, err := s.Store.GetByObjectType(objectType)
+	return s.merge(transactions, func(item MainDBItem) bool { return item.ObjectType == objectType }), err
+}
+
+func (s *stagedStore) GetByOrganization(organizationTx []byte) ([]MainDBItem, error) {
+	transactions, err := s.Store.GetByOrganization(organizationTx)
+	return s.merge(transactions, func(item MainDBItem) bool {
+		return bytes.Equal(item.OrganizationTransaction, organizationTx)
+	}), err
+}
+
+// the chain is dense from index 1
+func (s *stagedStore) CountNumberOfTransactions() (int64, error) {
+	return int64(s.from-1) + int64(len(s.items)), nil
+}
+
+func (s *stagedStore) GetBlock(hash []byte) (BlockDBItem, error) {
+	return s.keptBlock(s.Store.GetBlock(hash))
+}
+
+func (s *stagedStore) GetBlockByHeight(height uint64) (BlockDBItem, error) {
+	return s.keptBlock(s.Store.GetBlockByHeight(height))
+}
+
+func (s *stagedStore) GetBlockContaining(index uint64) (BlockDBItem, error) {
+	return s.keptBlock(s.Store.GetBlockContaining(index))
+}
+
+// blocks reaching the staged entries are dropped, see RemoveFrom
+func (s *stagedStore) GetLastBlock() (BlockDBItem, error) {
+	block, err := s.Store.GetLastBlock()
+	for err == nil && block.Last >= s.from {
+		if block.Height == 0 {
+			return BlockDBItem{}, ErrNotFound
+		}
+		block, err = s.Store.GetBlockByHeight(block.Height - 1)
+	}
+	return block, err
+}
+
+func (s *stagedStore) Insert(dbItem MainDBItem) error {
+	return ErrStaged
+}
+
+func (s *stagedStore) RemoveFrom(index uint64) error {
+	return ErrStaged
+}
+
+func (s *stagedStore) ReplaceFrom(index uint64, items []MainDBItem) error {
+	return ErrStaged
+}
+
+func (s *stagedStore) InsertBlock(block BlockDBItem, items []MainDBItem) error {
+	return ErrStaged
+}
+
+// merge keeps the transactions before the staged ones and appends the matching staged ones
+func (s *stagedStore) merge(transactions []MainDBItem, match func(MainDBItem) bool) []MainDBItem {
+	var merged []MainDBItem
+	for _, v := range transactions {
+		if v.Index < s.from {
+			merged = append(merged, v)
+		}
+	}
+	for _, v := range s.items {
+		if match(v) {
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+func (s *stagedStore) keptBlock(block BlockDBItem, err error) (BlockDBItem, error) {
+	if err == nil && block.Last >= s.from {
+		return BlockDBItem{}, ErrNotFound
+	}
+	return block, err
+}
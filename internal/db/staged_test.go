@@ -0,0 +1,61 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStaged(t *testing.T) {
+	previous := Current()
+	Use(NewMemoryStore())
+	defer Use(previous)
+
+	now := time.Now()
+	Insert(MainDBItem{Hash: genesisHash, Date: now, ObjectType: 0x00})
+	Insert(MainDBItem{Hash: bytes.Repeat([]byte{1}, 32), Date: now, ObjectType: 0x01, OrganizationTransaction: genesisHash})
+	InsertBlock(BlockDBItem{Height: 1, Hash: bytes.Repeat([]byte{9}, 32), Timestamp: now},
+		[]MainDBItem{{Hash: bytes.Repeat([]byte{2}, 32), Date: now, ObjectType: 0x01, OrganizationTransaction: genesisHash}})
+
+	staged := []MainDBItem{
+		{Index: 2, Hash: bytes.Repeat([]byte{3}, 32), ObjectType: 0x02, OrganizationTransaction: genesisHash},
+		{Index: 3, Hash: bytes.Repeat([]byte{4}, 32), ObjectType: 0x02, OrganizationTransaction: genesisHash},
+		{Index: 4, Hash: bytes.Repeat([]byte{5}, 32), ObjectType: 0x01},
+	}
+	view := Staged(2, staged)
+	if last := view.GetLastTransaction(); last.Index != 4 || !bytes.Equal(last.Hash, staged[2].Hash) {
+		t.Error("Staged head is not the last transaction", last.Index)
+	}
+	if item := view.GetByIndex(2); !bytes.Equal(item.Hash, staged[0].Hash) {
+		t.Error("Staged transaction is not at its index", item.Index)
+	}
+	if len(view.Get(bytes.Repeat([]byte{1}, 32)).Hash) != 0 {
+		t.Error("Replaced transaction should not be found")
+	}
+	if len(view.Get(genesisHash).Hash) == 0 {
+		t.Error("Transaction before the staged ones should be found")
+	}
+	if txs := view.GetByOrganization(genesisHash); len(txs) != 2 || txs[0].Index != 2 {
+		t.Error("Wrong transactions by organization", len(txs))
+	}
+	if txs := view.GetByObjectType(0x01); len(txs) != 1 || txs[0].Index != 4 {
+		t.Error("Wrong transactions by object type", len(txs))
+	}
+	if count := view.CountNumberOfTransactions(); count != 4 {
+		t.Error("Wrong number of transactions", count)
+	}
+	if block, _ := view.store.GetLastBlock(); len(block.Hash) != 0 {
+		t.Error("Block of replaced transactions should not be found", block.Height)
+	}
+	if err := view.store.Insert(MainDBItem{Index: 5}); err != ErrStaged {
+		t.Error("Staged chain should not be changed", err)
+	}
+
+	// the selected store is not staged
+	if len(Get(bytes.Repeat([]byte{1}, 32)).Hash) == 0 || len(Get(staged[0].Hash).Hash) != 0 {
+		t.Error("Chain should be as it is while staged")
+	}
+	if last := GetLastTransaction(); last.Index != 3 || len(GetLastBlock().Hash) == 0 {
+		t.Error("Chain should be as it was after staging", last.Index)
+	}
+}
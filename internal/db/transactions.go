@@ -3,81 +3,160 @@ package db
 // DB methods related to transactions
 
 import (
-	"context"
 	"fmt"
 	"log"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// View reads the chain of a store, the functions below read the selected one through it
+type View struct {
+	store Store
+}
+
+// ViewOf gets a view of the chain in given store
+func ViewOf(store Store) View {
+	return View{store}
+}
+
+// CurrentView gets a view of the chain in the selected store
+func CurrentView() View {
+	return View{Current()}
+}
+
 // Gets the transaction by its hash
-func Get(txhash []byte) MainDBItem {
-	var dbItem MainDBItem
-	filter := bson.M{"hash": txhash}
-	MainDBClient.FindOne(context.TODO(), filter).Decode(&dbItem)
+func (v View) Get(txhash []byte) MainDBItem {
+	dbItem, err := v.store.Get(txhash)
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting transaction", err)
+	}
 	return dbItem
 }
 
-// Gets the last transaction
-func GetLastTransaction() MainDBItem {
-	var lastDbItem MainDBItem
-	filter := bson.D{}
-	findOneOptions := options.FindOne()
-	findOneOptions.SetSort(bson.D{primitive.E{Key: "date", Value: -1}})
-	MainDBClient.FindOne(context.TODO(), filter, findOneOptions).Decode(&lastDbItem)
+// Gets the transaction at given index of the chain
+func (v View) GetByIndex(index uint64) MainDBItem {
+	dbItem, err := v.store.GetByIndex(index)
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting transaction by index", err)
+	}
+	return dbItem
+}
+
+// Gets the last transaction, the one with the highest index
+func (v View) GetLastTransaction() MainDBItem {
+	lastDbItem, err := v.store.GetLastTransaction()
+	if err != nil && err != ErrNotFound {
+		fmt.Println("Error getting last transaction", err)
+	}
 	return lastDbItem
 }
 
 // Get organization transactions
-func GetByObjectType(objectType byte) []MainDBItem {
-	var transactions []MainDBItem
-	filter := bson.M{"objecttype": objectType}
-	cur, err := MainDBClient.Find(context.TODO(), filter)
+func (v View) GetByObjectType(objectType byte) []MainDBItem {
+	transactions, err := v.store.GetByObjectType(objectType)
 	if err != nil {
 		fmt.Println("ERROR")
 		log.Fatal(err)
 	}
+	return transactions
+}
 
-	for i := 0; cur.Next(context.TODO()); {
-		transactions = append(transactions, MainDBItem{})
-		err := cur.Decode(&transactions[i])
-		if err != nil {
-			log.Fatal(err)
-		}
-		i++
+// Get transactions referring to an organization
+func (v View) GetByOrganization(organizationTx []byte) []MainDBItem {
+	transactions, err := v.store.GetByOrganization(organizationTx)
+	if err != nil {
+		fmt.Println("ERROR")
+		log.Fatal(err)
 	}
-
 	return transactions
 }
 
+func (v View) CountNumberOfTransactions() int64 {
+	count, err := v.store.CountNumberOfTransactions()
+	if err != nil {
+		fmt.Println("Cannot count transactions")
+	}
+	return count
+}
+
+// Gets the transaction by its hash
+func Get(txhash []byte) MainDBItem {
+	return CurrentView().Get(txhash)
+}
+
+// Gets the transaction at given index of the chain
+func GetByIndex(index uint64) MainDBItem {
+	return CurrentView().GetByIndex(index)
+}
+
+// Gets the last transaction, the one with the highest index
+func GetLastTransaction() MainDBItem {
+	return CurrentView().GetLastTransaction()
+}
+
+// Get organization transactions
+func GetByObjectType(objectType byte) []MainDBItem {
+	return CurrentView().GetByObjectType(objectType)
+}
+
+// Get transactions referring to an organization
+func GetByOrganization(organizationTx []byte) []MainDBItem {
+	return CurrentView().GetByOrganization(organizationTx)
+}
+
 // Saves a transaction
 func Insert(dbItem MainDBItem) {
 	// get the last transaction
 	lastDbItem := GetLastTransaction()
 	dbItem.Index = lastDbItem.Index + 1
-	dbItem.PrevHash = lastDbItem.Hash
+	dbItem.PrevHash = lastDbItem.EntryHash
+	dbItem.EntryHash = dbItem.CalculateEntryHash()
 	// go
-	_, err := MainDBClient.InsertOne(context.TODO(), dbItem)
+	err := Current().Insert(dbItem)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// Saves a transaction related to this account
-func InsertRelated(dbItem MainDBItem) {
+// Saves an entry of the chain as is, its index and links included
+func InsertEntry(dbItem MainDBItem) error {
+	return Current().Insert(dbItem)
+}
 
-	_, err := RelDBClient.InsertOne(context.TODO(), dbItem)
+// Removes the transactions from given index to the head, returns them in chain order
+func RemoveFrom(index uint64) []MainDBItem {
+	var removed []MainDBItem
+	last := GetLastTransaction()
+	for i := index; i <= last.Index; i++ {
+		removed = append(removed, GetByIndex(i))
+	}
+	err := Current().RemoveFrom(index)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return removed
 }
 
-func CountNumberOfTransactions() int64 {
-	count, err := MainDBClient.CountDocuments(context.TODO(), bson.M{})
+// Replaces the transactions from given index to the head with given entries at once,
+// returns the replaced ones in chain order
+func ReplaceFrom(index uint64, items []MainDBItem) ([]MainDBItem, error) {
+	var removed []MainDBItem
+	last := GetLastTransaction()
+	for i := index; i <= last.Index; i++ {
+		removed = append(removed, GetByIndex(i))
+	}
+	if err := Current().ReplaceFrom(index, items); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// Saves a transaction related to this account
+func InsertRelated(dbItem MainDBItem) {
+	err := Current().InsertRelated(dbItem)
 	if err != nil {
-		fmt.Println("Cannot count transactions")
+		log.Fatal(err)
 	}
-	return count
+}
+
+func CountNumberOfTransactions() int64 {
+	return CurrentView().CountNumberOfTransactions()
 }
@@ -2,11 +2,18 @@ package keystore
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
 )
 
+func TestMain(m *testing.M) {
+	db.Use(db.NewMemoryStore())
+	os.Exit(m.Run())
+}
+
 func TestGenerateKey(t *testing.T) {
 
 	Open()
@@ -2,24 +2,50 @@ package network
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 )
 
+// Peer protocol versions, see handshake
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+var UserAgent = "themachine"
+
 type Connection struct {
-	Conn net.Conn
+	Conn    net.Conn
+	Version uint16 // negotiated protocol version, 0 until the handshake is complete
+	Agent   string // user agent of the peer
+	PeerKey []byte // public Node key of the peer, see authenticate
+
+	reader  *bufio.Reader
+	wmu     sync.Mutex // a frame is written at once
+	session *session   // encrypts messages once keys are exchanged
 }
 
-func initConnection(conn net.Conn) Connection {
-	return Connection{
-		conn,
+func initConnection(conn net.Conn) *Connection {
+	return &Connection{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
 	}
 }
 
 func (c *Connection) connect() ([]string, error) {
+	// agree on the protocol version and authenticate first
+	err := c.handshake()
+	if err != nil {
+		fmt.Println("Error in handshake with peer", err)
+		c.Conn.Close()
+		return nil, err
+	}
+
 	// send initial code
-	_, err := c.write([]byte{byte(Connect)})
+	_, err = c.send(Connect, nil)
 	if err != nil {
 		fmt.Println("Error sending bytes to peer", err)
 		c.Conn.Close()
@@ -27,7 +53,7 @@ func (c *Connection) connect() ([]string, error) {
 	}
 
 	// read reply to connect, which is a slice of peer strings
-	message, err := c.read()
+	message, err := c.expect(ConnectResponse)
 	if err != nil {
 		fmt.Println("Error reading bytes from peer", err)
 		c.Conn.Close()
@@ -35,14 +61,99 @@ func (c *Connection) connect() ([]string, error) {
 	}
 
 	// get peer slice
-	peers := strings.Split(string(message), ",")
+	if len(message.Payload) == 0 {
+		return nil, nil
+	}
+	peers := strings.Split(string(message.Payload), ",")
 	return peers, nil
 }
 
+// handshake sends this node's version, waits for the peer to accept it and sets up the encrypted session
+func (c *Connection) handshake() error {
+	if _, err := c.send(Version, versionPayload()); err != nil {
+		return err
+	}
+	message, err := c.expect(VersionResponse)
+	if err != nil {
+		return err
+	}
+	if err = c.acceptVersion(message.Payload); err != nil {
+		return err
+	}
+
+	transcript, err := c.exchangeKeys(true)
+	if err != nil {
+		return err
+	}
+	return c.authenticate(true, transcript)
+}
+
+// accept is the other side of the handshake
+func (c *Connection) accept() error {
+	message, err := c.expect(Version)
+	if err != nil {
+		return err
+	}
+	if err = c.acceptVersion(message.Payload); err != nil {
+		return err
+	}
+	if _, err = c.send(VersionResponse, versionPayload()); err != nil {
+		return err
+	}
+
+	transcript, err := c.exchangeKeys(false)
+	if err != nil {
+		return err
+	}
+	return c.authenticate(false, transcript)
+}
+
+// version (2) + minimum accepted version (2) + user agent
+func versionPayload() []byte {
+	payload := make([]byte, 4, 4+len(UserAgent))
+	binary.BigEndian.PutUint16(payload[0:2], ProtocolVersion)
+	binary.BigEndian.PutUint16(payload[2:4], MinProtocolVersion)
+	return append(payload, UserAgent...)
+}
+
+// acceptVersion checks the version of the peer and sets the version both sides speak
+func (c *Connection) acceptVersion(payload []byte) error {
+	if len(payload) < 4 {
+		return fmt.Errorf("%w: short version message", ErrIncompatiblePeer)
+	}
+	version := binary.BigEndian.Uint16(payload[0:2])
+	minVersion := binary.BigEndian.Uint16(payload[2:4])
+	if version < MinProtocolVersion || minVersion > ProtocolVersion {
+		return fmt.Errorf("%w: peer speaks %d (minimum %d), this node %d (minimum %d)", ErrIncompatiblePeer, version, minVersion, ProtocolVersion, MinProtocolVersion)
+	}
+
+	c.Version = ProtocolVersion
+	if version < c.Version {
+		c.Version = version
+	}
+	c.Agent = string(payload[4:])
+	return nil
+}
+
+// expect reads the next message and fails unless it has given type
+func (c *Connection) expect(messageType MessageType) (*Message, error) {
+	message, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if message.Type == Reject {
+		return nil, fmt.Errorf("Rejected by peer: %s", message.Payload)
+	}
+	if message.Type != messageType {
+		return nil, fmt.Errorf("%w: %d instead of %d", ErrUnexpectedMessage, message.Type, messageType)
+	}
+	return message, nil
+}
+
 // Relays the transaction to the connected node, response is handled in connection handler thread
 func (c *Connection) Relay(tx []byte) error {
 	fmt.Println("Relaying to ", c.Conn.RemoteAddr().String())
-	_, err := c.write(prependCode(Relay, tx))
+	_, err := c.send(Relay, tx)
 	if err != nil {
 		fmt.Println("Could not relay transaction to", c.Conn.RemoteAddr().String(), err)
 		return err
@@ -51,10 +162,27 @@ func (c *Connection) Relay(tx []byte) error {
 	return nil
 }
 
+// Sends a signature for a pending transaction instead of relaying the whole transaction
+func (c *Connection) SendApproval(approval []byte) error {
+	fmt.Println("Sending approval to ", c.Conn.RemoteAddr().String())
+	_, err := c.send(Signature, approval)
+	if err != nil {
+		fmt.Println("Could not send approval to", c.Conn.RemoteAddr().String(), err)
+		return err
+	}
+
+	return nil
+}
+
 // Asks for the last transaction recorded to the node
 func (c *Connection) GetHead() {
 	fmt.Println("Getting head from ", c.Conn.RemoteAddr().String())
-	c.write(prependCode(Head, endMessage([]byte{})))
+	c.send(Head, nil)
+}
+
+// Tells the peer its message is refused and why
+func (c *Connection) reject(reason string) {
+	c.send(Reject, []byte(reason))
 }
 
 func appendIfMissing(slice []string, elem string) []string {
@@ -66,25 +194,22 @@ func appendIfMissing(slice []string, elem string) []string {
 	return append(slice, elem)
 }
 
-func endMessage(message []byte) []byte {
-	return append(message, MESSAGE_TERMINATOR)
-}
-
-func prependCode(ct MessageType, message []byte) []byte {
-	return append([]byte{byte(ct)}, message...)
-}
-
-// read & write (append message type and terminator bytes)
-func (c *Connection) read() ([]byte, error) {
-	message, err := bufio.NewReader(c.Conn).ReadBytes(MESSAGE_TERMINATOR)
-	if err != nil {
-		return nil, err
+// read & send framed messages, see Message
+// Encrypted after the key exchange, see session
+func (c *Connection) read() (*Message, error) {
+	message, err := ReadMessage(c.reader)
+	if err != nil || c.session == nil {
+		return message, err
 	}
-
-	return message[:len(message)-1], nil
+	return c.session.open(message)
 }
 
-// write function writes the given message + EOF byte 0xFF
-func (c *Connection) write(message []byte) (int, error) {
-	return c.Conn.Write(endMessage(message))
+func (c *Connection) send(messageType MessageType, payload []byte) (int, error) {
+	message := &Message{messageType, payload}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.session != nil {
+		message = c.session.seal(message)
+	}
+	return c.Conn.Write(message.ToBytes())
 }
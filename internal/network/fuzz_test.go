@@ -0,0 +1,45 @@
+//go:build go1.18
+// +build go1.18
+
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReadMessage(f *testing.F) {
+	relay := Message{Relay, []byte{1, 2, 0xFF, 3}}
+	f.Add(relay.ToBytes())
+	f.Add([]byte{})
+	f.Add(append(relay.ToBytes(), relay.ToBytes()...))
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		r := bytes.NewReader(frame)
+		message, err := ReadMessage(r)
+		if err != nil {
+			return
+		}
+		// whatever is read, is written the same way
+		consumed := len(frame) - r.Len()
+		if !bytes.Equal(message.ToBytes(), frame[:consumed]) {
+			t.Error("Message does not encode to the same frame")
+		}
+	})
+}
+
+func FuzzMessageRoundTrip(f *testing.F) {
+	f.Add(byte(Relay), []byte{0xFF, 0xFF})
+	f.Add(byte(Head), []byte{})
+
+	f.Fuzz(func(t *testing.T, messageType byte, payload []byte) {
+		message := Message{MessageType(messageType), payload}
+		read, err := ReadMessage(bytes.NewReader(message.ToBytes()))
+		if err != nil {
+			t.Fatal("Cannot read message", err)
+		}
+		if read.Type != message.Type || !bytes.Equal(read.Payload, payload) {
+			t.Error("Read message does not match", read, message)
+		}
+	})
+}
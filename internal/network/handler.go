@@ -11,13 +11,43 @@ import (
 	"net"
 	"strings"
 
+	"github.com/alpdeniz/themachine/internal/block"
 	"github.com/alpdeniz/themachine/internal/compute"
 	"github.com/alpdeniz/themachine/internal/transaction"
 )
 
+// executable code reads committed transactions, see compute.TransactionReader
+func init() {
+	compute.TransactionReader = func(hash []byte) []byte {
+		tx := transaction.Retrieve(hash)
+		if tx == nil {
+			return nil
+		}
+		return tx.ToBytes()
+	}
+}
+
 // keep listening to all connections, parse and reply
 func (c *Connection) handle(ch chan<- ConnectionChannel) {
 
+	// incoming connections first agree on the protocol and authenticate
+	if c.session == nil {
+		if err := c.accept(); err != nil {
+			fmt.Println("Closing connection, handshake failed", c.Conn.RemoteAddr().String(), err)
+			c.reject(err.Error())
+			ch <- ConnectionChannel{
+				true,
+				c,
+			}
+			return
+		}
+		// signal back in order to save
+		ch <- ConnectionChannel{
+			false,
+			c,
+		}
+	}
+
 	// Read loop
 	for {
 		// until
@@ -36,11 +66,10 @@ func (c *Connection) handle(ch chan<- ConnectionChannel) {
 			return
 		}
 
-		// message = strings.TrimSuffix(message, "\n")
-		fmt.Println("Message Received:", message)
+		fmt.Println("Message Received:", message.Type, len(message.Payload))
+		payload := message.Payload
 
-		actionType := MessageType(message[0])
-		switch actionType {
+		switch message.Type {
 
 		case Connect:
 			fmt.Println("Serving peers", len(connections)-1) // -1 for this connection as we won't be sending it back
@@ -54,119 +83,222 @@ func (c *Connection) handle(ch chan<- ConnectionChannel) {
 				peers = append(peers, host)
 			}
 
-			// Currently unused connect response format as it is handled before passing to connection handler thread
-			// c.write(prependCode(ConnectResponse, []byte(strings.Join(peers, ","))))
-
 			// Return response
-			c.write([]byte(strings.Join(peers, ",")))
+			c.send(ConnectResponse, []byte(strings.Join(peers, ",")))
 
 		case Head:
 
 			fmt.Println("Serving HEAD to", c.Conn.RemoteAddr().String())
-			lastTx, err := transaction.GetLast()
-			if err != nil {
-				fmt.Println("Error getting the last transaction as head", err)
-			}
-			// sends back the last index it has
-			var tmp = make([]byte, 8)
-			// cast uint64 to bytes
-			binary.BigEndian.PutUint64(tmp, lastTx.Index)
-			respnse := prependCode(HeadResponse, tmp)
-			fmt.Println("Response to write", respnse)
-			c.write(respnse)
+			// sends back the last index it has and its entry hash
+			c.send(HeadResponse, headPayload())
 
 		case HeadResponse:
 
-			index := binary.BigEndian.Uint64(message[1:])
+			if len(payload) != 8 && len(payload) != 40 {
+				fmt.Println("Error in head response. Invalid message length", len(payload))
+				continue
+			}
+			index := binary.BigEndian.Uint64(payload[0:8])
 			fmt.Println("Got head response", index)
+			Sync.HandleHead(c, index, payload[8:])
+
+		case GetRange:
+
+			if len(payload) != 12 {
+				fmt.Println("Error in range request. Invalid message length", len(payload))
+				c.reject("Invalid range")
+				continue
+			}
+			start := binary.BigEndian.Uint64(payload[0:8])
+			count := binary.BigEndian.Uint32(payload[8:12])
+			c.send(Inventory, inventoryPayload(start, count))
+
+		case Locate:
+
+			start, err := locate(payload)
+			if err != nil {
+				fmt.Println("Error in locate request", err)
+				c.reject("Invalid locator")
+				continue
+			}
+			c.send(Inventory, inventoryPayload(start, MaxInventory))
+
+		case Inventory:
+
+			start, hashes, err := parseInventory(payload)
+			if err != nil {
+				fmt.Println("Error in inventory", err)
+				continue
+			}
+			Sync.HandleInventory(c, start, hashes)
 
 		case Fetch:
 
-			if len(message) < 33 {
-				fmt.Println("Error in fetch request. Short message length", len(message))
-				c.write([]byte("Short message"))
+			if len(payload) < 32 {
+				fmt.Println("Error in fetch request. Short message length", len(payload))
+				c.reject("Short message")
 				continue
 			}
 
-			txhash := message[1:33]
+			txhash := payload[0:32]
 			tx := transaction.Retrieve(txhash)
 			if tx == nil {
-				c.write([]byte("No such transaction"))
+				c.reject("No such transaction")
+				continue
+			}
+
+			c.send(FetchResponse, tx.ToBytes())
+
+		case FetchEntry:
+
+			if len(payload) != 8 {
+				fmt.Println("Error in entry request. Invalid message length", len(payload))
+				c.reject("Invalid index")
+				continue
+			}
+			entry := transaction.RetrieveEntry(binary.BigEndian.Uint64(payload))
+			if entry == nil {
+				c.reject("No such entry")
+				continue
+			}
+			c.send(FetchEntryResponse, entry.ToBytes())
+
+		case FetchEntryResponse:
+
+			// entries are only asked by the sync
+			if !Sync.HandleEntry(c, payload) {
+				fmt.Println("Unexpected entry from", c.Conn.RemoteAddr().String())
+			}
+
+		case GetProof:
+
+			if len(payload) != 32 {
+				fmt.Println("Error in proof request. Invalid message length", len(payload))
+				c.reject("Invalid transaction hash")
 				continue
 			}
+			p, err := block.NewProof(payload)
+			if err != nil {
+				c.reject(err.Error())
+				continue
+			}
+			c.send(ProofResponse, p.ToBytes())
 
-			c.write(prependCode(FetchResponse, tx.ToBytes()))
+		case ProofResponse:
+
+			if err := handleProof(payload); err != nil {
+				fmt.Println("Proof from", c.Conn.RemoteAddr().String(), "is refused:", err)
+			}
 
 		case FetchResponse:
 
 			// process and save this message (if valid)
-			_, err := transaction.Process(message[1:])
-			if err != nil {
+			_, err := transaction.Process(payload)
+			if err != nil && err != transaction.ErrKnownTransaction {
 				fmt.Println("Could not verify tx (fetch): ", err)
-				c.write([]byte("Transaction rejected"))
+				c.reject("Transaction rejected")
 				continue
 			}
 
 		case Relay:
 
-			fmt.Println("Got relay request", string(message[1:]))
+			fmt.Println("Got relay request", len(payload))
 			// process and transmit message (if valid)
-			tx, err := transaction.Process(message[1:])
+			tx, err := transaction.Process(payload)
+			if err == transaction.ErrKnownTransaction {
+				// nothing new to tell to others
+				c.send(RelayResponse, tx.Hash)
+				continue
+			}
 			if err != nil {
 				fmt.Println("Could not verify tx (relay):", err)
-				c.write([]byte("Transaction rejected"))
+				c.reject("Transaction rejected")
 				continue
 			}
 
-			relayed := RelayTransaction(c, message[1:])
+			// relay pending transactions with all signatures collected so far
+			relayed := RelayTransaction(c, tx.ToBytes())
 			fmt.Println("RELAYED to", relayed, tx.Hash)
 
-			c.write(prependCode(RelayResponse, tx.Hash))
+			c.send(RelayResponse, tx.Hash)
 
 		case RelayResponse:
 
-			hash := message[1:]
-			fmt.Println("Got response hash:", hex.EncodeToString(hash), len(hash))
+			fmt.Println("Got response hash:", hex.EncodeToString(payload), len(payload))
+
+		case Signature:
+
+			// attach the signature to the pending transaction
+			tx, err := transaction.ProcessApproval(payload)
+			if err == transaction.ErrKnownSignature || err == transaction.ErrKnownTransaction {
+				continue
+			}
+			if err != nil {
+				fmt.Println("Could not add signature:", err)
+				c.reject("Signature rejected")
+				continue
+			}
+
+			relayed := RelayApproval(c, payload)
+			fmt.Println("Relayed signature to", relayed, hex.EncodeToString(tx.Hash))
+
+			c.send(SignatureResponse, tx.Hash)
+
+		case SignatureResponse:
+
+			fmt.Println("Got signature response hash:", hex.EncodeToString(payload))
+
+		case Reject:
+
+			fmt.Println("Got rejected by", c.Conn.RemoteAddr().String(), string(payload))
 
 		// Compute request handler
 		case Compute:
 
-			if len(message) < 33 {
-				fmt.Println("Error in compute request. Short message length", len(message))
-				c.write(prependCode(ComputeResponse, []byte("Short message")))
+			c.handleCompute(payload)
+
+		case Job:
+
+			state, err := handleJob(payload)
+			if err != nil {
+				fmt.Println("Error in job request.", err)
+				c.reject(err.Error())
 				continue
 			}
+			c.send(JobResponse, state.ToBytes())
 
-			// to match the process on requester's side
-			pid := message[1:5]
-			requestCode := message[5:9]
-			// tx to be executed
-			txhash := message[5:37]
-			// fetch
-			tx := transaction.Retrieve(txhash)
-			// check if executable
-			var result []byte
-			if tx.ObjectType == transaction.Executable {
-				result = compute.Execute(string(tx.Data))
-			} else {
-				fmt.Println("Not an executable transaction:", tx.Hash)
+		case JobResponse:
+
+			state, err := compute.ParseJobState(payload)
+			if err != nil {
+				fmt.Println("Error in job response.", err)
 				continue
 			}
-
-			// prepend message type, pid and request code to result
-			response := append(prependCode(ComputeResponse, []byte(pid)), append(requestCode, result...)...)
-			c.write(response)
+			fmt.Println("Got job", state.ID, state.Status, state.Error)
 
 		// Compute response handler. This is to stay here just in case.
 		// Currently python module handles all communications, well, it could use
 		// the node's existing connection, thus requiring the handler below
 		case ComputeResponse:
 
+			if len(payload) < computeHeader {
+				fmt.Println("Error in compute response. Short message length", len(payload))
+				continue
+			}
+
 			// parse computation response
-			pid := message[1:5]
-			requestCode := message[5:9]
-			result := message[9:]
-			fmt.Println("Got compute response", binary.BigEndian.Uint32(pid), binary.BigEndian.Uint32(requestCode), result)
+			pid := payload[0:4]
+			requestCode := payload[4:8]
+			result, err := compute.ParseJobResult(payload[computeHeader:])
+			if err != nil {
+				fmt.Println("Error in compute response.", err)
+				continue
+			}
+			if err := result.Verify(); err != nil {
+				fmt.Println("Error in compute response.", err)
+				continue
+			}
+			fmt.Println("Got compute response", binary.BigEndian.Uint32(pid), binary.BigEndian.Uint32(requestCode), result, string(result.Stdout))
 			// feed into parent process
 			// compute.HandleResponse(binary.BigEndian.Uint32(pid), binary.BigEndian.Uint32(requestCode), result)
 
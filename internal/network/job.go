@@ -0,0 +1,166 @@
+package network
+
+// Compute jobs of this node, for peers (Compute, Job) and the web interface
+// Jobs run in the background by the workers of the Jobs queue, so that long code blocks no connection
+// Results are signed by the Node key so that the requester can tell who computed them
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/alpdeniz/themachine/internal/compute"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+// Operations of a Job message, followed by
+// - JobSubmit  executable hash (32) + JSON input
+// - JobStatus  job id (16)
+// - JobCancel  job id (16)
+// Each is answered with the state of the job (JobResponse), see compute.JobState
+const (
+	JobSubmit byte = iota
+	JobStatus
+	JobCancel
+)
+
+// A Compute message is pid (4) + request code (4) + executable hash (32) + JSON input
+// The pid and request code come back in front of the result (ComputeResponse) to match the request
+const computeHeader = 8
+
+var (
+	ErrNotExecutable = errors.New("Not an executable transaction")
+	ErrNoJobs        = errors.New("Compute jobs are not started")
+)
+
+// Jobs of this node, see StartJobs
+var Jobs *compute.Queue
+
+// StartJobs starts the job queue with given number of workers, size and timeout
+func StartJobs(config compute.QueueConfig) {
+	if Jobs != nil {
+		Jobs.Close()
+	}
+	Jobs = compute.NewQueue(config, RunJob)
+}
+
+// SubmitJob queues the job if its transaction is executable
+func SubmitJob(job *compute.Job) (compute.JobState, error) {
+	if Jobs == nil {
+		return compute.JobState{}, ErrNoJobs
+	}
+	if _, err := retrieveExecutable(job.Executable); err != nil {
+		return compute.JobState{}, err
+	}
+	return Jobs.Submit(job)
+}
+
+// RunJob runs the executable transaction of the job and signs the result
+// A failing code is still a result, an error means nothing was run
+func RunJob(ctx context.Context, job *compute.Job) (*compute.JobResult, error) {
+	tx, err := retrieveExecutable(job.Executable)
+	if err != nil {
+		return nil, err
+	}
+	key, err := nodeKey()
+	if err != nil {
+		return nil, err
+	}
+	result, err := job.RunContext(ctx, string(tx.SubType), tx.Data)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.Sign(key.PublicKey, key.PrivateKey); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func retrieveExecutable(hash []byte) (*transaction.Transaction, error) {
+	tx := transaction.Retrieve(hash)
+	if tx == nil || tx.ObjectType != transaction.Executable {
+		return nil, fmt.Errorf("%w: %s", ErrNotExecutable, hex.EncodeToString(hash))
+	}
+	return tx, nil
+}
+
+// handleJob answers a Job message with the state of the job
+func handleJob(payload []byte) (compute.JobState, error) {
+	if len(payload) < 1 {
+		return compute.JobState{}, errors.New("Empty job request")
+	}
+	if Jobs == nil {
+		return compute.JobState{}, ErrNoJobs
+	}
+	switch op, body := payload[0], payload[1:]; {
+	case op == JobSubmit && len(body) >= 32:
+		job, err := compute.NewJob(body[:32], body[32:])
+		if err != nil {
+			return compute.JobState{}, err
+		}
+		return SubmitJob(job)
+	case op == JobStatus && len(body) == 16:
+		return Jobs.Status(hex.EncodeToString(body))
+	case op == JobCancel && len(body) == 16:
+		return Jobs.Cancel(hex.EncodeToString(body))
+	}
+	return compute.JobState{}, fmt.Errorf("Invalid job request %d of %d bytes", payload[0], len(payload))
+}
+
+// ComputeRequest builds the payload of a Compute message
+func ComputeRequest(pid uint32, requestCode uint32, txhash []byte, input []byte) []byte {
+	payload := make([]byte, computeHeader, computeHeader+len(txhash)+len(input))
+	binary.BigEndian.PutUint32(payload[0:4], pid)
+	binary.BigEndian.PutUint32(payload[4:8], requestCode)
+	return append(append(payload, txhash...), input...)
+}
+
+// handleCompute submits the job of a Compute message, the result is sent once it is finished
+func (c *Connection) handleCompute(payload []byte) {
+	if len(payload) < computeHeader+32 {
+		fmt.Println("Error in compute request. Short message length", len(payload))
+		c.send(ComputeResponse, []byte("Short message"))
+		return
+	}
+
+	// to match the process on requester's side
+	prefix := append([]byte{}, payload[:computeHeader]...)
+	// tx to be executed
+	txhash := payload[computeHeader : computeHeader+32]
+	// anything after the hash is the JSON input of the code
+	job, err := compute.NewJob(txhash, payload[computeHeader+32:])
+	if err != nil {
+		fmt.Println("Invalid compute request", hex.EncodeToString(txhash), err)
+		return
+	}
+	state, err := SubmitJob(job)
+	if err != nil {
+		fmt.Println("Cannot execute transaction", hex.EncodeToString(txhash), err)
+		c.reject(err.Error())
+		return
+	}
+	// answer once the job is finished, without blocking this connection
+	go c.sendJobResult(prefix, state.ID)
+}
+
+// sendJobResult answers a Compute request with the signed result (prefixed by pid and request code)
+// once the job is finished
+func (c *Connection) sendJobResult(prefix []byte, id string) {
+	done, err := Jobs.Done(id)
+	if err != nil {
+		return
+	}
+	<-done
+	state, err := Jobs.Status(id)
+	if err != nil {
+		return
+	}
+	if state.Result == nil {
+		fmt.Println("Compute job", id, "failed:", state.Error)
+		c.reject(state.Error)
+		return
+	}
+	c.send(ComputeResponse, append(prefix, state.Result.ToBytes()...))
+}
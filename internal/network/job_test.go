@@ -0,0 +1,113 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/compute"
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+// saves an executable of an organization, its main returns 7
+func newTestExecutable(t *testing.T) (*transaction.Transaction, *transaction.Transaction) {
+	module := []byte{0, 'a', 's', 'm', 1, 0, 0, 0, 1, 5, 1, 0x60, 0, 1, 0x7f, 3, 2, 1, 0,
+		7, 8, 1, 4, 'm', 'a', 'i', 'n', 0, 0, 10, 6, 1, 4, 0, 0x41, 7, 0x0b}
+	organization := newTestEntries(t, transaction.Height(), 1)[0].Tx
+	organization.Save()
+	tx, err := transaction.Build(transaction.Executable, transaction.CodeTypeWASM, organization.Hash, module, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Save()
+	return tx, organization
+}
+
+func TestRunJob(t *testing.T) {
+	tx, organization := newTestExecutable(t)
+	job, err := compute.NewJob(tx.Hash, []byte(`{"n": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := RunJob(context.Background(), job)
+	if err != nil {
+		t.Fatal("Cannot run job", err)
+	}
+	if result.ExitCode != 7 || !bytes.Equal(result.Executable, tx.Hash) {
+		t.Error("Unexpected job result", result)
+	}
+	if err := result.Verify(); err != nil || !bytes.Equal(result.Node, NodeKey.PublicKey) {
+		t.Error("Job result should be signed by this node", err)
+	}
+
+	job.Executable = organization.Hash
+	if _, err := RunJob(context.Background(), job); !errors.Is(err, ErrNotExecutable) {
+		t.Error("Only executables should run", err)
+	}
+}
+
+func TestJobRequests(t *testing.T) {
+	if _, err := handleJob([]byte{JobStatus}); !errors.Is(err, ErrNoJobs) {
+		t.Error("Jobs should not run before they are started", err)
+	}
+	StartJobs(compute.DefaultQueueConfig)
+	defer func() {
+		Jobs.Close()
+		Jobs = nil
+	}()
+	tx, organization := newTestExecutable(t)
+
+	state, err := handleJob(append([]byte{JobSubmit}, append(append([]byte{}, tx.Hash...), "[1]"...)...))
+	if err != nil {
+		t.Fatal("Cannot submit job", err)
+	}
+	done, _ := Jobs.Done(state.ID)
+	<-done
+	id, _ := hex.DecodeString(state.ID)
+	state, err = handleJob(append([]byte{JobStatus}, id...))
+	if err != nil || state.Status != compute.JobFailed || state.Result.ExitCode != 7 || state.Result.Verify() != nil {
+		t.Error("Job exiting with 7 should fail with a signed result", state, err)
+	}
+	parsed, err := compute.ParseJobState(state.ToBytes())
+	if err != nil || parsed.ID != state.ID || parsed.Result.ExitCode != 7 {
+		t.Error("Job state is not sent as it is", parsed, err)
+	}
+
+	// compute requests are answered by the job once finished, after the pid and request code
+	c, requests := newTestPeer(t)
+	request := ComputeRequest(1, 2, tx.Hash, []byte("[1]"))
+	if !bytes.Equal(request[:8], []byte{0, 0, 0, 1, 0, 0, 0, 2}) || !bytes.Equal(request[8:40], tx.Hash) || string(request[40:]) != "[1]" {
+		t.Fatal("Compute request should be pid, request code, hash and input", request)
+	}
+	c.handleCompute(request)
+	m := nextRequest(t, requests, ComputeResponse)
+	result, err := compute.ParseJobResult(m.Payload[8:])
+	if !bytes.Equal(m.Payload[:8], request[:8]) || err != nil || result.Verify() != nil {
+		t.Fatal("Compute response should carry the signed result", err)
+	}
+	if !bytes.Equal(result.Executable, tx.Hash) || !bytes.Equal(result.InputHash, crypto.Hash([]byte("[1]"))) || result.ExitCode != 7 {
+		t.Error("Compute request should run the executable with its input", result)
+	}
+	c.handleCompute(request[:39])
+	if m := nextRequest(t, requests, ComputeResponse); string(m.Payload) != "Short message" {
+		t.Error("Short compute request should be refused", string(m.Payload))
+	}
+
+	invalid := [][]byte{
+		{JobCancel, 1, 2},
+		append([]byte{JobSubmit}, organization.Hash...),
+		append([]byte{JobSubmit}, append(append([]byte{}, tx.Hash...), "{"...)...),
+		{9},
+	}
+	for _, v := range invalid {
+		if _, err := handleJob(v); err == nil {
+			t.Error("Job request should be refused", v)
+		}
+	}
+	if _, err := handleJob(append([]byte{JobCancel}, make([]byte, 16)...)); !errors.Is(err, compute.ErrUnknownJob) {
+		t.Error("Unknown job should not be cancelled", err)
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+// Message framing of the peer protocol
+// Every message is a fixed header followed by its payload:
+// magic (4) + frame version (1) + message type (1) + payload length (4, big endian) + checksum (4) + payload
+// The checksum is the first 4 bytes of the double sha256 of the payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+const (
+	FrameVersion   = 1
+	HeaderLength   = 14
+	MaxMessageSize = 32 * 1024 * 1024 // fits the largest transaction with its signatures
+)
+
+var MessageMagic = [4]byte{'t', 'm', 'c', 'h'}
+
+var (
+	ErrInvalidMagic        = errors.New("Invalid message magic")
+	ErrUnsupportedFrame    = errors.New("Unsupported frame version")
+	ErrMessageTooLarge     = errors.New("Message too large")
+	ErrInvalidChecksum     = errors.New("Invalid message checksum")
+	ErrIncompatiblePeer    = errors.New("Incompatible peer protocol version")
+	ErrUnexpectedMessage   = errors.New("Unexpected message")
+	ErrHandshakeIncomplete = errors.New("Handshake is not complete")
+)
+
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+func checksum(payload []byte) []byte {
+	return crypto.DHash(payload)[:4]
+}
+
+// Export message as a frame
+func (m *Message) ToBytes() []byte {
+	frame := make([]byte, HeaderLength, HeaderLength+len(m.Payload))
+	copy(frame[0:4], MessageMagic[:])
+	frame[4] = FrameVersion
+	frame[5] = byte(m.Type)
+	binary.BigEndian.PutUint32(frame[6:10], uint32(len(m.Payload)))
+	copy(frame[10:14], checksum(m.Payload))
+	return append(frame, m.Payload...)
+}
+
+// ReadMessage reads exactly one frame from the reader
+// The header is checked before the payload is read, so oversized messages are never buffered
+func ReadMessage(r io.Reader) (*Message, error) {
+	var header [HeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[0:4], MessageMagic[:]) {
+		return nil, fmt.Errorf("%w: %x", ErrInvalidMagic, header[0:4])
+	}
+	if header[4] != FrameVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedFrame, header[4])
+	}
+	length := binary.BigEndian.Uint32(header[6:10])
+	if length > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes, maximum is %d", ErrMessageTooLarge, length, MaxMessageSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[10:14], checksum(payload)) {
+		return nil, ErrInvalidChecksum
+	}
+
+	return &Message{MessageType(header[5]), payload}, nil
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+
+	// terminator like bytes used to cut messages
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint64(head, 0xFFFFFFFFFFFFFFFF)
+	messages := []Message{{HeadResponse, head}, {Head, nil}, {Relay, bytes.Repeat([]byte{0xFF}, 1000)}}
+
+	// several frames on one stream are read one by one
+	var stream []byte
+	for _, m := range messages {
+		stream = append(stream, m.ToBytes()...)
+	}
+	r := bytes.NewReader(stream)
+	for _, m := range messages {
+		read, err := ReadMessage(r)
+		if err != nil {
+			t.Fatal("Cannot read message", err)
+		}
+		if read.Type != m.Type || !bytes.Equal(read.Payload, m.Payload) {
+			t.Error("Read message does not match", read.Type, m.Type)
+		}
+	}
+
+	frame := (&Message{Relay, []byte("transaction")}).ToBytes()
+	corrupt := func(i int, b byte) []byte {
+		c := append([]byte{}, frame...)
+		c[i] = b
+		return c
+	}
+	tooLarge := append([]byte{}, frame...)
+	binary.BigEndian.PutUint32(tooLarge[6:10], MaxMessageSize+1)
+
+	cases := []struct {
+		frame []byte
+		err   error
+	}{
+		{corrupt(0, 'x'), ErrInvalidMagic},
+		{corrupt(4, FrameVersion+1), ErrUnsupportedFrame},
+		{tooLarge, ErrMessageTooLarge},
+		{corrupt(len(frame)-1, 'x'), ErrInvalidChecksum},
+	}
+	for _, c := range cases {
+		if _, err := ReadMessage(bytes.NewReader(c.frame)); !errors.Is(err, c.err) {
+			t.Error("Expected", c.err, "got", err)
+		}
+	}
+	if _, err := ReadMessage(bytes.NewReader(frame[:len(frame)-1])); err == nil {
+		t.Error("Truncated message should not be read")
+	}
+}
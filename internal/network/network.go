@@ -4,6 +4,7 @@ import (
 	"fmt"
 	mrand "math/rand"
 	"net"
+	"strconv"
 )
 
 type MessageType byte
@@ -14,11 +15,28 @@ const (
 	Relay                              // 2 Relay transactions forward - first verify, sign if it is asked by the transaction, then forward
 	Compute                            // 3 Compute transaction code by given id - if authorized
 	Fetch                              // 4 Fetch transaction by given id - public
-	ConnectResponse                    // Currently unused since connection is passed to handler after
+	ConnectResponse                    // Peers of the node, reply to Connect
 	HeadResponse
 	RelayResponse
 	ComputeResponse
 	FetchResponse
+	Signature         // 10 Add a signature to a pending transaction - see transaction.Approval
+	SignatureResponse // Hash of the transaction the signature is added to
+	Version           // 12 Handshake, first message of every connection - see Connection.handshake
+	VersionResponse
+	Reject      // Reason of refusing the previous message
+	KeyExchange // 15 Ephemeral key of the session - see secure.go
+	Identity    // Node key of the peer and its signature over the session keys
+	Encrypted   // Any message after the key exchange
+	GetRange    // 18 Ask for the entry hashes of an index range - see sync.go
+	Inventory   // Entry hashes of the asked range
+	Locate      // 20 Ask where the chain of the peer leaves the given one, answered with Inventory
+	FetchEntry  // Fetch the entry at given index - see transaction.Entry
+	FetchEntryResponse
+	GetProof // 23 Ask for the inclusion proof of a transaction - see proof.go
+	ProofResponse
+	Job // 25 Submit, poll or cancel a compute job - see job.go
+	JobResponse
 )
 
 type ConnectionChannel struct {
@@ -29,7 +47,6 @@ type ConnectionChannel struct {
 var SOCKET_PORT = 8443
 
 const MAXIMUM_CONNECTIONS = 20
-const MESSAGE_TERMINATOR = byte(0xFF) // socket reads until
 
 var connections []*Connection         // connection pool
 var peers []string                    // keeps active peer list as string
@@ -40,23 +57,40 @@ var seeds = []string{}
 
 // StartSocket fires up the socket listener and signal channel handler
 // param port int (optional)
-func StartNetwork(port int) {
+func StartNetwork(port int) error {
 	// set socket listener port (optional)
 	SOCKET_PORT = port
 	fmt.Println("Starting socket server on ", SOCKET_PORT)
+	// peers only accept authenticated nodes
+	if _, err := nodeKey(); err != nil {
+		return err
+	}
+	// set listener, ready to accept once returned
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(SOCKET_PORT)))
+	if err != nil {
+		return err
+	}
 	// start socket listener
-	go listen(ch)
+	go listen(ln, ch)
 	// listen for all new and removed connections via signal channel
 	go startChannelListener()
 	// connect to other nodes supplied in seeds
 	go ConnectToNodes(seeds, ch)
+	// catch up with the peers
+	go Sync.loop()
+	// seal batches of the organizations this node validates
+	go sealLoop()
+	return nil
 }
 
 // Stop channel and socket listeners, close connections
 func StopNetwork() {
 	stopServer = true
+	if Jobs != nil {
+		Jobs.Close()
+	}
 	// Close and remove all connections
-	for _, c := range connections {
+	for _, c := range append([]*Connection{}, connections...) {
 		removeConnection(c)
 	}
 	fmt.Println("Stopped network...")
@@ -79,11 +113,8 @@ func startChannelListener() {
 	}
 }
 
-// listen starts Socket listener, signals back on connection and passes connections to its handler
-func listen(ch chan<- ConnectionChannel) {
-
-	// set listener
-	ln, _ := net.Listen("tcp", fmt.Sprintf("%s:%d", "", SOCKET_PORT))
+// listen starts Socket listener and passes connections to its handler
+func listen(ln net.Listener, ch chan<- ConnectionChannel) {
 	defer ln.Close()
 
 	// run loop forever
@@ -101,13 +132,8 @@ func listen(ch chan<- ConnectionChannel) {
 
 		// create connection interface
 		c := initConnection(conn)
-		// signal back in order to save
-		ch <- ConnectionChannel{
-			false,
-			&c,
-		}
 
-		// handle in different thread
+		// handle in different thread, saved once the handshake is complete
 		go c.handle(ch)
 	}
 }
@@ -116,7 +142,7 @@ func listen(ch chan<- ConnectionChannel) {
 func ConnectToNode(host string) (*Connection, error) {
 
 	// connect to socket
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, SOCKET_PORT))
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(SOCKET_PORT)))
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +158,7 @@ func ConnectToNode(host string) (*Connection, error) {
 	// // continue to look for new connections
 	go ConnectToNodes(peers, ch)
 
-	return &c, nil
+	return c, nil
 }
 
 func ConnectToNodes(list []string, ch chan<- ConnectionChannel) {
@@ -180,7 +206,28 @@ func RelayTransaction(origin *Connection, tx []byte) int {
 
 		err := c.Relay(tx)
 		if err != nil {
-			fmt.Println("Could not relay transaction to", origin.Conn.RemoteAddr().String())
+			fmt.Println("Could not relay transaction to", c.Conn.RemoteAddr().String())
+			continue
+		}
+
+		counter++
+	}
+	return counter
+}
+
+// Relays an approval (signature of a pending transaction) to all connected nodes
+func RelayApproval(origin *Connection, approval []byte) int {
+
+	counter := 0
+	for _, c := range connections {
+		// do not send it back to the connection you got it from
+		if c == origin {
+			continue
+		}
+
+		err := c.SendApproval(approval)
+		if err != nil {
+			fmt.Println("Could not relay approval to", c.Conn.RemoteAddr().String())
 			continue
 		}
 
@@ -189,7 +236,7 @@ func RelayTransaction(origin *Connection, tx []byte) int {
 	return counter
 }
 
-// Syncronize transactions after startup
+// Syncronize transactions after startup, the sync starts with the head responses
 func StartToSyncronize() {
 	// Node is not connected to the network, stop
 	if len(connections) == 0 {
@@ -215,14 +262,20 @@ func saveConnection(c *Connection) {
 func removeConnection(c *Connection) {
 	fmt.Println("Connection to remove ", c.Conn.RemoteAddr().String())
 	c.Conn.Close()
-	c.Conn = nil
+	Sync.RemovePeer(c)
 	for i, v := range connections {
-		if v.Conn == nil {
+		if v == c {
 			fmt.Println("Removed one connection ")
 			connections = append(connections[:i], connections[i+1:]...)
-			peers = append(peers[:i], peers[i+1:]...)
+			break
 		}
 	}
+	// keep string peer list ready
+	peers = nil
+	for _, v := range connections {
+		host, _, _ := net.SplitHostPort(v.Conn.RemoteAddr().String())
+		peers = appendIfMissing(peers, host)
+	}
 	fmt.Println("Removed connection: ", len(connections))
 }
 
@@ -1,13 +1,38 @@
 package network
 
-import "testing"
+import (
+	"os"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+)
+
+func TestMain(m *testing.M) {
+	db.Use(db.NewMemoryStore())
+	// identity of this node
+	master, err := crypto.NewWallet()
+	if err != nil {
+		panic(err)
+	}
+	NodeKey = &keystore.KeyPair{
+		Name:       "Node",
+		PublicKey:  master.Pub().Key,
+		PrivateKey: master.Key,
+	}
+	os.Exit(m.Run())
+}
 
 func TestNetwork(t *testing.T) {
-	StartNetwork(8443)
+	err := StartNetwork(8443)
+	if err != nil {
+		t.Fatal("Cannot start network", err)
+	}
 
 	c, err := ConnectToNode("localhost")
 	if err != nil {
-		t.Error("Cannot connect to node", err)
+		t.Fatal("Cannot connect to node", err)
 	}
 
 	err = c.Relay([]byte("HELLO"))
@@ -0,0 +1,107 @@
+package network
+
+// Inclusion proofs for light clients
+// A node without the chain asks a peer for the proof of a transaction (GetProof -> ProofResponse)
+// and checks it offline, see block.Proof. A proof is delivered to the requests whose anchor
+// trusts its block only
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/block"
+)
+
+const ProofTimeout = 10 * time.Second
+
+var ErrNoProof = errors.New("No proof received")
+
+type proofRequest struct {
+	wait   chan *block.Proof
+	anchor block.Anchor
+}
+
+// proof requests waiting for a response, by transaction hash
+var proofRequests = struct {
+	mu      sync.Mutex
+	waiting map[string][]proofRequest
+}{waiting: make(map[string][]proofRequest)}
+
+// RequestProof asks the peer for the inclusion proof of a transaction and waits for one anchored
+// to a block the anchor trusts
+func (c *Connection) RequestProof(txid []byte, anchor block.Anchor) (*block.Proof, error) {
+	if len(txid) != 32 {
+		return nil, errors.New("Invalid transaction hash")
+	}
+	if anchor == nil {
+		return nil, block.ErrUntrustedProof
+	}
+	wait := make(chan *block.Proof, 1)
+	proofRequests.mu.Lock()
+	proofRequests.waiting[string(txid)] = append(proofRequests.waiting[string(txid)], proofRequest{wait, anchor})
+	proofRequests.mu.Unlock()
+	defer forgetProofRequest(txid, wait)
+
+	if _, err := c.send(GetProof, txid); err != nil {
+		return nil, err
+	}
+	select {
+	case p := <-wait:
+		return p, nil
+	case <-time.After(ProofTimeout):
+		return nil, fmt.Errorf("%w for %x from %s", ErrNoProof, txid, c.Conn.RemoteAddr().String())
+	}
+}
+
+func forgetProofRequest(txid []byte, wait chan *block.Proof) {
+	proofRequests.mu.Lock()
+	defer proofRequests.mu.Unlock()
+	var kept []proofRequest
+	for _, v := range proofRequests.waiting[string(txid)] {
+		if v.wait != wait {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		delete(proofRequests.waiting, string(txid))
+	} else {
+		proofRequests.waiting[string(txid)] = kept
+	}
+}
+
+// handleProof checks a proof response and hands it to the requests trusting it
+func handleProof(payload []byte) error {
+	p, err := block.ParseProof(payload)
+	if err != nil {
+		return err
+	}
+
+	proofRequests.mu.Lock()
+	defer proofRequests.mu.Unlock()
+	waiting := proofRequests.waiting[string(p.Transaction)]
+	if len(waiting) == 0 {
+		return fmt.Errorf("Unexpected proof of %x", p.Transaction)
+	}
+	var kept []proofRequest
+	for _, v := range waiting {
+		if err = p.Verify(v.anchor); err != nil {
+			kept = append(kept, v)
+			continue
+		}
+		select {
+		case v.wait <- p:
+		default:
+		}
+	}
+	if len(kept) == 0 {
+		delete(proofRequests.waiting, string(p.Transaction))
+	} else {
+		proofRequests.waiting[string(p.Transaction)] = kept
+	}
+	if len(kept) == len(waiting) {
+		return err
+	}
+	return nil
+}
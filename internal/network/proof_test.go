@@ -0,0 +1,72 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/block"
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+func TestRequestProof(t *testing.T) {
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := keystore.KeyPair{Name: "Node", DerivationPath: "0", PublicKey: master.Pub().Key, PrivateKey: master.Key}
+	var transactions []*transaction.Transaction
+	for _, e := range newTestEntries(t, transaction.Height(), 3) {
+		transactions = append(transactions, e.Tx)
+	}
+	if _, err := block.Commit(transactions, sealer); err != nil {
+		t.Fatal("Cannot commit block", err)
+	}
+	txid := transactions[1].Hash
+	p, err := block.NewProof(txid)
+	if err != nil {
+		t.Fatal("Cannot build proof", err)
+	}
+
+	c, requests := newTestPeer(t)
+	type result struct {
+		proof *block.Proof
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		proof, err := c.RequestProof(txid, block.TrustSealers(sealer.PublicKey))
+		done <- result{proof, err}
+	}()
+
+	m := nextRequest(t, requests, GetProof)
+	if !bytes.Equal(m.Payload, txid) {
+		t.Fatal("Proof of another transaction is asked")
+	}
+
+	// invalid proofs and proofs of untrusted sealers are not delivered
+	forged := *p
+	forged.Position = 0
+	if err := handleProof(forged.ToBytes()); err == nil {
+		t.Error("Invalid proof should be refused")
+	}
+	minted := *p
+	minted.Sealer = NodeKey.PublicKey
+	minted.Signature, _ = crypto.Sign(minted.BlockHash(), NodeKey.PrivateKey)
+	if err := handleProof(minted.ToBytes()); !errors.Is(err, block.ErrUntrustedProof) {
+		t.Error("Proof of an untrusted sealer should be refused", err)
+	}
+	if err := handleProof(p.ToBytes()); err != nil {
+		t.Fatal("Valid proof should be delivered", err)
+	}
+	r := <-done
+	if r.err != nil || !bytes.Equal(r.proof.BlockHash(), p.BlockHash()) || r.proof.Verify(block.TrustChain) != nil {
+		t.Error("Requested proof is not received", r.err)
+	}
+
+	if err := handleProof(p.ToBytes()); err == nil {
+		t.Error("Proof nobody asked for should be refused")
+	}
+}
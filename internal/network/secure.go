@@ -0,0 +1,212 @@
+package network
+
+// Encrypted and authenticated transport
+// After agreeing on the protocol version both sides
+// - exchange ephemeral secp256k1 keys (KeyExchange) and derive an AES-GCM key per direction (ECDH + HKDF)
+// - prove the ownership of their Node key by signing both ephemeral keys (Identity, already encrypted)
+// From then on every message is sealed into an Encrypted frame, the sequence number of the
+// direction is the nonce so that replayed, reordered or dropped messages fail to open
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+)
+
+var (
+	ErrNoNodeKey           = errors.New("Node key is not available")
+	ErrUnauthenticatedPeer = errors.New("Peer could not be authenticated")
+	ErrBannedPeer          = errors.New("Peer is banned")
+	ErrDecryption          = errors.New("Cannot decrypt message")
+)
+
+// NodeKey proves the identity of this node to its peers, the "Node" key of the keystore if not set
+var NodeKey *keystore.KeyPair
+
+var transportInfo = []byte("themachine transport")
+
+type session struct {
+	sender   cipher.AEAD
+	receiver cipher.AEAD
+	sent     uint64
+	received uint64
+}
+
+func nodeKey() (*keystore.KeyPair, error) {
+	if NodeKey != nil {
+		return NodeKey, nil
+	}
+	if key := keystore.GetKeyPairByName("Node"); key != nil {
+		return key, nil
+	}
+	return nil, ErrNoNodeKey
+}
+
+func sequenceNonce(aead cipher.AEAD, sequence uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], sequence)
+	return nonce
+}
+
+// seal encrypts message type and payload into an Encrypted message
+func (s *session) seal(m *Message) *Message {
+	plaintext := append([]byte{byte(m.Type)}, m.Payload...)
+	ciphertext := s.sender.Seal(nil, sequenceNonce(s.sender, s.sent), plaintext, nil)
+	s.sent++
+	return &Message{Encrypted, ciphertext}
+}
+
+// open decrypts an Encrypted message, anything else is refused
+func (s *session) open(m *Message) (*Message, error) {
+	if m.Type != Encrypted {
+		return nil, fmt.Errorf("%w: plaintext message %d", ErrDecryption, m.Type)
+	}
+	plaintext, err := s.receiver.Open(nil, sequenceNonce(s.receiver, s.received), m.Payload, nil)
+	if err != nil || len(plaintext) == 0 {
+		return nil, ErrDecryption
+	}
+	s.received++
+	return &Message{MessageType(plaintext[0]), plaintext[1:]}, nil
+}
+
+// exchangeKeys sets up the session, the initiator sends its key first
+// Returns the transcript (initiator key + responder key) to authenticate
+func (c *Connection) exchangeKeys(initiator bool) ([]byte, error) {
+	private, public, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var message *Message
+	if initiator {
+		if _, err = c.send(KeyExchange, public); err == nil {
+			message, err = c.expect(KeyExchange)
+		}
+	} else {
+		if message, err = c.expect(KeyExchange); err == nil {
+			_, err = c.send(KeyExchange, public)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := crypto.ECDH(private, message.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticatedPeer, err)
+	}
+	transcript := append(append([]byte{}, public...), message.Payload...)
+	if !initiator {
+		transcript = append(append([]byte{}, message.Payload...), public...)
+	}
+
+	// one key for each direction
+	keys, err := crypto.HKDF(secret, append(append([]byte{}, transportInfo...), transcript...), 2, 32)
+	if err != nil {
+		return nil, err
+	}
+	if !initiator {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	s := session{}
+	if s.sender, err = crypto.NewGCM(keys[0]); err != nil {
+		return nil, err
+	}
+	if s.receiver, err = crypto.NewGCM(keys[1]); err != nil {
+		return nil, err
+	}
+
+	c.wmu.Lock()
+	c.session = &s
+	c.wmu.Unlock()
+	return transcript, nil
+}
+
+// authenticate proves the Node key of both sides over the encrypted session
+// Identity: public key (33) + signature of the transcript and the role of the signer (64)
+func (c *Connection) authenticate(initiator bool, transcript []byte) error {
+	key, err := nodeKey()
+	if err != nil {
+		return err
+	}
+	sign := func(role bool) []byte {
+		r := byte(0)
+		if role {
+			r = 1
+		}
+		return crypto.DHash(append(append([]byte{}, transcript...), r))
+	}
+	signature, err := crypto.Sign(sign(initiator), key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	identity := append(append([]byte{}, key.PublicKey...), signature...)
+
+	var message *Message
+	if initiator {
+		if _, err = c.send(Identity, identity); err == nil {
+			message, err = c.expect(Identity)
+		}
+	} else {
+		message, err = c.expect(Identity)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(message.Payload) != 33+64 {
+		return fmt.Errorf("%w: identity is %d bytes", ErrUnauthenticatedPeer, len(message.Payload))
+	}
+	publicKey, signature := message.Payload[:33], message.Payload[33:]
+	if !crypto.Verify(signature, sign(!initiator), publicKey) {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthenticatedPeer)
+	}
+	if IsBanned(publicKey) {
+		return fmt.Errorf("%w: %s", ErrBannedPeer, hex.EncodeToString(publicKey))
+	}
+	c.PeerKey = publicKey
+
+	if !initiator {
+		_, err = c.send(Identity, identity)
+	}
+	return err
+}
+
+// Ban list by node public key
+var (
+	banned   = make(map[string]bool)
+	bannedMu sync.Mutex
+)
+
+// Ban refuses the node with given public key and closes its open connections
+func Ban(publicKey []byte) {
+	bannedMu.Lock()
+	banned[string(publicKey)] = true
+	bannedMu.Unlock()
+
+	for _, c := range connections {
+		if bytes.Equal(c.PeerKey, publicKey) {
+			fmt.Println("Closing connection to banned peer", c.Conn.RemoteAddr().String())
+			c.Conn.Close()
+		}
+	}
+}
+
+func Unban(publicKey []byte) {
+	bannedMu.Lock()
+	defer bannedMu.Unlock()
+	delete(banned, string(publicKey))
+}
+
+func IsBanned(publicKey []byte) bool {
+	bannedMu.Lock()
+	defer bannedMu.Unlock()
+	return banned[string(publicKey)]
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// runs the handshake of both sides over a pipe
+func pipeConnections(t *testing.T) (*Connection, *Connection, error, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	local, remote := initConnection(client), initConnection(server)
+	done := make(chan error)
+	go func() {
+		err := remote.accept()
+		if err != nil {
+			remote.reject(err.Error())
+		}
+		done <- err
+	}()
+	err := local.handshake()
+	return local, remote, err, <-done
+}
+
+func TestHandshake(t *testing.T) {
+
+	c, remote, err, remoteErr := pipeConnections(t)
+	if err != nil || remoteErr != nil {
+		t.Fatal("Handshake failed", err, remoteErr)
+	}
+	if c.Version != ProtocolVersion || remote.Version != ProtocolVersion || c.Agent != UserAgent {
+		t.Error("Unexpected negotiated version", c.Version, remote.Version, c.Agent)
+	}
+	if !bytes.Equal(c.PeerKey, NodeKey.PublicKey) || !bytes.Equal(remote.PeerKey, NodeKey.PublicKey) {
+		t.Error("Peers should know each other's node key")
+	}
+
+	// messages are encrypted on the wire
+	go c.send(Relay, []byte("organization data"))
+	frame, err := ReadMessage(remote.reader)
+	if err != nil {
+		t.Fatal("Cannot read frame", err)
+	}
+	if frame.Type != Encrypted || bytes.Contains(frame.Payload, []byte("organization data")) {
+		t.Error("Message should be encrypted")
+	}
+	// the raw read skipped a sequence number
+	go c.send(Relay, []byte("next"))
+	if _, err := remote.read(); !errors.Is(err, ErrDecryption) {
+		t.Error("Out of order message should not decrypt", err)
+	}
+
+	// peers only speaking newer versions are refused
+	newer := make([]byte, 4)
+	binary.BigEndian.PutUint16(newer[0:2], ProtocolVersion+2)
+	binary.BigEndian.PutUint16(newer[2:4], ProtocolVersion+1)
+	if err := initConnection(nil).acceptVersion(newer); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Error("Incompatible peer should be refused", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+
+	c, remote, err, remoteErr := pipeConnections(t)
+	if err != nil || remoteErr != nil {
+		t.Fatal("Handshake failed", err, remoteErr)
+	}
+
+	sealed := c.session.seal(&Message{Relay, []byte("transaction")})
+	tampered := *sealed
+	tampered.Payload = append([]byte{}, sealed.Payload...)
+	tampered.Payload[0] ^= 1
+	if _, err := remote.session.open(&tampered); !errors.Is(err, ErrDecryption) {
+		t.Error("Tampered message should not decrypt", err)
+	}
+	if _, err := remote.session.open(&Message{Relay, []byte("transaction")}); !errors.Is(err, ErrDecryption) {
+		t.Error("Plaintext message should be refused", err)
+	}
+
+	opened, err := remote.session.open(sealed)
+	if err != nil || opened.Type != Relay || string(opened.Payload) != "transaction" {
+		t.Fatal("Cannot open sealed message", err)
+	}
+	if _, err := remote.session.open(sealed); !errors.Is(err, ErrDecryption) {
+		t.Error("Replayed message should not decrypt", err)
+	}
+}
+
+func TestBan(t *testing.T) {
+
+	Ban(NodeKey.PublicKey)
+	defer Unban(NodeKey.PublicKey)
+
+	_, _, err, remoteErr := pipeConnections(t)
+	if err == nil || !errors.Is(remoteErr, ErrBannedPeer) {
+		t.Error("Banned peer should be refused", err, remoteErr)
+	}
+}
@@ -0,0 +1,519 @@
+package network
+
+// Chain synchronization, headers first
+// - the head (index and entry hash) of every peer is asked on connect (see StartToSyncronize)
+// - the peer with the highest head leads: it is asked where its chain leaves the local one,
+//   given the entry hashes of a few local indices (Locate -> Inventory)
+// - then for the entry hashes of missing indices (GetRange -> Inventory)
+// - entries are fetched by index from several peers at once (FetchEntry -> FetchEntryResponse)
+// - fetched entries are applied strictly in index order by transaction.AddEntry, entries of
+//   another branch reorganize the local chain once it is better, see transaction.Forks
+// Requests of lost or slow peers time out and are retried with another peer, and a restarted
+// node continues after its last transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/consensus"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+const (
+	MaxInventory = 500              // hashes per Inventory
+	MaxLocator   = 100              // hashes per Locate
+	MaxInFlight  = 16               // fetches waiting per peer
+	SyncWindow   = 4 * MaxInventory // indices ahead of the next one to apply
+	SyncTimeout  = 10 * time.Second
+)
+
+var (
+	ErrInvalidInventory = errors.New("Invalid inventory")
+	ErrInvalidLocator   = errors.New("Invalid locator")
+)
+
+type syncHead struct {
+	index uint64
+	hash  []byte // entry hash at index
+}
+
+type syncRequest struct {
+	peer *Connection
+	at   time.Time
+}
+
+// syncAction is a request to send, built under the lock and sent after
+type syncAction struct {
+	peer        *Connection
+	messageType MessageType
+	payload     []byte
+}
+
+type Syncer struct {
+	mu       sync.Mutex
+	heads    map[*Connection]syncHead
+	located  *Connection            // leader whose chain is located against the local one
+	locating syncRequest            // Locate request
+	next     uint64                 // index of the next entry to apply
+	hashes   map[uint64][]byte      // inventory of indices not applied yet
+	indices  map[string]uint64      // reverse of hashes
+	ranges   map[uint64]uint64      // start -> end (exclusive) of GetRange requests
+	rangeOf  map[uint64]syncRequest // start -> request
+	fetches  map[uint64]syncRequest // index -> FetchEntry request
+	fetched  map[uint64]*transaction.Entry
+	held     map[uint64]bool // fetched entries kept in a branch, not committed yet
+	applying bool            // entries are being added, see apply
+}
+
+// Sync is the synchronization state of this node
+var Sync = NewSyncer()
+
+func NewSyncer() *Syncer {
+	return &Syncer{
+		heads:   make(map[*Connection]syncHead),
+		hashes:  make(map[uint64][]byte),
+		indices: make(map[string]uint64),
+		ranges:  make(map[uint64]uint64),
+		rangeOf: make(map[uint64]syncRequest),
+		fetches: make(map[uint64]syncRequest),
+		fetched: make(map[uint64]*transaction.Entry),
+		held:    make(map[uint64]bool),
+	}
+}
+
+// Progress returns the index of the last applied entry and the highest head known
+func (s *Syncer) Progress() (uint64, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.next - 1, s.heads[s.leader()].index
+}
+
+// continue after the local chain
+func (s *Syncer) init() {
+	if s.next == 0 {
+		s.next = transaction.Height() + 1
+	}
+}
+
+// leader is the peer with the highest head, the located one of equals
+func (s *Syncer) leader() *Connection {
+	leader := s.located
+	if _, ok := s.heads[leader]; !ok {
+		leader = nil
+	}
+	for c, v := range s.heads {
+		if leader == nil || v.index > s.heads[leader].index {
+			leader = c
+		}
+	}
+	return leader
+}
+
+// HandleHead records the head of a peer
+func (s *Syncer) HandleHead(c *Connection, index uint64, hash []byte) {
+	s.mu.Lock()
+	s.heads[c] = syncHead{index, hash}
+	if s.located == c {
+		s.located = nil
+	}
+	s.mu.Unlock()
+	s.run()
+}
+
+// HandleInventory records the hashes of indices starting from start
+func (s *Syncer) HandleInventory(c *Connection, start uint64, hashes [][]byte) {
+	s.mu.Lock()
+	if req, ok := s.rangeOf[start]; ok && req.peer == c {
+		delete(s.ranges, start)
+		delete(s.rangeOf, start)
+	} else if s.locating.peer == c {
+		// the chain of the leader continues from start
+		s.locating = syncRequest{}
+		s.located = c
+		s.reset(start)
+	}
+	for i, hash := range hashes {
+		index := start + uint64(i)
+		if index < s.next || s.hashes[index] != nil {
+			continue
+		}
+		s.hashes[index] = hash
+		s.indices[string(hash)] = index
+	}
+	s.mu.Unlock()
+	s.run()
+}
+
+// HandleEntry takes a fetched entry, returns false if it was not asked by the sync
+func (s *Syncer) HandleEntry(c *Connection, entryBytes []byte) bool {
+	entry, err := transaction.ParseEntry(entryBytes)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	index, ok := s.indices[string(entry.Hash())]
+	if !ok || index != entry.Index {
+		// the peer is on another branch than the inventory, leave it out
+		if req, asked := s.fetches[entry.Index]; asked && req.peer == c {
+			s.removePeer(c)
+		}
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.fetches, index)
+	s.fetched[index] = entry
+	s.mu.Unlock()
+
+	s.apply()
+	s.run()
+	return true
+}
+
+// RemovePeer forgets a lost peer, its requests are retried with others
+func (s *Syncer) RemovePeer(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removePeer(c)
+}
+
+func (s *Syncer) removePeer(c *Connection) {
+	delete(s.heads, c)
+	if s.located == c {
+		s.located = nil
+	}
+	if s.locating.peer == c {
+		s.locating = syncRequest{}
+	}
+	for start, req := range s.rangeOf {
+		if req.peer == c {
+			delete(s.ranges, start)
+			delete(s.rangeOf, start)
+		}
+	}
+	for index, req := range s.fetches {
+		if req.peer == c {
+			delete(s.fetches, index)
+		}
+	}
+}
+
+// apply adds fetched entries in index order by one caller at a time, the lock is released
+// while an entry is added. Entries of a branch which is not better yet are held, the sync
+// moves past an entry once it is committed to the local chain
+func (s *Syncer) apply() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.applying {
+		// the running one picks up the new entries
+		return
+	}
+	s.applying = true
+	defer func() { s.applying = false }()
+
+	for {
+		index := s.next
+		for s.held[index] {
+			index++
+		}
+		entry, ok := s.fetched[index]
+		if !ok {
+			return
+		}
+
+		s.mu.Unlock()
+		_, err := transaction.AddEntry(entry)
+		committed := err == nil && bytes.Equal(transaction.EntryHash(index), entry.Hash())
+		s.mu.Lock()
+
+		if s.fetched[index] != entry {
+			// reset meanwhile
+			continue
+		}
+		if err != nil {
+			// the inventory or the peer is wrong, locate the chain again
+			fmt.Println("Could not apply synced entry", index, hex.EncodeToString(entry.Tx.Hash), err)
+			s.forget(index)
+			s.located = nil
+			return
+		}
+		if !committed {
+			s.held[index] = true
+			continue
+		}
+		// the entries of the branch below it are committed along with it
+		for ; s.next <= index; s.next++ {
+			s.forget(s.next)
+		}
+	}
+}
+
+// reset drops everything from index on and continues from there
+func (s *Syncer) reset(index uint64) {
+	for i := range s.hashes {
+		if i >= index {
+			s.forget(i)
+		}
+	}
+	for i := range s.fetched {
+		if i >= index {
+			s.forget(i)
+		}
+	}
+	for i := range s.fetches {
+		if i >= index {
+			s.forget(i)
+		}
+	}
+	s.ranges = make(map[uint64]uint64)
+	s.rangeOf = make(map[uint64]syncRequest)
+	s.next = index
+}
+
+func (s *Syncer) forget(index uint64) {
+	delete(s.indices, string(s.hashes[index]))
+	delete(s.hashes, index)
+	delete(s.fetches, index)
+	delete(s.fetched, index)
+	delete(s.held, index)
+}
+
+// run sends the requests the sync needs next
+func (s *Syncer) run() {
+	for _, a := range s.schedule(time.Now()) {
+		a.peer.send(a.messageType, a.payload)
+	}
+}
+
+// schedule returns the requests to send: where the chain of the leader leaves the local one first,
+// then missing inventory, then missing entries
+func (s *Syncer) schedule(now time.Time) []syncAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+
+	leader := s.leader()
+	if leader == nil {
+		return nil
+	}
+	if s.located != leader {
+		if !s.diverged(s.heads[leader]) {
+			s.located = leader
+		} else {
+			if s.locating.peer == nil || now.Sub(s.locating.at) > SyncTimeout {
+				s.locating = syncRequest{leader, now}
+				return []syncAction{{leader, Locate, locatorPayload()}}
+			}
+			return nil
+		}
+	}
+
+	// retry whatever timed out
+	for start, req := range s.rangeOf {
+		if now.Sub(req.at) > SyncTimeout {
+			delete(s.ranges, start)
+			delete(s.rangeOf, start)
+		}
+	}
+	for index, req := range s.fetches {
+		if now.Sub(req.at) > SyncTimeout {
+			// the hash may be made up, ask for it again as well
+			s.forget(index)
+		}
+	}
+
+	last := s.heads[leader].index
+	if last >= s.next+SyncWindow {
+		last = s.next + SyncWindow - 1
+	}
+
+	inFlight := make(map[*Connection]int)
+	for _, req := range s.fetches {
+		inFlight[req.peer]++
+	}
+
+	var actions []syncAction
+	for index := s.next; index <= last; {
+		if end, ok := s.rangeEnd(index); ok {
+			index = end
+			continue
+		}
+		if s.hashes[index] != nil {
+			index++
+			continue
+		}
+		// inventory of the leader only, to follow a single chain
+		peer := leader
+		count := s.heads[peer].index - index + 1
+		if count > MaxInventory {
+			count = MaxInventory
+		}
+		inFlight[peer]++
+		s.ranges[index] = index + count
+		s.rangeOf[index] = syncRequest{peer, now}
+		actions = append(actions, syncAction{peer, GetRange, rangePayload(index, uint32(count))})
+		index += count
+	}
+
+	for index := s.next; index <= last; index++ {
+		hash := s.hashes[index]
+		if hash == nil || s.fetched[index] != nil {
+			continue
+		}
+		if _, ok := s.fetches[index]; ok {
+			continue
+		}
+		peer := s.peerFor(index, inFlight)
+		if peer == nil || inFlight[peer] >= MaxInFlight {
+			continue
+		}
+		inFlight[peer]++
+		s.fetches[index] = syncRequest{peer, now}
+		actions = append(actions, syncAction{peer, FetchEntry, indexPayload(index)})
+	}
+	return actions
+}
+
+// rangeEnd returns the end of the requested range covering index
+func (s *Syncer) rangeEnd(index uint64) (uint64, bool) {
+	for start, end := range s.ranges {
+		if start <= index && index < end {
+			return end, true
+		}
+	}
+	return 0, false
+}
+
+// peerFor picks the least busy peer having the index
+func (s *Syncer) peerFor(index uint64, inFlight map[*Connection]int) *Connection {
+	var best *Connection
+	for c, head := range s.heads {
+		if head.index < index {
+			continue
+		}
+		if best == nil || inFlight[c] < inFlight[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// diverged tells if the chain of a peer may leave the local one, thus needs to be located
+func (s *Syncer) diverged(head syncHead) bool {
+	if transaction.Forks.Has(head.hash) {
+		// known and not better
+		return false
+	}
+	local := transaction.EntryHash(head.index)
+	return len(local) == 0 && head.index > 0 || !bytes.Equal(local, head.hash)
+}
+
+// keep retrying timed out requests while connected
+func (s *Syncer) loop() {
+	for !stopServer {
+		time.Sleep(time.Second)
+		s.run()
+	}
+}
+
+// sealLoop seals the waiting transactions while this node is in sync, see consensus.Propose
+func sealLoop() {
+	for !stopServer {
+		time.Sleep(consensus.BatchInterval)
+		if applied, head := Sync.Progress(); applied < head {
+			continue
+		}
+		for _, seal := range consensus.ProposeAll() {
+			RelayTransaction(nil, seal.ToBytes())
+		}
+	}
+}
+
+// GetRange: start index (8) + count (4)
+func rangePayload(start uint64, count uint32) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint64(payload[0:8], start)
+	binary.BigEndian.PutUint32(payload[8:12], count)
+	return payload
+}
+
+// Inventory: start index (8) + entry hashes (32 each) of the indices this node has
+func inventoryPayload(start uint64, count uint32) []byte {
+	if count > MaxInventory {
+		count = MaxInventory
+	}
+	payload := make([]byte, 8, 8+32*int(count))
+	binary.BigEndian.PutUint64(payload, start)
+	for i := uint64(0); i < uint64(count); i++ {
+		hash := transaction.EntryHash(start + i)
+		if hash == nil {
+			break
+		}
+		payload = append(payload, hash...)
+	}
+	return payload
+}
+
+// FetchEntry, head: index (8)
+func indexPayload(index uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, index)
+	return payload
+}
+
+// HeadResponse: index (8) + entry hash (32) of the head, no hash if the chain is empty
+func headPayload() []byte {
+	index := transaction.Height()
+	return append(indexPayload(index), transaction.EntryHash(index)...)
+}
+
+// Locate: index (8) + entry hash (32) of local indices, dense near the head then sparser down to 1
+func locatorPayload() []byte {
+	var payload []byte
+	var last uint64
+	for index, step := transaction.Height(), uint64(1); index > 0; index -= step {
+		payload = append(append(payload, indexPayload(index)...), transaction.EntryHash(index)...)
+		last = index
+		if len(payload) >= 10*40 {
+			step *= 2
+		}
+		if index <= step {
+			break
+		}
+	}
+	if last > 1 {
+		payload = append(append(payload, indexPayload(1)...), transaction.EntryHash(1)...)
+	}
+	return payload
+}
+
+// locate returns the index after the highest locator entry this node has as well
+func locate(payload []byte) (uint64, error) {
+	if len(payload)%40 != 0 || len(payload)/40 > MaxLocator {
+		return 0, fmt.Errorf("%w: %d bytes", ErrInvalidLocator, len(payload))
+	}
+	for i := 0; i < len(payload); i += 40 {
+		index := binary.BigEndian.Uint64(payload[i : i+8])
+		if bytes.Equal(transaction.EntryHash(index), payload[i+8:i+40]) {
+			return index + 1, nil
+		}
+	}
+	return 1, nil
+}
+
+func parseInventory(payload []byte) (uint64, [][]byte, error) {
+	if len(payload) < 8 || (len(payload)-8)%32 != 0 || (len(payload)-8)/32 > MaxInventory {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrInvalidInventory, len(payload))
+	}
+	var hashes [][]byte
+	for i := 8; i < len(payload); i += 32 {
+		hashes = append(hashes, payload[i:i+32])
+	}
+	return binary.BigEndian.Uint64(payload[0:8]), hashes, nil
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/transaction"
+)
+
+// a peer recording the requests it gets
+func newTestPeer(t *testing.T) (*Connection, chan *Message) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	requests := make(chan *Message, 100)
+	go func() {
+		for {
+			message, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			requests <- message
+		}
+	}()
+	return initConnection(local), requests
+}
+
+func nextRequest(t *testing.T, requests chan *Message, messageType MessageType) *Message {
+	select {
+	case m := <-requests:
+		if m.Type != messageType {
+			t.Fatal("Unexpected request", m.Type, "instead of", messageType)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("No request of type", messageType)
+	}
+	return nil
+}
+
+// entries of new organizations following the local entry at index
+func newTestEntries(t *testing.T, index uint64, n int) []*transaction.Entry {
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator := keystore.KeyPair{Name: "creator", DerivationPath: "0", PublicKey: master.Pub().Key, PrivateKey: master.Key}
+
+	var entries []*transaction.Entry
+	prevHash := transaction.EntryHash(index)
+	for i := 0; i < n; i++ {
+		foundation, _ := json.Marshal(transaction.Organization{Name: fmt.Sprint("Synced Org ", i, time.Now().UnixNano())})
+		tx, err := transaction.Build(transaction.Genesis, "json", nil, foundation, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Sign(creator)
+		entry := &transaction.Entry{Index: index + uint64(i) + 1, PrevHash: prevHash, Date: time.Now(), Tx: tx}
+		prevHash = entry.Hash()
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func entryHashes(entries []*transaction.Entry) [][]byte {
+	var hashes [][]byte
+	for _, e := range entries {
+		hashes = append(hashes, e.Hash())
+	}
+	return hashes
+}
+
+func TestSync(t *testing.T) {
+
+	s := NewSyncer()
+	base := transaction.Height()
+	entries := newTestEntries(t, base, 3)
+	a, fromA := newTestPeer(t)
+	b, fromB := newTestPeer(t)
+
+	// where the chain of the leader continues first
+	s.HandleHead(a, base+3, entries[2].Hash())
+	m := nextRequest(t, fromA, Locate)
+	if start, err := locate(m.Payload); err != nil || start != base+1 {
+		t.Fatal("Unexpected locator", start, err)
+	}
+	s.HandleHead(b, base+3, entries[2].Hash())
+
+	// then entries from both peers
+	s.HandleInventory(a, base+1, entryHashes(entries))
+	fetches := 0
+	for fetches < 3 {
+		select {
+		case m = <-fromA:
+		case m = <-fromB:
+		case <-time.After(time.Second):
+			t.Fatal("Missing fetch requests", fetches)
+		}
+		if m.Type == FetchEntry {
+			fetches++
+		}
+	}
+	if len(fromA)+len(fromB) != 0 {
+		t.Error("Unexpected requests")
+	}
+
+	// applied in order whatever order they arrive
+	if !s.HandleEntry(b, entries[2].ToBytes()) {
+		t.Fatal("Synced entry should be handled")
+	}
+	if transaction.Retrieve(entries[2].Tx.Hash) != nil {
+		t.Fatal("Entry should wait for the previous ones")
+	}
+	s.HandleEntry(a, entries[0].ToBytes())
+	s.HandleEntry(b, entries[1].ToBytes())
+	if applied, target := s.Progress(); applied != base+3 || target != base+3 {
+		t.Error("Unexpected progress", applied, target)
+	}
+	for i, e := range entries {
+		if !bytes.Equal(transaction.EntryHash(base+1+uint64(i)), e.Hash()) {
+			t.Error("Entry is not synced as it is", i)
+		}
+	}
+
+	// served back as inventory
+	start, served, err := parseInventory(inventoryPayload(base+1, 10))
+	if err != nil || start != base+1 || len(served) != 3 || !bytes.Equal(served[2], entries[2].Hash()) {
+		t.Error("Unexpected inventory", start, len(served), err)
+	}
+	if s.HandleEntry(a, entries[0].ToBytes()) {
+		t.Error("Applied entries are not handled by the sync")
+	}
+
+	// requests of a lost peer go to another one
+	s.HandleHead(a, base+5, make([]byte, 32))
+	nextRequest(t, fromA, Locate)
+	s.RemovePeer(a)
+	s.HandleHead(b, base+5, make([]byte, 32))
+	nextRequest(t, fromB, Locate)
+	s.HandleInventory(b, base+4, nil)
+	m = nextRequest(t, fromB, GetRange)
+	if binary.BigEndian.Uint64(m.Payload[0:8]) != base+4 {
+		t.Error("Unexpected range after losing a peer", m.Payload)
+	}
+
+	// and timed out ones are retried
+	if actions := s.schedule(time.Now()); len(actions) != 0 {
+		t.Error("Requests should wait for their timeout", len(actions))
+	}
+	if actions := s.schedule(time.Now().Add(SyncTimeout + time.Second)); len(actions) != 1 || actions[0].messageType != GetRange {
+		t.Error("Timed out request should be retried", actions)
+	}
+}
+
+func TestSyncFork(t *testing.T) {
+
+	s := NewSyncer()
+	base := transaction.Height()
+	local := newTestEntries(t, base, 3)
+	for _, e := range local {
+		if _, err := transaction.AddEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a peer with a longer chain leaving the local one after its first entry
+	// saved later, so the branch is not better before it is longer
+	time.Sleep(2 * time.Millisecond)
+	branch := newTestEntries(t, base+1, 3)
+	c, fromC := newTestPeer(t)
+	s.HandleHead(c, base+4, branch[2].Hash())
+	nextRequest(t, fromC, Locate)
+	s.HandleInventory(c, base+2, entryHashes(branch))
+	for range branch {
+		m := nextRequest(t, fromC, FetchEntry)
+		index := binary.BigEndian.Uint64(m.Payload)
+		s.HandleEntry(c, branch[index-base-2].ToBytes())
+		// kept in a branch until it is better, not committed
+		if applied, _ := s.Progress(); index < base+4 && applied != base+1 {
+			t.Error("Sync should not move past an entry which is not committed", index, applied)
+		}
+	}
+
+	for i, e := range branch {
+		if !bytes.Equal(transaction.EntryHash(base+2+uint64(i)), e.Hash()) {
+			t.Fatal("Chain is not reorganized to the better branch", i)
+		}
+	}
+	// replaced transactions are saved after the new head
+	for _, e := range local[1:] {
+		if tx := transaction.Retrieve(e.Tx.Hash); tx == nil || tx.Index <= base+4 {
+			t.Error("Replaced transaction is not saved again", e.Index)
+		}
+	}
+	if applied, _ := s.Progress(); applied != base+4 {
+		t.Error("Unexpected progress", applied)
+	}
+}
+
+func TestLocate(t *testing.T) {
+
+	if start, err := locate(locatorPayload()); err != nil || start != transaction.Height()+1 {
+		t.Error("Own locator should be located at the head", start, err)
+	}
+	unknown := append(indexPayload(1), make([]byte, 32)...)
+	if start, err := locate(unknown); err != nil || start != 1 {
+		t.Error("Unknown chain should be located at the start", start, err)
+	}
+	if _, err := locate(make([]byte, 39)); err == nil {
+		t.Error("Invalid locator should not be located")
+	}
+}
+
+func TestParseInventory(t *testing.T) {
+
+	for _, payload := range [][]byte{nil, make([]byte, 8+31), make([]byte, 8+32*(MaxInventory+1))} {
+		if _, _, err := parseInventory(payload); err == nil {
+			t.Error("Invalid inventory should not parse", len(payload))
+		}
+	}
+	start, hashes, err := parseInventory(make([]byte, 8+64))
+	if err != nil || start != 0 || len(hashes) != 2 {
+		t.Error("Cannot parse inventory", err)
+	}
+}
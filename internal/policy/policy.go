@@ -0,0 +1,354 @@
+package policy
+
+// Threshold policy language for required signatures
+// Organizations describe who has to sign their transactions, e.g.
+//   "5 of m/1'/1/*"                   five keys under m/1'/1
+//   "2 of board AND 1 of legal"       groups named by the organization
+//   "(1 of 0/1 OR 1 of 0/2) AND 0/3"
+// Shorthands used in targets and older organizations:
+//   "m/1'/1:5"  same as "5 of m/1'/1"
+//   "1/*+"      one or more, same as "1 of 1/*"
+//   "0/3"       same as "1 of 0/3"
+//
+// Grammar:
+//   policy    := and ( "OR" and )*
+//   and       := unary ( "AND" unary )*
+//   unary     := "(" policy ")" | threshold
+//   threshold := N "of" subject | subject [ ":" N | "+" ]
+//   subject   := derivation path | group name
+// Expressions are limited to MaxLength bytes and MaxDepth nested parentheses,
+// they come from peers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+const (
+	MaxLength = 4096 // bytes of a policy expression
+	MaxDepth  = 32   // nested parentheses
+)
+
+type Op int
+
+const (
+	Threshold Op = iota // N signatures under Path
+	And                 // all children
+	Or                  // any of children
+)
+
+// Policy is a node of a parsed policy expression
+type Policy struct {
+	Op       Op
+	N        int       // Threshold: required number of signers
+	Path     string    // Threshold: derivation path the signers should be under
+	Group    string    // Threshold: group name the path is resolved from, if any
+	Children []*Policy // And, Or
+}
+
+// SyntaxError is returned for malformed policies
+type SyntaxError struct {
+	Policy string
+	Pos    int // byte offset in Policy
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Invalid policy %q at %d: %s", e.Policy, e.Pos, e.Msg)
+}
+
+// UnsatisfiedError tells which threshold of a policy is not met
+type UnsatisfiedError struct {
+	Policy *Policy
+	Have   int
+}
+
+func (e *UnsatisfiedError) Error() string {
+	return fmt.Sprintf("Policy not satisfied: %d of %d signatures for %s", e.Have, e.Policy.N, e.Policy)
+}
+
+// Parse parses a policy expression, resolving group names via groups (name -> path)
+func Parse(expression string, groups map[string]string) (*Policy, error) {
+	if len(expression) > MaxLength {
+		return nil, &SyntaxError{expression[:32] + "...", MaxLength, fmt.Sprintf("policy longer than %d bytes", MaxLength)}
+	}
+	p := parser{expression: expression, groups: groups, tokens: tokenize(expression)}
+	if len(p.tokens) == 0 {
+		return nil, p.errorAt(len(expression), "empty policy")
+	}
+
+	policy, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, p.errorAt(t.pos, fmt.Sprintf("unexpected %q", t.text))
+	}
+	return policy, nil
+}
+
+// All combines policies into one requiring all of them. Nil for none
+func All(policies ...*Policy) *Policy {
+	switch len(policies) {
+	case 0:
+		return nil
+	case 1:
+		return policies[0]
+	}
+	return &Policy{Op: And, Children: policies}
+}
+
+// Evaluate checks the policy against the derivation paths of verified, distinct signers
+// Returns nil if satisfied, an UnsatisfiedError otherwise
+func (p *Policy) Evaluate(signers [][]uint32) error {
+	switch p.Op {
+	case And:
+		for _, child := range p.Children {
+			if err := child.Evaluate(signers); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Or:
+		var err error
+		for _, child := range p.Children {
+			if err = child.Evaluate(signers); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+
+	target, err := crypto.ParsePath(p.Path)
+	if err != nil {
+		return &UnsatisfiedError{p, 0}
+	}
+	have := 0
+	for _, v := range signers {
+		if crypto.IsPathUnderPath(v, target) {
+			have++
+		}
+	}
+	if have < p.N {
+		return &UnsatisfiedError{p, have}
+	}
+	return nil
+}
+
+// String formats the policy in its canonical form
+func (p *Policy) String() string {
+	switch p.Op {
+	case And, Or:
+		op := " AND "
+		if p.Op == Or {
+			op = " OR "
+		}
+		parts := make([]string, len(p.Children))
+		for i, child := range p.Children {
+			parts[i] = child.String()
+			if child.Op != Threshold && child.Op != p.Op {
+				parts[i] = "(" + parts[i] + ")"
+			}
+		}
+		return strings.Join(parts, op)
+	}
+
+	if p.Group != "" {
+		return fmt.Sprintf("%d of %s", p.N, p.Group)
+	}
+	return fmt.Sprintf("%d of %s", p.N, p.Path)
+}
+
+// Parser
+
+type token struct {
+	text string
+	pos  int
+}
+
+// tokenize splits on white space and parentheses
+func tokenize(expression string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range expression {
+		switch {
+		case r == '(' || r == ')':
+			if start >= 0 {
+				tokens = append(tokens, token{expression[start:i], start})
+				start = -1
+			}
+			tokens = append(tokens, token{string(r), i})
+		case r == ' ' || r == '\t' || r == '\n':
+			if start >= 0 {
+				tokens = append(tokens, token{expression[start:i], start})
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{expression[start:], start})
+	}
+	return tokens
+}
+
+type parser struct {
+	expression string
+	groups     map[string]string
+	tokens     []token
+	next       int
+	depth      int // of parentheses around the next token
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.next >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *parser) isKeyword(word string) bool {
+	t, ok := p.peek()
+	return ok && strings.EqualFold(t.text, word)
+}
+
+func (p *parser) errorAt(pos int, msg string) error {
+	return &SyntaxError{p.expression, pos, msg}
+}
+
+func (p *parser) parseOr() (*Policy, error) {
+	return p.parseList(Or, "OR", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*Policy, error) {
+	return p.parseList(And, "AND", p.parseUnary)
+}
+
+func (p *parser) parseList(op Op, keyword string, parseChild func() (*Policy, error)) (*Policy, error) {
+	first, err := parseChild()
+	if err != nil {
+		return nil, err
+	}
+	children := []*Policy{first}
+	for p.isKeyword(keyword) {
+		p.next++
+		child, err := parseChild()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &Policy{Op: op, Children: children}, nil
+}
+
+func (p *parser) parseUnary() (*Policy, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, p.errorAt(len(p.expression), "unexpected end of policy")
+	}
+
+	if t.text == "(" {
+		if p.depth++; p.depth > MaxDepth {
+			return nil, p.errorAt(t.pos, fmt.Sprintf("parentheses nested deeper than %d", MaxDepth))
+		}
+		p.next++
+		policy, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.peek()
+		if !ok || closing.text != ")" {
+			return nil, p.errorAt(t.pos, "unclosed parenthesis")
+		}
+		p.next++
+		p.depth--
+		return policy, nil
+	}
+
+	return p.parseThreshold()
+}
+
+func (p *parser) parseThreshold() (*Policy, error) {
+	t, _ := p.peek()
+	p.next++
+
+	// N of subject
+	if n, err := strconv.Atoi(t.text); err == nil && p.isKeyword("of") {
+		p.next++
+		subject, ok := p.peek()
+		if !ok {
+			return nil, p.errorAt(len(p.expression), "missing path or group after \"of\"")
+		}
+		p.next++
+		return p.threshold(n, subject)
+	}
+
+	// subject with optional suffix
+	n := 1
+	text := t.text
+	if strings.HasSuffix(text, "+") {
+		text = strings.TrimSuffix(text, "+")
+	} else if i := strings.LastIndex(text, ":"); i >= 0 {
+		var err error
+		n, err = strconv.Atoi(text[i+1:])
+		if err != nil {
+			return nil, p.errorAt(t.pos+i+1, fmt.Sprintf("invalid threshold %q", text[i+1:]))
+		}
+		text = text[:i]
+	}
+	return p.threshold(n, token{text, t.pos})
+}
+
+func (p *parser) threshold(n int, subject token) (*Policy, error) {
+	if n < 1 {
+		return nil, p.errorAt(subject.pos, fmt.Sprintf("threshold should be at least 1, got %d", n))
+	}
+
+	switch {
+	case subject.text == "(" || subject.text == ")":
+		return nil, p.errorAt(subject.pos, fmt.Sprintf("unexpected %q", subject.text))
+	case isPath(subject.text):
+		if !crypto.IsValidDerivationPath(subject.text) {
+			return nil, p.errorAt(subject.pos, fmt.Sprintf("invalid derivation path %q", subject.text))
+		}
+		return &Policy{Op: Threshold, N: n, Path: subject.text}, nil
+	}
+
+	path, ok := p.groups[subject.text]
+	if !ok {
+		return nil, p.errorAt(subject.pos, fmt.Sprintf("unknown group %q", subject.text))
+	}
+	if !crypto.IsValidDerivationPath(path) {
+		return nil, p.errorAt(subject.pos, fmt.Sprintf("group %q has invalid derivation path %q", subject.text, path))
+	}
+	return &Policy{Op: Threshold, N: n, Path: path, Group: subject.text}, nil
+}
+
+// paths start with "m", a digit or a wildcard, group names do not
+func isPath(text string) bool {
+	if text == "" {
+		return false
+	}
+	return text == "m" || strings.HasPrefix(text, "m/") || text[0] == '*' || (text[0] >= '0' && text[0] <= '9')
+}
+
+// Paths lists the derivation paths of all thresholds in the policy
+func (p *Policy) Paths() []string {
+	if p.Op == Threshold {
+		return []string{p.Path}
+	}
+	var paths []string
+	for _, child := range p.Children {
+		paths = append(paths, child.Paths()...)
+	}
+	return paths
+}
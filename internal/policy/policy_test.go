@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+var groups = map[string]string{
+	"board": "1/*",
+	"legal": "2/*",
+}
+
+func TestParse(t *testing.T) {
+
+	cases := map[string]string{
+		"5 of 1/*":                    "5 of 1/*",
+		"m/1'/1:5":                    "5 of m/1'/1",
+		"1/*+":                        "1 of 1/*",
+		"0/3":                         "1 of 0/3",
+		"2 of board AND 1 of legal":   "2 of board AND 1 of legal",
+		"2 OF board and (legal OR 3)": "2 of board AND (1 of legal OR 1 of 3)",
+		"(1/1 AND 1/2) OR 2/1":        "(1 of 1/1 AND 1 of 1/2) OR 1 of 2/1",
+	}
+
+	for expression, expected := range cases {
+		p, err := Parse(expression, groups)
+		if err != nil {
+			t.Errorf("Cannot parse %q: %s", expression, err)
+			continue
+		}
+		if p.String() != expected {
+			t.Errorf("Parsed %q as %q, expected %q", expression, p.String(), expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	for _, expression := range []string{
+		"",
+		"2 of",
+		"0 of board",
+		"2 of finance",
+		"1/a/b",
+		"1/*:x",
+		"(1/* AND 2/*",
+		"1/* 2/*",
+		"1/* AND",
+		strings.Repeat("(", MaxDepth+1) + "1/*" + strings.Repeat(")", MaxDepth+1),
+		strings.Repeat("(", 8<<20),
+		strings.Repeat("1/* OR ", MaxLength) + "1/*",
+	} {
+		_, err := Parse(expression, groups)
+		var syntaxError *SyntaxError
+		if !errors.As(err, &syntaxError) {
+			t.Errorf("Expected a syntax error for %q, got %v", expression, err)
+		}
+	}
+}
+
+func TestParseNested(t *testing.T) {
+	expression := strings.Repeat("(", MaxDepth) + "1/*" + strings.Repeat(")", MaxDepth)
+	if _, err := Parse(expression, groups); err != nil {
+		t.Error("Policy nested up to the limit should parse", err)
+	}
+	if _, err := Parse(strings.Repeat("(1/*) AND ", MaxDepth)+"1/*", groups); err != nil {
+		t.Error("Parentheses side by side should not count as nested", err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+
+	p, err := Parse("2 of board AND 1 of legal", groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	board1, _ := crypto.ParseDerivationPathString("1/3")
+	board2, _ := crypto.ParseDerivationPathString("1/4")
+	lawyer, _ := crypto.ParseDerivationPathString("2/1")
+
+	if err := p.Evaluate([][]uint32{board1, board2, lawyer}); err != nil {
+		t.Error("Policy should be satisfied", err)
+	}
+
+	err = p.Evaluate([][]uint32{board1, lawyer})
+	var unsatisfied *UnsatisfiedError
+	if !errors.As(err, &unsatisfied) || unsatisfied.Policy.Group != "board" || unsatisfied.Have != 1 {
+		t.Error("Expected missing board signature", err)
+	}
+
+	p, err = Parse("2 of board OR 1 of legal", groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Evaluate([][]uint32{lawyer}); err != nil {
+		t.Error("Either group should be enough", err)
+	}
+	if err := p.Evaluate([][]uint32{board1}); err == nil {
+		t.Error("One board member should not be enough")
+	}
+}
@@ -0,0 +1,230 @@
+package transaction
+
+// Approvals are signatures contributed to a pending transaction without
+// re-sending its data. Format:
+// hash (32) + public key length (1) + public key + signature length (1) + signature + derivation path length (1) + derivation path
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/policy"
+)
+
+var (
+	ErrInvalidApproval = errors.New("Invalid approval")
+	ErrKnownSignature  = errors.New("Signature is already known")
+	ErrUnknownPending  = errors.New("No such pending transaction")
+)
+
+type Approval struct {
+	Hash           []byte
+	PublicKey      []byte
+	Signature      []byte
+	DerivationPath []byte
+}
+
+// NewApproval signs the transaction hash with given key
+func (tx *Transaction) NewApproval(keypair keystore.KeyPair) (*Approval, error) {
+	steps, err := crypto.ParseDerivationPathString(keypair.DerivationPath)
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := crypto.GetScheme(tx.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if !scheme.IsPublicKey(keypair.PublicKey) {
+		return nil, fmt.Errorf("%s is not a %s key", keypair.Name, tx.Scheme)
+	}
+	sig, err := scheme.Sign(tx.Hash, keypair.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Approval{
+		Hash:           tx.Hash,
+		PublicKey:      keypair.PublicKey,
+		Signature:      sig,
+		DerivationPath: crypto.DerivationPathToBytes(steps),
+	}, nil
+}
+
+// ApprovalByIndex returns the signature at index as an approval
+func (tx *Transaction) ApprovalByIndex(index int) *Approval {
+	return &Approval{
+		Hash:           tx.Hash,
+		PublicKey:      tx.PublicKeys[index],
+		Signature:      tx.Signatures[index],
+		DerivationPath: tx.DerivationPaths[index],
+	}
+}
+
+// Export approval as bytes, ready to relay into the network
+// Layout: hash (32) + [public key, signature, derivation path] each prefixed by its length as in Transaction.ToBytes
+func (a *Approval) ToBytes() []byte {
+	var approvalBytes []byte
+	approvalBytes = append(approvalBytes, a.Hash...)
+	for _, v := range [][]byte{a.PublicKey, a.Signature, a.DerivationPath} {
+		approvalBytes = appendShortBytes(approvalBytes, v)
+	}
+	return approvalBytes
+}
+
+// Get bytes and construct the approval
+func ParseApproval(approvalBytes []byte) (*Approval, error) {
+	if len(approvalBytes) < 32 {
+		return nil, fmt.Errorf("%w: short message length %d", ErrInvalidApproval, len(approvalBytes))
+	}
+
+	d := decoder{buf: approvalBytes}
+	a := Approval{Hash: d.next(32)}
+	a.PublicKey = d.shortBytes()
+	a.Signature = d.shortBytes()
+	a.DerivationPath = d.shortBytes()
+	if d.err == nil && len(d.buf) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidApproval, len(d.buf))
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidApproval, d.err)
+	}
+	return &a, nil
+}
+
+// AddSignature appends a co-signature after checking it against the hash and
+// the organization key hierarchy
+func (tx *Transaction) AddSignature(publicKey []byte, signature []byte, derivationPath []byte) error {
+	if tx.hasSigner(publicKey) {
+		return ErrKnownSignature
+	}
+	if len(tx.Signatures) >= MaxSignatures {
+		return fmt.Errorf("%w: %d signatures", ErrSizeLimit, len(tx.Signatures))
+	}
+
+	steps := crypto.ParseDerivationPathBytes(derivationPath)
+	if steps == nil {
+		return fmt.Errorf("%w: malformed derivation path", ErrInvalidApproval)
+	}
+	if len(signature) == 0 {
+		return fmt.Errorf("%w: empty signature", ErrInvalidApproval)
+	}
+	tx.Signatures = append(tx.Signatures, signature)
+	tx.PublicKeys = append(tx.PublicKeys, publicKey)
+	tx.DerivationPaths = append(tx.DerivationPaths, derivationPath)
+	tx.DerivationSteps = append(tx.DerivationSteps, steps)
+
+	last := len(tx.Signatures) - 1
+	var err error
+	if !tx.VerifySignatureByIndex(last) {
+		err = fmt.Errorf("%w: signature does not match", ErrInvalidApproval)
+	} else if !tx.Organization.checkPublicKeyPath(tx.Scheme, steps, publicKey) {
+		err = fmt.Errorf("%w: public key is not derived from the organization at given path", ErrInvalidApproval)
+	}
+	if err != nil {
+		tx.Signatures = tx.Signatures[:last]
+		tx.PublicKeys = tx.PublicKeys[:last]
+		tx.DerivationPaths = tx.DerivationPaths[:last]
+		tx.DerivationSteps = tx.DerivationSteps[:last]
+		return err
+	}
+	return nil
+}
+
+// AddSignature attaches an approval to its pending transaction
+func (p *PendingPool) AddSignature(a *Approval) (*Transaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[string(a.Hash)]
+	if !ok {
+		return nil, ErrUnknownPending
+	}
+	err := entry.tx.AddSignature(a.PublicKey, a.Signature, a.DerivationPath)
+	return entry.tx.Clone(), err
+}
+
+// ProcessApproval applies an incoming approval and promotes the transaction if verified.
+// Returns ErrKnownSignature or ErrKnownTransaction if it brings nothing new, thus should not be relayed
+func ProcessApproval(approvalBytes []byte) (*Transaction, error) {
+	a, err := ParseApproval(approvalBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := Pending.AddSignature(a)
+	if err == ErrUnknownPending && len(db.Get(a.Hash).Hash) != 0 {
+		// already verified and part of the chain
+		return nil, ErrKnownTransaction
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := Pending.promote(tx.Hash); ok {
+		// as committed, e.g. with aggregated signatures
+		if saved := Retrieve(tx.Hash); saved != nil {
+			return saved, nil
+		}
+	}
+	return tx, nil
+}
+
+// EligibleKeyPairs returns the keys of this node which are asked to sign the transaction
+func (tx *Transaction) EligibleKeyPairs() []keystore.KeyPair {
+	var keypairs []keystore.KeyPair
+	scheme, err := crypto.GetScheme(tx.Scheme)
+	if err != nil {
+		return nil
+	}
+	for _, keypair := range keystore.CurrentKeyMap {
+		if !scheme.IsPublicKey(keypair.PublicKey) {
+			continue
+		}
+		keyPath, err := crypto.ParseDerivationPathString(keypair.DerivationPath)
+		if err != nil {
+			continue
+		}
+		for _, target := range tx.Targets {
+			p, err := policy.Parse(target, tx.Organization.SignatureGroups)
+			if err != nil {
+				continue
+			}
+			if isUnderAny(keyPath, p.Paths()) {
+				keypairs = append(keypairs, keypair)
+				break
+			}
+		}
+	}
+	return keypairs
+}
+
+// Approve signs the transaction with the eligible keys of this node that did not sign yet
+// The transaction itself is not modified, see ProcessApproval
+func (tx *Transaction) Approve() []*Approval {
+	var approvals []*Approval
+	for _, keypair := range tx.EligibleKeyPairs() {
+		if tx.hasSigner(keypair.PublicKey) {
+			continue
+		}
+		approval, err := tx.NewApproval(keypair)
+		if err != nil {
+			fmt.Println("Error signing transaction", err)
+			continue
+		}
+		approvals = append(approvals, approval)
+	}
+	return approvals
+}
+
+func isUnderAny(keyPath []uint32, paths []string) bool {
+	for _, path := range paths {
+		target, err := crypto.ParsePath(path)
+		if err == nil && crypto.IsPathUnderPath(keyPath, target) {
+			return true
+		}
+	}
+	return false
+}
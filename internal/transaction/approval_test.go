@@ -0,0 +1,98 @@
+package transaction
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+)
+
+func TestParseApproval(t *testing.T) {
+
+	a := Approval{
+		Hash:           bytes.Repeat([]byte{1}, 32),
+		PublicKey:      bytes.Repeat([]byte{2}, 33),
+		Signature:      bytes.Repeat([]byte{3}, 192),
+		DerivationPath: bytes.Repeat([]byte{4}, 16),
+	}
+	approvalBytes := a.ToBytes()
+
+	parsed, err := ParseApproval(approvalBytes)
+	if err != nil {
+		t.Fatal("Cannot parse approval", err)
+	}
+	if !bytes.Equal(parsed.PublicKey, a.PublicKey) || !bytes.Equal(parsed.Signature, a.Signature) || !bytes.Equal(parsed.DerivationPath, a.DerivationPath) {
+		t.Error("Parsed approval does not match")
+	}
+
+	for _, malformed := range [][]byte{approvalBytes[:20], approvalBytes[:len(approvalBytes)-1], append(approvalBytes, 0)} {
+		if _, err := ParseApproval(malformed); !errors.Is(err, ErrInvalidApproval) {
+			t.Error("Malformed approval should be rejected", err)
+		}
+	}
+}
+
+func TestProcessApproval(t *testing.T) {
+
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := Organization{
+		Name:                          "Approving Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		MinimumRequiredSignaturePaths: []string{"2 of 1/*"},
+	}
+	creator := newTestKeyPair(t)
+	genesis := newTestOrganization(t, org, creator)
+
+	file, err := Build(File, "txt", genesis.Hash, bytes.Repeat([]byte("large file"), 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Sign(creator)
+	if _, err := ProcessTransaction(cloneTransaction(file)); err != nil {
+		t.Fatal("Cannot process transaction", err)
+	}
+
+	// a key outside of the organization
+	outsider := newTestKeyPair(t)
+	outsider.DerivationPath = "1/3"
+	a, _ := file.NewApproval(outsider)
+	if _, err := ProcessApproval(a.ToBytes()); !errors.Is(err, ErrInvalidApproval) {
+		t.Error("Approval of a key outside the organization should be rejected", err)
+	}
+
+	// signature of another transaction
+	member := deriveTestKeyPair(t, master, "1/1")
+	a, _ = file.NewApproval(member)
+	a.Signature, _ = crypto.Sign(crypto.DHash([]byte("other")), member.PrivateKey)
+	if _, err := ProcessApproval(a.ToBytes()); !errors.Is(err, ErrInvalidApproval) {
+		t.Error("Approval with invalid signature should be rejected", err)
+	}
+
+	a, _ = file.NewApproval(member)
+	if _, err := ProcessApproval(a.ToBytes()); err != nil {
+		t.Fatal("Cannot add approval", err)
+	}
+	if _, err := ProcessApproval(a.ToBytes()); err != ErrKnownSignature {
+		t.Error("Same approval should be known", err)
+	}
+	if Retrieve(file.Hash) != nil {
+		t.Fatal("One approval should not be enough")
+	}
+
+	a, _ = file.NewApproval(deriveTestKeyPair(t, master, "1/2"))
+	tx, err := ProcessApproval(a.ToBytes())
+	if err != nil {
+		t.Fatal("Cannot add approval", err)
+	}
+	if len(tx.Signatures) != 3 || Pending.Get(file.Hash) != nil || Retrieve(file.Hash) == nil {
+		t.Error("Approved transaction should be promoted to the chain")
+	}
+
+	if _, err := ProcessApproval(a.ToBytes()); err != ErrKnownTransaction {
+		t.Error("Approval of a saved transaction should be known", err)
+	}
+}
@@ -0,0 +1,98 @@
+package transaction
+
+// Chain verification
+// Walks the stored chain from genesis to head and rechecks what was checked when each
+// transaction was saved: entry links and hashes (see db.CalculateEntryHash), transaction hashes,
+// every signature and the organization policy. Proves the local store was not tampered with
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+var ErrBrokenChain = errors.New("Chain is broken")
+
+// ChainError tells the first inconsistent entry of the chain
+type ChainError struct {
+	Index  uint64
+	Hash   []byte
+	Detail string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%s at index %d (%x): %s", ErrBrokenChain, e.Index, e.Hash, e.Detail)
+}
+
+func (e *ChainError) Unwrap() error {
+	return ErrBrokenChain
+}
+
+// VerifyChain checks the whole chain, returns the number of entries verified
+// Stops at the first inconsistency, returned as a *ChainError
+func VerifyChain() (uint64, error) {
+	chain := db.CurrentView()
+	height := chain.GetLastTransaction().Index
+
+	var prev db.MainDBItem
+	for index := uint64(1); index <= height; index++ {
+		item := chain.GetByIndex(index)
+		if err := verifyEntry(chain, index, item, prev); err != nil {
+			return index - 1, err
+		}
+		prev = item
+	}
+
+	// nothing may be stored beyond the head
+	if count := chain.CountNumberOfTransactions(); count != int64(height) {
+		return height, &ChainError{height + 1, nil, fmt.Sprintf("%d transactions stored for a chain of %d", count, height)}
+	}
+	return height, nil
+}
+
+// verifyEntry checks an entry of given chain following prev
+func verifyEntry(chain db.View, index uint64, item db.MainDBItem, prev db.MainDBItem) error {
+	broken := func(format string, args ...interface{}) error {
+		return &ChainError{index, item.Hash, fmt.Sprintf(format, args...)}
+	}
+
+	// links
+	if len(item.Hash) == 0 {
+		return broken("missing entry")
+	}
+	if item.Index != index {
+		return broken("entry has index %d", item.Index)
+	}
+	if !bytes.Equal(item.PrevHash, prev.EntryHash) {
+		return broken("previous entry hash is %x instead of %x", item.PrevHash, prev.EntryHash)
+	}
+	if !bytes.Equal(item.EntryHash, item.CalculateEntryHash()) {
+		return broken("entry hash does not match its content")
+	}
+
+	// the transaction itself
+	tx, err := fromChain(chain, item)
+	if err != nil {
+		return broken("%s", err)
+	}
+	if tx.ObjectType != Genesis {
+		organization := chain.Get(tx.OrganizationTx)
+		if organization.Index == 0 || organization.Index >= index {
+			return broken("organization %x is not recorded before", tx.OrganizationTx)
+		}
+	}
+	if ok, err := tx.ValidateIn(chain); !ok || err != nil {
+		return broken("%s", err)
+	}
+	for i := range tx.Signatures {
+		if !tx.VerifySignatureByIndex(i) {
+			return broken("signature %d is invalid", i)
+		}
+	}
+	if ok, err := tx.Verify(); !ok || err != nil {
+		return broken("not verified by the organization policy: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package transaction
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+// copies the chain of the current store into a new one, changing the entry at given index
+func tamperedChain(t *testing.T, index uint64, change func(item *db.MainDBItem)) db.Store {
+	s := db.NewMemoryStore()
+	for i := uint64(1); i <= Height(); i++ {
+		item := db.GetByIndex(i)
+		if i == index {
+			change(&item)
+		}
+		if err := s.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestVerifyChain(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, Organization{Name: "Chain Org"}, keypair)
+	for _, data := range []string{"first", "second"} {
+		file, err := Build(File, "txt", genesis.Hash, []byte(data), nil)
+		if err != nil {
+			t.Fatal("Cannot build file transaction", err)
+		}
+		file.Sign(keypair)
+		file.Save()
+	}
+
+	count, err := VerifyChain()
+	if err != nil || count != 3 {
+		t.Fatal("Chain should be consistent", count, err)
+	}
+
+	cases := []struct {
+		name   string
+		index  uint64
+		change func(item *db.MainDBItem)
+	}{
+		{"data", 2, func(item *db.MainDBItem) { item.Data = []byte("changed") }},
+		{"signature", 3, func(item *db.MainDBItem) {
+			item.Signatures = [][]byte{make([]byte, 64)}
+			item.EntryHash = item.CalculateEntryHash()
+		}},
+		{"link", 2, func(item *db.MainDBItem) {
+			item.PrevHash = make([]byte, 32)
+			item.EntryHash = item.CalculateEntryHash()
+		}},
+		{"entry hash", 3, func(item *db.MainDBItem) { item.Date = item.Date.Add(-1e9) }},
+		{"index", 3, func(item *db.MainDBItem) { item.Index = 4 }},
+	}
+	chain := db.Current()
+	for _, c := range cases {
+		db.Use(tamperedChain(t, c.index, c.change))
+		count, err := VerifyChain()
+		var chainErr *ChainError
+		if !errors.As(err, &chainErr) || !errors.Is(err, ErrBrokenChain) {
+			t.Error("Tampered", c.name, "should break the chain", err)
+		} else if chainErr.Index != c.index || count != c.index-1 {
+			t.Error("Tampered", c.name, "is reported at", chainErr.Index, count, err)
+		}
+		db.Use(chain)
+	}
+}
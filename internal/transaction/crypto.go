@@ -1,26 +1,17 @@
 package transaction
 
 import (
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/alpdeniz/themachine/internal/crypto"
 	"github.com/alpdeniz/themachine/internal/keystore"
 )
 
+// GetHashedBytes returns the body encoding of the transaction, i.e. everything but the signatures
 func (tx *Transaction) GetHashedBytes() []byte {
-	var totalLen int = len(tx.Meta) + len(tx.OrganizationTx) + len(tx.Data) + len(strings.Join(tx.Targets, ","))
-	tmp := make([]byte, totalLen)
-	slices := [4][]byte{tx.Meta[:], tx.OrganizationTx, tx.Data, []byte(strings.Join(tx.Targets, ","))}
-	var i int
-	for _, s := range slices {
-		i += copy(tmp[i:], s)
-	}
-
-	return tmp
+	return tx.encodeBody()
 }
 
 func (tx *Transaction) CalculateHash() []byte {
@@ -38,14 +29,21 @@ func (tx *Transaction) CheckInitialSignature() (bool, error) {
 	return ok, nil
 }
 
-func (tx *Transaction) CheckSignatures() int {
+// CheckSignatures returns the derivation paths of distinct co-signers whose
+// signatures are valid and whose keys derive from the organization master public key
+func (tx *Transaction) CheckSignatures() [][]uint32 {
 
-	signatureCounter := 0
+	var signers [][]uint32
+	seen := make(map[string]bool)
 	for i, v := range tx.PublicKeys {
 		// skip first signature
 		if i == 0 {
 			continue
 		}
+		// count each signer once
+		if seen[string(v)] {
+			continue
+		}
 
 		// check signature
 		ok := tx.VerifySignatureByIndex(i)
@@ -54,46 +52,207 @@ func (tx *Transaction) CheckSignatures() int {
 			continue
 		}
 		// check if provided path is correct for organization master key
-		if crypto.CheckPublicKeyPath(tx.DerivationSteps[i], v, hex.EncodeToString(tx.Organization.MasterPublicKey)) {
-			// go over targets
-			for _, v2 := range tx.Targets {
-				// check if it belongs to one of the target paths
-				if crypto.IsPathUnderPath(tx.DerivationSteps[i], crypto.ParseDerivationPathString(v2)) {
-					signatureCounter++
-				}
-			}
-		} // given derivation path to the public key does not correspond
-	}
-	return signatureCounter
+		if !tx.Organization.checkPublicKeyPath(tx.Scheme, tx.DerivationSteps[i], v) {
+			// given derivation path to the public key does not correspond
+			continue
+		}
+		seen[string(v)] = true
+		signers = append(signers, tx.DerivationSteps[i])
+	}
+	return signers
 }
 
-func (tx *Transaction) IsVerified(signatureCounter int) bool {
-	sum := 0
-	for range tx.MinimumRequiredSignatures {
-		sum++
+// IsVerified evaluates the signature policy of the transaction over given signers
+func (tx *Transaction) IsVerified(signers [][]uint32) (bool, error) {
+	p, err := tx.Policy()
+	if err != nil {
+		return false, err
 	}
-	return sum == signatureCounter
+	// nothing required
+	if p == nil {
+		return true, nil
+	}
+	if err := p.Evaluate(signers); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Function to call when the key is ready and transaction is approved
 func (tx *Transaction) Sign(keypair keystore.KeyPair) {
 	// This signing should be done by people
-	fmt.Println("Signing transaction with", keypair)
-	sig, err := crypto.Sign(tx.Hash, keypair.PrivateKey)
+	fmt.Println("Signing transaction with", keypair.Name)
+	approval, err := tx.NewApproval(keypair)
 	if err != nil {
 		fmt.Println("Error signing transaction", err)
+		return
 	}
-	tx.Signatures = append(tx.Signatures, sig)
-	tx.PublicKeys = append(tx.PublicKeys, keypair.PublicKey)
-	var tmpBytes = make([]byte, 4)
-	var derivationPathBytes = make([]byte, 16)
-	for i, v := range crypto.ParseDerivationPathString(keypair.DerivationPath) {
-		binary.BigEndian.PutUint32(tmpBytes, v)
-		copy(derivationPathBytes[i*4:(i+1)*4], tmpBytes)
-	}
-	tx.DerivationPaths = append(tx.DerivationPaths, derivationPathBytes)
+	tx.Signatures = append(tx.Signatures, approval.Signature)
+	tx.PublicKeys = append(tx.PublicKeys, approval.PublicKey)
+	tx.DerivationPaths = append(tx.DerivationPaths, approval.DerivationPath)
+	tx.DerivationSteps = append(tx.DerivationSteps, crypto.ParseDerivationPathBytes(approval.DerivationPath))
 }
 
+// VerifySignatureByIndex checks the signature at index, an empty co-signature is checked
+// as part of the aggregate signature, see Aggregate
 func (tx *Transaction) VerifySignatureByIndex(index int) bool {
-	return crypto.Verify(tx.Signatures[index], tx.Hash, tx.PublicKeys[index])
+	scheme, err := crypto.GetScheme(tx.Scheme)
+	if err != nil {
+		return false
+	}
+	if len(tx.Signatures[index]) == 0 && index > 0 {
+		return tx.verifyAggregate()
+	}
+	return scheme.Verify(tx.Signatures[index], tx.Hash, tx.PublicKeys[index])
+}
+
+// aggregates tells if the signature scheme of the transaction compresses co-signatures
+func (tx *Transaction) aggregates() bool {
+	scheme, err := crypto.GetScheme(tx.Scheme)
+	if err != nil {
+		return false
+	}
+	_, ok := scheme.(crypto.AggregateVerifier)
+	return ok
+}
+
+// aggregator returns the scheme of the transaction if its signatures can be folded afterwards
+func (tx *Transaction) aggregator() crypto.Aggregator {
+	scheme, err := crypto.GetScheme(tx.Scheme)
+	if err != nil {
+		return nil
+	}
+	aggregator, _ := scheme.(crypto.Aggregator)
+	return aggregator
+}
+
+// Aggregate folds the valid co-signatures into AggregateSignature, so that N approvals
+// take the space of one. Signers stay listed with an empty signature, the ones with an
+// invalid signature are dropped. The initial signature is kept as it is
+func (tx *Transaction) Aggregate() error {
+	aggregator := tx.aggregator()
+	if aggregator == nil {
+		return fmt.Errorf("%s signatures cannot be aggregated", tx.Scheme)
+	}
+	if len(tx.Signatures) < 2 {
+		return nil
+	}
+
+	var signatures [][]byte
+	if len(tx.AggregateSignature) != 0 {
+		if !tx.verifyAggregate() {
+			return errors.New("Invalid aggregate signature")
+		}
+		signatures = append(signatures, tx.AggregateSignature)
+	}
+	kept := []int{0}
+	for i := 1; i < len(tx.Signatures); i++ {
+		if len(tx.Signatures[i]) == 0 {
+			kept = append(kept, i)
+			continue
+		}
+		if !tx.VerifySignatureByIndex(i) {
+			continue
+		}
+		signatures = append(signatures, tx.Signatures[i])
+		kept = append(kept, i)
+	}
+	if len(signatures) == 0 {
+		return nil
+	}
+	aggregate, err := aggregator.Aggregate(signatures)
+	if err != nil {
+		return err
+	}
+
+	var result Transaction
+	for _, i := range kept {
+		signature := tx.Signatures[i]
+		if i > 0 {
+			signature = nil
+		}
+		result.Signatures = append(result.Signatures, signature)
+		result.PublicKeys = append(result.PublicKeys, tx.PublicKeys[i])
+		result.DerivationPaths = append(result.DerivationPaths, tx.DerivationPaths[i])
+		result.DerivationSteps = append(result.DerivationSteps, tx.DerivationSteps[i])
+	}
+	tx.Signatures = result.Signatures
+	tx.PublicKeys = result.PublicKeys
+	tx.DerivationPaths = result.DerivationPaths
+	tx.DerivationSteps = result.DerivationSteps
+	tx.AggregateSignature = aggregate
+	return nil
+}
+
+// verifyAggregate checks the aggregate signature against the co-signers with an empty signature
+// Their keys have to derive from the organization: the sum of the keys is checked, a key chosen
+// as a function of the others could otherwise claim the signatures of all
+func (tx *Transaction) verifyAggregate() bool {
+	scheme, err := crypto.GetScheme(tx.Scheme)
+	if err != nil {
+		return false
+	}
+	verifier, ok := scheme.(crypto.AggregateVerifier)
+	if !ok || len(tx.AggregateSignature) == 0 {
+		return false
+	}
+	var publicKeys [][]byte
+	for i := 1; i < len(tx.Signatures); i++ {
+		if len(tx.Signatures[i]) != 0 {
+			continue
+		}
+		if !tx.Organization.checkPublicKeyPath(tx.Scheme, tx.DerivationSteps[i], tx.PublicKeys[i]) {
+			return false
+		}
+		publicKeys = append(publicKeys, tx.PublicKeys[i])
+	}
+	return verifier.VerifyAggregate(tx.AggregateSignature, tx.Hash, publicKeys)
+}
+
+// AddAggregateSignature attaches the signature co-signers made together, e.g. with a MuSig2
+// session over the transaction hash (see crypto.MuSigSession). The signers are listed in the
+// order of the signature with an empty signature each
+func (tx *Transaction) AddAggregateSignature(signature []byte, publicKeys [][]byte, derivationPaths [][]byte) error {
+	if !tx.aggregates() {
+		return fmt.Errorf("%s signatures cannot be aggregated", tx.Scheme)
+	}
+	if len(tx.Signatures) == 0 {
+		return errors.New("Transaction is not signed")
+	}
+	if len(tx.AggregateSignature) != 0 {
+		return errors.New("Transaction already has an aggregate signature")
+	}
+	if len(publicKeys) == 0 || len(publicKeys) != len(derivationPaths) {
+		return fmt.Errorf("%w: %d public keys with %d derivation paths", ErrInvalidApproval, len(publicKeys), len(derivationPaths))
+	}
+
+	var steps [][]uint32
+	for i, v := range publicKeys {
+		if tx.hasSigner(v) {
+			return ErrKnownSignature
+		}
+		s := crypto.ParseDerivationPathBytes(derivationPaths[i])
+		if s == nil {
+			return fmt.Errorf("%w: malformed derivation path", ErrInvalidApproval)
+		}
+		steps = append(steps, s)
+	}
+
+	result := *tx
+	result.AggregateSignature = signature
+	result.Signatures = append([][]byte{}, tx.Signatures...)
+	result.PublicKeys = append([][]byte{}, tx.PublicKeys...)
+	result.DerivationPaths = append([][]byte{}, tx.DerivationPaths...)
+	result.DerivationSteps = append([][]uint32{}, tx.DerivationSteps...)
+	for i := range publicKeys {
+		result.Signatures = append(result.Signatures, nil)
+		result.PublicKeys = append(result.PublicKeys, publicKeys[i])
+		result.DerivationPaths = append(result.DerivationPaths, derivationPaths[i])
+		result.DerivationSteps = append(result.DerivationSteps, steps[i])
+	}
+	if !result.verifyAggregate() {
+		return fmt.Errorf("%w: aggregate signature does not match", ErrInvalidApproval)
+	}
+	*tx = result
+	return nil
 }
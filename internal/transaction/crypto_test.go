@@ -0,0 +1,252 @@
+package transaction
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+)
+
+// derives the BLS keypair of an organization member
+func deriveTestBLSKeyPair(t *testing.T, masterPrivateKey []byte, path string) keystore.KeyPair {
+	steps, err := crypto.ParseDerivationPathString(path)
+	if err != nil {
+		t.Fatal("Invalid derivation path", err)
+	}
+	sk, err := crypto.BLSDeriveKey(steps, masterPrivateKey)
+	if err != nil {
+		t.Fatal("Cannot derive BLS key", err)
+	}
+	pk, _ := crypto.BLSPublicKey(sk)
+	return keystore.KeyPair{Name: path, DerivationPath: path, PublicKey: pk, PrivateKey: sk}
+}
+
+func TestAggregateSignatures(t *testing.T) {
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blsMaster, blsMasterPublic, err := crypto.BLSMasterKey(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := Organization{
+		Name:                            "BLS Org",
+		MasterPublicKey:                 master.Pub().Serialize(),
+		BLSMasterPublicKey:              blsMasterPublic,
+		RequiredSignaturePathsPerObject: map[string][]string{"Decision": {"3 of board"}},
+		SignatureGroups:                 map[string]string{"board": "1/*"},
+	}
+	genesis := newTestOrganization(t, org, newTestKeyPair(t))
+
+	decision, err := Build(Decision, "json", genesis.Hash, []byte(`{"aggregate": true}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decision.UseScheme(crypto.BLS); err != nil {
+		t.Fatal(err)
+	}
+	creator := deriveTestBLSKeyPair(t, blsMaster, "9")
+	decision.Sign(creator)
+	if ok, err := decision.Validate(); !ok {
+		t.Fatal("BLS decision should be valid", err)
+	}
+	if _, err := decision.NewApproval(deriveTestKeyPair(t, master, "1/1")); err == nil {
+		t.Error("secp256k1 key should not sign a BLS transaction")
+	}
+
+	for _, path := range []string{"1/1", "1/2", "1/3"} {
+		decision.Sign(deriveTestBLSKeyPair(t, blsMaster, path))
+	}
+	if ok, err := decision.Verify(); !ok {
+		t.Fatal("Decision should be verified", err)
+	}
+	size := len(decision.ToBytes())
+
+	if err := decision.Aggregate(); err != nil {
+		t.Fatal("Cannot aggregate", err)
+	}
+	if len(decision.Signatures) != 4 || len(decision.Signatures[0]) == 0 || len(decision.Signatures[1]) != 0 || len(decision.AggregateSignature) == 0 {
+		t.Fatal("Co-signatures should be folded into the aggregate signature")
+	}
+	// a BLS signature is 192 bytes, its length takes a second byte
+	if saved := size - len(decision.ToBytes()); saved != 2*(crypto.BLSSignatureSize+1) {
+		t.Error("Three signatures should take the space of one, saved", saved)
+	}
+	if ok, err := decision.Verify(); !ok {
+		t.Error("Aggregated decision should be verified", err)
+	}
+
+	parsed, err := ParseBytes(decision.ToBytes())
+	if err != nil {
+		t.Fatal("Cannot parse aggregated transaction", err)
+	}
+	if ok, err := parsed.Validate(); !ok {
+		t.Fatal("Parsed decision should be valid", err)
+	}
+	if ok, err := parsed.Verify(); !ok || parsed.Scheme != crypto.BLS {
+		t.Error("Parsed decision should be verified", err)
+	}
+	if stored := fromDBItem(decision.ToDBItem()); stored.Scheme != crypto.BLS || string(stored.AggregateSignature) != string(decision.AggregateSignature) || stored.Meta != decision.Meta {
+		t.Error("Scheme and aggregate signature should be stored")
+	}
+
+	// the aggregate only holds for all of its signers
+	forged := *parsed
+	forged.AggregateSignature = forged.Signatures[0]
+	if ok, _ := forged.Verify(); ok {
+		t.Error("Forged aggregate should not verify")
+	}
+	forged = *parsed
+	forged.Signatures = forged.Signatures[:3]
+	forged.PublicKeys = forged.PublicKeys[:3]
+	forged.DerivationPaths = forged.DerivationPaths[:3]
+	forged.DerivationSteps = forged.DerivationSteps[:3]
+	if ok, _ := forged.Verify(); ok {
+		t.Error("Aggregate should not verify without one of its signers")
+	}
+
+	// later approvals fold into the existing aggregate
+	parsed.Sign(deriveTestBLSKeyPair(t, blsMaster, "1/4"))
+	if err := parsed.Aggregate(); err != nil || len(parsed.Signatures[4]) != 0 {
+		t.Fatal("Cannot aggregate a new approval", err)
+	}
+	if signers := parsed.CheckSignatures(); len(signers) != 4 {
+		t.Error("All co-signers should count", len(signers))
+	}
+}
+
+func TestAggregateOnPromotion(t *testing.T) {
+	master, _ := crypto.NewWallet()
+	blsMaster, blsMasterPublic, _ := crypto.BLSMasterKey(master)
+	org := Organization{
+		Name:                          "BLS Promotion Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		BLSMasterPublicKey:            blsMasterPublic,
+		MinimumRequiredSignaturePaths: []string{"2 of 1/*"},
+	}
+	genesis := newTestOrganization(t, org, newTestKeyPair(t))
+
+	tx, _ := Build(Object, "json", genesis.Hash, []byte(`{"promoted": true}`), nil)
+	tx.UseScheme(crypto.BLS)
+	tx.Sign(deriveTestBLSKeyPair(t, blsMaster, "9"))
+	tx.Sign(deriveTestBLSKeyPair(t, blsMaster, "1/1"))
+	tx.Sign(deriveTestBLSKeyPair(t, blsMaster, "1/2"))
+	if _, err := Process(tx.ToBytes()); err != nil {
+		t.Fatal("Cannot process transaction", err)
+	}
+	saved := Retrieve(tx.Hash)
+	if saved == nil || len(saved.AggregateSignature) == 0 {
+		t.Fatal("Promoted transaction should be saved with an aggregate signature")
+	}
+	if ok, err := saved.Verify(); !ok {
+		t.Error("Saved transaction should be verified", err)
+	}
+
+	// an organization without BLS master key cannot check BLS signers
+	plain := newTestOrganization(t, Organization{Name: "Plain Org", MasterPublicKey: master.Pub().Serialize()}, newTestKeyPair(t))
+	other, _ := Build(Object, "json", plain.Hash, []byte("{}"), nil)
+	other.UseScheme(crypto.BLS)
+	other.Sign(deriveTestBLSKeyPair(t, blsMaster, "9"))
+	if _, err := other.Validate(); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Error("BLS transaction of an organization without BLS master key should be refused", err)
+	}
+}
+
+func TestMuSigTransaction(t *testing.T) {
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := Organization{
+		Name:                          "Schnorr Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		MinimumRequiredSignaturePaths: []string{"3 of board"},
+		SignatureGroups:               map[string]string{"board": "1/*"},
+	}
+	creator := newTestKeyPair(t)
+	genesis := newTestOrganization(t, org, creator)
+
+	tx, _ := Build(Object, "json", genesis.Hash, []byte(`{"musig": true}`), nil)
+	if err := tx.UseScheme(crypto.Schnorr); err != nil {
+		t.Fatal(err)
+	}
+	tx.Sign(creator)
+	if ok, err := tx.Validate(); !ok {
+		t.Fatal("Schnorr transaction should be valid", err)
+	}
+
+	// the usual HD keys of the board sign together
+	var board []keystore.KeyPair
+	var publicKeys, paths [][]byte
+	for _, path := range []string{"1/1", "1/2", "1/3"} {
+		keypair := deriveTestKeyPair(t, master, path)
+		steps, _ := crypto.ParseDerivationPathString(path)
+		board = append(board, keypair)
+		publicKeys = append(publicKeys, keypair.PublicKey)
+		paths = append(paths, crypto.DerivationPathToBytes(steps))
+	}
+	nonces := make([]*crypto.MuSigNonce, len(board))
+	publicNonces := make([][]byte, len(board))
+	for i, keypair := range board {
+		nonces[i], publicNonces[i], err = crypto.MuSigNonceGen(keypair.PrivateKey, tx.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	aggregateNonce, _ := crypto.MuSigNonceAgg(publicNonces)
+	session, err := crypto.NewMuSigSession(publicKeys, aggregateNonce, tx.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partials [][]byte
+	for i, keypair := range board {
+		partial, err := session.Sign(nonces[i], keypair.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partials = append(partials, partial)
+	}
+	signature, _ := session.Aggregate(partials)
+
+	if err := tx.AddAggregateSignature(signature, publicKeys[:2], paths[:2]); err == nil {
+		t.Error("Aggregate signature should not be attached to part of its signers")
+	}
+	if err := tx.AddAggregateSignature(signature, publicKeys, paths); err != nil {
+		t.Fatal("Cannot attach aggregate signature", err)
+	}
+	if ok, err := tx.Verify(); !ok {
+		t.Error("Transaction signed with MuSig2 should be verified", err)
+	}
+	if err := tx.AddAggregateSignature(signature, publicKeys, paths); err == nil {
+		t.Error("Second aggregate signature should be refused")
+	}
+	if err := tx.Aggregate(); err == nil {
+		t.Error("Schnorr signatures made apart should not be aggregated")
+	}
+
+	parsed, err := ParseBytes(tx.ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := parsed.Validate(); !ok {
+		t.Fatal("Parsed transaction should be valid", err)
+	}
+	if ok, err := parsed.Verify(); !ok || len(parsed.AggregateSignature) != crypto.SchnorrSignatureSize {
+		t.Error("Parsed transaction should be verified", err)
+	}
+
+	// keys out of the organization tree do not count even if they sign together
+	outsider, _ := Build(Object, "json", genesis.Hash, []byte(`{"musig": false}`), nil)
+	outsider.UseScheme(crypto.Schnorr)
+	outsider.Sign(creator)
+	stranger := newTestKeyPair(t)
+	nonce, publicNonce, _ := crypto.MuSigNonceGen(stranger.PrivateKey, outsider.Hash)
+	session, _ = crypto.NewMuSigSession([][]byte{stranger.PublicKey}, publicNonce, outsider.Hash)
+	partial, _ := session.Sign(nonce, stranger.PrivateKey)
+	signature, _ = session.Aggregate([][]byte{partial})
+	if err := outsider.AddAggregateSignature(signature, [][]byte{stranger.PublicKey}, paths[:1]); !errors.Is(err, ErrInvalidApproval) {
+		t.Error("Key not derived from the organization should be refused", err)
+	}
+}
@@ -0,0 +1,98 @@
+package transaction
+
+// Entries of the chain as exchanged between nodes
+// An entry is a transaction at its place in the chain: index, link to the previous entry
+// and the date it was saved. Entries are saved as they are so that every node ends up
+// with the same entry hashes, see db.CalculateEntryHash
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+type Entry struct {
+	Index    uint64
+	PrevHash []byte // hash of the previous entry, empty for the first one
+	Date     time.Time
+	Tx       *Transaction
+}
+
+// dbItem is the entry as saved
+func (e *Entry) dbItem() db.MainDBItem {
+	item := e.Tx.ToDBItem()
+	item.Index = e.Index
+	item.PrevHash = e.PrevHash
+	item.Date = e.Date
+	item.EntryHash = item.CalculateEntryHash()
+	return item
+}
+
+func (e *Entry) Hash() []byte {
+	return e.dbItem().EntryHash
+}
+
+// Export entry as bytes
+// Layout (little endian): index (8) + date in milliseconds (8) + previous entry hash length (varint)
+// + previous entry hash + transaction, see Transaction.ToBytes
+func (e *Entry) ToBytes() []byte {
+	entryBytes := make([]byte, 16, 17+len(e.PrevHash))
+	binary.LittleEndian.PutUint64(entryBytes[0:8], e.Index)
+	binary.LittleEndian.PutUint64(entryBytes[8:16], uint64(e.Date.UnixNano()/1e6))
+	entryBytes = appendShortBytes(entryBytes, e.PrevHash)
+	return append(entryBytes, e.Tx.ToBytes()...)
+}
+
+// Parse entry bytes, see ToBytes
+func ParseEntry(entryBytes []byte) (*Entry, error) {
+	d := decoder{buf: entryBytes}
+	index := d.next(8)
+	date := d.next(8)
+	prevHash := d.shortBytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(prevHash) != 0 && len(prevHash) != 32 {
+		d.fail("previous entry hash is %d bytes", len(prevHash))
+		return nil, d.err
+	}
+
+	tx, err := ParseBytes(d.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Entry{
+		Index:    binary.LittleEndian.Uint64(index),
+		PrevHash: prevHash,
+		Date:     time.Unix(0, int64(binary.LittleEndian.Uint64(date))*1e6),
+		Tx:       tx,
+	}
+	tx.Index = e.Index
+	tx.Date = e.Date
+	return &e, nil
+}
+
+func entryFromDBItem(item db.MainDBItem) *Entry {
+	return &Entry{
+		Index:    item.Index,
+		PrevHash: item.PrevHash,
+		Date:     item.Date,
+		Tx:       fromDBItem(item),
+	}
+}
+
+// Get the entry at given index of the chain
+func RetrieveEntry(index uint64) *Entry {
+	item := db.GetByIndex(index)
+	if len(item.Hash) == 0 {
+		return nil
+	}
+	return entryFromDBItem(item)
+}
+
+// EntryHash returns the hash of the entry at given index, nil if there is none
+func EntryHash(index uint64) []byte {
+	return db.GetByIndex(index).EntryHash
+}
@@ -0,0 +1,85 @@
+package transaction
+
+// Finality of organizations
+// The entries of an organization up to its last seal are final: a fork starting with an entry of
+// the organization at or below it is refused, see AddEntry. Only seals accepted by SealVerifier,
+// signed by the validators of the organization, count. Seals of one organization do not keep
+// entries of others from being replaced.
+// The index of the seals is kept as the chain grows, reading every entry once, and cut back when
+// the chain is reorganized. It is rebuilt only when the last entry read is no longer in the chain.
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+type finalityIndex struct {
+	mu      sync.Mutex
+	through uint64              // index of the last entry read
+	last    []byte              // entry hash of the last entry read, the index is rebuilt for another chain
+	seals   map[string][]uint64 // organization tx -> indices of its seals in chain order
+}
+
+var finality = &finalityIndex{}
+
+// Finalized returns the index of the last seal of the organization, its entries up to it are final
+func Finalized(organizationTx []byte) uint64 {
+	finality.mu.Lock()
+	defer finality.mu.Unlock()
+	finality.update()
+	seals := finality.seals[string(organizationTx)]
+	if len(seals) == 0 {
+		return 0
+	}
+	return seals[len(seals)-1]
+}
+
+// update reads the entries added since the last call, f.mu is held
+func (f *finalityIndex) update() {
+	chain := db.CurrentView()
+	if f.seals == nil || !bytes.Equal(chain.GetByIndex(f.through).EntryHash, f.last) {
+		f.through = 0
+		f.last = nil
+		f.seals = make(map[string][]uint64)
+	}
+	for height := chain.GetLastTransaction().Index; f.through < height; {
+		f.through++
+		item := chain.GetByIndex(f.through)
+		f.last = item.EntryHash
+		if item.ObjectType != byte(Seal) {
+			continue
+		}
+		tx, err := fromChain(chain, item)
+		if err != nil || SealVerifier == nil || SealVerifier(tx, chain) != nil {
+			continue
+		}
+		f.seals[string(tx.OrganizationTx)] = append(f.seals[string(tx.OrganizationTx)], item.Index)
+	}
+}
+
+// replaced forgets the seals from index on, the chain is replaced from there
+func (f *finalityIndex) replaced(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.through >= index {
+		f.through = index - 1
+		f.last = db.GetByIndex(f.through).EntryHash
+	}
+	for k, v := range f.seals {
+		kept := len(v)
+		for kept > 0 && v[kept-1] >= index {
+			kept--
+		}
+		f.seals[k] = v[:kept]
+	}
+}
+
+// organizationOf returns the organization an entry belongs to, a genesis is its own
+func organizationOf(tx *Transaction) []byte {
+	if tx.ObjectType == Genesis {
+		return tx.Hash
+	}
+	return tx.OrganizationTx
+}
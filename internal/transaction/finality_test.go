@@ -0,0 +1,70 @@
+package transaction
+
+import (
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+func TestFinalized(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+	defer func(verifier func(tx *Transaction, chain db.View) error) { SealVerifier = verifier }(SealVerifier)
+	verified := 0
+	SealVerifier = func(tx *Transaction, chain db.View) error {
+		verified++
+		if string(tx.Data) == "forged" {
+			return ErrInvalidSeal
+		}
+		return nil
+	}
+
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, Organization{Name: "Final Org"}, keypair)
+	seal := func(data string) {
+		tx, err := Build(Seal, "batch", genesis.Hash, []byte(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Sign(keypair)
+		tx.Save()
+	}
+
+	seal("sealed")
+	seal("forged")
+	if finalized := Finalized(genesis.Hash); finalized != 2 {
+		t.Error("Only accepted seals should count", finalized)
+	}
+	seal("sealed again")
+	if finalized := Finalized(genesis.Hash); finalized != 4 {
+		t.Error("New seal should be read", finalized)
+	}
+	if finalized := Finalized(make([]byte, 32)); finalized != 0 {
+		t.Error("Other organizations should not be final", finalized)
+	}
+
+	// a replaced seal no longer counts
+	if _, err := db.ReplaceFrom(4, nil); err != nil {
+		t.Fatal(err)
+	}
+	finality.replaced(4)
+	if finalized := Finalized(genesis.Hash); finalized != 2 {
+		t.Error("Replaced seal should not count", finalized)
+	}
+
+	// the same chain in another store is not read again, another chain is
+	verified = 0
+	copied := db.NewMemoryStore()
+	for index := uint64(1); index <= Height(); index++ {
+		copied.Insert(db.GetByIndex(index))
+	}
+	db.Use(copied)
+	if finalized := Finalized(genesis.Hash); finalized != 2 || verified != 0 {
+		t.Error("Same chain should not be read again", finalized, verified)
+	}
+	db.Use(db.NewMemoryStore())
+	if finalized := Finalized(genesis.Hash); finalized != 0 {
+		t.Error("Seals of another chain should not count", finalized)
+	}
+}
@@ -0,0 +1,304 @@
+package transaction
+
+// Forks of the chain
+// Nodes saving transactions at the same time end up with different entries at the same index.
+// Entries of peers that do not extend the local head are kept in branches diverging from the
+// local chain. Every node picks the canonical chain by the same rule:
+// - the longer chain wins
+// - of equal length, the one whose first diverging entry was saved first
+// - of equal dates, the one whose first diverging entry has the lower hash
+// Once a branch is better the local chain is reorganized: its entries after the fork point are
+// replaced by the branch, kept as a branch themselves, and their transactions missing in the
+// new chain are processed again.
+// A fork starting with an entry of an organization at or below its last seal is refused, see Finalized
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+const (
+	MaxReorgDepth = 1000 // entries of the local chain a branch may replace
+	MaxBranches   = 16
+)
+
+var (
+	ErrUnknownParent = errors.New("Entry does not extend a known chain")
+	ErrDeepFork      = errors.New("Fork is too deep")
+	ErrFinalized     = errors.New("Entry is final")
+)
+
+// chainMu serializes the changes of the chain
+var chainMu sync.Mutex
+
+// WithChain runs f while no other change of the chain takes place
+func WithChain(f func() error) error {
+	chainMu.Lock()
+	defer chainMu.Unlock()
+	return f()
+}
+
+type ForkPool struct {
+	mu       sync.Mutex
+	branches map[string][]*Entry // entry hash of the tip -> entries from the fork point on
+}
+
+// Forks are the branches known to this node
+var Forks = NewForkPool()
+
+func NewForkPool() *ForkPool {
+	return &ForkPool{
+		branches: make(map[string][]*Entry),
+	}
+}
+
+// Branches returns all branches, each from its fork point to its tip
+func (p *ForkPool) Branches() [][]*Entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var branches [][]*Entry
+	for _, v := range p.branches {
+		branches = append(branches, v)
+	}
+	return branches
+}
+
+// Has tells if there is a branch ending with the entry of given hash
+func (p *ForkPool) Has(hash []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.branches[string(hash)]
+	return ok
+}
+
+func (p *ForkPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.branches)
+}
+
+// add puts the entry into the branch it extends or starts a new branch
+// from the local chain, returns the branch
+func (p *ForkPool) add(entry *Entry, hash []byte) ([]*Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if branch, ok := p.branches[string(entry.PrevHash)]; ok {
+		if branch[len(branch)-1].Index+1 != entry.Index {
+			return nil, fmt.Errorf("%w: index %d after %d", ErrUnknownParent, entry.Index, branch[len(branch)-1].Index)
+		}
+		delete(p.branches, string(entry.PrevHash))
+		branch = append(append([]*Entry{}, branch...), entry)
+		p.branches[string(hash)] = branch
+		return branch, nil
+	}
+
+	branch := []*Entry{entry}
+	if !forksFromChain(branch) {
+		return nil, fmt.Errorf("%w: index %d", ErrUnknownParent, entry.Index)
+	}
+	p.keep(hash, branch)
+	return branch, nil
+}
+
+// keep stores a branch, the shortest one is dropped when full
+func (p *ForkPool) keep(hash []byte, branch []*Entry) {
+	if len(p.branches) >= MaxBranches {
+		var shortest string
+		for k, v := range p.branches {
+			if shortest == "" || v[len(v)-1].Index < p.branches[shortest][len(p.branches[shortest])-1].Index {
+				shortest = k
+			}
+		}
+		delete(p.branches, shortest)
+	}
+	p.branches[string(hash)] = branch
+}
+
+func (p *ForkPool) remove(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.branches, string(hash))
+}
+
+// prune drops the branches no longer forking from the local chain
+func (p *ForkPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.branches {
+		if !forksFromChain(v) {
+			delete(p.branches, k)
+		}
+	}
+}
+
+// forksFromChain tells if the first entry of the branch follows an entry of the local chain
+func forksFromChain(branch []*Entry) bool {
+	first := branch[0]
+	if first.Index == 1 {
+		return len(first.PrevHash) == 0
+	}
+	parent := EntryHash(first.Index - 1)
+	return first.Index > 1 && len(parent) != 0 && bytes.Equal(parent, first.PrevHash)
+}
+
+// AddEntry takes an entry of a peer's chain
+// An entry extending the head is saved as it is, others are kept in a branch
+// which replaces the local chain once it is better. Returns true if the local chain changed
+func AddEntry(entry *Entry) (bool, error) {
+	hash := entry.Hash()
+
+	chainMu.Lock()
+	// already part of the chain
+	if bytes.Equal(EntryHash(entry.Index), hash) {
+		chainMu.Unlock()
+		return false, nil
+	}
+
+	head := db.GetLastTransaction()
+	if entry.Index == head.Index+1 && bytes.Equal(entry.PrevHash, head.EntryHash) {
+		err := saveEntry(entry)
+		chainMu.Unlock()
+		return err == nil, err
+	}
+
+	branch, err := Forks.add(entry, hash)
+	if err == nil {
+		err = checkFork(branch[0], head)
+		if err != nil {
+			Forks.remove(hash)
+		}
+	}
+	if err != nil || !better(branch, head) {
+		chainMu.Unlock()
+		return false, err
+	}
+
+	removed, err := reorganize(branch, hash)
+	chainMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	reprocess(removed)
+	return true, nil
+}
+
+// checkFork tells if the local chain may be replaced from the first entry of a branch on
+func checkFork(first *Entry, head db.MainDBItem) error {
+	if head.Index >= first.Index && head.Index-first.Index >= MaxReorgDepth {
+		return fmt.Errorf("%w: from index %d, head is %d", ErrDeepFork, first.Index, head.Index)
+	}
+	if finalized := Finalized(organizationOf(first.Tx)); first.Index <= finalized {
+		return fmt.Errorf("%w: organization is sealed up to index %d", ErrFinalized, finalized)
+	}
+	return nil
+}
+
+// better tells if the branch is to replace the local chain ending with head
+func better(branch []*Entry, head db.MainDBItem) bool {
+	tip := branch[len(branch)-1]
+	if tip.Index != head.Index {
+		return tip.Index > head.Index
+	}
+
+	first := branch[0]
+	local := db.GetByIndex(first.Index)
+	// dates are compared as saved, see db.CalculateEntryHash
+	firstDate, localDate := first.Date.UnixNano()/1e6, local.Date.UnixNano()/1e6
+	if firstDate != localDate {
+		return firstDate < localDate
+	}
+	return bytes.Compare(first.Hash(), local.EntryHash) < 0
+}
+
+// reorganize replaces the local chain from the fork point on with the branch
+// Every entry of the branch is validated against the chain as it would be before the chain is
+// replaced at once, the local chain is kept if any of them is invalid
+func reorganize(branch []*Entry, hash []byte) ([]db.MainDBItem, error) {
+	fork := branch[0].Index
+	fmt.Println("Reorganizing the chain from index", fork, "to", branch[len(branch)-1].Index)
+
+	items := make([]db.MainDBItem, len(branch))
+	for i, e := range branch {
+		items[i] = e.dbItem()
+		if err := checkEntry(db.Staged(fork, items[:i]), e.Index, items[i]); err != nil {
+			fmt.Println("Invalid branch, keeping the chain", err)
+			Forks.remove(hash)
+			return nil, err
+		}
+	}
+
+	removed, err := db.ReplaceFrom(fork, items)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot replace the chain from index %d: %w", fork, err)
+	}
+	finality.replaced(fork)
+	for _, item := range items {
+		committed(item)
+	}
+
+	// the replaced entries are a branch now
+	Forks.remove(hash)
+	if len(removed) > 0 {
+		var replaced []*Entry
+		for _, item := range removed {
+			replaced = append(replaced, entryFromDBItem(item))
+		}
+		Forks.mu.Lock()
+		Forks.keep(removed[len(removed)-1].EntryHash, replaced)
+		Forks.mu.Unlock()
+	}
+	Forks.prune()
+	return removed, nil
+}
+
+// saveEntry checks an entry extending the head and saves it as it is
+func saveEntry(e *Entry) error {
+	item := e.dbItem()
+	if err := checkEntry(db.CurrentView(), e.Index, item); err != nil {
+		return err
+	}
+	if err := db.InsertEntry(item); err != nil {
+		return err
+	}
+	committed(item)
+	return nil
+}
+
+// checkEntry tells if an entry may follow given chain
+func checkEntry(chain db.View, index uint64, item db.MainDBItem) error {
+	if len(chain.Get(item.Hash).Hash) != 0 {
+		return &ChainError{index, item.Hash, "transaction is already in the chain"}
+	}
+	return verifyEntry(chain, index, item, chain.GetByIndex(index-1))
+}
+
+// committed processes a transaction once its entry is part of the chain
+func committed(item db.MainDBItem) {
+	Pending.Remove(item.Hash)
+	if tx, err := FromDBItem(item); err == nil {
+		processRelated(tx)
+	}
+}
+
+// reprocess processes the transactions of replaced entries again, those missing
+// in the new chain are saved after its head
+func reprocess(removed []db.MainDBItem) {
+	for _, item := range removed {
+		if len(db.Get(item.Hash).Hash) != 0 {
+			continue
+		}
+		tx, err := FromDBItem(item)
+		if err != nil {
+			fmt.Println("Cannot process replaced transaction", item.Index, err)
+			continue
+		}
+		if _, err = ProcessTransaction(tx); err != nil {
+			fmt.Println("Replaced transaction is dropped", item.Index, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/keystore"
+)
+
+// a signed file entry of given organization, not saved
+func newTestEntry(t *testing.T, keypair keystore.KeyPair, organization []byte, data string, prev *Entry, date time.Time) *Entry {
+	file, err := Build(File, "txt", organization, []byte(data), nil)
+	if err != nil {
+		t.Fatal("Cannot build file transaction", err)
+	}
+	file.Sign(keypair)
+
+	e := &Entry{Index: prev.Index + 1, PrevHash: prev.Hash(), Date: date, Tx: file}
+	// round trip as if it came from a peer
+	parsed, err := ParseEntry(e.ToBytes())
+	if err != nil || !bytes.Equal(parsed.Hash(), e.Hash()) {
+		t.Fatal("Entry does not parse back", err)
+	}
+	return parsed
+}
+
+func TestReorganize(t *testing.T) {
+	previous := db.Current()
+	db.Use(db.NewMemoryStore())
+	defer db.Use(previous)
+	Forks = NewForkPool()
+
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, Organization{Name: "Fork Org"}, keypair)
+	local, err := Build(File, "txt", genesis.Hash, []byte("local"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Sign(keypair)
+	local.Save()
+	localEntry := EntryHash(2)
+
+	// a peer saved other transactions after the genesis, later than this node
+	later := time.Now().Add(time.Hour)
+	first := newTestEntry(t, keypair, genesis.Hash, "remote 1", RetrieveEntry(1), later)
+	second := newTestEntry(t, keypair, genesis.Hash, "remote 2", first, later)
+
+	if _, err := AddEntry(&Entry{Index: 3, PrevHash: make([]byte, 32), Date: later, Tx: second.Tx}); !errors.Is(err, ErrUnknownParent) {
+		t.Error("Entry of an unknown chain should be refused", err)
+	}
+
+	// of equal length, the older chain stays
+	changed, err := AddEntry(first)
+	if changed || err != nil || Forks.Len() != 1 {
+		t.Fatal("Equal but newer branch should be kept aside", changed, err, Forks.Len())
+	}
+
+	// an invalid branch leaves the chain as it is
+	forged := *second
+	forgedTx := *second.Tx
+	forgedTx.Signatures = [][]byte{make([]byte, 64)}
+	forged.Tx = &forgedTx
+	if _, err := AddEntry(&forged); err == nil {
+		t.Error("Invalid branch should be refused")
+	}
+	if Height() != 2 || !bytes.Equal(EntryHash(2), localEntry) || Forks.Len() != 0 || len(db.Get(first.Tx.Hash).Hash) != 0 {
+		t.Fatal("Chain is not kept after an invalid branch", Height(), Forks.Len())
+	}
+
+	// the longer chain wins
+	AddEntry(first)
+	changed, err = AddEntry(second)
+	if !changed || err != nil {
+		t.Fatal("Longer branch should replace the chain", err)
+	}
+	if !bytes.Equal(EntryHash(2), first.Hash()) || !bytes.Equal(EntryHash(3), second.Hash()) {
+		t.Error("Chain is not reorganized")
+	}
+	// the replaced transaction is processed again
+	if tx := RetrieveByIndex(4); tx == nil || !bytes.Equal(tx.Hash, local.Hash) {
+		t.Error("Replaced transaction is not saved after the new head")
+	}
+	if !Forks.Has(localEntry) {
+		t.Error("Replaced entries should be kept as a branch")
+	}
+
+	// of equal length, the older chain wins
+	older := newTestEntry(t, keypair, genesis.Hash, "remote 3", second, time.Now().Add(-time.Hour))
+	changed, err = AddEntry(older)
+	if !changed || err != nil || !bytes.Equal(EntryHash(4), older.Hash()) {
+		t.Fatal("Equal but older branch should replace the chain", err)
+	}
+	if tx := RetrieveByIndex(5); tx == nil || !bytes.Equal(tx.Hash, local.Hash) {
+		t.Error("Replaced transaction is not saved after the new head")
+	}
+
+	if changed, err = AddEntry(older); changed || err != nil {
+		t.Error("Known entry should change nothing", changed, err)
+	}
+	if count, err := VerifyChain(); count != 5 || err != nil {
+		t.Error("Reorganized chain does not verify", count, err)
+	}
+
+	// a branch is validated as a whole, an organization created in it is known to its later entries
+	foundation, _ := json.Marshal(Organization{Name: "Branch Org"})
+	branchGenesis, err := Build(Genesis, "json", nil, foundation, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branchGenesis.Sign(keypair)
+	created := &Entry{Index: 5, PrevHash: older.Hash(), Date: later, Tx: branchGenesis}
+	// built where the organization is saved, the chain does not know it before the branch
+	chain := db.Current()
+	db.Use(db.NewMemoryStore())
+	branchGenesis.Save()
+	file := newTestEntry(t, keypair, branchGenesis.Hash, "remote 4", created, later)
+	db.Use(chain)
+	AddEntry(created)
+	changed, err = AddEntry(file)
+	if !changed || err != nil || !bytes.Equal(EntryHash(6), file.Hash()) {
+		t.Fatal("Branch with its own organization should replace the chain", err)
+	}
+	if count, err := VerifyChain(); count != 7 || err != nil {
+		t.Error("Reorganized chain does not verify", count, err)
+	}
+}
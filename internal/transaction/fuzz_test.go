@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package transaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func FuzzParseBytes(f *testing.F) {
+	genesis, _ := Build(Genesis, "json", nil, []byte(`{"Name":"Fuzz Org"}`), []string{"1/*:2"})
+	genesis.Sign(newTestKeyPair(f))
+	f.Add(genesis.ToBytes())
+	f.Add([]byte{})
+	f.Add([]byte{0, EncodingVersion, 0, 0})
+
+	f.Fuzz(func(t *testing.T, txBytes []byte) {
+		tx, err := ParseBytes(txBytes)
+		if err != nil {
+			return
+		}
+		// whatever parses, encodes back to the same bytes
+		if !bytes.Equal(tx.ToBytes(), txBytes) {
+			t.Error("Parsed transaction does not encode to the same bytes")
+		}
+		if len(tx.Signatures) != len(tx.PublicKeys) || len(tx.Signatures) != len(tx.DerivationPaths) {
+			t.Error("Signatures, public keys and derivation paths do not match")
+		}
+	})
+}
+
+func FuzzParseOrganizationData(f *testing.F) {
+	foundation, _ := json.Marshal(testOrg)
+	f.Add(foundation)
+	f.Add([]byte(`{"SignatureGroups":{"board":"1/*"}}`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		organization, err := ParseOrganizationData(data)
+		if err != nil {
+			return
+		}
+		// must not panic on any parsed organization
+		organization.checkPolicies()
+		organization.MasterPublicKeyString()
+	})
+}
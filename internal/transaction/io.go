@@ -8,20 +8,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/alpdeniz/themachine/internal/crypto"
 	"github.com/alpdeniz/themachine/internal/db"
 )
 
+// Version of the binary encoding, stored in Meta[1]
+const EncodingVersion = 1
+
+var (
+	ErrMalformedTransaction = errors.New("Malformed transaction")
+	ErrUnsupportedVersion   = errors.New("Unsupported transaction version")
+)
+
 // Initialize a transaction for the first time
 func Build(objectType ObjectType, subType string, organizationTx []byte, message []byte, targets []string) (*Transaction, error) {
 
 	// Set data
 	tx := Transaction{}
 	tx.ObjectType = objectType
-	tx.Meta = [4]byte{byte(objectType), byte(0x00), byte(0x00), byte(0x00)}
+	tx.Meta = [4]byte{byte(objectType), EncodingVersion, byte(0x00), byte(0x00)}
 	tx.SubType = ObjectSubType(subType)
 	tx.Data = message
 	tx.DataLength = uint32(len(message))
@@ -52,6 +59,20 @@ func Build(objectType ObjectType, subType string, organizationTx []byte, message
 	return &tx, nil
 }
 
+// UseScheme sets the signature scheme of the transaction, before it is signed
+func (tx *Transaction) UseScheme(id crypto.SchemeID) error {
+	if _, err := crypto.GetScheme(id); err != nil {
+		return err
+	}
+	if len(tx.Signatures) != 0 {
+		return errors.New("Cannot change the signature scheme of a signed transaction")
+	}
+	tx.Scheme = id
+	tx.Meta[2] = byte(id)
+	tx.CalculateHash()
+	return nil
+}
+
 // Export transaction as a db object
 func (tx *Transaction) ToDBItem() db.MainDBItem {
 	item := db.MainDBItem{
@@ -59,12 +80,14 @@ func (tx *Transaction) ToDBItem() db.MainDBItem {
 		PrevHash:                nil,
 		Date:                    time.Now(),
 		ObjectType:              byte(tx.ObjectType),
-		SubType:                 0x00,
+		SubType:                 string(tx.SubType),
 		Data:                    tx.Data,
 		Targets:                 tx.Targets,
 		Signatures:              tx.Signatures,
 		PublicKeys:              tx.PublicKeys,
 		DerivationPaths:         tx.DerivationPaths,
+		AggregateSignature:      tx.AggregateSignature,
+		Scheme:                  byte(tx.Scheme),
 		OrganizationTransaction: tx.OrganizationTx,
 	}
 	return item
@@ -72,19 +95,12 @@ func (tx *Transaction) ToDBItem() db.MainDBItem {
 
 // Construct a transaction from a db object
 func FromDBItem(item db.MainDBItem) (*Transaction, error) {
-	tx := Transaction{}
-	tx.Hash = item.Hash
-	tx.Data = item.Data
-	tx.DataLength = uint32(len(item.Data))
-	tx.ObjectType = ObjectType(item.ObjectType)
-	tx.SubType = ObjectSubType(item.SubType)
-	tx.Date = item.Date
-	tx.OrganizationTx = item.OrganizationTransaction
-	tx.Targets = item.Targets
-	tx.PublicKeys = item.PublicKeys
-	tx.Signatures = item.Signatures
-	tx.DerivationPaths = item.DerivationPaths
-	tx.Meta = [4]byte{byte(item.ObjectType), byte(0x00), byte(0x00), byte(0x00)}
+	return fromChain(db.CurrentView(), item)
+}
+
+// fromChain constructs a transaction from a db object, its organization as given chain has it
+func fromChain(chain db.View, item db.MainDBItem) (*Transaction, error) {
+	tx := *fromDBItem(item)
 
 	// build organization
 	var orgData []byte
@@ -99,7 +115,7 @@ func FromDBItem(item db.MainDBItem) (*Transaction, error) {
 			return nil, errors.New("Invalid organization transaction hash")
 		}
 		// fetch if exists
-		organizationTransaction := Retrieve(tx.OrganizationTx)
+		organizationTransaction := retrieve(chain, tx.OrganizationTx)
 		if organizationTransaction == nil {
 			return nil, errors.New("Cannot find organization transaction")
 		}
@@ -118,109 +134,145 @@ func FromDBItem(item db.MainDBItem) (*Transaction, error) {
 	return &tx, nil
 }
 
+// fromDBItem sets all but the organization
+func fromDBItem(item db.MainDBItem) *Transaction {
+	tx := Transaction{}
+	tx.Index = item.Index
+	tx.Hash = item.Hash
+	tx.Data = item.Data
+	tx.DataLength = uint32(len(item.Data))
+	tx.ObjectType = ObjectType(item.ObjectType)
+	tx.SubType = ObjectSubType(item.SubType)
+	tx.Date = item.Date
+	tx.OrganizationTx = item.OrganizationTransaction
+	tx.Targets = item.Targets
+	tx.PublicKeys = item.PublicKeys
+	tx.Signatures = item.Signatures
+	tx.DerivationPaths = item.DerivationPaths
+	tx.AggregateSignature = item.AggregateSignature
+	tx.Scheme = crypto.SchemeID(item.Scheme)
+	for _, v := range item.DerivationPaths {
+		tx.DerivationSteps = append(tx.DerivationSteps, crypto.ParseDerivationPathBytes(v))
+	}
+	tx.Meta = [4]byte{byte(item.ObjectType), EncodingVersion, item.Scheme, byte(0x00)}
+	return &tx
+}
+
 // Export transaction as bytes, ready to relay into the network
+// Layout (version 1, lengths are little endian):
+// body:       meta (4) + organization tx length (v) + organization tx + sub type length (v) + sub type
+//   - data length (4) + data + target count (2) + [target length (2) + target]
+//
+// signatures: signature count (2) + [public key length (v) + public key + signature length (v) + signature
+//   - derivation path length (v) + derivation path]
+//   - aggregate signature length (v) + aggregate signature, for schemes which aggregate (see Meta[2])
+//
+// (v) is an unsigned varint, one byte for lengths below 128
+//
+// The hash of the transaction is calculated over the body
 func (tx *Transaction) ToBytes() []byte {
+	transactionBytes := tx.encodeBody()
 
-	// total length of byte array
-	// Genesis: 4 + 4 + mLength + 2 + targetLength + signatures
-	// Organization Transaction:  4 + 32 + 4 + mLength + 2 + targetLength + signatures (33 pk + 64 sig + 16 derivation path (4 * uint32) )
-	// Message to Network: 4 + mLength ?
-	metaLength, txHashLength, messageLenBytes, targetLenBytes := 4, 0, 4, 2
-	var transactionBytes []byte
-	transactionBytes = append(transactionBytes, tx.Meta[:]...)
-
-	// set organization tx (32 byte) if not genesis
-	if tx.ObjectType != Genesis {
-		fmt.Println("It is not a genesis transaction")
-		txHashLength = 32 // TRANSACTION_HASH_LENGTH
-		transactionBytes = append(transactionBytes, tx.OrganizationTx...)
-	}
-
-	// set message length bytes as uint32 and append the message (4 + mLength)
-	transactionBytes = append(transactionBytes, []byte{0, 0, 0, 0}...)
-	binary.LittleEndian.PutUint32(transactionBytes[metaLength+txHashLength:metaLength+txHashLength+messageLenBytes], uint32(len(tx.Data)))
-	transactionBytes = append(transactionBytes, tx.Data[:]...)
-
-	// set target byte length as uint16 and append targets (2 + tLength)
-	targetString := strings.Join(tx.Targets, ",")
-	transactionBytes = append(transactionBytes, []byte{0, 0}...)
-	binary.LittleEndian.PutUint16(transactionBytes[metaLength+txHashLength+messageLenBytes+len(tx.Data):metaLength+txHashLength+messageLenBytes+len(tx.Data)+targetLenBytes], uint16(len([]byte(targetString))))
-	transactionBytes = append(transactionBytes, []byte(targetString)[:]...)
-
-	// append signatures
+	transactionBytes = appendUint16(transactionBytes, uint16(len(tx.Signatures)))
 	for i := range tx.Signatures {
-		transactionBytes = append(transactionBytes, tx.PublicKeys[i][:]...)
-		transactionBytes = append(transactionBytes, tx.Signatures[i][:]...)
-		transactionBytes = append(transactionBytes, tx.DerivationPaths[i][:]...)
+		transactionBytes = appendShortBytes(transactionBytes, tx.PublicKeys[i])
+		transactionBytes = appendShortBytes(transactionBytes, tx.Signatures[i])
+		transactionBytes = appendShortBytes(transactionBytes, tx.DerivationPaths[i])
+	}
+	if tx.aggregates() {
+		transactionBytes = appendShortBytes(transactionBytes, tx.AggregateSignature)
 	}
 	return transactionBytes
 }
 
-// Get bytes and construct the transaction
-func ParseBytes(txBytes []byte) (*Transaction, error) {
+func (tx *Transaction) encodeBody() []byte {
+	var body []byte
+	body = append(body, tx.Meta[:]...)
+	body = appendShortBytes(body, tx.OrganizationTx)
+	body = appendShortBytes(body, []byte(tx.SubType))
 
-	// total length of byte array
-	// Genesis: 4 + 4 + mLength + 2 + targetLength + signatures
-	// Normal:  4 + 32 + 4 + mLength + 2 + targetLength + signatures
-	metaLength, txHashLength, messageLenBytes, targetLenBytes := 4, 0, 4, 2
+	body = appendUint32(body, uint32(len(tx.Data)))
+	body = append(body, tx.Data...)
 
-	// This is not a tx
-	if len(txBytes) < 8 {
-		return nil, errors.New("Short message length")
+	body = appendUint16(body, uint16(len(tx.Targets)))
+	for _, v := range tx.Targets {
+		body = appendUint16(body, uint16(len(v)))
+		body = append(body, v...)
 	}
+	return body
+}
 
+// Get bytes and construct the transaction
+// Returns ErrMalformedTransaction (or ErrUnsupportedVersion) for anything not
+// following the layout of ToBytes exactly
+func ParseBytes(txBytes []byte) (*Transaction, error) {
+	d := decoder{buf: txBytes}
 	tx := Transaction{}
 
 	// Get meta
-	meta := txBytes[0:metaLength]
-	fmt.Println("OBJECT TYPE:", ObjectType(meta[0]).String())
-	if ObjectType(meta[0]) != Genesis {
-		fmt.Println("It is not a genesis transaction")
-		txHashLength = 32
-		tx.OrganizationTx = txBytes[metaLength : metaLength+txHashLength]
-	}
-
-	// Get message length
-	messageLengthBytes := txBytes[metaLength+txHashLength : metaLength+txHashLength+messageLenBytes]
-	messageLength := binary.LittleEndian.Uint32(messageLengthBytes)
-	fmt.Println("Message length: ", messageLength)
-	// Get message
-	if messageLength < 1 || len(txBytes) < metaLength+txHashLength+messageLenBytes {
-		return nil, errors.New("Invalid transaction")
-	}
-	tx.Data = txBytes[metaLength+txHashLength+messageLenBytes : metaLength+txHashLength+messageLenBytes+int(messageLength)]
-	fmt.Println("Message: ", string(tx.Data))
-
-	// Get targets length
-	targetLengthBytes := txBytes[metaLength+txHashLength+messageLenBytes+int(messageLength) : metaLength+txHashLength+messageLenBytes+int(messageLength)+targetLenBytes]
-	targetLength := binary.LittleEndian.Uint16(targetLengthBytes)
-	fmt.Println("Targets length: ", targetLength, int(targetLength))
+	copy(tx.Meta[:], d.next(len(tx.Meta)))
+	if d.err != nil {
+		return nil, d.err
+	}
+	if tx.Meta[1] != EncodingVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, tx.Meta[1])
+	}
+	if _, err := crypto.GetScheme(crypto.SchemeID(tx.Meta[2])); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedTransaction, err)
+	}
+	if tx.Meta[3] != 0 {
+		return nil, fmt.Errorf("%w: unknown flags %x", ErrMalformedTransaction, tx.Meta[3:])
+	}
+	tx.ObjectType = ObjectType(tx.Meta[0])
+	tx.Scheme = crypto.SchemeID(tx.Meta[2])
+
+	tx.OrganizationTx = d.shortBytes()
+	if tx.ObjectType == Genesis && len(tx.OrganizationTx) != 0 || tx.ObjectType != Genesis && len(tx.OrganizationTx) != 32 {
+		d.fail("organization tx is %d bytes", len(tx.OrganizationTx))
+	}
+	tx.SubType = ObjectSubType(d.shortBytes())
+
+	// Get data
+	dataLength := d.uint32()
+	if d.err == nil && dataLength > MaxDataLength {
+		d.fail("data is %d bytes, maximum is %d", dataLength, MaxDataLength)
+	}
+	tx.Data = d.next(int(dataLength))
+	tx.DataLength = uint32(len(tx.Data))
+
 	// Get targets
-	if len(txBytes) < metaLength+txHashLength+messageLenBytes+int(messageLength)+targetLenBytes+int(targetLength) {
-		return nil, errors.New("Invalid transaction")
-	}
-	tx.Targets = strings.Split(string(txBytes[metaLength+txHashLength+messageLenBytes+int(messageLength)+targetLenBytes:metaLength+txHashLength+messageLenBytes+int(messageLength)+targetLenBytes+int(targetLength)]), ",")
-	fmt.Println("Targets: ", tx.Targets)
-
-	// Get signature(s) = [](public key + signature)
-	multipleSignatureBytes := txBytes[metaLength+txHashLength+messageLenBytes+int(messageLength)+targetLenBytes+int(targetLength):]
-	fmt.Println("Signature bytes length: ", len(multipleSignatureBytes))
-
-	// extract public keys and signatures
-	for i := 0; (i+1)*113 <= len(multipleSignatureBytes); i++ {
-		fmt.Println("Parsing ", i, "th signature")
-		tx.PublicKeys = append(tx.PublicKeys, make([]byte, 33))
-		copy(tx.PublicKeys[i][:], multipleSignatureBytes[i*101:i*101+33])
-		tx.Signatures = append(tx.Signatures, make([]byte, 64))
-		copy(tx.Signatures[i][:], multipleSignatureBytes[i*101+33:i*101+97])
-		tx.DerivationPaths = append(tx.DerivationPaths, make([]byte, 16))
-		copy(tx.DerivationPaths[i][:], multipleSignatureBytes[i*101+97:i*101+97+16])
+	targetCount := int(d.uint16())
+	if targetCount > MaxTargets {
+		d.fail("%d targets, maximum is %d", targetCount, MaxTargets)
+	}
+	for i := 0; i < targetCount && d.err == nil; i++ {
+		tx.Targets = append(tx.Targets, string(d.next(int(d.uint16()))))
+	}
+
+	// Get signature(s) = [](public key + signature + derivation path)
+	signatureCount := int(d.uint16())
+	if signatureCount > MaxSignatures {
+		d.fail("%d signatures, maximum is %d", signatureCount, MaxSignatures)
+	}
+	for i := 0; i < signatureCount && d.err == nil; i++ {
+		tx.PublicKeys = append(tx.PublicKeys, d.shortBytes())
+		tx.Signatures = append(tx.Signatures, d.shortBytes())
+		tx.DerivationPaths = append(tx.DerivationPaths, d.shortBytes())
 		// convert derivation steps to uint32
 		tx.DerivationSteps = append(tx.DerivationSteps, crypto.ParseDerivationPathBytes(tx.DerivationPaths[i]))
 	}
+	if tx.aggregates() {
+		if aggregate := d.shortBytes(); len(aggregate) != 0 {
+			tx.AggregateSignature = aggregate
+		}
+	}
 
-	// Build transaction by casting the parameters into its arrays
-	copy(tx.Meta[:], meta)
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail("%d trailing bytes", len(d.buf))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
 
 	// Make sure tx hash is set
 	tx.CalculateHash()
@@ -228,6 +280,92 @@ func ParseBytes(txBytes []byte) (*Transaction, error) {
 	return &tx, nil
 }
 
+func appendUint16(b []byte, v uint16) []byte {
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+// appendShortBytes prefixes v with its length as an unsigned varint, a single byte below 128
+func appendShortBytes(b []byte, v []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(v)))
+	b = append(b, tmp[:n]...)
+	return append(b, v...)
+}
+
+// decoder reads fields in order, the first error sticks and the rest of the reads return zero values
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformedTransaction, fmt.Sprintf(format, args...))
+	}
+}
+
+// next returns a copy of the following n bytes
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.buf) {
+		d.fail("need %d bytes, %d left", n, len(d.buf))
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.buf[:n])
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// shortBytes reads bytes prefixed by their length as a minimally encoded unsigned varint
+func (d *decoder) shortBytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	length, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("invalid length")
+		return nil
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(tmp[:], length) != n {
+		d.fail("length is not minimally encoded")
+		return nil
+	}
+	d.buf = d.buf[n:]
+	if length > uint64(len(d.buf)) {
+		d.fail("need %d bytes, %d left", length, len(d.buf))
+		return nil
+	}
+	return d.next(int(length))
+}
+
 // Parse organization transaction's data
 func ParseOrganizationData(data []byte) (*Organization, error) {
 	var organization Organization
@@ -241,8 +379,14 @@ func ParseOrganizationData(data []byte) (*Organization, error) {
 // DB Methods
 // ---------------------------
 // Append
+// A transaction already in the chain is not saved again
 func (tx *Transaction) Save() {
 	fmt.Println("Saving transaction", hex.EncodeToString(tx.Hash))
+	chainMu.Lock()
+	defer chainMu.Unlock()
+	if len(db.Get(tx.Hash).Hash) != 0 {
+		return
+	}
 	db.Insert(tx.ToDBItem())
 }
 
@@ -253,12 +397,32 @@ func (tx *Transaction) SaveRelated() {
 
 // Get
 func Retrieve(txid []byte) *Transaction {
-	item := db.Get(txid[:])
+	return retrieve(db.CurrentView(), txid)
+}
+
+func retrieve(chain db.View, txid []byte) *Transaction {
+	item := chain.Get(txid[:])
 	if len(item.Data) == 0 {
 		fmt.Println("No such transaction with id", txid)
 		return nil
 	}
 
+	tx, err := fromChain(chain, item)
+	if err != nil {
+		fmt.Println("Error while building transaction by db entry", err)
+		return nil
+	}
+
+	return tx
+}
+
+// Get by index in the chain
+func RetrieveByIndex(index uint64) *Transaction {
+	item := db.GetByIndex(index)
+	if len(item.Hash) == 0 {
+		return nil
+	}
+
 	tx, err := FromDBItem(item)
 	if err != nil {
 		fmt.Println("Error while building transaction by db entry", err)
@@ -268,6 +432,11 @@ func Retrieve(txid []byte) *Transaction {
 	return tx
 }
 
+// Height is the index of the last transaction, 0 if the chain is empty
+func Height() uint64 {
+	return db.GetLastTransaction().Index
+}
+
 // Get by object type (e.g. File, Genesis, Object, Certificat)
 func RetrieveByObjectType(objectType ObjectType) []*Transaction {
 	items := db.GetByObjectType(byte(objectType))
@@ -0,0 +1,112 @@
+package transaction
+
+// Organization rules, see internal/policy for the policy language
+
+import (
+	"fmt"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/policy"
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// MasterPublicKeyString returns the serialized extended master public key in its base58 form
+func (o *Organization) MasterPublicKeyString() string {
+	return base58.Encode(o.MasterPublicKey)
+}
+
+// checkPublicKeyPath checks if the key of given scheme derives from the organization master key at path
+func (o *Organization) checkPublicKeyPath(scheme crypto.SchemeID, path []uint32, publicKey []byte) bool {
+	switch scheme {
+	case crypto.Secp256k1, crypto.Schnorr:
+		return crypto.CheckPublicKeyPath(path, publicKey, o.MasterPublicKeyString())
+	case crypto.BLS:
+		return len(o.BLSMasterPublicKey) != 0 && crypto.CheckBLSPublicKeyPath(path, publicKey, o.BLSMasterPublicKey)
+	}
+	return false
+}
+
+// Policy returns the signature policy of the organization for an object type
+// Per object rules override MinimumRequiredSignaturePaths, all listed expressions are required
+func (o *Organization) Policy(objectType ObjectType) (*policy.Policy, error) {
+	expressions, ok := o.RequiredSignaturePathsPerObject[objectType.String()]
+	if !ok {
+		expressions = o.MinimumRequiredSignaturePaths
+	}
+	return o.parsePolicies(expressions)
+}
+
+// checkPolicies makes sure all rules of the organization can be parsed
+func (o *Organization) checkPolicies() error {
+	if _, err := o.parsePolicies(o.MinimumRequiredSignaturePaths); err != nil {
+		return err
+	}
+	for _, expressions := range o.RequiredSignaturePathsPerObject {
+		if _, err := o.parsePolicies(expressions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidatorSteps returns the derivation steps of the validator key at given index
+func (o *Organization) ValidatorSteps(index uint32) ([]uint32, error) {
+	path, err := crypto.ParsePath(o.ValidatorPath)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := path.Steps()
+	if err != nil {
+		return nil, err
+	}
+	return append(steps, index), nil
+}
+
+// checkValidators makes sure validator keys can be derived from the master public key
+func (o *Organization) checkValidators() error {
+	if o.Validators == 0 {
+		return nil
+	}
+	steps, err := o.ValidatorSteps(0)
+	if err != nil {
+		return fmt.Errorf("validator path: %s", err)
+	}
+	for _, v := range steps {
+		if v >= crypto.HardenedOffset {
+			return fmt.Errorf("validator path %s cannot be hardened", o.ValidatorPath)
+		}
+	}
+	return nil
+}
+
+func (o *Organization) parsePolicies(expressions []string) (*policy.Policy, error) {
+	var policies []*policy.Policy
+	for _, v := range expressions {
+		p, err := policy.Parse(v, o.SignatureGroups)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policy.All(policies...), nil
+}
+
+// Policy returns the organization policy for the transaction combined with its targets
+func (tx *Transaction) Policy() (*policy.Policy, error) {
+	organizationPolicy, err := tx.Organization.Policy(tx.ObjectType)
+	if err != nil {
+		return nil, err
+	}
+	var policies []*policy.Policy
+	if organizationPolicy != nil {
+		policies = append(policies, organizationPolicy)
+	}
+	for _, v := range tx.Targets {
+		p, err := policy.Parse(v, tx.Organization.SignatureGroups)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policy.All(policies...), nil
+}
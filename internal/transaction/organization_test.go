@@ -0,0 +1,114 @@
+package transaction
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/policy"
+	"github.com/wemeetagain/go-hdwallet"
+)
+
+// derives the keypair of an organization member
+func deriveTestKeyPair(t *testing.T, master *hdwallet.HDWallet, path string) keystore.KeyPair {
+	steps, err := crypto.ParseDerivationPathString(path)
+	if err != nil {
+		t.Fatal("Invalid derivation path", err)
+	}
+	w := master
+	for _, v := range steps {
+		w, err = w.Child(v)
+		if err != nil {
+			t.Fatal("Cannot derive child", err)
+		}
+	}
+	return keystore.KeyPair{
+		Name:           path,
+		DerivationPath: path,
+		PublicKey:      w.Pub().Key,
+		PrivateKey:     w.Key,
+	}
+}
+
+func TestVerifyPolicy(t *testing.T) {
+
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := Organization{
+		Name:                            "Governed Org",
+		MasterPublicKey:                 master.Pub().Serialize(),
+		MinimumRequiredSignaturePaths:   []string{"1 of 3/*"},
+		RequiredSignaturePathsPerObject: map[string][]string{"Decision": {"2 of board AND 1 of legal"}},
+		SignatureGroups:                 map[string]string{"board": "1/*", "legal": "2/*"},
+	}
+	creator := newTestKeyPair(t)
+	genesis := newTestOrganization(t, org, creator)
+
+	decision, err := Build(Decision, "json", genesis.Hash, []byte("{}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision.Sign(creator)
+	if ok, err := decision.Validate(); !ok {
+		t.Fatal("Decision should be valid", err)
+	}
+
+	// per object rule overrides the minimum required paths
+	ok, err := decision.Verify()
+	var unsatisfied *policy.UnsatisfiedError
+	if ok || !errors.As(err, &unsatisfied) || unsatisfied.Policy.Group != "board" {
+		t.Error("Decision without signatures should not be verified", err)
+	}
+
+	board := deriveTestKeyPair(t, master, "1/1")
+	decision.Sign(board)
+	// the same signer does not count twice
+	decision.Sign(board)
+	decision.Sign(deriveTestKeyPair(t, master, "2/1"))
+	if ok, _ := decision.Verify(); ok {
+		t.Error("One board member should not be enough")
+	}
+
+	// a key outside of the organization does not count
+	outsider := newTestKeyPair(t)
+	outsider.DerivationPath = "1/2"
+	decision.Sign(outsider)
+	if ok, _ := decision.Verify(); ok {
+		t.Error("Keys not derived from the master public key should not count")
+	}
+
+	decision.Sign(deriveTestKeyPair(t, master, "1/2"))
+	if ok, err := decision.Verify(); !ok {
+		t.Error("Decision should be verified", err)
+	}
+}
+
+func TestInvalidOrganizationPolicy(t *testing.T) {
+
+	org := testOrg
+	org.MinimumRequiredSignaturePaths = []string{"2 of nobody"}
+	genesis := newTestOrganization(t, org, newTestKeyPair(t))
+
+	ok, err := genesis.Validate()
+	if ok || !errors.Is(err, ErrInvalidPolicy) {
+		t.Error("Organization with unknown group should be invalid", err)
+	}
+}
+
+func TestInvalidValidatorPath(t *testing.T) {
+
+	for _, path := range []string{"m/7'", "m/7/*", "seven"} {
+		org := testOrg
+		org.ValidatorPath = path
+		org.Validators = 3
+		genesis := newTestOrganization(t, org, newTestKeyPair(t))
+
+		ok, err := genesis.Validate()
+		if ok || !errors.Is(err, ErrInvalidPolicy) {
+			t.Error("Organization with validator path", path, "should be invalid", err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package transaction
+
+// Pending pool of valid transactions waiting for signatures
+// A transaction stays here until the signatures required by its policy are
+// collected. Copies of the same transaction arriving from other nodes are
+// merged so that signatures from several nodes, aggregate ones included, end
+// up on one transaction, and once verified it is promoted into the main chain.
+// Co-signatures of schemes that aggregate (BLS) are folded into one on
+// promotion, see Aggregate.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/db"
+)
+
+const MaxPendingTransactions = 10000
+
+var (
+	// MaxPendingPerSigner limits the transactions of one creator key waiting in the pool
+	MaxPendingPerSigner = 100
+	// PendingExpiry is how long a transaction may wait for its signatures
+	PendingExpiry = 24 * time.Hour
+	// MaxPendingBytes limits the data and signatures of all transactions in the pool,
+	// new creator keys are free to make
+	MaxPendingBytes = 256 << 20
+)
+
+var (
+	ErrKnownTransaction = errors.New("Transaction is already known")
+	ErrPendingPoolFull  = errors.New("Pending pool is full")
+	ErrPendingQuota     = errors.New("Too many pending transactions of the signer")
+)
+
+// The pool owns its transactions: they are only changed under its lock and
+// callers get clones, see Transaction.Clone
+type PendingPool struct {
+	mu        sync.Mutex
+	entries   map[string]*pendingEntry
+	perSigner map[string]int // number of entries by creator public key
+	size      int            // of all entries, see pendingSize
+	expired   time.Time      // last time expired entries were dropped
+}
+
+type pendingEntry struct {
+	tx      *Transaction
+	creator string
+	size    int
+	added   time.Time
+}
+
+// Pending is the pool of this node
+var Pending = NewPendingPool()
+
+// Committer takes promoted transactions into the chain, one by one unless
+// a block builder is started, see internal/block
+var Committer = func(tx *Transaction) { tx.Save() }
+
+func NewPendingPool() *PendingPool {
+	return &PendingPool{
+		entries:   make(map[string]*pendingEntry),
+		perSigner: make(map[string]int),
+	}
+}
+
+// Add puts a copy of the transaction into the pool or merges its signatures into the existing entry
+// Returns the transaction itself if it is new, a copy of the pooled one otherwise,
+// and the number of new signatures
+func (p *PendingPool) Add(tx *Transaction) (*Transaction, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.expired) > time.Minute || len(p.entries) >= MaxPendingTransactions {
+		p.expire(now)
+	}
+
+	entry, ok := p.entries[string(tx.Hash)]
+	if !ok {
+		if len(p.entries) >= MaxPendingTransactions {
+			return nil, 0, ErrPendingPoolFull
+		}
+		creator := ""
+		if len(tx.PublicKeys) > 0 {
+			creator = string(tx.PublicKeys[0])
+		}
+		if p.perSigner[creator] >= MaxPendingPerSigner {
+			return nil, 0, ErrPendingQuota
+		}
+		size := pendingSize(tx)
+		if p.size+size > MaxPendingBytes {
+			return nil, 0, ErrPendingPoolFull
+		}
+		p.entries[string(tx.Hash)] = &pendingEntry{tx: tx.Clone(), creator: creator, size: size, added: now}
+		p.perSigner[creator]++
+		p.size += size
+		return tx, len(tx.Signatures), nil
+	}
+
+	added := entry.tx.MergeSignatures(tx)
+	size := pendingSize(entry.tx)
+	p.size += size - entry.size
+	entry.size = size
+	return entry.tx.Clone(), added, nil
+}
+
+// Gets the size of a transaction in the pool: its data and signatures
+func pendingSize(tx *Transaction) int {
+	size := len(tx.Data) + len(tx.AggregateSignature)
+	for i := range tx.Signatures {
+		size += len(tx.Signatures[i]) + len(tx.PublicKeys[i]) + len(tx.DerivationPaths[i])
+	}
+	return size
+}
+
+// Get returns a copy of the pending transaction with given hash, nil if there is none
+func (p *PendingPool) Get(hash []byte) *Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.entries[string(hash)]
+	if !ok {
+		return nil
+	}
+	return entry.tx.Clone()
+}
+
+// List returns copies of all pending transactions
+func (p *PendingPool) List() []*Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var transactions []*Transaction
+	for _, v := range p.entries {
+		transactions = append(transactions, v.tx.Clone())
+	}
+	return transactions
+}
+
+func (p *PendingPool) Remove(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remove(hash)
+}
+
+func (p *PendingPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// remove an entry, p.mu is held
+func (p *PendingPool) remove(hash []byte) {
+	entry, ok := p.entries[string(hash)]
+	if !ok {
+		return
+	}
+	delete(p.entries, string(hash))
+	p.size -= entry.size
+	if p.perSigner[entry.creator]--; p.perSigner[entry.creator] <= 0 {
+		delete(p.perSigner, entry.creator)
+	}
+}
+
+// expire drops the entries waiting longer than PendingExpiry, p.mu is held
+func (p *PendingPool) expire(now time.Time) {
+	p.expired = now
+	for _, v := range p.entries {
+		if now.Sub(v.added) > PendingExpiry {
+			fmt.Println("Pending transaction expired", hex.EncodeToString(v.tx.Hash))
+			p.remove(v.tx.Hash)
+		}
+	}
+}
+
+// promote saves the pooled transaction into the main chain if it is verified
+// The entry leaves the pool under the lock and while the chain does not change, so a copy
+// delivered meanwhile finds it in the chain or in the pool: it is aggregated and committed once
+func (p *PendingPool) promote(hash []byte) (bool, error) {
+	chainMu.Lock()
+	p.mu.Lock()
+	entry, pending := p.entries[string(hash)]
+	// someone else promoted it meanwhile
+	known := len(db.Get(hash).Hash) != 0
+	var ok bool
+	var err error
+	if known {
+		p.remove(hash)
+	} else if pending {
+		if ok, err = entry.tx.Verify(); ok {
+			p.remove(hash)
+		}
+	}
+	p.mu.Unlock()
+	chainMu.Unlock()
+
+	if known {
+		return true, nil
+	}
+	if !pending {
+		return false, ErrUnknownPending
+	}
+	if !ok {
+		return false, err
+	}
+	tx := entry.tx
+	if tx.aggregator() != nil {
+		if err := tx.Aggregate(); err != nil {
+			fmt.Println("Cannot aggregate signatures of", hex.EncodeToString(tx.Hash), err)
+		}
+	}
+	Committer(tx)
+	return true, nil
+}
+
+// MergeSignatures appends the valid signatures of other copy of the transaction, up to MaxSignatures
+// Signers have to derive from the organization like those of approvals, see AddSignature
+// A valid aggregate signature of the other copy is taken along with its signers, see mergeAggregate
+func (tx *Transaction) MergeSignatures(other *Transaction) int {
+	if !bytes.Equal(tx.Hash, other.Hash) {
+		return 0
+	}
+
+	added := tx.mergeAggregate(other)
+	for i := range other.Signatures {
+		if len(tx.Signatures) >= MaxSignatures {
+			break
+		}
+		// aggregated signers come with the aggregate signature
+		if len(other.Signatures[i]) == 0 {
+			continue
+		}
+		// as checked by AddSignature
+		if tx.hasSigner(other.PublicKeys[i]) || !other.VerifySignatureByIndex(i) ||
+			!tx.Organization.checkPublicKeyPath(tx.Scheme, other.DerivationSteps[i], other.PublicKeys[i]) {
+			continue
+		}
+		tx.Signatures = append(tx.Signatures, other.Signatures[i])
+		tx.PublicKeys = append(tx.PublicKeys, other.PublicKeys[i])
+		tx.DerivationPaths = append(tx.DerivationPaths, other.DerivationPaths[i])
+		tx.DerivationSteps = append(tx.DerivationSteps, other.DerivationSteps[i])
+		added++
+	}
+	return added
+}
+
+// mergeAggregate takes the aggregate signature of other copy if it covers all signers of the
+// current one. Signers it covers are listed after the others in the order of the other copy,
+// which MuSig2 keys are aggregated in. Returns the number of new signers
+func (tx *Transaction) mergeAggregate(other *Transaction) int {
+	if len(other.AggregateSignature) == 0 || bytes.Equal(tx.AggregateSignature, other.AggregateSignature) {
+		return 0
+	}
+	aggregated := make(map[string]bool)
+	for i := 1; i < len(other.Signatures); i++ {
+		if len(other.Signatures[i]) == 0 {
+			aggregated[string(other.PublicKeys[i])] = true
+		}
+	}
+	// the creator signs apart
+	if len(tx.PublicKeys) == 0 || aggregated[string(tx.PublicKeys[0])] {
+		return 0
+	}
+	for i := 1; i < len(tx.Signatures); i++ {
+		if len(tx.Signatures[i]) == 0 && !aggregated[string(tx.PublicKeys[i])] {
+			return 0
+		}
+	}
+
+	result := *tx
+	result.AggregateSignature = other.AggregateSignature
+	result.Signatures, result.PublicKeys, result.DerivationPaths, result.DerivationSteps = nil, nil, nil, nil
+	for i := range tx.Signatures {
+		if i > 0 && aggregated[string(tx.PublicKeys[i])] {
+			continue
+		}
+		result.Signatures = append(result.Signatures, tx.Signatures[i])
+		result.PublicKeys = append(result.PublicKeys, tx.PublicKeys[i])
+		result.DerivationPaths = append(result.DerivationPaths, tx.DerivationPaths[i])
+		result.DerivationSteps = append(result.DerivationSteps, tx.DerivationSteps[i])
+	}
+	added := 0
+	for i := 1; i < len(other.Signatures); i++ {
+		if len(other.Signatures[i]) != 0 {
+			continue
+		}
+		if !tx.hasSigner(other.PublicKeys[i]) {
+			added++
+		}
+		result.Signatures = append(result.Signatures, nil)
+		result.PublicKeys = append(result.PublicKeys, other.PublicKeys[i])
+		result.DerivationPaths = append(result.DerivationPaths, other.DerivationPaths[i])
+		result.DerivationSteps = append(result.DerivationSteps, other.DerivationSteps[i])
+	}
+	if len(result.Signatures) > MaxSignatures || !result.verifyAggregate() {
+		return 0
+	}
+	*tx = result
+	return added
+}
+
+func (tx *Transaction) hasSigner(publicKey []byte) bool {
+	for _, v := range tx.PublicKeys {
+		if bytes.Equal(v, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone copies the transaction with its own signature lists, which pooling and aggregation change
+func (tx *Transaction) Clone() *Transaction {
+	c := *tx
+	c.Signatures = append([][]byte{}, tx.Signatures...)
+	c.PublicKeys = append([][]byte{}, tx.PublicKeys...)
+	c.DerivationPaths = append([][]byte{}, tx.DerivationPaths...)
+	c.DerivationSteps = append([][]uint32{}, tx.DerivationSteps...)
+	c.AggregateSignature = append([]byte{}, tx.AggregateSignature...)
+	return &c
+}
@@ -0,0 +1,337 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+)
+
+// copy of a transaction as another node would have it
+func cloneTransaction(tx *Transaction) *Transaction {
+	c := *tx
+	c.Signatures = append([][]byte{}, tx.Signatures...)
+	c.PublicKeys = append([][]byte{}, tx.PublicKeys...)
+	c.DerivationPaths = append([][]byte{}, tx.DerivationPaths...)
+	c.DerivationSteps = append([][]uint32{}, tx.DerivationSteps...)
+	return &c
+}
+
+func TestPendingPool(t *testing.T) {
+
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := Organization{
+		Name:                          "Pending Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		MinimumRequiredSignaturePaths: []string{"2 of board"},
+		SignatureGroups:               map[string]string{"board": "1/*"},
+	}
+	creator := newTestKeyPair(t)
+	genesis := newTestOrganization(t, org, creator)
+
+	decision, err := Build(Decision, "json", genesis.Hash, []byte(`{"decision":"pending"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision.Sign(creator)
+
+	// only created, waits for the board
+	pooled, err := ProcessTransaction(cloneTransaction(decision))
+	if err != nil {
+		t.Fatal("Cannot process transaction", err)
+	}
+	if pending := Pending.Get(decision.Hash); pending == nil || pending == pooled || Retrieve(decision.Hash) != nil {
+		t.Fatal("Unverified transaction should be pending")
+	}
+
+	// the same copy again brings nothing new
+	if _, err := ProcessTransaction(cloneTransaction(decision)); err != ErrKnownTransaction {
+		t.Error("Expected known transaction", err)
+	}
+
+	// signatures from two nodes
+	first := cloneTransaction(decision)
+	first.Sign(deriveTestKeyPair(t, master, "1/1"))
+	second := cloneTransaction(decision)
+	second.Sign(deriveTestKeyPair(t, master, "1/2"))
+
+	if _, err := ProcessTransaction(first); err != nil {
+		t.Fatal("Cannot merge first signature", err)
+	}
+	if pending := Pending.Get(decision.Hash); len(pending.Signatures) != 2 || len(pooled.Signatures) != 1 || Retrieve(decision.Hash) != nil {
+		t.Fatal("First signature should be merged into the pending transaction, not into the copies handed out", len(pending.Signatures))
+	}
+
+	if _, err := ProcessTransaction(second); err != nil {
+		t.Fatal("Cannot merge second signature", err)
+	}
+	if Pending.Get(decision.Hash) != nil {
+		t.Error("Verified transaction should leave the pending pool")
+	}
+	saved := Retrieve(decision.Hash)
+	if saved == nil || len(saved.Signatures) != 3 {
+		t.Fatal("Verified transaction should be saved with all signatures")
+	}
+
+	// already in the chain
+	if _, err := ProcessTransaction(cloneTransaction(decision)); err != ErrKnownTransaction {
+		t.Error("Expected known transaction", err)
+	}
+}
+
+func TestMergeSignatures(t *testing.T) {
+
+	master, _ := crypto.NewWallet()
+	org := Organization{
+		Name:                          "Merge Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		MinimumRequiredSignaturePaths: []string{"2 of 1/*"},
+	}
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, org, keypair)
+	tx, err := Build(Object, "json", genesis.Hash, []byte(`{"merged": "signatures"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Sign(keypair)
+	if ok, err := tx.Validate(); !ok {
+		t.Fatal("Transaction should be valid", err)
+	}
+
+	other := cloneTransaction(tx)
+	other.Sign(deriveTestKeyPair(t, master, "1/1"))
+	forged := cloneTransaction(tx)
+	forged.Sign(deriveTestKeyPair(t, master, "1/2"))
+	forged.Signatures[1] = forged.Signatures[0]
+	outsider := cloneTransaction(tx)
+	outsider.Sign(newTestKeyPair(t))
+
+	if added := tx.MergeSignatures(forged); added != 0 {
+		t.Error("Invalid signatures should not be merged")
+	}
+	if added := tx.MergeSignatures(outsider); added != 0 {
+		t.Error("Signature of a key out of the organization should not be merged")
+	}
+	if added := tx.MergeSignatures(other); added != 1 || len(tx.Signatures) != 2 {
+		t.Error("Valid signature should be merged", added)
+	}
+	if added := tx.MergeSignatures(other); added != 0 {
+		t.Error("Signature should be merged only once")
+	}
+
+	// signatures stop at MaxSignatures
+	full := cloneTransaction(tx)
+	for len(full.Signatures) < MaxSignatures {
+		full.Signatures = append(full.Signatures, full.Signatures[1])
+		full.PublicKeys = append(full.PublicKeys, make([]byte, 33))
+		full.DerivationPaths = append(full.DerivationPaths, full.DerivationPaths[1])
+		full.DerivationSteps = append(full.DerivationSteps, full.DerivationSteps[1])
+	}
+	more := cloneTransaction(tx)
+	more.Sign(deriveTestKeyPair(t, master, "1/3"))
+	if added := full.MergeSignatures(more); added != 0 || len(full.Signatures) != MaxSignatures {
+		t.Error("Signatures should not be merged past MaxSignatures", added)
+	}
+	if err := full.AddSignature(more.PublicKeys[2], more.Signatures[2], more.DerivationPaths[2]); !errors.Is(err, ErrSizeLimit) {
+		t.Error("Approvals should not be added past MaxSignatures", err)
+	}
+}
+
+func TestPendingLimits(t *testing.T) {
+
+	defer func(quota int) { MaxPendingPerSigner = quota }(MaxPendingPerSigner)
+	MaxPendingPerSigner = 2
+	pool := NewPendingPool()
+	spammer, other := newTestKeyPair(t), newTestKeyPair(t)
+	build := func(keypair keystore.KeyPair, i int) *Transaction {
+		tx, err := Build(Genesis, "json", nil, []byte(fmt.Sprintf(`{"Name":"Spam %d"}`, i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Sign(keypair)
+		return tx
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := pool.Add(build(spammer, i)); err != nil {
+			t.Fatal("Cannot add transaction", err)
+		}
+	}
+	if _, _, err := pool.Add(build(spammer, 2)); err != ErrPendingQuota {
+		t.Error("Signer should not pool more than its quota", err)
+	}
+	if _, _, err := pool.Add(build(other, 2)); err != nil {
+		t.Error("Quota should be per signer", err)
+	}
+
+	// expired entries leave and free the quota of their signer
+	pool.mu.Lock()
+	pool.expire(time.Now().Add(PendingExpiry + time.Second))
+	pool.mu.Unlock()
+	if pool.Len() != 0 {
+		t.Error("Expired transactions should leave the pool", pool.Len())
+	}
+	if _, _, err := pool.Add(build(spammer, 3)); err != nil {
+		t.Error("Quota should be freed by expiry", err)
+	}
+
+	// fresh creator keys do not get past the size of the pool
+	defer func(size int) { MaxPendingBytes = size }(MaxPendingBytes)
+	MaxPendingBytes = pool.size + 100
+	if _, _, err := pool.Add(build(newTestKeyPair(t), 4)); err != ErrPendingPoolFull {
+		t.Error("Pool should not grow past MaxPendingBytes", err)
+	}
+	pool.Remove(build(spammer, 3).Hash)
+	if _, _, err := pool.Add(build(newTestKeyPair(t), 4)); err != nil {
+		t.Error("Removed transaction should free its size", err)
+	}
+}
+
+func TestPendingConcurrency(t *testing.T) {
+
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := Organization{
+		Name:                          "Busy Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		MinimumRequiredSignaturePaths: []string{"6 of board"},
+		SignatureGroups:               map[string]string{"board": "1/*"},
+	}
+	creator := newTestKeyPair(t)
+	genesis := newTestOrganization(t, org, creator)
+	decision, err := Build(Decision, "json", genesis.Hash, []byte(`{"decision":"busy"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision.Sign(creator)
+
+	// copies signed by the board arrive at once, the pooled one is read meanwhile
+	var copies []*Transaction
+	for i := 1; i <= 8; i++ {
+		c := cloneTransaction(decision)
+		c.Sign(deriveTestKeyPair(t, master, fmt.Sprintf("1/%d", i)))
+		copies = append(copies, c)
+	}
+	var wg sync.WaitGroup
+	for _, c := range copies {
+		wg.Add(1)
+		go func(c *Transaction) {
+			defer wg.Done()
+			if pooled, err := ProcessTransaction(c); err == nil {
+				pooled.ToBytes()
+			}
+			if pending := Pending.Get(decision.Hash); pending != nil {
+				pending.ToBytes()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if Pending.Get(decision.Hash) != nil {
+		t.Error("Verified transaction should leave the pending pool")
+	}
+	if saved := Retrieve(decision.Hash); saved == nil || len(saved.Signatures) < 7 {
+		t.Error("Verified transaction should be saved once with the merged signatures")
+	}
+}
+
+func TestPromoteOnce(t *testing.T) {
+
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, Organization{Name: "Once Org"}, keypair)
+	tx, err := Build(Object, "json", genesis.Hash, []byte(`{"promoted": "once"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Sign(keypair)
+
+	// copies delivered at once are committed by one of them
+	height := Height()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(c *Transaction) {
+			defer wg.Done()
+			ProcessTransaction(c)
+		}(cloneTransaction(tx))
+	}
+	wg.Wait()
+	if committed := Height() - height; committed != 1 {
+		t.Error("Transaction should be committed once", committed)
+	}
+	if Pending.Get(tx.Hash) != nil {
+		t.Error("Committed transaction should not stay pending")
+	}
+}
+
+func TestMergeAggregateSignature(t *testing.T) {
+	master, _ := crypto.NewWallet()
+	blsMaster, blsMasterPublic, _ := crypto.BLSMasterKey(master)
+	org := Organization{
+		Name:                          "BLS Merge Org",
+		MasterPublicKey:               master.Pub().Serialize(),
+		BLSMasterPublicKey:            blsMasterPublic,
+		MinimumRequiredSignaturePaths: []string{"4 of 1/*"},
+	}
+	genesis := newTestOrganization(t, org, newTestKeyPair(t))
+
+	tx, _ := Build(Object, "json", genesis.Hash, []byte(`{"merged": true}`), nil)
+	tx.UseScheme(crypto.BLS)
+	tx.Sign(deriveTestBLSKeyPair(t, blsMaster, "9"))
+	if ok, err := tx.Validate(); !ok {
+		t.Fatal("BLS transaction should be valid", err)
+	}
+
+	// one node has two approvals, another has three folded into its aggregate
+	pending := cloneTransaction(tx)
+	pending.Sign(deriveTestBLSKeyPair(t, blsMaster, "1/1"))
+	pending.Sign(deriveTestBLSKeyPair(t, blsMaster, "1/4"))
+	aggregated := cloneTransaction(tx)
+	for _, path := range []string{"1/1", "1/2", "1/3"} {
+		aggregated.Sign(deriveTestBLSKeyPair(t, blsMaster, path))
+	}
+	if err := aggregated.Aggregate(); err != nil {
+		t.Fatal("Cannot aggregate", err)
+	}
+
+	forged := cloneTransaction(aggregated)
+	forged.AggregateSignature = forged.Signatures[0]
+	if added := pending.MergeSignatures(forged); added != 0 || len(pending.AggregateSignature) != 0 {
+		t.Error("Invalid aggregate signature should not be merged")
+	}
+
+	if added := pending.MergeSignatures(aggregated); added != 2 || len(pending.Signatures) != 5 {
+		t.Fatal("Aggregated signers should be merged", added, len(pending.Signatures))
+	}
+	if ok, err := pending.Verify(); !ok {
+		t.Error("Merged transaction should be verified", err)
+	}
+	if added := pending.MergeSignatures(aggregated); added != 0 {
+		t.Error("Aggregate signature should be merged only once")
+	}
+
+	// the merged approval folds into the aggregate
+	if err := pending.Aggregate(); err != nil {
+		t.Fatal("Cannot aggregate merged transaction", err)
+	}
+	if signers := pending.CheckSignatures(); len(signers) != 4 {
+		t.Error("All co-signers should count", len(signers))
+	}
+
+	// an aggregate missing signers of the current one is not taken
+	if added := pending.MergeSignatures(aggregated); added != 0 || len(pending.Signatures) != 5 {
+		t.Error("Smaller aggregate should not replace the current one", added)
+	}
+	if ok, err := pending.Verify(); !ok {
+		t.Error("Transaction should stay verified", err)
+	}
+}
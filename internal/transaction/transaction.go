@@ -4,8 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 
-	"github.com/alpdeniz/themachine/internal/crypto"
-	"github.com/alpdeniz/themachine/internal/keystore"
+	"github.com/alpdeniz/themachine/internal/db"
 )
 
 // Process applies the procedure to all incoming transactions
@@ -17,6 +16,14 @@ func Process(transactionBytes []byte) (*Transaction, error) {
 		return nil, err
 	}
 
+	return ProcessTransaction(tx)
+}
+
+// ProcessTransaction validates the transaction, puts it into the pending pool
+// (or merges it with its pending copy) and saves it once verified.
+// Returns ErrKnownTransaction if it brings nothing new, thus should not be relayed
+func ProcessTransaction(tx *Transaction) (*Transaction, error) {
+
 	// Validate
 	ok, err := tx.Validate()
 	if !ok || err != nil {
@@ -24,57 +31,50 @@ func Process(transactionBytes []byte) (*Transaction, error) {
 		return nil, err
 	}
 
-	// // Check to see if it is related to this node, if yes, save into related
-	processRelated(tx)
-
-	// // Validate
-	// ok, err = Verify(tx)
-	// if !ok || err != nil {
-	// 	fmt.Println("Valid but unverified transaction", hex.EncodeToString(tx.Hash), err)
-	// // Not saving but relaying
-	// 	return tx, err
-	// }
-
-	// Validated
-	tx.Save()
-
-	return tx, nil
-}
+	// Already part of the chain
+	if len(db.Get(tx.Hash).Hash) != 0 {
+		return tx, ErrKnownTransaction
+	}
 
-// check if transaction is valid
-func (tx *Transaction) Validate() (bool, error) {
+	// Wait for the required signatures in the pending pool
+	pooled, added, err := Pending.Add(tx)
+	if err != nil {
+		return nil, err
+	}
+	if pooled == tx {
+		// Check to see if it is related to this node, if yes, save into related
+		processRelated(tx)
+	} else if added == 0 {
+		return pooled, ErrKnownTransaction
+	}
 
-	// ok, err := tx.CheckInitialSignature()
-	// if !ok {
-	// 	return false, err
-	// }
+	// Verified transactions are promoted to the main chain
+	ok, err = Pending.promote(pooled.Hash)
+	if !ok {
+		fmt.Println("Valid but unverified transaction", hex.EncodeToString(tx.Hash), err)
+	}
 
-	// check hash, check rules etc.
-	return true, nil
+	return pooled, nil
 }
 
 // check if transaction is verified
+// i.e. signed by the signers required by the organization policy and its targets
 func (tx *Transaction) Verify() (bool, error) {
 
-	// check if signed by required number of signers
-	numberOfSignatures := tx.CheckSignatures()
-	if tx.IsVerified(numberOfSignatures) {
+	// creating an organization only requires its creator's signature
+	// and a seal the one of its validator, see checkSeal
+	if tx.ObjectType == Genesis || tx.ObjectType == Seal {
 		return true, nil
 	}
 
-	return false, nil
+	return tx.IsVerified(tx.CheckSignatures())
 }
 
 func processRelated(tx *Transaction) {
 	// Find out if asks for our signature
-	for _, target := range tx.Targets {
-		for _, keypair := range keystore.CurrentKeyMap {
-			// check if our key is eligible to sign
-			if crypto.IsPathUnderPath(crypto.ParseDerivationPathString(keypair.DerivationPath), crypto.ParseDerivationPathString(target)) {
-				// then it is of importance to this node
-				// the app should inform the user of this node to read and to sign or not
-				tx.SaveRelated()
-			}
-		}
+	if len(tx.EligibleKeyPairs()) > 0 {
+		// then it is of importance to this node
+		// the app should inform the user of this node to read and to sign or not
+		tx.SaveRelated()
 	}
 }
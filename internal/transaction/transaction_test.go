@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
 	"testing"
+	"testing/quick"
 
+	"github.com/alpdeniz/themachine/internal/db"
 	"github.com/alpdeniz/themachine/internal/keystore"
 )
 
@@ -23,11 +29,16 @@ var (
 	}
 )
 
+func TestMain(m *testing.M) {
+	db.Use(db.NewMemoryStore())
+	os.Exit(m.Run())
+}
+
 func TestBuild(t *testing.T) {
 
 	organizationTx := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31}
-	exampleHash, _ := hex.DecodeString("337349113a5c51e8bc96c9c7182fdb16fd3aec7f292ce5e1847ef0f70530bb2d")
-	exampleBytes := []byte{0, 0, 0, 0, 170, 0, 0, 0, 123, 34, 78, 97, 109, 101, 34, 58, 34, 84, 101, 115, 116, 32, 79, 114, 103, 34, 44, 34, 68, 101, 115, 99, 114, 105, 112, 116, 105, 111, 110, 34, 58, 34, 84, 101, 115, 116, 32, 68, 101, 115, 99, 34, 44, 34, 77, 97, 115, 116, 101, 114, 80, 117, 98, 108, 105, 99, 75, 101, 121, 34, 58, 34, 34, 44, 34, 77, 105, 110, 105, 109, 117, 109, 82, 101, 113, 117, 105, 114, 101, 100, 83, 105, 103, 110, 97, 116, 117, 114, 101, 80, 97, 116, 104, 115, 34, 58, 91, 34, 49, 47, 42, 43, 34, 93, 44, 34, 82, 101, 113, 117, 105, 114, 101, 100, 83, 105, 103, 110, 97, 116, 117, 114, 101, 80, 97, 116, 104, 115, 80, 101, 114, 79, 98, 106, 101, 99, 116, 34, 58, 123, 125, 44, 34, 82, 117, 108, 101, 115, 34, 58, 91, 34, 82, 117, 108, 101, 49, 34, 44, 34, 82, 117, 108, 101, 50, 34, 93, 125, 8, 0, 109, 47, 49, 39, 47, 49, 58, 53}
+	exampleHash, _ := hex.DecodeString("8abc2b355a302dd77cbdc45807793c132c5c38fcd74af619e84713cb88b226c9")
+	exampleBytes := []byte{0, 1, 0, 0, 0, 4, 106, 115, 111, 110, 170, 0, 0, 0, 123, 34, 78, 97, 109, 101, 34, 58, 34, 84, 101, 115, 116, 32, 79, 114, 103, 34, 44, 34, 68, 101, 115, 99, 114, 105, 112, 116, 105, 111, 110, 34, 58, 34, 84, 101, 115, 116, 32, 68, 101, 115, 99, 34, 44, 34, 77, 97, 115, 116, 101, 114, 80, 117, 98, 108, 105, 99, 75, 101, 121, 34, 58, 34, 34, 44, 34, 77, 105, 110, 105, 109, 117, 109, 82, 101, 113, 117, 105, 114, 101, 100, 83, 105, 103, 110, 97, 116, 117, 114, 101, 80, 97, 116, 104, 115, 34, 58, 91, 34, 49, 47, 42, 43, 34, 93, 44, 34, 82, 101, 113, 117, 105, 114, 101, 100, 83, 105, 103, 110, 97, 116, 117, 114, 101, 80, 97, 116, 104, 115, 80, 101, 114, 79, 98, 106, 101, 99, 116, 34, 58, 123, 125, 44, 34, 82, 117, 108, 101, 115, 34, 58, 91, 34, 82, 117, 108, 101, 49, 34, 44, 34, 82, 117, 108, 101, 50, 34, 93, 125, 1, 0, 8, 0, 109, 47, 49, 39, 47, 49, 58, 53, 0, 0}
 	targets := []string{"m/1'/1:5"} // e.g 5 signatures are enough for approval
 	var err error = nil
 
@@ -70,6 +81,136 @@ func TestParseBytes(t *testing.T) {
 
 }
 
+func TestParseMalformedBytes(t *testing.T) {
+
+	signed := cloneTransaction(tx)
+	signed.Sign(newTestKeyPair(t))
+	signedBytes := signed.ToBytes()
+
+	parsed, err := ParseBytes(signedBytes)
+	if err != nil {
+		t.Fatal("Cannot parse signed transaction", err)
+	}
+	if parsed.SubType != "json" || len(parsed.Signatures) != 1 || !bytes.Equal(parsed.ToBytes(), signedBytes) {
+		t.Error("Parsed transaction does not encode to the same bytes")
+	}
+
+	// every truncation is an error, not a panic
+	for i := 0; i < len(signedBytes); i++ {
+		if _, err := ParseBytes(signedBytes[:i]); !errors.Is(err, ErrMalformedTransaction) {
+			t.Fatal("Truncated transaction should be malformed", i, err)
+		}
+	}
+
+	if _, err := ParseBytes(append(signedBytes, 0)); !errors.Is(err, ErrMalformedTransaction) {
+		t.Error("Trailing bytes should be malformed", err)
+	}
+
+	unknownVersion := append([]byte{}, signedBytes...)
+	unknownVersion[1] = 2
+	if _, err := ParseBytes(unknownVersion); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("Unknown version should be rejected", err)
+	}
+
+	// a genesis does not refer to an organization
+	withOrganization := append([]byte{}, signedBytes[:4]...)
+	withOrganization = append(withOrganization, 32)
+	withOrganization = append(withOrganization, make([]byte, 32)...)
+	withOrganization = append(withOrganization, signedBytes[5:]...)
+	if _, err := ParseBytes(withOrganization); !errors.Is(err, ErrMalformedTransaction) {
+		t.Error("Genesis with organization tx should be malformed", err)
+	}
+
+	// a length is encoded one way only
+	nonMinimal := append([]byte{}, signedBytes[:4]...)
+	nonMinimal = append(nonMinimal, 0x80, 0x00)
+	nonMinimal = append(nonMinimal, signedBytes[5:]...)
+	if _, err := ParseBytes(nonMinimal); !errors.Is(err, ErrMalformedTransaction) {
+		t.Error("Non minimal length should be malformed", err)
+	}
+}
+
+func TestLongFields(t *testing.T) {
+
+	long := cloneTransaction(tx)
+	long.Sign(newTestKeyPair(t))
+	long.DerivationPaths[0] = bytes.Repeat([]byte{0, 0, 0, 1}, 100)
+	parsed, err := ParseBytes(long.ToBytes())
+	if err != nil {
+		t.Fatal("Cannot parse transaction with a long field", err)
+	}
+	if !bytes.Equal(parsed.DerivationPaths[0], long.DerivationPaths[0]) || !bytes.Equal(parsed.ToBytes(), long.ToBytes()) {
+		t.Error("Field over 255 bytes should not be truncated", len(parsed.DerivationPaths[0]))
+	}
+}
+
+// randomTransaction generates transactions with random fields for property tests
+type randomTransaction struct {
+	*Transaction
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func (randomTransaction) Generate(r *rand.Rand, size int) reflect.Value {
+	tx := Transaction{}
+	tx.ObjectType = ObjectType(r.Intn(256))
+	tx.Meta = [4]byte{byte(tx.ObjectType), EncodingVersion, 0, 0}
+	if tx.ObjectType != Genesis {
+		tx.OrganizationTx = randomBytes(r, 32)
+	}
+	tx.SubType = ObjectSubType(randomBytes(r, r.Intn(16)))
+	tx.Data = randomBytes(r, r.Intn(size*16+1))
+	tx.DataLength = uint32(len(tx.Data))
+	for i := r.Intn(MaxTargets); i > 0; i-- {
+		tx.Targets = append(tx.Targets, string(randomBytes(r, r.Intn(MaxTargetLength))))
+	}
+	for i := r.Intn(8); i > 0; i-- {
+		tx.PublicKeys = append(tx.PublicKeys, randomBytes(r, 33))
+		tx.Signatures = append(tx.Signatures, randomBytes(r, 64))
+		tx.DerivationPaths = append(tx.DerivationPaths, randomBytes(r, 4*r.Intn(100)))
+	}
+	tx.CalculateHash()
+	return reflect.ValueOf(randomTransaction{&tx})
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	roundTrip := func(r randomTransaction) bool {
+		parsed, err := ParseBytes(r.ToBytes())
+		if err != nil {
+			t.Log("Cannot parse transaction", err)
+			return false
+		}
+		return bytes.Equal(parsed.Hash, r.Hash) &&
+			reflect.DeepEqual(parsed.Targets, r.Targets) &&
+			reflect.DeepEqual(parsed.Signatures, r.Signatures) &&
+			reflect.DeepEqual(parsed.PublicKeys, r.PublicKeys) &&
+			reflect.DeepEqual(parsed.DerivationPaths, r.DerivationPaths)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+
+	// any single corrupted byte either fails parsing or changes the transaction
+	corrupted := func(r randomTransaction, i int, b byte) bool {
+		txBytes := r.ToBytes()
+		i = int(uint(i) % uint(len(txBytes)))
+		if txBytes[i] == b {
+			return true
+		}
+		txBytes[i] = b
+		parsed, err := ParseBytes(txBytes)
+		return err != nil || !bytes.Equal(parsed.ToBytes(), r.ToBytes())
+	}
+	if err := quick.Check(corrupted, nil); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestSign(t *testing.T) {
 	keystore.Open()
 	keypair := keystore.GetKeyPairByName("Node")
@@ -3,7 +3,11 @@ package transaction
 // Types for transaction package
 
 import (
+	"fmt"
 	"time"
+
+	"github.com/alpdeniz/themachine/internal/compute"
+	"github.com/alpdeniz/themachine/internal/crypto"
 )
 
 type Organization struct {
@@ -13,25 +17,30 @@ type Organization struct {
 	MinimumRequiredSignaturePaths   []string            // Minimum signature needed to validate a transaction
 	RequiredSignaturePathsPerObject map[string][]string // An organization may allow some time and disallow another
 	Rules                           []string            // no idea - dummy
+	SignatureGroups                 map[string]string   `json:",omitempty"` // Named derivation paths to use in policies e.g. "board": "m/1'/1/*"
+	ValidatorPath                   string              `json:",omitempty"` // Keys at ValidatorPath/0 .. /Validators-1 seal batches, see internal/consensus
+	Validators                      uint32              `json:",omitempty"`
+	BLSMasterPublicKey              []byte              `json:",omitempty"` // BLS keys of members derive from it, see crypto.BLSDerivePublicKey
 }
 
 type Transaction struct {
-	Index                     uint64        // Index to work out longest chain
-	Hash                      []byte        // hash of transaction contents
-	Meta                      [4]byte       // To store transaction type + some flags
-	ObjectType                ObjectType    // see TransactionObjectType
-	SubType                   ObjectSubType // file type, cert type etc
-	Targets                   []string      // Key derivation paths which are needed sign for this to be part of the chain
-	OrganizationTx            []byte        // 32 bytes Genesis tx hash
-	Organization              Organization  // points to organization Genesis tx
-	DataLength                uint32
-	Data                      []byte     // Data of ObjectTypes x
-	Signatures                [][]byte   // Signatures 64 bytes each
-	PublicKeys                [][]byte   // Respective public keys 33 bytes each
-	DerivationPaths           [][]byte   // Respective derivation paths of public keys in relation to organizational master public key as 4 uint32
-	DerivationSteps           [][]uint32 // Ready to use form of above
-	MinimumRequiredSignatures []int      // for each derivation path
-	Date                      time.Time
+	Index              uint64        // Place in the chain, see Entry and fork.go
+	Hash               []byte        // hash of transaction contents
+	Meta               [4]byte       // To store transaction type + encoding version + signature scheme + flags
+	ObjectType         ObjectType    // see TransactionObjectType
+	SubType            ObjectSubType // file type, cert type etc
+	Targets            []string      // Key derivation paths which are needed sign for this to be part of the chain
+	OrganizationTx     []byte        // 32 bytes Genesis tx hash
+	Organization       Organization  // points to organization Genesis tx
+	DataLength         uint32
+	Data               []byte          // Data of ObjectTypes x
+	Signatures         [][]byte        // Signatures 64 bytes each (192 for BLS), empty if aggregated
+	PublicKeys         [][]byte        // Respective public keys 33 bytes each (96 for BLS)
+	DerivationPaths    [][]byte        // Respective derivation paths of public keys in relation to organizational master public key as 4 uint32
+	DerivationSteps    [][]uint32      // Ready to use form of above
+	Scheme             crypto.SchemeID // Signature scheme, stored in Meta[2]
+	AggregateSignature []byte          // Co-signatures folded into one if the scheme allows, see Aggregate
+	Date               time.Time
 }
 
 type ObjectSubType string
@@ -42,8 +51,9 @@ const (
 	FileTypePNG    = "png"
 	FileTypeTXT    = "txt"
 	FileTypeJSON   = "json"
-	CodeTypePython = "python"
-	CodeTypeNodeJS = "nodejs"
+	CodeTypePython = compute.CodeTypePython
+	CodeTypeNodeJS = compute.CodeTypeNodeJS
+	CodeTypeWASM   = compute.CodeTypeWASM
 )
 
 type ObjectType int
@@ -67,9 +77,15 @@ const (
 	EncryptedExecutable
 	EncryptedAsset
 	EncryptedObject
+	Seal // 18 batch of transactions sealed by a validator of the organization
 )
 
 // Returns string representation of a ObjectType
 func (o ObjectType) String() string {
-	return [...]string{"Genesis", "File", "Object", "Certificate", "Executable", "Asset", "Token", "Decision", "Law", "Proposal"}[o]
+	names := [...]string{"Genesis", "File", "Object", "Certificate", "Executable", "Asset", "Token", "Decision", "Law", "Proposal",
+		"EncryptedFile", "EncryptedCertificate", "EncryptedDecision", "EncryptedIdentity", "EncryptedProposal", "EncryptedExecutable", "EncryptedAsset", "EncryptedObject", "Seal"}
+	if o < 0 || int(o) >= len(names) {
+		return fmt.Sprintf("ObjectType(%d)", int(o))
+	}
+	return names[o]
 }
@@ -0,0 +1,247 @@
+package transaction
+
+// Validation rules every transaction has to obey before it is accepted
+// - Size      limits on data, targets and signatures
+// - Hash      hash matches GetHashedBytes
+// - Signature first signature (of the creator) is valid
+// - Genesis   referred organization exists (or genesis data is an organization)
+// - Object    object type is allowed by the organization
+// - Targets   target policies (e.g. "m/1'/1:5") are well formed
+// - Seal      seal transactions are sealed by the right validator, see SealVerifier
+// - Scheme    signature scheme is usable by the organization, e.g. BLS needs its BLS master key
+// - Code      executables have a runtime for their sub type, WebAssembly ones are modules the node can run
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/alpdeniz/themachine/internal/compute"
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/db"
+	"github.com/alpdeniz/themachine/internal/policy"
+)
+
+// Size limits
+const (
+	MaxDataLength    = 16 * 1024 * 1024
+	MaxSubTypeLength = 255
+	MaxTargets       = 64
+	MaxTargetLength  = 256
+	MaxSignatures    = 256
+)
+
+// Rules, check with errors.Is
+var (
+	ErrSizeLimit            = errors.New("Size limit exceeded")
+	ErrInvalidHash          = errors.New("Invalid transaction hash")
+	ErrInvalidSignature     = errors.New("Invalid initial signature")
+	ErrUnknownOrganization  = errors.New("Unknown organization")
+	ErrObjectTypeNotAllowed = errors.New("Object type is not allowed")
+	ErrInvalidTarget        = errors.New("Invalid target path")
+	ErrInvalidPolicy        = errors.New("Invalid organization policy")
+	ErrInvalidSeal          = errors.New("Invalid seal")
+	ErrUnsupportedScheme    = errors.New("Unsupported signature scheme")
+	ErrInvalidCode          = errors.New("Invalid executable code")
+)
+
+// SealVerifier checks Seal transactions against given chain, set by the consensus package
+var SealVerifier func(tx *Transaction, chain db.View) error
+
+// ValidationError tells which rule a transaction failed and why
+type ValidationError struct {
+	Rule   error
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Rule, e.Detail)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Rule
+}
+
+func invalid(rule error, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{rule, fmt.Sprintf(format, args...)}
+}
+
+// check if transaction is valid
+// Sets the organization of the transaction on success
+func (tx *Transaction) Validate() (bool, error) {
+	return tx.ValidateIn(db.CurrentView())
+}
+
+// ValidateIn checks the transaction against given chain, see db.Staged
+func (tx *Transaction) ValidateIn(chain db.View) (bool, error) {
+
+	checks := []func() error{
+		tx.checkSize,
+		tx.checkHash,
+		tx.checkInitialSignature,
+		func() error { return tx.checkOrganization(chain) },
+		tx.checkObjectType,
+		tx.checkTargets,
+		func() error { return tx.checkSeal(chain) },
+		tx.checkScheme,
+		tx.checkCode,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (tx *Transaction) checkSize() error {
+	if len(tx.Data) > MaxDataLength {
+		return invalid(ErrSizeLimit, "data is %d bytes, maximum is %d", len(tx.Data), MaxDataLength)
+	}
+	if len(tx.SubType) > MaxSubTypeLength {
+		return invalid(ErrSizeLimit, "sub type is %d bytes, maximum is %d", len(tx.SubType), MaxSubTypeLength)
+	}
+	if len(tx.Targets) > MaxTargets {
+		return invalid(ErrSizeLimit, "%d targets, maximum is %d", len(tx.Targets), MaxTargets)
+	}
+	for _, v := range tx.Targets {
+		if len(v) > MaxTargetLength {
+			return invalid(ErrSizeLimit, "target is %d bytes, maximum is %d", len(v), MaxTargetLength)
+		}
+	}
+	if len(tx.Signatures) > MaxSignatures {
+		return invalid(ErrSizeLimit, "%d signatures, maximum is %d", len(tx.Signatures), MaxSignatures)
+	}
+	if len(tx.PublicKeys) != len(tx.Signatures) || len(tx.DerivationPaths) != len(tx.Signatures) {
+		return invalid(ErrSizeLimit, "%d signatures with %d public keys and %d derivation paths", len(tx.Signatures), len(tx.PublicKeys), len(tx.DerivationPaths))
+	}
+	return nil
+}
+
+func (tx *Transaction) checkHash() error {
+	if !bytes.Equal(tx.Hash, crypto.DHash(tx.GetHashedBytes())) {
+		return invalid(ErrInvalidHash, "hash does not match transaction contents")
+	}
+	return nil
+}
+
+func (tx *Transaction) checkInitialSignature() error {
+	ok, err := tx.CheckInitialSignature()
+	if err != nil {
+		return invalid(ErrInvalidSignature, "%s", err)
+	}
+	if !ok {
+		return invalid(ErrInvalidSignature, "signature does not match the first public key")
+	}
+	return nil
+}
+
+func (tx *Transaction) checkOrganization(chain db.View) error {
+
+	// a genesis transaction defines the organization itself
+	if tx.ObjectType == Genesis {
+		if len(tx.OrganizationTx) != 0 {
+			return invalid(ErrUnknownOrganization, "genesis transaction cannot refer to an organization")
+		}
+		organization, err := ParseOrganizationData(tx.Data)
+		if err != nil {
+			return invalid(ErrUnknownOrganization, "cannot parse organization data: %s", err)
+		}
+		if err := organization.checkPolicies(); err != nil {
+			return invalid(ErrInvalidPolicy, "%s", err)
+		}
+		if err := organization.checkValidators(); err != nil {
+			return invalid(ErrInvalidPolicy, "%s", err)
+		}
+		if len(organization.BLSMasterPublicKey) != 0 {
+			if _, err := crypto.BLSDerivePublicKey(nil, organization.BLSMasterPublicKey); err != nil {
+				return invalid(ErrInvalidPolicy, "BLS master public key: %s", err)
+			}
+		}
+		tx.Organization = *organization
+		return nil
+	}
+
+	if len(tx.OrganizationTx) != 32 {
+		return invalid(ErrUnknownOrganization, "organization transaction hash is %d bytes", len(tx.OrganizationTx))
+	}
+	organizationTransaction := retrieve(chain, tx.OrganizationTx)
+	if organizationTransaction == nil {
+		return invalid(ErrUnknownOrganization, "cannot find organization transaction")
+	}
+	if organizationTransaction.ObjectType != Genesis {
+		return invalid(ErrUnknownOrganization, "organization transaction is a %s transaction", organizationTransaction.ObjectType)
+	}
+	tx.Organization = organizationTransaction.Organization
+	return nil
+}
+
+func (tx *Transaction) checkObjectType() error {
+	if tx.ObjectType < Genesis || tx.ObjectType > Seal {
+		return invalid(ErrObjectTypeNotAllowed, "unknown object type %d", int(tx.ObjectType))
+	}
+	if tx.ObjectType == Seal && tx.Organization.Validators == 0 {
+		return invalid(ErrObjectTypeNotAllowed, "%s has no validators", tx.Organization.Name)
+	}
+	// an organization without per object rules allows every object type
+	if tx.ObjectType == Genesis || tx.ObjectType == Seal || len(tx.Organization.RequiredSignaturePathsPerObject) == 0 {
+		return nil
+	}
+	if _, ok := tx.Organization.RequiredSignaturePathsPerObject[tx.ObjectType.String()]; !ok {
+		return invalid(ErrObjectTypeNotAllowed, "%s is not allowed by %s", tx.ObjectType, tx.Organization.Name)
+	}
+	return nil
+}
+
+func (tx *Transaction) checkTargets() error {
+	for _, v := range tx.Targets {
+		if _, err := policy.Parse(v, tx.Organization.SignatureGroups); err != nil {
+			return invalid(ErrInvalidTarget, "%s", err)
+		}
+	}
+	return nil
+}
+
+func (tx *Transaction) checkSeal(chain db.View) error {
+	if tx.ObjectType != Seal {
+		return nil
+	}
+	if SealVerifier == nil {
+		return invalid(ErrInvalidSeal, "no consensus to verify the seal")
+	}
+	if err := SealVerifier(tx, chain); err != nil {
+		return invalid(ErrInvalidSeal, "%s", err)
+	}
+	return nil
+}
+
+func (tx *Transaction) checkScheme() error {
+	if _, err := crypto.GetScheme(tx.Scheme); err != nil {
+		return invalid(ErrUnsupportedScheme, "%s", err)
+	}
+	if len(tx.AggregateSignature) != 0 && !tx.aggregates() {
+		return invalid(ErrUnsupportedScheme, "%s signatures cannot be aggregated", tx.Scheme)
+	}
+	if tx.Scheme == crypto.Secp256k1 || tx.ObjectType == Genesis {
+		return nil
+	}
+	// validators seal with their secp256k1 keys, see internal/consensus
+	if tx.ObjectType == Seal {
+		return invalid(ErrUnsupportedScheme, "seals are signed with %s", crypto.Secp256k1)
+	}
+	if tx.Scheme == crypto.BLS && len(tx.Organization.BLSMasterPublicKey) == 0 {
+		return invalid(ErrUnsupportedScheme, "%s has no BLS master public key", tx.Organization.Name)
+	}
+	return nil
+}
+
+func (tx *Transaction) checkCode() error {
+	if tx.ObjectType != Executable {
+		return nil
+	}
+	if err := compute.ValidateCode(string(tx.SubType), tx.Data); err != nil {
+		return invalid(ErrInvalidCode, "%s", err)
+	}
+	return nil
+}
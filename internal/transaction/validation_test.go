@@ -0,0 +1,153 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/alpdeniz/themachine/internal/crypto"
+	"github.com/alpdeniz/themachine/internal/keystore"
+)
+
+func newTestKeyPair(t testing.TB) keystore.KeyPair {
+	master, err := crypto.NewWallet()
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	return keystore.KeyPair{
+		Name:           "test",
+		DerivationPath: "0",
+		PublicKey:      master.Pub().Key,
+		PrivateKey:     master.Key,
+	}
+}
+
+// builds, signs and saves a genesis transaction of given organization
+func newTestOrganization(t *testing.T, organization Organization, keypair keystore.KeyPair) *Transaction {
+	foundation, err := json.Marshal(organization)
+	if err != nil {
+		t.Fatal("Cannot marshal organization object")
+	}
+	genesis, err := Build(Genesis, "json", nil, foundation, []string{"m/1'/1:5"})
+	if err != nil {
+		t.Fatal("Cannot build genesis transaction", err)
+	}
+	genesis.Sign(keypair)
+	genesis.Save()
+	return genesis
+}
+
+func TestValidate(t *testing.T) {
+
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, testOrg, keypair)
+	if ok, err := genesis.Validate(); !ok || err != nil {
+		t.Error("Genesis transaction should be valid", err)
+	}
+
+	file, err := Build(File, "txt", genesis.Hash, []byte("file contents"), []string{"0/4/*"})
+	if err != nil {
+		t.Fatal("Cannot build file transaction", err)
+	}
+	file.Sign(keypair)
+	if ok, err := file.Validate(); !ok || err != nil {
+		t.Error("File transaction should be valid", err)
+	}
+	if file.Organization.Name != testOrg.Name {
+		t.Error("Organization is not set by validation", file.Organization.Name)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+
+	keypair := newTestKeyPair(t)
+	restrictedOrg := testOrg
+	restrictedOrg.Name = "Restricted Org"
+	restrictedOrg.RequiredSignaturePathsPerObject = map[string][]string{"Certificate": {"1/*"}}
+	genesis := newTestOrganization(t, restrictedOrg, keypair)
+
+	cases := []struct {
+		name  string
+		build func(tx *Transaction)
+		rule  error
+	}{
+		{"tampered data", func(tx *Transaction) {
+			tx.Sign(keypair)
+			tx.Data = []byte("changed")
+		}, ErrInvalidHash},
+		{"unsigned", func(tx *Transaction) {}, ErrInvalidSignature},
+		{"wrong signer", func(tx *Transaction) {
+			tx.Sign(keypair)
+			tx.PublicKeys[0] = newTestKeyPair(t).PublicKey
+		}, ErrInvalidSignature},
+		{"unknown organization", func(tx *Transaction) {
+			tx.OrganizationTx = bytes.Repeat([]byte{7}, 32)
+			tx.CalculateHash()
+			tx.Sign(keypair)
+		}, ErrUnknownOrganization},
+		{"object type not allowed", func(tx *Transaction) {
+			tx.ObjectType = File
+			tx.Meta[0] = byte(File)
+			tx.CalculateHash()
+			tx.Sign(keypair)
+		}, ErrObjectTypeNotAllowed},
+		{"invalid target", func(tx *Transaction) {
+			tx.Targets = []string{"1/a/b"}
+			tx.CalculateHash()
+			tx.Sign(keypair)
+		}, ErrInvalidTarget},
+		{"too many targets", func(tx *Transaction) {
+			tx.Targets = make([]string, MaxTargets+1)
+			tx.CalculateHash()
+			tx.Sign(keypair)
+		}, ErrSizeLimit},
+	}
+
+	for _, c := range cases {
+		tx, err := Build(Certificate, "json", genesis.Hash, []byte("{}"), []string{"1/*"})
+		if err != nil {
+			t.Fatal("Cannot build transaction", err)
+		}
+		c.build(tx)
+
+		ok, err := tx.Validate()
+		if ok || !errors.Is(err, c.rule) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.rule, err)
+		}
+		var validationError *ValidationError
+		if !errors.As(err, &validationError) {
+			t.Errorf("%s: expected a ValidationError, got %T", c.name, err)
+		}
+	}
+}
+
+func TestValidateCode(t *testing.T) {
+
+	keypair := newTestKeyPair(t)
+	genesis := newTestOrganization(t, testOrg, keypair)
+
+	// main doing nothing
+	module := []byte{0, 'a', 's', 'm', 1, 0, 0, 0, 1, 4, 1, 0x60, 0, 0, 3, 2, 1, 0,
+		7, 8, 1, 4, 'm', 'a', 'i', 'n', 0, 0, 10, 4, 1, 2, 0, 0x0b}
+	for code, valid := range map[string]bool{string(module): true, "print('python')": false} {
+		tx, _ := Build(Executable, CodeTypeWASM, genesis.Hash, []byte(code), nil)
+		tx.Sign(keypair)
+		if ok, err := tx.Validate(); ok != valid || !valid && !errors.Is(err, ErrInvalidCode) {
+			t.Error("Unexpected validation of WebAssembly code", valid, err)
+		}
+	}
+	python, _ := Build(Executable, CodeTypePython, genesis.Hash, []byte("print('python')"), nil)
+	python.Sign(keypair)
+	if ok, err := python.Validate(); !ok {
+		t.Error("Python code is not checked", err)
+	}
+	// only the sub types of the protocol, whichever runtimes the node has
+	for _, v := range []string{"ruby", "json", "cobol"} {
+		unsupported, _ := Build(Executable, v, genesis.Hash, []byte("puts 'ruby'"), nil)
+		unsupported.Sign(keypair)
+		if ok, err := unsupported.Validate(); ok || !errors.Is(err, ErrInvalidCode) {
+			t.Error("Executable of a sub type out of the protocol should be invalid", v, err)
+		}
+	}
+}
@@ -2,14 +2,22 @@ package webserver
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/alpdeniz/themachine/internal/block"
 	"github.com/alpdeniz/themachine/internal/compute"
 	"github.com/alpdeniz/themachine/internal/keystore"
 	"github.com/alpdeniz/themachine/internal/network"
@@ -56,14 +64,50 @@ type ShowTransactionData struct {
 	Date         string
 	DownloadLink string // in case it is a downloadable
 	Result       string // in case it is an executable
+	Errors       string // stderr of the executable
+	Failed       bool   // the executable did not exit with 0 within its limits
+	Usage        string // exit status and resources used by the executable
+	Node         string // public key of the node that signed the result
 }
 
 var tmpl *template.Template
 
+// Token authenticates web requests acting with the keys of this node: creating and signing transactions
+// Sent as "Authorization: Bearer <token>" or a posted "token" field, generated on Start if not set
+var Token string
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Cannot generate web token ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requireToken refuses requests without the web token
+func requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.PostFormValue("token")
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimPrefix(header, "Bearer ")
+		}
+		if Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(Token)) != 1 {
+			http.Error(w, "Invalid web token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 // Start sets up a webserver and it routes to handlers
 func Start(port int) {
 	fmt.Println("Starting web server")
 
+	if Token == "" {
+		Token = newToken()
+		fmt.Println("Web token to create and sign transactions:", Token)
+	}
+
 	// setup templates
 	var err error
 	tmpl, err = template.ParseGlob("./templates/*")
@@ -76,9 +120,14 @@ func Start(port int) {
 	r := chi.NewRouter()
 	r.Get("/", homeHandler)
 	r.Get("/{cmd}", cmdHandler)
+	r.Get("/proof/{txid}", proofHandler)
+	r.Post("/jobs/{txid}", submitJobHandler)
+	r.Get("/jobs/{id}", jobHandler)
+	r.Post("/jobs/{id}/cancel", jobHandler)
 	r.Get("/{cmd}/{txid}", txOperationHandler)
 
-	r.Post("/create", relayHandler)
+	r.Post("/create", requireToken(relayHandler))
+	r.Post("/sign/{txid}", requireToken(signHandler))
 
 	// start http server
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), r))
@@ -179,7 +228,7 @@ func cmdHandler(w http.ResponseWriter, r *http.Request) {
 // Handles web user requests
 // - /web/show/{txhash}     : Shows transaction contents
 // - /web/download/{txhash} : Downloads transaction contents
-// - /web/run/{txhash}      : Executes code (depending on the permission setup) and displays the result
+// - /web/run/{txhash}      : Executes code (depending on the permission setup) and displays the signed result, ?input= as JSON
 func txOperationHandler(w http.ResponseWriter, r *http.Request) {
 
 	info := ShowTransactionData{}
@@ -196,8 +245,11 @@ func txOperationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if transaction exists
+	// check if transaction exists, in the chain or waiting for signatures
 	tx := transaction.Retrieve(txhexBytes)
+	if tx == nil {
+		tx = transaction.Pending.Get(txhexBytes)
+	}
 	if tx == nil {
 		fmt.Fprintf(w, "There is no transaction with hash %s", hex.EncodeToString(txhexBytes))
 		return
@@ -227,13 +279,40 @@ func txOperationHandler(w http.ResponseWriter, r *http.Request) {
 		http.ServeContent(w, r, fmt.Sprintf("transaction-%s.%s", txhex[:4], string(tx.SubType)), tx.Date, bytes.NewReader(tx.Data))
 		return
 
+	case "sign":
+
+		// signs with the keys of this node, see signHandler
+		http.Error(w, "Signing needs an authenticated POST request", http.StatusMethodNotAllowed)
+		return
+
 	case "run":
 		// set template
 		templatePath = "run.html"
 		// is executable?
 		// then execute via compute.Execute()
 		if tx.ObjectType == transaction.Executable {
-			info.Result = string(compute.Execute(string(tx.Data)))
+			// ?input= is the JSON input of the code
+			job, err := compute.NewJob(tx.Hash, []byte(r.URL.Query().Get("input")))
+			if err != nil {
+				fmt.Fprintf(w, "Cannot execute %s: %s", txhex, err)
+				return
+			}
+			// runs in the job queue, the page waits for it
+			state, err := waitJob(r, job)
+			if err != nil {
+				fmt.Fprintf(w, "Cannot execute %s: %s", txhex, err)
+				return
+			}
+			result := state.Result
+			if result == nil {
+				fmt.Fprintf(w, "Cannot execute %s: %s", txhex, state.Error)
+				return
+			}
+			info.Result = string(result.Stdout)
+			info.Errors = string(result.Stderr)
+			info.Failed = !result.Succeeded()
+			info.Usage = result.String()
+			info.Node = hex.EncodeToString(result.Node)
 			// fmt.Fprintf(w, "Got compute request at %s. Result is: %s", txhex, result)
 
 		} else {
@@ -246,14 +325,47 @@ func txOperationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serves the inclusion proof of a committed transaction as JSON, see block.Proof
+// - /proof/{txhash}
+func proofHandler(w http.ResponseWriter, r *http.Request) {
+
+	txid, err := hex.DecodeString(chi.URLParam(r, "txid"))
+	if err != nil || len(txid) != 32 {
+		http.Error(w, "Invalid transaction hash", http.StatusBadRequest)
+		return
+	}
+
+	proof, err := block.NewProof(txid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(proof)
+	if err != nil {
+		fmt.Println("Cannot encode proof", err)
+	}
+}
+
 // Relays a transaction via web interface
 func relayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// read posted transaction
 	objectTypeStr := r.PostFormValue("objectType")
+	subType := strings.TrimSpace(r.PostFormValue("subType"))
+	if subType == "" {
+		subType = transaction.FileTypeJSON
+	}
 	data := r.PostFormValue("data")
-	targets := strings.Split(r.PostFormValue("targetPaths"), ",")
 	organizationHex := r.PostFormValue("organization")
+	keyName := r.PostFormValue("key")
+	var targets []string
+	for _, v := range strings.Split(r.PostFormValue("targetPaths"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			targets = append(targets, v)
+		}
+	}
 
 	// cast object type to int
 	objectTypeInt, err := strconv.Atoi(objectTypeStr)
@@ -271,19 +383,28 @@ func relayHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// build transaction
-	tx, err := transaction.Build(transaction.ObjectType(objectTypeInt), "json", organization, []byte(data), targets)
+	tx, err := transaction.Build(transaction.ObjectType(objectTypeInt), subType, organization, []byte(data), targets)
 	if err != nil {
 		fmt.Println("Error while building transaction via web", err)
 		return
 	}
 
-	ok, err := tx.Validate()
-	if !ok || err != nil {
-		fmt.Println("Transaction is not valid", err)
+	// sign as its creator
+	keypair := keystore.GetKeyPairByName(keyName)
+	if keypair == nil {
+		fmt.Println("Cannot find key to sign with", keyName)
+		w.Write([]byte("Error key"))
 		return
 	}
+	tx.Sign(*keypair)
 
-	tx.Save()
+	// save if verified, wait for signatures in the pending pool otherwise
+	tx, err = transaction.ProcessTransaction(tx)
+	if err != nil {
+		fmt.Println("Transaction is not valid", err)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	// fire away
 	counter := network.RelayTransaction(nil, tx.ToBytes())
@@ -293,3 +414,150 @@ func relayHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(tx.Hash))
 }
+
+// Job state as served by the job handlers
+type Job struct {
+	ID         string
+	Executable string
+	Status     compute.JobStatus
+	Error      string `json:",omitempty"`
+	Stdout     string `json:",omitempty"`
+	Stderr     string `json:",omitempty"`
+	ExitCode   int
+	Usage      string `json:",omitempty"`
+	Node       string `json:",omitempty"` // public key of the node that signed the result
+	Signature  string `json:",omitempty"`
+	Submitted  time.Time
+	Started    time.Time
+	Finished   time.Time
+}
+
+func newJob(state compute.JobState) Job {
+	job := Job{
+		ID:         state.ID,
+		Executable: hex.EncodeToString(state.Job.Executable),
+		Status:     state.Status,
+		Error:      state.Error,
+		Submitted:  state.Submitted,
+		Started:    state.Started,
+		Finished:   state.Finished,
+	}
+	if result := state.Result; result != nil {
+		job.Stdout = string(result.Stdout)
+		job.Stderr = string(result.Stderr)
+		job.ExitCode = result.ExitCode
+		job.Usage = result.String()
+		job.Node = hex.EncodeToString(result.Node)
+		job.Signature = hex.EncodeToString(result.Signature)
+	}
+	return job
+}
+
+// waitJob submits a job and waits until it is finished, it is cancelled if the request is
+func waitJob(r *http.Request, job *compute.Job) (compute.JobState, error) {
+	state, err := network.SubmitJob(job)
+	if err != nil {
+		return state, err
+	}
+	done, err := network.Jobs.Done(state.ID)
+	if err != nil {
+		return state, err
+	}
+	select {
+	case <-done:
+		return network.Jobs.Status(state.ID)
+	case <-r.Context().Done():
+		return network.Jobs.Cancel(state.ID)
+	}
+}
+
+func writeJob(w http.ResponseWriter, state compute.JobState, err error) {
+	if errors.Is(err, compute.ErrUnknownJob) || errors.Is(err, network.ErrNotExecutable) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, compute.ErrQueueFull) || errors.Is(err, network.ErrNoJobs) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newJob(state)); err != nil {
+		fmt.Println("Cannot encode job", err)
+	}
+}
+
+// Queues an executable transaction to run, the posted body is its JSON input
+// - POST /jobs/{txhash}
+func submitJobHandler(w http.ResponseWriter, r *http.Request) {
+	txid, err := hex.DecodeString(chi.URLParam(r, "txid"))
+	if err != nil {
+		http.Error(w, "Invalid transaction hash", http.StatusBadRequest)
+		return
+	}
+	input, err := ioutil.ReadAll(io.LimitReader(r.Body, compute.MaxInput+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, err := compute.NewJob(txid, input)
+	if err != nil {
+		writeJob(w, compute.JobState{}, err)
+		return
+	}
+	state, err := network.SubmitJob(job)
+	writeJob(w, state, err)
+}
+
+// Serves the state of a job, or cancels it
+// - GET /jobs/{id}
+// - POST /jobs/{id}/cancel
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if network.Jobs == nil {
+		writeJob(w, compute.JobState{}, network.ErrNoJobs)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	var state compute.JobState
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/cancel") {
+		state, err = network.Jobs.Cancel(id)
+	} else {
+		state, err = network.Jobs.Status(id)
+	}
+	writeJob(w, state, err)
+}
+
+// Signs a pending transaction with the eligible keys of this node and spreads the signatures
+// - POST /sign/{txhash}, with the web token
+func signHandler(w http.ResponseWriter, r *http.Request) {
+	txid, err := hex.DecodeString(chi.URLParam(r, "txid"))
+	if err != nil {
+		http.Error(w, "Invalid transaction hash", http.StatusBadRequest)
+		return
+	}
+	tx := transaction.Pending.Get(txid)
+	if tx == nil {
+		http.Error(w, fmt.Sprintf("There is no pending transaction with hash %x", txid), http.StatusNotFound)
+		return
+	}
+
+	// sign with our keys under the target paths
+	approvals := tx.Approve()
+	if len(approvals) == 0 {
+		fmt.Fprintf(w, "No keys of this node are asked to sign %x", txid)
+		return
+	}
+	for _, approval := range approvals {
+		_, err := transaction.ProcessApproval(approval.ToBytes())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot sign: %s", err), http.StatusBadRequest)
+			return
+		}
+		network.RelayApproval(nil, approval.ToBytes())
+	}
+	fmt.Fprintf(w, "Signed %x with %d keys", txid, len(approvals))
+}
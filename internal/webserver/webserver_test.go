@@ -0,0 +1,54 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	defer func(token string) { Token = token }(Token)
+	handler := requireToken(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		name    string
+		token   string
+		request func() *http.Request
+		status  int
+	}{
+		{"no token", "secret", func() *http.Request {
+			return httptest.NewRequest("POST", "/sign/00", nil)
+		}, http.StatusUnauthorized},
+		{"wrong token", "secret", func() *http.Request {
+			r := httptest.NewRequest("POST", "/sign/00", nil)
+			r.Header.Set("Authorization", "Bearer guess")
+			return r
+		}, http.StatusUnauthorized},
+		{"token in a link", "secret", func() *http.Request {
+			return httptest.NewRequest("POST", "/sign/00?token=secret", nil)
+		}, http.StatusUnauthorized},
+		{"no token set", "", func() *http.Request {
+			return httptest.NewRequest("POST", "/sign/00", nil)
+		}, http.StatusUnauthorized},
+		{"bearer token", "secret", func() *http.Request {
+			r := httptest.NewRequest("POST", "/sign/00", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			return r
+		}, http.StatusOK},
+		{"posted token", "secret", func() *http.Request {
+			r := httptest.NewRequest("POST", "/create", strings.NewReader(url.Values{"token": {"secret"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return r
+		}, http.StatusOK},
+	}
+	for _, c := range cases {
+		Token = c.token
+		w := httptest.NewRecorder()
+		handler(w, c.request())
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, w.Code)
+		}
+	}
+}